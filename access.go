@@ -0,0 +1,165 @@
+package relayer
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+type requestIDKey struct{}
+
+// RequestID is the id [Server.ServeHTTP] gave the request ctx belongs to, the
+// X-Request-Id it came with or a new UUID, or "" outside of a request. Handlers
+// added to [Server.Router] can log it to be matched with the access log.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID is a random (version 4) UUID.
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// ParseTrustedProxies reads addresses and CIDR ranges, as set in
+// [Server.TrustedProxies].
+func ParseTrustedProxies(addrs []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range addrs {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", s, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", s, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func (s *Server) trusted(addr netip.Addr) bool {
+	for _, prefix := range s.TrustedProxies {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is where r came from. When that is one of the TrustedProxies, it is
+// the last address in X-Forwarded-For that isn't a trusted proxy itself.
+func (s *Server) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil || !s.trusted(peer) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		addr, err := netip.ParseAddr(hop)
+		if err != nil {
+			break
+		}
+		if !s.trusted(addr) {
+			return addr.Unmap().String()
+		}
+		host = hop
+	}
+	return host
+}
+
+// accessRecorder counts what a handler answered.
+type accessRecorder struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	hijacked bool
+}
+
+func (w *accessRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *accessRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack is what the websocket upgrade takes the connection over with.
+func (w *accessRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T can't be hijacked", w.ResponseWriter)
+	}
+	conn, rw, err := hj.Hijack()
+	if err == nil {
+		w.hijacked = true
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// serveLogged gives r a request id, sets it as the X-Request-Id of the
+// response, and logs r once handle is done with it.
+func (s *Server) serveLogged(w http.ResponseWriter, r *http.Request, websocket bool, handle func(http.ResponseWriter, *http.Request)) {
+	id := r.Header.Get("X-Request-Id")
+	if id == "" || len(id) > 128 {
+		id = newRequestID()
+	}
+	w.Header().Set("X-Request-Id", id)
+	rec := &accessRecorder{ResponseWriter: w}
+	start := time.Now()
+
+	handle(rec, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	kind := "http request"
+	if websocket {
+		kind = "websocket upgrade"
+		if !rec.hijacked {
+			kind = "failed websocket upgrade"
+		}
+	}
+	s.Log.Infof("%s id=%s method=%s path=%s status=%d bytes=%d duration=%s remote=%s",
+		kind, id, r.Method, r.URL.Path, rec.status, rec.bytes, time.Since(start).Round(time.Microsecond), s.clientIP(r))
+}
@@ -0,0 +1,137 @@
+package relayer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingLogger keeps every line logged.
+type recordingLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) record(format string, v ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) Infof(format string, v ...any)    { l.record(format, v...) }
+func (l *recordingLogger) Warningf(format string, v ...any) { l.record(format, v...) }
+func (l *recordingLogger) Errorf(format string, v ...any)   { l.record(format, v...) }
+
+// waitForLine returns the first logged line starting with prefix and containing all of parts.
+func (l *recordingLogger) waitForLine(t *testing.T, prefix string, parts ...string) string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		l.mu.Lock()
+		for _, line := range l.lines {
+			if !strings.HasPrefix(line, prefix) {
+				continue
+			}
+			found := true
+			for _, part := range parts {
+				found = found && strings.Contains(line, part)
+			}
+			if found {
+				l.mu.Unlock()
+				return line
+			}
+		}
+		l.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no %q line with %v in %v", prefix, parts, l.lines)
+	return ""
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestAccessLog(t *testing.T) {
+	srv, err := NewServer(&testRelay{storage: &testStorage{}})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	logs := &recordingLogger{}
+	srv.Log = logs
+	srv.Router().HandleFunc("/paid", func(w http.ResponseWriter, r *http.Request) {
+		srv.Log.Infof("handling payment id=%s", RequestID(r.Context()))
+		fmt.Fprint(w, "paid")
+	})
+	started := make(chan bool)
+	go srv.Start("127.0.0.1", 0, started)
+	<-started
+	defer srv.Shutdown(context.Background())
+
+	resp, err := http.Get("http://" + srv.Addr + "/paid")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	id := resp.Header.Get("X-Request-Id")
+	if !uuidPattern.MatchString(id) {
+		t.Errorf("X-Request-Id = %q; want a UUID", id)
+	}
+	logs.waitForLine(t, "handling payment", "id="+id)
+	logs.waitForLine(t, "http request", "id="+id, "method=GET", "path=/paid", "status=200", "bytes=4", "duration=", "remote=127.0.0.1")
+
+	req, _ := http.NewRequest("GET", "http://"+srv.Addr+"/paid", nil)
+	req.Header.Set("X-Request-Id", "from-the-proxy")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("X-Request-Id"); got != "from-the-proxy" {
+		t.Errorf("X-Request-Id = %q; want the inbound one", got)
+	}
+	logs.waitForLine(t, "handling payment", "id=from-the-proxy")
+
+	conn := dialTestRelay(t, srv)
+	conn.Close()
+	logs.waitForLine(t, "websocket upgrade", "status=101", "path=/")
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8", " 192.168.1.1 ", ""})
+	if err != nil {
+		t.Fatalf("ParseTrustedProxies: %v", err)
+	}
+	s := &Server{TrustedProxies: trusted}
+
+	for _, tt := range []struct {
+		remote, forwarded, want string
+	}{
+		{"203.0.113.5:1234", "", "203.0.113.5"},
+		{"203.0.113.5:1234", "198.51.100.7", "203.0.113.5"},
+		{"10.1.2.3:1234", "198.51.100.7", "198.51.100.7"},
+		{"10.1.2.3:1234", "6.6.6.6, 198.51.100.7, 192.168.1.1", "198.51.100.7"},
+		{"10.1.2.3:1234", "", "10.1.2.3"},
+		{"10.1.2.3:1234", "garbage", "10.1.2.3"},
+		{"[::ffff:10.1.2.3]:1234", "198.51.100.7", "198.51.100.7"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := s.clientIP(r); got != tt.want {
+			t.Errorf("clientIP(%s, X-Forwarded-For %q) = %s; want %s", tt.remote, tt.forwarded, got, tt.want)
+		}
+	}
+
+	if _, err := ParseTrustedProxies([]string{"10.0.0.0/99"}); err == nil {
+		t.Error("ParseTrustedProxies accepted a bad range")
+	}
+}
@@ -17,11 +17,27 @@ func AddEvent(ctx context.Context, relay Relay, evt *nostr.Event) (accepted bool
 	store := relay.Storage(ctx)
 	advancedSaver, _ := store.(AdvancedSaver)
 
-	if !relay.AcceptEvent(ctx, evt) {
+	if expiration, ok := Expiration(evt); ok && expiration <= nostr.Now() {
+		return false, "invalid: event has expired"
+	}
+	if evt.Kind == KindRelayList {
+		if err := CheckRelayList(evt); err != nil {
+			return false, "invalid: " + err.Error()
+		}
+	}
+
+	if rejecter, ok := relay.(Rejecter); ok {
+		if reject, msg := rejecter.RejectEvent(ctx, evt); reject {
+			if msg == "" {
+				msg = "blocked: event blocked by relay"
+			}
+			return false, msg
+		}
+	} else if !relay.AcceptEvent(ctx, evt) {
 		return false, "blocked: event blocked by relay"
 	}
 
-	if 20000 <= evt.Kind && evt.Kind < 30000 {
+	if isEphemeral(relay, evt.Kind) {
 		// do not store ephemeral events
 	} else {
 		if advancedSaver != nil {
@@ -30,7 +46,7 @@ func AddEvent(ctx context.Context, relay Relay, evt *nostr.Event) (accepted bool
 
 		if saveErr := store.SaveEvent(ctx, evt); saveErr != nil {
 			switch saveErr {
-			case storage.ErrDupEvent:
+			case storage.ErrDupEvent, storage.ErrOldEvent:
 				return true, saveErr.Error()
 			default:
 				return false, fmt.Sprintf("error: failed to save: %s", saveErr.Error())
@@ -43,6 +59,16 @@ func AddEvent(ctx context.Context, relay Relay, evt *nostr.Event) (accepted bool
 	}
 
 	notifyListeners(evt)
+	publish(relay, evt)
 
 	return true, ""
 }
+
+// publish passes evt on to the EventSink of relay, if it has one.
+func publish(relay Relay, evt *nostr.Event) {
+	if sinker, ok := relay.(EventSinker); ok {
+		if sink := sinker.EventSink(); sink != nil {
+			sink.Publish(evt)
+		}
+	}
+}
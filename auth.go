@@ -0,0 +1,48 @@
+package relayer
+
+import (
+	"context"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+type authedPubkeyKey struct{}
+
+// AuthedPubkey is the pubkey the client a query comes from authenticated as
+// with NIP-42, or "" if it didn't, the relay isn't an [Auther] or ctx isn't
+// that of a query. The server sets it in the ctx given to [Storage.QueryEvents]
+// and [EventCounter.CountEvents], so storages of private or paid relays can
+// leave out what that user may not see, e.g. with [VisibleTo]. Storages of
+// public relays can ignore it.
+func AuthedPubkey(ctx context.Context) string {
+	pubkey, _ := ctx.Value(authedPubkeyKey{}).(string)
+	return pubkey
+}
+
+func withAuthedPubkey(ctx context.Context, pubkey string) context.Context {
+	if pubkey == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, authedPubkeyKey{}, pubkey)
+}
+
+// VisibleTo tells whether evt may be returned to the user authenticated as
+// pubkey, "" for none: kind-4 direct messages only go to their author and the
+// users they p-tag, everything else goes to anyone.
+func VisibleTo(evt *nostr.Event, pubkey string) bool {
+	if evt.Kind != nostr.KindEncryptedDirectMessage {
+		return true
+	}
+	if pubkey == "" {
+		return false
+	}
+	if evt.PubKey == pubkey {
+		return true
+	}
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == "p" && tag[1] == pubkey {
+			return true
+		}
+	}
+	return false
+}
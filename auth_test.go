@@ -0,0 +1,105 @@
+package relayer
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip42"
+)
+
+func TestQueryScopedToAuthedPubkey(t *testing.T) {
+	aliceKey, bobKey, carolKey := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	alice, _ := nostr.GetPublicKey(aliceKey)
+	bob, _ := nostr.GetPublicKey(bobKey)
+
+	dm := nostr.Event{PubKey: alice, Kind: nostr.KindEncryptedDirectMessage, Tags: nostr.Tags{{"p", bob}}, Content: "secret?iv=x"}
+	note := nostr.Event{PubKey: alice, Kind: nostr.KindTextNote, Tags: nostr.Tags{}, Content: "hello"}
+	for _, evt := range []*nostr.Event{&dm, &note} {
+		evt.Sign(aliceKey)
+	}
+
+	storage := &testStorage{queryEvents: func(ctx context.Context, f *nostr.Filter) (chan *nostr.Event, error) {
+		ch := make(chan *nostr.Event, 2)
+		for _, evt := range []nostr.Event{dm, note} {
+			if evt := evt; VisibleTo(&evt, AuthedPubkey(ctx)) {
+				ch <- &evt
+			}
+		}
+		close(ch)
+		return ch, nil
+	}}
+	srv := startTestRelay(t, testAuthRelay{&testRelay{storage: storage}})
+	defer srv.Shutdown(context.Background())
+
+	// query asks for everything as the user of sk, or as no one if sk is empty,
+	// returning the ids of the events it got.
+	query := func(sk string) []string {
+		t.Helper()
+		conn := dialTestRelay(t, srv)
+		defer conn.Close()
+
+		var challenge string
+		read := func() []json.RawMessage {
+			t.Helper()
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("ReadMessage: %v", err)
+			}
+			var envelope []json.RawMessage
+			json.Unmarshal(message, &envelope)
+			return envelope
+		}
+		if envelope := read(); string(envelope[0]) != `"AUTH"` || json.Unmarshal(envelope[1], &challenge) != nil {
+			t.Fatalf("got %s; want an AUTH challenge", envelope)
+		}
+
+		if sk != "" {
+			pubkey, _ := nostr.GetPublicKey(sk)
+			auth := nip42.CreateUnsignedAuthEvent(challenge, pubkey, "wss://relay.example.com")
+			auth.Sign(sk)
+			conn.WriteJSON([]any{"AUTH", auth})
+			if envelope := read(); string(envelope[0]) != `"OK"` || string(envelope[2]) != "true" {
+				t.Fatalf("got %s; want the AUTH accepted", envelope)
+			}
+		}
+
+		conn.WriteMessage(websocket.TextMessage, []byte(`["REQ","sub",{}]`))
+		var ids []string
+		for {
+			envelope := read()
+			if string(envelope[0]) == `"EOSE"` {
+				return ids
+			}
+			var evt nostr.Event
+			json.Unmarshal(envelope[2], &evt)
+			ids = append(ids, evt.ID)
+		}
+	}
+
+	for _, tt := range []struct {
+		name string
+		sk   string
+		want int
+	}{
+		{"unauthenticated", "", 1},
+		{"sender", aliceKey, 2},
+		{"recipient", bobKey, 2},
+		{"someone else", carolKey, 1},
+	} {
+		if ids := query(tt.sk); len(ids) != tt.want || ids[len(ids)-1] != note.ID {
+			t.Errorf("%s got %v; want %d events", tt.name, ids, tt.want)
+		}
+	}
+}
+
+func TestAuthedPubkeyDefault(t *testing.T) {
+	if pubkey := AuthedPubkey(context.Background()); pubkey != "" {
+		t.Errorf("AuthedPubkey outside of a query = %q; want none", pubkey)
+	}
+	if pubkey := AuthedPubkey(withAuthedPubkey(context.Background(), "abc")); pubkey != "abc" {
+		t.Errorf("AuthedPubkey = %q; want abc", pubkey)
+	}
+}
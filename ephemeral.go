@@ -0,0 +1,17 @@
+package relayer
+
+// IsEphemeralKind tells whether kind is in the NIP-16 range of ephemeral
+// events, 20000 to 29999, which are relayed to current subscribers but not
+// stored.
+func IsEphemeralKind(kind int) bool {
+	return 20000 <= kind && kind < 30000
+}
+
+// isEphemeral tells whether events of kind are relayed without being stored
+// by relay, asking it if it is an [Ephemeraler].
+func isEphemeral(relay Relay, kind int) bool {
+	if e, ok := relay.(Ephemeraler); ok {
+		return e.IsEphemeral(kind)
+	}
+	return IsEphemeralKind(kind)
+}
@@ -0,0 +1,40 @@
+package relayer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ephemeralRelay relays kinds without storing them, and stores all others.
+type ephemeralRelay struct {
+	testRelay
+	kinds map[int]bool
+}
+
+func (er *ephemeralRelay) IsEphemeral(kind int) bool { return er.kinds[kind] }
+
+func TestAddEventEphemeral(t *testing.T) {
+	var saved []int
+	storage := &testStorage{saveEvent: func(_ context.Context, evt *nostr.Event) error { saved = append(saved, evt.Kind); return nil }}
+
+	for _, tt := range []struct {
+		name  string
+		relay Relay
+		want  []int
+	}{
+		{"NIP-16", &testRelay{storage: storage}, []int{1, 30000}},
+		{"Ephemeraler", &ephemeralRelay{testRelay{storage: storage}, map[int]bool{1: true}}, []int{20001, 30000}},
+	} {
+		saved = nil
+		for _, kind := range []int{1, 20001, 30000} {
+			if ok, msg := AddEvent(context.Background(), tt.relay, &nostr.Event{Kind: kind}); !ok {
+				t.Errorf("%s: AddEvent(kind %d) = %v, %q; want it accepted", tt.name, kind, ok, msg)
+			}
+		}
+		if len(saved) != len(tt.want) || saved[0] != tt.want[0] || saved[1] != tt.want[1] {
+			t.Errorf("%s: saved kinds %v; want %v", tt.name, saved, tt.want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/relayer/v2"
+	"github.com/fiatjaf/relayer/v2/storage"
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+// exportPageSize is how many events are asked for at once from storages that
+// don't tell their own limit.
+const exportPageSize = 100
+
+// exportEvents writes the stored events matching the since and kinds of filter
+// to w, one JSON object per line, newest first. It goes through the storage in
+// pages, each ending one second after the last event of the previous one, so
+// only the ids already written for that second are kept around. That relies on
+// until being exclusive and on events of the same second always coming in the
+// same order, as storagetest checks for every storage.
+//
+// A second with more events than the storage returns at once can't be paged
+// through, so that fails the export rather than leave some of them out.
+func exportEvents(ctx context.Context, store relayer.Storage, w io.Writer, filter nostr.Filter) (exported int, err error) {
+	filter.Limit = exportPageSize
+	if limiter, ok := store.(relayer.QueryLimiter); ok && limiter.MaxLimit() > 0 {
+		filter.Limit = limiter.MaxLimit()
+	}
+
+	out := bufio.NewWriter(w)
+	enc := json.NewEncoder(out)
+
+	// the events written with created_at == last
+	var last nostr.Timestamp
+	written := make(map[string]bool)
+
+	for {
+		ch, err := store.QueryEvents(ctx, &filter)
+		if err != nil {
+			return exported, err
+		}
+
+		got, fresh := 0, 0
+		for evt := range ch {
+			got++
+			if evt.CreatedAt == last && written[evt.ID] {
+				continue
+			}
+			if err := enc.Encode(evt); err != nil {
+				for range ch {
+				}
+				return exported, err
+			}
+			if evt.CreatedAt != last {
+				last = evt.CreatedAt
+				written = make(map[string]bool)
+			}
+			written[evt.ID] = true
+			exported++
+			fresh++
+		}
+		if err := ctx.Err(); err != nil {
+			return exported, err
+		}
+
+		until := last + 1
+		switch {
+		case got == 0:
+			return exported, out.Flush()
+		case fresh == 0 && got >= filter.Limit:
+			// a full page with nothing but that second, which has more events
+			// than the storage returns at once
+			return exported, fmt.Errorf("more than %d events were created at %d, the storage doesn't return that many at once", got, last)
+		case fresh == 0:
+			// the rest of that second, all written already: go on with older ones
+			until = last
+		}
+		filter.Until = &until
+	}
+}
+
+// importStats counts what importEvents did with each line.
+type importStats struct {
+	Imported   int
+	Duplicates int
+	Invalid    int
+	Skipped    int
+}
+
+// importEvents saves the events read from r, one JSON object per line, that
+// match the since and kinds of filter. Lines that don't decode to an event with
+// a valid id and signature are counted as invalid and left out, as are events
+// already stored.
+func importEvents(ctx context.Context, store relayer.Storage, r io.Reader, filter nostr.Filter) (stats importStats, err error) {
+	in := bufio.NewReader(r)
+	for {
+		line, err := in.ReadBytes('\n')
+		if len(line) > 0 {
+			if err := importLine(ctx, store, line, filter, &stats); err != nil {
+				return stats, err
+			}
+		}
+		if err == io.EOF {
+			return stats, nil
+		} else if err != nil {
+			return stats, err
+		}
+	}
+}
+
+func importLine(ctx context.Context, store relayer.Storage, line []byte, filter nostr.Filter, stats *importStats) error {
+	if len(bytes.TrimSpace(line)) == 0 {
+		return nil
+	}
+
+	var evt nostr.Event
+	if err := json.Unmarshal(line, &evt); err != nil || evt.GetID() != evt.ID {
+		stats.Invalid++
+		return nil
+	}
+	if ok, _ := evt.CheckSignature(); !ok {
+		stats.Invalid++
+		return nil
+	}
+
+	if (filter.Since != nil && evt.CreatedAt <= *filter.Since) ||
+		(filter.Kinds != nil && !slices.Contains(filter.Kinds, evt.Kind)) {
+		stats.Skipped++
+		return nil
+	}
+
+	err := store.SaveEvent(ctx, &evt)
+	switch {
+	case err == nil:
+		stats.Imported++
+	case errors.Is(err, storage.ErrDupEvent), errors.Is(err, storage.ErrOldEvent):
+		stats.Duplicates++
+	default:
+		return err
+	}
+	return nil
+}
+
+// backupFilter is the filter made of the -since and -kinds flags.
+func backupFilter(since int64, kinds string) (nostr.Filter, error) {
+	var filter nostr.Filter
+	if since > 0 {
+		ts := nostr.Timestamp(since)
+		filter.Since = &ts
+	}
+	if kinds != "" {
+		for _, kind := range strings.Split(kinds, ",") {
+			k, err := strconv.Atoi(strings.TrimSpace(kind))
+			if err != nil {
+				return filter, fmt.Errorf("invalid kind %q", kind)
+			}
+			filter.Kinds = append(filter.Kinds, k)
+		}
+	}
+	return filter, nil
+}
+
+func runExport(store relayer.Storage, path string, filter nostr.Filter) error {
+	out := os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	exported, err := exportEvents(context.Background(), store, out, filter)
+	if err != nil {
+		return fmt.Errorf("export failed after %d events: %w", exported, err)
+	}
+	if out != os.Stdout {
+		if err := out.Close(); err != nil {
+			return err
+		}
+	}
+	log.Printf("exported %d events", exported)
+	return nil
+}
+
+func runImport(store relayer.Storage, path string, filter nostr.Filter) error {
+	in := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	stats, err := importEvents(context.Background(), store, in, filter)
+	log.Printf("imported %d events, %d already stored, %d invalid, %d filtered out",
+		stats.Imported, stats.Duplicates, stats.Invalid, stats.Skipped)
+	if err != nil {
+		return fmt.Errorf("import failed: %w", err)
+	}
+	return nil
+}
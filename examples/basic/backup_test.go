@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/relayer/v2/storage/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func testStorage(t *testing.T, name string) *sqlite3.SQLite3Backend {
+	t.Helper()
+	store := &sqlite3.SQLite3Backend{DatabaseURL: filepath.Join(t.TempDir(), name)}
+	if err := store.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	t.Cleanup(func() { store.DB.Close() })
+	return store
+}
+
+// seedEvents stores n notes and reactions, several per second so that pages
+// end in the middle of one.
+func seedEvents(t *testing.T, store *sqlite3.SQLite3Backend, n int) []nostr.Event {
+	t.Helper()
+	keys := []string{nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()}
+	evts := make([]nostr.Event, n)
+	for i := range evts {
+		evts[i] = nostr.Event{
+			CreatedAt: nostr.Timestamp(1700000000 + i/7),
+			Kind:      []int{nostr.KindTextNote, nostr.KindReaction}[i%2],
+			Tags:      nostr.Tags{nostr.Tag{"t", fmt.Sprint(i % 3)}},
+			Content:   fmt.Sprintf("event %d", i),
+		}
+		evts[i].Sign(keys[i%len(keys)])
+		if err := store.SaveEvent(context.Background(), &evts[i]); err != nil {
+			t.Fatalf("SaveEvent: %v", err)
+		}
+	}
+	return evts
+}
+
+// dump is every event in store, serialized and sorted.
+func dump(t *testing.T, store *sqlite3.SQLite3Backend) []string {
+	t.Helper()
+	var lines []string
+	rows, err := store.DB.Query(`SELECT id, pubkey, created_at, kind, tags, content, sig FROM event`)
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var evt nostr.Event
+		var createdAt int64
+		if err := rows.Scan(&evt.ID, &evt.PubKey, &createdAt, &evt.Kind, &evt.Tags, &evt.Content, &evt.Sig); err != nil {
+			t.Fatalf("Scan: %v", err)
+		}
+		evt.CreatedAt = nostr.Timestamp(createdAt)
+		line, _ := json.Marshal(evt)
+		lines = append(lines, string(line))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	source := testStorage(t, "source.db")
+	seeded := seedEvents(t, source, 250)
+
+	var backup bytes.Buffer
+	exported, err := exportEvents(ctx, source, &backup, nostr.Filter{})
+	if err != nil {
+		t.Fatalf("exportEvents: %v", err)
+	}
+	if exported != len(seeded) || strings.Count(backup.String(), "\n") != len(seeded) {
+		t.Errorf("exported %d events in %d lines; want %d", exported, strings.Count(backup.String(), "\n"), len(seeded))
+	}
+
+	target := testStorage(t, "target.db")
+	stats, err := importEvents(ctx, target, bytes.NewReader(backup.Bytes()), nostr.Filter{})
+	if err != nil {
+		t.Fatalf("importEvents: %v", err)
+	}
+	if stats != (importStats{Imported: len(seeded)}) {
+		t.Errorf("import stats = %+v; want all %d imported", stats, len(seeded))
+	}
+
+	want, got := dump(t, source), dump(t, target)
+	if len(got) != len(want) {
+		t.Fatalf("target has %d events; want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("target event %s; want %s", got[i], want[i])
+		}
+	}
+
+	// a second time everything is there already
+	stats, err = importEvents(ctx, target, bytes.NewReader(backup.Bytes()), nostr.Filter{})
+	if err != nil {
+		t.Fatalf("importEvents: %v", err)
+	}
+	if stats != (importStats{Duplicates: len(seeded)}) {
+		t.Errorf("import stats = %+v; want all %d duplicates", stats, len(seeded))
+	}
+}
+
+func TestExportFailsOnCrowdedSecond(t *testing.T) {
+	ctx := context.Background()
+	source := testStorage(t, "source.db")
+	sk := nostr.GeneratePrivateKey()
+	for i := 0; i < exportPageSize+1; i++ {
+		evt := nostr.Event{CreatedAt: 1700000000, Kind: nostr.KindTextNote, Content: fmt.Sprint(i)}
+		evt.Sign(sk)
+		if err := source.SaveEvent(ctx, &evt); err != nil {
+			t.Fatalf("SaveEvent: %v", err)
+		}
+	}
+
+	if _, err := exportEvents(ctx, source, &bytes.Buffer{}, nostr.Filter{}); err == nil {
+		t.Error("exportEvents left out events of a second with more than a page of them")
+	}
+}
+
+func TestImportValidatesAndFilters(t *testing.T) {
+	ctx := context.Background()
+	source := testStorage(t, "source.db")
+	seeded := seedEvents(t, source, 4)
+
+	tampered := seeded[0]
+	tampered.Content = "something else"
+	forged := seeded[1]
+	forged.Sig = strings.Repeat("0", 128)
+
+	var input bytes.Buffer
+	for _, evt := range []nostr.Event{seeded[0], tampered, forged, seeded[1], seeded[2], seeded[3]} {
+		line, _ := json.Marshal(evt)
+		input.Write(line)
+		input.WriteString("\n")
+	}
+	input.WriteString("not json\n\n")
+
+	filter, err := backupFilter(0, fmt.Sprint(nostr.KindTextNote))
+	if err != nil {
+		t.Fatalf("backupFilter: %v", err)
+	}
+	target := testStorage(t, "target.db")
+	stats, err := importEvents(ctx, target, &input, filter)
+	if err != nil {
+		t.Fatalf("importEvents: %v", err)
+	}
+	if want := (importStats{Imported: 2, Invalid: 3, Skipped: 2}); stats != want {
+		t.Errorf("import stats = %+v; want %+v", stats, want)
+	}
+
+	var backup bytes.Buffer
+	exported, err := exportEvents(ctx, source, &backup, filter)
+	if err != nil {
+		t.Fatalf("exportEvents: %v", err)
+	}
+	if exported != 2 {
+		t.Errorf("exported %d notes; want 2", exported)
+	}
+
+	if _, err := backupFilter(0, "1,seven"); err == nil {
+		t.Error("backupFilter accepted a kind that isn't a number")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+// configError is everything wrong with the settings, one problem a line.
+type configError []string
+
+func (e configError) Error() string {
+	return "bad configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// loadConfig reads the settings from the environment into r and checks them,
+// returning a configError with every problem found.
+func (r *Relay) loadConfig() error {
+	problems := processEnv(r)
+
+	limits, err := kindSizeLimits(os.Environ())
+	if kindProblems, ok := err.(configError); ok {
+		problems = append(problems, kindProblems...)
+	}
+	r.kindMaxSize = limits
+
+	problems = append(problems, r.validate()...)
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// processEnv is envconfig.Process reporting every value that doesn't parse
+// instead of only the first one. Those are left at their defaults.
+//
+// examples/rss-bridge has the same, as every example builds on its own.
+func processEnv(spec any) configError {
+	var problems configError
+	restore := map[string]string{}
+	defer func() {
+		for key, value := range restore {
+			os.Setenv(key, value)
+		}
+	}()
+
+	for {
+		err := envconfig.Process("", spec)
+		var parseErr *envconfig.ParseError
+		if errors.As(err, &parseErr) {
+			value, set := os.LookupEnv(parseErr.KeyName)
+			if set {
+				problems = append(problems, fmt.Sprintf("%s: %q is not a valid %s", parseErr.KeyName, parseErr.Value, parseErr.TypeName))
+				// try again without it to find the next one
+				restore[parseErr.KeyName] = value
+				os.Unsetenv(parseErr.KeyName)
+				continue
+			}
+		}
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		return problems
+	}
+}
+
+// validate checks what envconfig can't tell is wrong.
+func (r *Relay) validate() configError {
+	var problems configError
+	problem := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	switch r.StorageBackend {
+	case "postgresql":
+		if r.PostgresDatabase == "" {
+			problem("POSTGRESQL_DATABASE: missing, it is needed with STORAGE_BACKEND=postgresql")
+		} else if strings.Contains(r.PostgresDatabase, "://") {
+			// otherwise it is a "key=value ..." connection string
+			if u, err := url.Parse(r.PostgresDatabase); err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") {
+				problem("POSTGRESQL_DATABASE: not a postgres:// or postgresql:// url")
+			}
+		}
+	case "sqlite3":
+		if r.SQLiteDatabase == "" {
+			problem("SQLITE_DATABASE: missing, it is needed with STORAGE_BACKEND=sqlite3")
+		}
+	default:
+		problem("STORAGE_BACKEND: %q is neither postgresql nor sqlite3", r.StorageBackend)
+	}
+
+	if r.MaxSize <= 0 {
+		problem("MAX_SIZE: must be more than zero")
+	}
+	if r.RedisSinkURL != "" {
+		if u, err := url.Parse(r.RedisSinkURL); err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+			problem("REDIS_SINK_URL: %q is not a redis or rediss url", r.RedisSinkURL)
+		}
+	}
+
+	for _, kind := range r.EphemeralKinds {
+		if kind < 0 {
+			problem("EPHEMERAL_KINDS: %d is not a kind", kind)
+		}
+	}
+
+	for _, d := range []struct {
+		key   string
+		value int64
+	}{
+		{"POSTGRESQL_MAX_OPEN_CONNS", int64(r.PostgresMaxOpenConns)},
+		{"POSTGRESQL_MAX_IDLE_CONNS", int64(r.PostgresMaxIdleConns)},
+		{"POSTGRESQL_CONN_MAX_LIFETIME", int64(r.PostgresConnMaxLifetime)},
+		{"POSTGRESQL_STATEMENT_TIMEOUT", int64(r.PostgresStatementTimeout)},
+		{"POSTGRESQL_CONNECT_TIMEOUT", int64(r.PostgresConnectTimeout)},
+		{"WS_MAX_MESSAGE_SIZE", r.WSMaxMessageSize},
+		{"WS_SEND_QUEUE", int64(r.WSSendQueue)},
+	} {
+		if d.value < 0 {
+			problem("%s: can't be negative", d.key)
+		}
+	}
+
+	return problems
+}
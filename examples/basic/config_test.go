@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("STORAGE_BACKEND", "postgresql")
+	t.Setenv("POSTGRESQL_DATABASE", "postgres://nostr@localhost/nostr?sslmode=disable")
+	t.Setenv("MAX_SIZE_KIND_30023", "50000")
+	var r Relay
+	if err := r.loadConfig(); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if r.MaxSize != 10000 || r.kindMaxSize[30023] != 50000 {
+		t.Errorf("loaded %+v; want the environment over the defaults", r)
+	}
+
+	// lib/pq connection strings are fine too
+	t.Setenv("POSTGRESQL_DATABASE", "host=localhost dbname=nostr")
+	if err := r.loadConfig(); err != nil {
+		t.Errorf("loadConfig with a key=value connection string: %v", err)
+	}
+}
+
+func TestLoadConfigListsEveryProblem(t *testing.T) {
+	for key, value := range map[string]string{
+		"STORAGE_BACKEND":     "postgresql",
+		"POSTGRESQL_DATABASE": "mysql://localhost/nostr",
+		"MAX_SIZE":            "10k",
+		"MAX_SIZE_KIND_note":  "1000",
+		"MAX_SIZE_KIND_1":     "big",
+		"REDIS_SINK_URL":      "localhost:6379",
+		"WS_SEND_QUEUE":       "-1",
+		"HEALTH_CACHE_TTL":    "5",
+	} {
+		t.Setenv(key, value)
+	}
+
+	var r Relay
+	err := r.loadConfig()
+	var problems configError
+	if !errors.As(err, &problems) {
+		t.Fatalf("loadConfig = %v; want a configError", err)
+	}
+	for _, want := range []string{
+		"POSTGRESQL_DATABASE: not a postgres:// or postgresql:// url",
+		`MAX_SIZE: "10k" is not a valid int`,
+		"MAX_SIZE_KIND_note: not a kind",
+		`MAX_SIZE_KIND_1: invalid size "big"`,
+		`REDIS_SINK_URL: "localhost:6379" is not a redis or rediss url`,
+		"WS_SEND_QUEUE: can't be negative",
+		`HEALTH_CACHE_TTL: "5" is not a valid time.Duration`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("no %q in:\n%v", want, err)
+		}
+	}
+	if len(problems) != 7 {
+		t.Errorf("got %d problems; want 7:\n%v", len(problems), err)
+	}
+}
+
+func TestLoadConfigStorage(t *testing.T) {
+	for _, tt := range []struct {
+		backend, database string
+		want              string
+	}{
+		{"postgresql", "", "POSTGRESQL_DATABASE: missing"},
+		{"mysql", "", `STORAGE_BACKEND: "mysql" is neither postgresql nor sqlite3`},
+	} {
+		t.Setenv("STORAGE_BACKEND", tt.backend)
+		t.Setenv("POSTGRESQL_DATABASE", tt.database)
+		var r Relay
+		if err := r.loadConfig(); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("loadConfig with %s %q = %v; want %q", tt.backend, tt.database, err, tt.want)
+		}
+	}
+}
+
+func TestEphemeralKinds(t *testing.T) {
+	t.Setenv("STORAGE_BACKEND", "sqlite3")
+	t.Setenv("EPHEMERAL_KINDS", "1311,10312")
+	var r Relay
+	if err := r.loadConfig(); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	for kind, want := range map[int]bool{1311: true, 10312: true, 20001: true, 1: false, 30023: false} {
+		if got := r.IsEphemeral(kind); got != want {
+			t.Errorf("IsEphemeral(%d) = %v; want %v", kind, got, want)
+		}
+	}
+
+	t.Setenv("EPHEMERAL_KINDS", "1,-5")
+	if err := r.loadConfig(); err == nil || !strings.Contains(err.Error(), "EPHEMERAL_KINDS") {
+		t.Errorf("loadConfig = %v; want an EPHEMERAL_KINDS problem", err)
+	}
+}
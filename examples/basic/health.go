@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pinger is what the sql storages offer to check their connection.
+type pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// lastRetention is when old events were last deleted, in unix nanoseconds.
+var lastRetention int64
+
+// ComponentHealth is the status of one of the parts /healthz checks.
+type ComponentHealth struct {
+	Healthy     bool       `json:"healthy"`
+	LatencyMs   float64    `json:"latency_ms,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	MaxAge      string     `json:"max_age,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// healthz answers /healthz with the status of the database and of the
+// retention job, checked at most once per ttl.
+type healthz struct {
+	db              pinger
+	ttl             time.Duration
+	retentionMaxAge time.Duration
+	started         time.Time
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	dbStatus  ComponentHealth
+	retention ComponentHealth
+}
+
+func (h *healthz) check() (db, retention ComponentHealth) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.checkedAt.IsZero() || time.Since(h.checkedAt) >= h.ttl {
+		h.dbStatus = checkPing(h.db)
+		h.retention = checkRetention(h.started, h.retentionMaxAge)
+		h.checkedAt = time.Now()
+	}
+	return h.dbStatus, h.retention
+}
+
+func (h *healthz) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	db, retention := h.check()
+	report := struct {
+		Status     string                     `json:"status"`
+		Components map[string]ComponentHealth `json:"components"`
+	}{"ok", map[string]ComponentHealth{"db": db, "retention": retention}}
+
+	w.Header().Set("content-type", "application/json")
+	if !db.Healthy || !retention.Healthy {
+		report.Status = "unhealthy"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+func checkPing(db pinger) ComponentHealth {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if err := db.PingContext(ctx); err != nil {
+		return ComponentHealth{Error: err.Error()}
+	}
+	return ComponentHealth{Healthy: true, LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+}
+
+// checkRetention reports the retention job as stuck when it hasn't deleted old
+// events in maxAge, counting from started until it first does.
+func checkRetention(started time.Time, maxAge time.Duration) ComponentHealth {
+	last := started
+	status := ComponentHealth{MaxAge: maxAge.String()}
+	if nanos := atomic.LoadInt64(&lastRetention); nanos != 0 {
+		last = time.Unix(0, nanos)
+		status.LastSuccess = &last
+	}
+	if age := time.Since(last); age > maxAge {
+		status.Error = fmt.Sprintf("old events weren't deleted in %s", age.Round(time.Second))
+	} else {
+		status.Healthy = true
+	}
+	return status
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type healthzReport struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentHealth `json:"components"`
+}
+
+func TestHealthz(t *testing.T) {
+	defer atomic.StoreInt64(&lastRetention, atomic.LoadInt64(&lastRetention))
+	atomic.StoreInt64(&lastRetention, 0)
+
+	store := testStorage(t, "relay.db")
+	h := &healthz{db: store, retentionMaxAge: time.Hour, started: time.Now()}
+	get := func() (int, healthzReport) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+		var report healthzReport
+		if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return w.Code, report
+	}
+
+	if code, report := get(); code != http.StatusOK || report.Status != "ok" || !report.Components["db"].Healthy {
+		t.Errorf("healthz = %d %+v; want ok", code, report)
+	}
+
+	// retention hasn't run for too long
+	atomic.StoreInt64(&lastRetention, time.Now().Add(-2*time.Hour).UnixNano())
+	code, report := get()
+	if retention := report.Components["retention"]; code != http.StatusServiceUnavailable || report.Status != "unhealthy" ||
+		retention.Healthy || retention.Error == "" || retention.LastSuccess == nil {
+		t.Errorf("healthz = %d %+v; want retention unhealthy", code, report)
+	}
+	atomic.StoreInt64(&lastRetention, time.Now().UnixNano())
+
+	// the database went away
+	store.DB.Close()
+	code, report = get()
+	if db := report.Components["db"]; code != http.StatusServiceUnavailable || db.Healthy || db.Error == "" {
+		t.Errorf("healthz = %d %+v; want the db unhealthy", code, report)
+	}
+	if !report.Components["retention"].Healthy {
+		t.Errorf("retention = %+v; want it healthy", report.Components["retention"])
+	}
+
+	// results are reused for ttl
+	h.ttl = time.Hour
+	atomic.StoreInt64(&lastRetention, time.Now().Add(-2*time.Hour).UnixNano())
+	if _, report := get(); !report.Components["retention"].Healthy {
+		t.Errorf("retention = %+v; want the cached status", report.Components["retention"])
+	}
+}
@@ -2,21 +2,61 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/fiatjaf/relayer/v2"
+	"github.com/fiatjaf/relayer/v2/sink/redis"
 	"github.com/fiatjaf/relayer/v2/storage/postgresql"
-	"github.com/kelseyhightower/envconfig"
+	"github.com/fiatjaf/relayer/v2/storage/sqlite3"
 	"github.com/nbd-wtf/go-nostr"
 )
 
 type Relay struct {
+	StorageBackend   string `envconfig:"STORAGE_BACKEND" default:"postgresql"`
 	PostgresDatabase string `envconfig:"POSTGRESQL_DATABASE"`
+	SQLiteDatabase   string `envconfig:"SQLITE_DATABASE" default:"relay.db"`
 
-	storage *postgresql.PostgresBackend
+	// zero leaves the backend defaults
+	PostgresMaxOpenConns     int           `envconfig:"POSTGRESQL_MAX_OPEN_CONNS"`
+	PostgresMaxIdleConns     int           `envconfig:"POSTGRESQL_MAX_IDLE_CONNS"`
+	PostgresConnMaxLifetime  time.Duration `envconfig:"POSTGRESQL_CONN_MAX_LIFETIME"`
+	PostgresStatementTimeout time.Duration `envconfig:"POSTGRESQL_STATEMENT_TIMEOUT"`
+	PostgresConnectTimeout   time.Duration `envconfig:"POSTGRESQL_CONNECT_TIMEOUT"`
+
+	HealthRetentionMaxAge time.Duration `envconfig:"HEALTH_RETENTION_MAX_AGE" default:"2h"`
+	HealthCacheTTL        time.Duration `envconfig:"HEALTH_CACHE_TTL" default:"5s"`
+
+	// in bytes of JSON, overridden for some kinds by MAX_SIZE_KIND_<kind>
+	MaxSize     int `envconfig:"MAX_SIZE" default:"10000"`
+	kindMaxSize map[int]int
+
+	// relayed to subscribers but not stored, besides kinds 20000-29999
+	EphemeralKinds []int `envconfig:"EPHEMERAL_KINDS"`
+
+	// zero leaves the relayer defaults, see relayer.WebSocketOptions
+	WSMaxMessageSize int64         `envconfig:"WS_MAX_MESSAGE_SIZE"`
+	WSWriteWait      time.Duration `envconfig:"WS_WRITE_WAIT"`
+	WSPingPeriod     time.Duration `envconfig:"WS_PING_PERIOD"`
+	WSPongWait       time.Duration `envconfig:"WS_PONG_WAIT"`
+	WSSendQueue      int           `envconfig:"WS_SEND_QUEUE"`
+
+	RedisSinkURL     string `envconfig:"REDIS_SINK_URL"`
+	RedisSinkChannel string `envconfig:"REDIS_SINK_CHANNEL" default:"nostr:events"`
+	sink             *redis.Sink
+
+	storage relayer.Storage
+}
+
+// execer is what the sql storages have in common, enough to clean up old events.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
 }
 
 func (r *Relay) Name() string {
@@ -28,28 +68,74 @@ func (r *Relay) Storage(ctx context.Context) relayer.Storage {
 }
 
 func (r *Relay) Init() error {
-	err := envconfig.Process("", r)
+	err := r.loadConfig()
 	if err != nil {
-		return fmt.Errorf("couldn't process envconfig: %w", err)
+		return err
+	}
+	if r.RedisSinkURL != "" {
+		if r.sink, err = redis.New(r.RedisSinkURL, r.RedisSinkChannel); err != nil {
+			return fmt.Errorf("bad REDIS_SINK_URL: %w", err)
+		}
 	}
 
 	// every hour, delete all very old events
 	go func() {
-		db := r.Storage(context.TODO()).(*postgresql.PostgresBackend)
+		db, ok := r.Storage(context.TODO()).(execer)
+		if !ok {
+			return
+		}
 
 		for {
 			time.Sleep(60 * time.Minute)
-			db.DB.Exec(`DELETE FROM event WHERE created_at < $1`, time.Now().AddDate(0, -3, 0).Unix()) // 3 months
+			_, err := db.Exec(`DELETE FROM event WHERE created_at < $1`, time.Now().AddDate(0, -3, 0).Unix()) // 3 months
+			if err != nil {
+				log.Printf("failed to delete old events: %v", err)
+				continue
+			}
+			atomic.StoreInt64(&lastRetention, time.Now().UnixNano())
 		}
 	}()
 
 	return nil
 }
 
+// EventSink is where accepted events are published, if REDIS_SINK_URL is set.
+func (r *Relay) EventSink() relayer.EventSink {
+	if r.sink == nil {
+		return nil
+	}
+	return r.sink
+}
+
+// WebSocketOptions are the WS_* settings clients are served with.
+func (r *Relay) WebSocketOptions() relayer.WebSocketOptions {
+	return relayer.WebSocketOptions{
+		MaxMessageSize: r.WSMaxMessageSize,
+		WriteWait:      r.WSWriteWait,
+		PingPeriod:     r.WSPingPeriod,
+		PongWait:       r.WSPongWait,
+		SendQueue:      r.WSSendQueue,
+	}
+}
+
+// IsEphemeral implements relayer.Ephemeraler, adding EPHEMERAL_KINDS to the
+// NIP-16 ones.
+func (r *Relay) IsEphemeral(kind int) bool {
+	if relayer.IsEphemeralKind(kind) {
+		return true
+	}
+	for _, k := range r.EphemeralKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
 func (r *Relay) AcceptEvent(ctx context.Context, evt *nostr.Event) bool {
 	// block events that are too large
 	jsonb, _ := json.Marshal(evt)
-	if len(jsonb) > 10000 {
+	if len(jsonb) > r.maxSize(evt.Kind) {
 		return false
 	}
 
@@ -57,16 +143,73 @@ func (r *Relay) AcceptEvent(ctx context.Context, evt *nostr.Event) bool {
 }
 
 func main() {
+	migrateOnly := flag.Bool("migrate-only", false, "bring the database schema up to date and exit")
+	exportTo := flag.String("export", "", "write every stored event to this file, or - for stdout, as JSON lines and exit")
+	importFrom := flag.String("import", "", "save the events in this JSON lines file, or - for stdin, and exit")
+	since := flag.Int64("since", 0, "only export or import events created after this unix timestamp")
+	kinds := flag.String("kinds", "", "only export or import events of these comma-separated kinds")
+	checkConfig := flag.Bool("check-config", false, "check the settings in the environment and exit")
+	flag.Parse()
+
 	r := Relay{}
-	if err := envconfig.Process("", &r); err != nil {
-		log.Fatalf("failed to read from env: %v", err)
+	// before anything else, so that every problem is listed readably
+	if err := r.loadConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *checkConfig {
+		fmt.Println("configuration ok")
+		return
+	}
+	switch r.StorageBackend {
+	case "postgresql":
+		r.storage = &postgresql.PostgresBackend{
+			DatabaseURL:      r.PostgresDatabase,
+			MaxOpenConns:     r.PostgresMaxOpenConns,
+			MaxIdleConns:     r.PostgresMaxIdleConns,
+			ConnMaxLifetime:  r.PostgresConnMaxLifetime,
+			StatementTimeout: r.PostgresStatementTimeout,
+			ConnectTimeout:   r.PostgresConnectTimeout,
+		}
+	case "sqlite3":
+		r.storage = &sqlite3.SQLite3Backend{DatabaseURL: r.SQLiteDatabase}
+	}
+	if *migrateOnly {
+		if err := r.storage.Init(); err != nil {
+			log.Fatalf("failed to migrate: %v", err)
+		}
+		return
+	}
+	if *exportTo != "" || *importFrom != "" {
+		filter, err := backupFilter(*since, *kinds)
+		if err != nil {
+			log.Fatalf("bad filter: %v", err)
+		}
+		if err := r.storage.Init(); err != nil {
+			log.Fatalf("failed to open the storage: %v", err)
+		}
+		if *exportTo != "" {
+			err = runExport(r.storage, *exportTo, filter)
+		} else {
+			err = runImport(r.storage, *importFrom, filter)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
 		return
 	}
-	r.storage = &postgresql.PostgresBackend{DatabaseURL: r.PostgresDatabase}
 	server, err := relayer.NewServer(&r)
 	if err != nil {
 		log.Fatalf("failed to create server: %v", err)
 	}
+	if db, ok := r.storage.(pinger); ok {
+		server.Router().Handle("/healthz", &healthz{
+			db:              db,
+			ttl:             r.HealthCacheTTL,
+			retentionMaxAge: r.HealthRetentionMaxAge,
+			started:         time.Now(),
+		})
+	}
 	if err := server.Start("0.0.0.0", 7447); err != nil {
 		log.Fatalf("server terminated: %v", err)
 	}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// kindSizePrefix starts the environment variables that set the size limit of
+// a single kind, e.g. MAX_SIZE_KIND_30023=100000.
+const kindSizePrefix = "MAX_SIZE_KIND_"
+
+// kindSizeLimits reads the per-kind size limits out of environ, as given by
+// os.Environ, returning a configError with all the bad ones.
+func kindSizeLimits(environ []string) (map[int]int, error) {
+	limits := make(map[int]int)
+	var problems configError
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, kindSizePrefix) {
+			continue
+		}
+		kind, err := strconv.Atoi(strings.TrimPrefix(name, kindSizePrefix))
+		if err != nil || kind < 0 {
+			problems = append(problems, fmt.Sprintf("%s: not a kind", name))
+			continue
+		}
+		size, err := strconv.Atoi(value)
+		if err != nil || size <= 0 {
+			problems = append(problems, fmt.Sprintf("%s: invalid size %q", name, value))
+			continue
+		}
+		limits[kind] = size
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return limits, nil
+}
+
+// maxSize is how large, serialized, an event of kind may be.
+func (r *Relay) maxSize(kind int) int {
+	if size, ok := r.kindMaxSize[kind]; ok {
+		return size
+	}
+	return r.MaxSize
+}
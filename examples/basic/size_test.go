@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestKindSizeLimits(t *testing.T) {
+	t.Setenv("STORAGE_BACKEND", "sqlite3")
+	t.Setenv("MAX_SIZE", "2000")
+	t.Setenv("MAX_SIZE_KIND_30023", "50000")
+	t.Setenv("MAX_SIZE_KIND_0", "500")
+	var r Relay
+	if err := r.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	sk := nostr.GeneratePrivateKey()
+	event := func(kind, size int) *nostr.Event {
+		evt := &nostr.Event{Kind: kind, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: strings.Repeat("a", size)}
+		evt.Sign(sk)
+		return evt
+	}
+
+	for _, tt := range []struct {
+		name string
+		evt  *nostr.Event
+		want bool
+	}{
+		{"large article", event(30023, 20000), true},
+		{"equally large note", event(nostr.KindTextNote, 20000), false},
+		{"small note", event(nostr.KindTextNote, 1000), true},
+		{"profile over its own limit", event(nostr.KindSetMetadata, 1000), false},
+		{"article over its own limit", event(30023, 60000), false},
+	} {
+		if got := r.AcceptEvent(context.Background(), tt.evt); got != tt.want {
+			t.Errorf("%s: AcceptEvent = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestKindSizeLimitsInvalid(t *testing.T) {
+	for _, kv := range []string{"MAX_SIZE_KIND_note=1000", "MAX_SIZE_KIND_1=big", "MAX_SIZE_KIND_1=0"} {
+		if _, err := kindSizeLimits([]string{"PATH=/bin", kv}); err == nil {
+			t.Errorf("kindSizeLimits accepted %s", kv)
+		}
+	}
+	limits, err := kindSizeLimits([]string{"MAX_SIZE=1", "MAX_SIZE_KIND_1=300"})
+	if err != nil || len(limits) != 1 || limits[1] != 300 {
+		t.Errorf("kindSizeLimits = %v, %v; want only kind 1 at 300", limits, err)
+	}
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"net/http"
+	"strings"
+
+	"github.com/fiatjaf/relayer/v2"
+	"github.com/nbd-wtf/go-nostr"
 )
 
 func handleWebpage(w http.ResponseWriter, rq *http.Request) {
@@ -66,3 +71,51 @@ func handleInvoice(w http.ResponseWriter, rq *http.Request, r *Relay) {
 		}{invoice})
 	}
 }
+
+// handleRelayList answers GET /relaylist/<pubkey> with the relays of the latest
+// NIP-65 relay list of pubkey, for tools that don't speak nostr.
+func handleRelayList(w http.ResponseWriter, rq *http.Request, r *Relay) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(status int, msg string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(struct {
+			Error string `json:"error"`
+		}{msg})
+	}
+
+	pubkey := strings.TrimPrefix(rq.URL.Path, "/relaylist/")
+	if b, err := hex.DecodeString(pubkey); err != nil || len(b) != 32 {
+		fail(http.StatusBadRequest, "invalid pubkey")
+		return
+	}
+
+	ch, err := r.Storage(rq.Context()).QueryEvents(rq.Context(), &nostr.Filter{
+		Kinds:   []int{relayer.KindRelayList},
+		Authors: []string{pubkey},
+		Limit:   1,
+	})
+	if err != nil {
+		fail(http.StatusInternalServerError, "failed to query relay list")
+		return
+	}
+	var latest *nostr.Event
+	for evt := range ch {
+		if latest == nil || evt.CreatedAt > latest.CreatedAt {
+			latest = evt
+		}
+	}
+	if latest == nil {
+		fail(http.StatusNotFound, "no relay list")
+		return
+	}
+
+	relays := relayer.RelayList(latest)
+	if relays == nil {
+		relays = []relayer.RelayListEntry{}
+	}
+	json.NewEncoder(w).Encode(struct {
+		PubKey    string                   `json:"pubkey"`
+		CreatedAt nostr.Timestamp          `json:"created_at"`
+		Relays    []relayer.RelayListEntry `json:"relays"`
+	}{pubkey, latest.CreatedAt, relays})
+}
@@ -48,9 +48,15 @@ func (r *Relay) Init() error {
 	return nil
 }
 
+// freeKinds are accepted from anyone, paid or not. Relay lists tell clients
+// where to find a user, so they are useful to have even for those who didn't pay.
+var freeKinds = map[int]bool{
+	relayer.KindRelayList: true,
+}
+
 func (r *Relay) AcceptEvent(ctx context.Context, evt *nostr.Event) bool {
 	// only accept they have a good preimage for a paid invoice for their public key
-	if !checkInvoicePaidOk(evt.PubKey) {
+	if !freeKinds[evt.Kind] && !checkInvoicePaidOk(evt.PubKey) {
 		return false
 	}
 
@@ -79,6 +85,9 @@ func main() {
 	server.Router().HandleFunc("/invoice", func(w http.ResponseWriter, rq *http.Request) {
 		handleInvoice(w, rq, &r)
 	})
+	server.Router().HandleFunc("/relaylist/", func(w http.ResponseWriter, rq *http.Request) {
+		handleRelayList(w, rq, &r)
+	})
 	if err := server.Start("0.0.0.0", 7447); err != nil {
 		log.Fatalf("server terminated: %v", err)
 	}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// requireAdmin wraps handlers that should only be reachable with the ADMIN_TOKEN.
+// They are disabled altogether when no token is configured.
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			httpError(w, r, 401, "unauthorized")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// isAdmin tells whether r carries the ADMIN_TOKEN, never when there is none.
+func isAdmin(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return relay.AdminToken != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(relay.AdminToken)) == 1
+}
+
+func handlePinFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, 405, "method not allowed")
+		return
+	}
+
+	pubkey := r.URL.Query().Get("pubkey")
+	pinned := r.URL.Query().Get("pinned") != "false"
+
+	entity, err := updateEntity(relay.db, pubkey, func(entity *Entity) { entity.Pinned = pinned })
+	if err == pebble.ErrNotFound {
+		httpError(w, r, 404, "unknown feed")
+		return
+	} else if err != nil {
+		httpError(w, r, 500, err.Error())
+		return
+	}
+
+	fmt.Fprintf(w, "url   : %s\npinned: %v", entity.URL, pinned)
+}
+
+func handleSetOutbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, 405, "method not allowed")
+		return
+	}
+
+	var relays []string
+	for _, url := range strings.Split(r.URL.Query().Get("relays"), ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			relays = append(relays, url)
+		}
+	}
+	only := r.URL.Query().Get("only") == "true"
+
+	entity, err := updateEntity(relay.db, r.URL.Query().Get("pubkey"), func(entity *Entity) {
+		entity.OutboxRelays = relays
+		entity.OutboxOnly = only
+	})
+	if err == pebble.ErrNotFound {
+		httpError(w, r, 404, "unknown feed")
+		return
+	} else if err != nil {
+		httpError(w, r, 500, err.Error())
+		return
+	}
+
+	fmt.Fprintf(w, "url   : %s\noutbox: %s", entity.URL, strings.Join(entity.OutboxRelays, ", "))
+}
+
+// handleRefreshFeed drops a feed from the cache so it's fetched again right away.
+func handleRefreshFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, 405, "method not allowed")
+		return
+	}
+
+	entity, err := loadEntity(relay.db, r.URL.Query().Get("pubkey"))
+	if err == pebble.ErrNotFound {
+		httpError(w, r, 404, "unknown feed")
+		return
+	} else if err != nil {
+		httpError(w, r, 500, err.Error())
+		return
+	}
+
+	feeds.Invalidate(entity.URL)
+	if _, err := parseFeed(r.Context(), entity.URL); err != nil {
+		httpError(w, r, 502, "bad feed: "+err.Error())
+		return
+	}
+
+	fmt.Fprintf(w, "url   : %s\nrefreshed", entity.URL)
+}
+
+// handleRotateKey moves a feed to a key derived from the current secret.
+func handleRotateKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, 405, "method not allowed")
+		return
+	}
+
+	pubkey := r.URL.Query().Get("pubkey")
+	newPubkey, events, err := rotateFeedKey(relay.db, pubkey, r.URL.Query().Get("announce") == "true")
+	if err == pebble.ErrNotFound {
+		httpError(w, r, 404, "unknown feed")
+		return
+	} else if err == ErrAlreadyCurrent {
+		httpError(w, r, 409, fmt.Sprintf("%s, pubkey %s", err.Error(), newPubkey))
+		return
+	} else if err != nil {
+		httpError(w, r, 500, err.Error())
+		return
+	}
+
+	for _, evt := range events {
+		select {
+		case relay.updates <- evt:
+		case <-r.Context().Done():
+			// shutting down, followers will get the moved profile from QueryEvents anyway
+			return
+		}
+	}
+
+	fmt.Fprintf(w, "old pubkey: %s\nnew pubkey: %s", pubkey, newPubkey)
+}
+
+// handleAuditKeys lists every feed with its stored pubkey and the one the current
+// secret derives for it, flagging those that don't match.
+func handleAuditKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, r, 405, "method not allowed")
+		return
+	}
+
+	audits, err := auditKeys(relay.db)
+	if err != nil {
+		httpError(w, r, 500, err.Error())
+		return
+	}
+
+	mismatched := 0
+	for _, audit := range audits {
+		status := "ok"
+		if !audit.Match {
+			status = "MISMATCH"
+			mismatched++
+		}
+		if audit.MovedTo != "" {
+			status += " (moved to " + audit.MovedTo + ")"
+		}
+		npub, _ := nip19.EncodePublicKey(audit.Pubkey)
+		derived, _ := nip19.EncodePublicKey(audit.DerivedPubkey)
+		fmt.Fprintf(w, "url    : %s\nstored : %s\nderived: %s\nsecret : v%d\nstatus : %s\n\n",
+			audit.URL, npub, derived, audit.SecretVersion, status)
+	}
+	fmt.Fprintf(w, "%d feeds, %d mismatched", len(audits), mismatched)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+)
+
+var ErrBadAuth = errors.New("bad feed credentials")
+
+// feedAuths holds the credentials of the feeds that need some, by feed url.
+var feedAuths sync.Map
+
+// FeedAuth is how a private feed is fetched: with Basic auth, where Credential
+// is "user:password", a bearer token, or a custom header called Name.
+type FeedAuth struct {
+	Type       string `json:"type"`
+	Name       string `json:"name,omitempty"`
+	Credential string `json:"credential"`
+}
+
+// String keeps the credential out of anything that prints a FeedAuth.
+func (auth FeedAuth) String() string {
+	return auth.Type + " credentials"
+}
+
+// parseFeedAuth checks the credentials given when registering a feed, which
+// are optional: no type means no auth.
+func parseFeedAuth(typ, name, credential string) (*FeedAuth, error) {
+	auth := &FeedAuth{Type: strings.ToLower(typ), Credential: credential}
+	switch auth.Type {
+	case "":
+		return nil, nil
+	case "basic":
+		if !strings.Contains(credential, ":") {
+			return nil, fmt.Errorf("%w: basic credentials must be user:password", ErrBadAuth)
+		}
+	case "bearer":
+	case "header":
+		if name == "" || strings.ContainsAny(name, " :\r\n") {
+			return nil, fmt.Errorf("%w: missing or invalid header name", ErrBadAuth)
+		}
+		auth.Name = textproto.CanonicalMIMEHeaderKey(name)
+	default:
+		return nil, fmt.Errorf("%w: unknown type %q", ErrBadAuth, typ)
+	}
+	if credential == "" {
+		return nil, fmt.Errorf("%w: missing credential", ErrBadAuth)
+	}
+	return auth, nil
+}
+
+// authorize adds the credentials to req.
+func (auth *FeedAuth) authorize(req *http.Request) {
+	switch auth.Type {
+	case "basic":
+		user, password, _ := strings.Cut(auth.Credential, ":")
+		req.SetBasicAuth(user, password)
+	case "bearer":
+		req.Header.Set("Authorization", "Bearer "+auth.Credential)
+	case "header":
+		req.Header.Set(auth.Name, auth.Credential)
+	}
+}
+
+// credentialsFor returns the credentials of the feed at url, nil if it has none.
+func credentialsFor(url string) *FeedAuth {
+	if auth, ok := feedAuths.Load(url); ok {
+		return auth.(*FeedAuth)
+	}
+	return nil
+}
+
+// secretCipher is an AES-GCM cipher keyed off secret, for the given purpose.
+func secretCipher(secret, purpose string) (cipher.AEAD, error) {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(purpose))
+	block, err := aes.NewCipher(m.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plain with aead, prefixing a random nonce.
+func seal(aead cipher.AEAD, plain []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+// unseal decrypts what seal returned.
+func unseal(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed data too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// sealAuth encrypts auth for storing in an Entity.
+func sealAuth(secret string, auth *FeedAuth) ([]byte, error) {
+	aead, err := secretCipher(secret, "feed credentials")
+	if err != nil {
+		return nil, err
+	}
+	plain, err := json.Marshal(auth)
+	if err != nil {
+		return nil, err
+	}
+	return seal(aead, plain)
+}
+
+// openAuth decrypts what sealAuth returned, which fails if the secret changed since.
+func openAuth(secret string, sealed []byte) (*FeedAuth, error) {
+	aead, err := secretCipher(secret, "feed credentials")
+	if err != nil {
+		return nil, err
+	}
+	plain, err := unseal(aead, sealed)
+	if err != nil {
+		return nil, err
+	}
+	var auth FeedAuth
+	if err := json.Unmarshal(plain, &auth); err != nil {
+		return nil, err
+	}
+	return &auth, nil
+}
+
+// storeFeedAuth saves entity with auth sealed in it and starts using auth for its feed.
+func storeFeedAuth(db *pebble.DB, secret, pubkey string, entity Entity, auth *FeedAuth) error {
+	sealed, err := sealAuth(secret, auth)
+	if err != nil {
+		return fmt.Errorf("failed to seal credentials: %w", err)
+	}
+	entity.Auth = sealed
+	if err := saveEntity(db, pubkey, entity); err != nil {
+		return err
+	}
+	feedAuths.Store(entity.URL, auth)
+	return nil
+}
+
+// loadFeedAuths opens the stored credentials of every feed into feedAuths.
+// Feeds whose credentials can't be opened are logged and fetched without them.
+func loadFeedAuths(db *pebble.DB, secret string) error {
+	return skipCorrupt(ForEachEntity(db, func(stored StoredEntity) error {
+		if len(stored.Entity.Auth) == 0 || stored.Entity.MovedTo != "" {
+			return nil
+		}
+		auth, err := openAuth(secret, stored.Entity.Auth)
+		if err != nil {
+			logger.Error("failed to open feed credentials, register it again", "pubkey", stored.Pubkey, "err", err)
+			return nil
+		}
+		feedAuths.Store(stored.Entity.URL, auth)
+		return nil
+	}))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// privateFeed serves testFeed only to requests that authorized is happy with.
+func privateFeed(t *testing.T, authorized func(*http.Request) bool) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { feedAuths = sync.Map{} })
+	return srv
+}
+
+func TestFeedBasicAuth(t *testing.T) {
+	setupTestRelay(t)
+	srv := privateFeed(t, func(r *http.Request) bool {
+		user, password, ok := r.BasicAuth()
+		return ok && user == "reader" && password == "hunter2"
+	})
+
+	if _, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{}); !errors.Is(err, ErrNoFeedFound) {
+		t.Errorf("Feed without credentials = %v; want ErrNoFeedFound", err)
+	}
+	wrong := &FeedAuth{Type: "basic", Credential: "reader:wrong"}
+	if _, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{Auth: wrong}); err == nil {
+		t.Error("Feed with wrong credentials succeeded")
+	}
+
+	auth := &FeedAuth{Type: "basic", Credential: "reader:hunter2"}
+	pubkey, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{Auth: auth})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+
+	// polling goes through the cache, which must use the credentials too
+	feeds.Flush()
+	if _, err := parseFeed(context.Background(), srv.URL); err != nil {
+		t.Errorf("parseFeed after registering: %v", err)
+	}
+
+	val, closer, err := relay.db.Get(entityKey(pubkey))
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer closer.Close()
+	if bytes.Contains(val, []byte("hunter2")) {
+		t.Error("credentials are stored in the clear")
+	}
+
+	// and after a restart
+	feedAuths = sync.Map{}
+	feeds.Flush()
+	if err := loadFeedAuths(relay.db, relay.Secret); err != nil {
+		t.Fatalf("loadFeedAuths: %v", err)
+	}
+	if _, err := parseFeed(context.Background(), srv.URL); err != nil {
+		t.Errorf("parseFeed after reloading credentials: %v", err)
+	}
+
+	// a different secret can't open them
+	feedAuths = sync.Map{}
+	if err := loadFeedAuths(relay.db, "another-secret"); err != nil {
+		t.Fatalf("loadFeedAuths: %v", err)
+	}
+	if credentialsFor(srv.URL) != nil {
+		t.Error("credentials opened with the wrong secret")
+	}
+}
+
+func TestFeedBearerAuth(t *testing.T) {
+	setupTestRelay(t)
+	srv := privateFeed(t, func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Bearer s3cret"
+	})
+
+	pubkey, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{Auth: &FeedAuth{Type: "bearer", Credential: "s3cret"}})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+	entity, err := loadEntity(relay.db, pubkey)
+	if err != nil {
+		t.Fatalf("loadEntity: %v", err)
+	}
+	auth, err := openAuth(relay.Secret, entity.Auth)
+	if err != nil {
+		t.Fatalf("openAuth: %v", err)
+	}
+	if auth.Type != "bearer" || auth.Credential != "s3cret" {
+		t.Errorf("stored credentials = %+v", *auth)
+	}
+}
+
+func TestParseFeedAuth(t *testing.T) {
+	for _, tc := range []struct {
+		typ, name, credential string
+		ok                    bool
+	}{
+		{"", "", "", true},
+		{"basic", "", "user:password", true},
+		{"basic", "", "password", false},
+		{"Bearer", "", "token", true},
+		{"bearer", "", "", false},
+		{"header", "x-api-key", "key", true},
+		{"header", "", "key", false},
+		{"header", "X Api", "key", false},
+		{"cookie", "", "key", false},
+	} {
+		_, err := parseFeedAuth(tc.typ, tc.name, tc.credential)
+		if (err == nil) != tc.ok {
+			t.Errorf("parseFeedAuth(%q, %q, %q) = %v", tc.typ, tc.name, tc.credential, err)
+		}
+	}
+
+	auth, _ := parseFeedAuth("header", "x-api-key", "s3cret")
+	if auth.Name != "X-Api-Key" {
+		t.Errorf("header name = %q; want X-Api-Key", auth.Name)
+	}
+	if s := fmt.Sprintf("%v %+v", auth, *auth); strings.Contains(s, "s3cret") {
+		t.Errorf("credential printed: %s", s)
+	}
+}
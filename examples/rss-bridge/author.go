@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr/nip05"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/rif/cache2go"
+)
+
+var (
+	npubRe  = regexp.MustCompile(`npub1[02-9ac-hj-np-z]{58}`)
+	nip05Re = regexp.MustCompile(`(?i)[a-z0-9._-]+@[a-z0-9-]+(\.[a-z0-9-]+)+`)
+
+	// nip05Cache holds the pubkey each NIP-05 address resolved to, "" when it didn't.
+	nip05Cache = cache2go.New(1024, time.Hour*6)
+)
+
+// resolveNip05 looks up the pubkey of a NIP-05 address, "" if it has none.
+var resolveNip05 = func(ctx context.Context, address string) (string, error) {
+	pointer, err := nip05.QueryIdentifier(ctx, address)
+	if err != nil || pointer == nil {
+		return "", err
+	}
+	return pointer.PublicKey, nil
+}
+
+// itemAuthor is the name of whoever wrote item. gofeed already picks it from
+// the RSS author, dc:creator or Atom author elements.
+func itemAuthor(item *gofeed.Item) string {
+	authors := item.Authors
+	if item.Author != nil {
+		authors = append([]*gofeed.Person{item.Author}, authors...)
+	}
+	for _, person := range authors {
+		if person == nil {
+			continue
+		}
+		if name := strings.TrimSpace(person.Name); name != "" {
+			return name
+		}
+		if email := strings.TrimSpace(person.Email); email != "" {
+			return email
+		}
+	}
+	return ""
+}
+
+// authorPubkey finds a nostr identity in the author of item: an npub written
+// out, or a NIP-05 address that resolves. It returns "" when there's none.
+func authorPubkey(item *gofeed.Item) string {
+	var text []string
+	for _, person := range append([]*gofeed.Person{item.Author}, item.Authors...) {
+		if person != nil {
+			text = append(text, person.Name, person.Email)
+		}
+	}
+	if item.DublinCoreExt != nil {
+		// raw, in case gofeed couldn't make a name and address out of it
+		text = append(text, item.DublinCoreExt.Creator...)
+	}
+	author := strings.Join(text, " ")
+
+	if npub := npubRe.FindString(author); npub != "" {
+		if prefix, value, err := nip19.Decode(npub); err == nil && prefix == "npub" {
+			return value.(string)
+		}
+	}
+
+	for _, address := range nip05Re.FindAllString(author, -1) {
+		if pubkey := lookupNip05(strings.ToLower(address)); pubkey != "" {
+			return pubkey
+		}
+	}
+	return ""
+}
+
+// lookupNip05 resolves address through nip05Cache. Failures are cached too, so
+// authors whose address is just an email don't get looked up on every poll.
+func lookupNip05(address string) string {
+	if pubkey, ok := nip05Cache.Get(address); ok {
+		return pubkey.(string)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pubkey, err := resolveNip05(ctx, address)
+	if err != nil {
+		pubkey = ""
+	}
+	nip05Cache.Set(address, pubkey)
+	return pubkey
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestItemAuthors(t *testing.T) {
+	pubkey, _ := nostr.GetPublicKey(privateKeyFromFeed("test-secret", "https://example.com/author"))
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	nip05Pubkey, _ := nostr.GetPublicKey(privateKeyFromFeed("test-secret", "https://example.com/nip05"))
+
+	lookups := map[string]int{}
+	defer func(resolve func(context.Context, string) (string, error)) { resolveNip05 = resolve }(resolveNip05)
+	resolveNip05 = func(ctx context.Context, address string) (string, error) {
+		lookups[address]++
+		if address == "bob@example.com" {
+			return nip05Pubkey, nil
+		}
+		return "", errors.New("no nostr.json there")
+	}
+	nip05Cache.Flush()
+
+	var tests = []struct {
+		name   string
+		feed   string
+		author string
+		pubkey string
+	}{
+		{"dc:creator", `<?xml version="1.0"?>
+<rss version="2.0" xmlns:dc="http://purl.org/dc/elements/1.1/"><channel><title>t</title>
+<item><title>post</title><link>https://example.com/1</link><dc:creator>Alice Smith</dc:creator></item>
+</channel></rss>`, "Alice Smith", ""},
+		{"atom author", `<?xml version="1.0"?>
+<feed xmlns="http://www.w3.org/2005/Atom"><title>t</title>
+<entry><id>1</id><title>post</title><link href="https://example.com/1"/><updated>2023-01-01T00:00:00Z</updated><author><name>Bob</name><email>bob@example.com</email></author></entry>
+</feed>`, "Bob", nip05Pubkey},
+		{"npub in author", `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>t</title>
+<item><title>post</title><link>https://example.com/1</link><author>Carol - ` + npub + `</author></item>
+</channel></rss>`, "Carol", pubkey},
+		{"email that isn't nip05", `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>t</title>
+<item><title>post</title><link>https://example.com/1</link><author>dave@example.org (Dave)</author></item>
+</channel></rss>`, "Dave", ""},
+	}
+
+	for _, tt := range tests {
+		feed, err := fp.Parse(strings.NewReader(tt.feed))
+		if err != nil {
+			t.Fatalf("%s: parse: %v", tt.name, err)
+		}
+		evt := itemToTextNote("pubkey", feed.Items[0], defaultNoteTemplate)
+
+		if tt.author != "" && !strings.Contains(evt.Content, "by "+tt.author) {
+			t.Errorf("%s: content %q doesn't credit %s", tt.name, evt.Content, tt.author)
+		}
+		var tagged []string
+		for _, tag := range evt.Tags {
+			if tag.Key() == "p" {
+				tagged = append(tagged, tag.Value())
+			}
+		}
+		if (tt.pubkey == "" && len(tagged) != 0) || (tt.pubkey != "" && (len(tagged) != 1 || tagged[0] != tt.pubkey)) {
+			t.Errorf("%s: p tags = %v; want %q", tt.name, tagged, tt.pubkey)
+		}
+	}
+
+	// lookups, failed ones included, are cached
+	feed, _ := fp.Parse(strings.NewReader(tests[3].feed))
+	itemToTextNote("pubkey", feed.Items[0], defaultNoteTemplate)
+	if lookups["dave@example.org"] != 1 || lookups["bob@example.com"] != 1 {
+		t.Errorf("lookups = %v; want each address resolved once", lookups)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// sortBackfill puts events in the order given by BACKFILL_ORDER, "oldest" first
+// or else newest first, with ties broken by id so the result is deterministic.
+func sortBackfill(events []nostr.Event, order string) {
+	oldestFirst := order == "oldest"
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].CreatedAt != events[j].CreatedAt {
+			return (events[i].CreatedAt < events[j].CreatedAt) == oldestFirst
+		}
+		return events[i].ID < events[j].ID
+	})
+}
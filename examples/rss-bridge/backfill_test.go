@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestSortBackfill(t *testing.T) {
+	events := func() []nostr.Event {
+		return []nostr.Event{
+			{ID: "b", CreatedAt: 2},
+			{ID: "c", CreatedAt: 1},
+			{ID: "a", CreatedAt: 2},
+			{ID: "d", CreatedAt: 3},
+		}
+	}
+
+	for _, tc := range []struct {
+		order string
+		want  string
+	}{
+		{"newest", "dabc"},
+		{"", "dabc"},
+		{"oldest", "cabd"},
+	} {
+		evts := events()
+		sortBackfill(evts, tc.order)
+		got := ""
+		for _, evt := range evts {
+			got += evt.ID
+		}
+		if got != tc.want {
+			t.Errorf("sortBackfill(%q) = %s; want %s", tc.order, got, tc.want)
+		}
+	}
+}
+
+func TestQueryEventsOrder(t *testing.T) {
+	setupTestRelay(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+	defer srv.Close()
+
+	pubkey, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+
+	defer func(order string) { relay.BackfillOrder = order }(relay.BackfillOrder)
+	for _, tc := range []struct {
+		order string
+		limit int
+		want  []string
+	}{
+		{"newest", 0, []string{"second", "first"}},
+		{"oldest", 0, []string{"first", "second"}},
+		{"newest", 1, []string{"second"}},
+		{"oldest", 1, []string{"first"}},
+	} {
+		relay.BackfillOrder = tc.order
+		evts, err := store{relay.db}.QueryEvents(context.Background(), &nostr.Filter{
+			Authors: []string{pubkey},
+			Kinds:   []int{nostr.KindTextNote},
+			Limit:   tc.limit,
+		})
+		if err != nil {
+			t.Fatalf("QueryEvents: %v", err)
+		}
+
+		var got []string
+		for evt := range evts {
+			for _, title := range []string{"first", "second"} {
+				if strings.HasPrefix(evt.Content, "**"+title+"**") {
+					got = append(got, title)
+				}
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("order %q, limit %d: got %v; want %v", tc.order, tc.limit, got, tc.want)
+		}
+	}
+}
+
+func TestQueryEventsCancelled(t *testing.T) {
+	setupTestRelay(t)
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+	defer srv.Close()
+
+	pubkey, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+	feeds.Flush()
+	before := atomic.LoadInt32(&fetches)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	evts, err := store{relay.db}.QueryEvents(ctx, &nostr.Filter{Authors: []string{pubkey}})
+	if err == nil || evts != nil {
+		t.Errorf("QueryEvents = %v, %v; want no events and an error", evts, err)
+	}
+	if n := atomic.LoadInt32(&fetches); n != before {
+		t.Errorf("the feed was fetched %d more times after the query was cancelled", n-before)
+	}
+}
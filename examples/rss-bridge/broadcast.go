@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+// broadcaster publishes emitted events to the global RELAYS and to each feed's
+// own outbox relays, reusing connections across feeds.
+type broadcaster struct {
+	pool   *nostr.SimplePool
+	relays []string
+	// queue, if set, keeps the events until the relays got them, see send.
+	queue *deliveryQueue
+}
+
+func newBroadcaster(ctx context.Context, relays []string) *broadcaster {
+	return &broadcaster{
+		pool:   nostr.NewSimplePool(ctx),
+		relays: relays,
+	}
+}
+
+// targets returns the relays events from entity should be published to.
+func (b *broadcaster) targets(entity Entity) []string {
+	urls := make([]string, 0, len(b.relays)+len(entity.OutboxRelays))
+	add := func(list []string) {
+		for _, url := range list {
+			url = nostr.NormalizeURL(url)
+			if url != "" && !slices.Contains(urls, url) {
+				urls = append(urls, url)
+			}
+		}
+	}
+
+	if !entity.OutboxOnly || len(entity.OutboxRelays) == 0 {
+		add(b.relays)
+	}
+	add(entity.OutboxRelays)
+
+	return urls
+}
+
+// send has evt, from the feed of pubkey feed, published to every target relay
+// of entity: queued for delivery if there is a queue, returning once it's
+// stored, or else published in the background, where relays that fail to take
+// it miss it.
+func (b *broadcaster) send(feed string, entity Entity, evt nostr.Event) {
+	if b.queue == nil {
+		go b.publish(context.Background(), entity, evt)
+		return
+	}
+	if err := b.queue.add(b.targets(entity), feed, evt); err != nil {
+		logger.Error("failed to queue event for delivery", "event", evt.ID, "err", err)
+	}
+}
+
+// publish sends evt to every target relay of entity, returning once all have answered.
+func (b *broadcaster) publish(ctx context.Context, entity Entity, evt nostr.Event) {
+	var wg sync.WaitGroup
+	for _, url := range b.targets(entity) {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+
+			relay, err := b.pool.EnsureRelay(url)
+			if err != nil {
+				logger.Warn("failed to connect to relay", "relay", url, "err", err)
+				return
+			}
+			if status, err := relay.Publish(ctx, evt); status != nostr.PublishStatusSucceeded {
+				logger.Warn("failed to publish", "event", evt.ID, "relay", url, "status", status, "err", err)
+			}
+		}(url)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// fakeRelay accepts every EVENT it gets and hands it over on saved.
+func fakeRelay(t *testing.T, saved chan<- nostr.Event) *httptest.Server {
+	return httptest.NewServer(fakeRelayHandler(t, saved))
+}
+
+func fakeRelayHandler(t *testing.T, saved chan<- nostr.Event) http.Handler {
+	upgrader := websocket.Upgrader{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		for {
+			var msg []json.RawMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			var evt nostr.Event
+			if len(msg) == 2 && string(msg[0]) == `"EVENT"` && json.Unmarshal(msg[1], &evt) == nil {
+				saved <- evt
+				conn.WriteJSON([]any{"OK", evt.ID, true, ""})
+			}
+		}
+	})
+}
+
+func TestBroadcasterTargets(t *testing.T) {
+	b := newBroadcaster(context.Background(), []string{"wss://global.example.com"})
+
+	if got := b.targets(Entity{}); len(got) != 1 {
+		t.Errorf("targets without outbox = %v; want the global relay", got)
+	}
+	got := b.targets(Entity{OutboxRelays: []string{"wss://regional.example.com", "wss://global.example.com/"}})
+	if len(got) != 2 {
+		t.Errorf("targets with outbox = %v; want global and regional once each", got)
+	}
+	got = b.targets(Entity{OutboxRelays: []string{"wss://regional.example.com"}, OutboxOnly: true})
+	if len(got) != 1 || got[0] != "wss://regional.example.com" {
+		t.Errorf("targets with outbox only = %v; want just the regional relay", got)
+	}
+}
+
+func TestBroadcasterPublishesToOutbox(t *testing.T) {
+	saved := make(chan nostr.Event, 1)
+	outbox := fakeRelay(t, saved)
+	defer outbox.Close()
+
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	evt := nostr.Event{PubKey: pubkey, CreatedAt: nostr.Now(), Kind: nostr.KindTextNote, Tags: nostr.Tags{}, Content: "hello"}
+	evt.Sign(sk)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b := newBroadcaster(ctx, nil)
+	b.publish(ctx, Entity{OutboxRelays: []string{"ws" + strings.TrimPrefix(outbox.URL, "http")}}, evt)
+
+	select {
+	case got := <-saved:
+		if got.ID != evt.ID {
+			t.Errorf("outbox got %s; want %s", got.ID, evt.ID)
+		}
+	case <-time.After(time.Second):
+		t.Error("event didn't reach the outbox relay")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/rif/cache2go"
+)
+
+// feedCache keeps parsed feeds in memory. Entries older than ttl are still served,
+// for up to stale more, while a single background refresh replaces them, unless
+// the lookup wants them fresh. When disk is set, feeds missing from memory are
+// looked up there before fetching.
+type feedCache struct {
+	entries *cache2go.Cache
+	ttl     time.Duration
+	fetch   func(ctx context.Context, url string) (*gofeed.Feed, error)
+	disk    *diskFeedCache
+
+	mu         sync.Mutex
+	refreshing map[string]bool
+
+	hits        int64
+	misses      int64
+	staleServed int64
+	diskHits    int64
+}
+
+type cachedFeed struct {
+	feed    *gofeed.Feed
+	fetched time.Time
+}
+
+// CacheStats counts how feed lookups were answered.
+type CacheStats struct {
+	Size        int   `json:"size"`
+	Hits        int64 `json:"hits"`
+	Misses      int64 `json:"misses"`
+	StaleServed int64 `json:"stale_served"`
+	DiskHits    int64 `json:"disk_hits"`
+}
+
+func newFeedCache(size int, ttl, stale time.Duration, fetch func(context.Context, string) (*gofeed.Feed, error)) *feedCache {
+	return &feedCache{
+		entries:    cache2go.New(size, ttl+stale),
+		ttl:        ttl,
+		fetch:      fetch,
+		refreshing: make(map[string]bool),
+	}
+}
+
+type freshKey struct{}
+
+// fresh makes feed lookups with ctx fetch the feeds whose copy is past its
+// ttl, rather than be served that while it is refreshed, for the poller to see
+// new items as soon as they are there.
+func fresh(ctx context.Context) context.Context {
+	return context.WithValue(ctx, freshKey{}, true)
+}
+
+func (c *feedCache) Get(ctx context.Context, url string) (*gofeed.Feed, error) {
+	wantFresh, _ := ctx.Value(freshKey{}).(bool)
+	if v, ok := c.entries.Get(url); ok {
+		entry := v.(cachedFeed)
+		switch {
+		case time.Since(entry.fetched) < c.ttl:
+			atomic.AddInt64(&c.hits, 1)
+			return entry.feed, nil
+		case !wantFresh:
+			atomic.AddInt64(&c.staleServed, 1)
+			c.refresh(url)
+			return entry.feed, nil
+		}
+	} else if c.disk != nil && !wantFresh {
+		if feed, ok := c.disk.Get(url); ok {
+			atomic.AddInt64(&c.diskHits, 1)
+			c.entries.Set(url, cachedFeed{feed, time.Now()})
+			return feed, nil
+		}
+	}
+
+	atomic.AddInt64(&c.misses, 1)
+	return c.load(ctx, url)
+}
+
+// Peek is the feed at url if it is in memory, never fetching it.
+func (c *feedCache) Peek(url string) (*gofeed.Feed, bool) {
+	if v, ok := c.entries.Get(url); ok {
+		return v.(cachedFeed).feed, true
+	}
+	return nil, false
+}
+
+// Invalidate drops url from the cache so the next Get fetches it again.
+func (c *feedCache) Invalidate(url string) {
+	c.entries.Delete(url)
+	if c.disk != nil {
+		c.disk.Delete(url)
+	}
+}
+
+func (c *feedCache) Flush() {
+	c.entries.Flush()
+}
+
+func (c *feedCache) Stats() CacheStats {
+	return CacheStats{
+		Size:        c.entries.Len(),
+		Hits:        atomic.LoadInt64(&c.hits),
+		Misses:      atomic.LoadInt64(&c.misses),
+		StaleServed: atomic.LoadInt64(&c.staleServed),
+		DiskHits:    atomic.LoadInt64(&c.diskHits),
+	}
+}
+
+func (c *feedCache) load(ctx context.Context, url string) (*gofeed.Feed, error) {
+	feed, err := c.fetch(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	c.entries.Set(url, cachedFeed{feed, time.Now()})
+	if c.disk != nil {
+		c.disk.Set(url, feed)
+	}
+	return feed, nil
+}
+
+// refresh reloads url in the background, unless that is already happening.
+func (c *feedCache) refresh(url string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.refreshing[url] {
+		return
+	}
+	c.refreshing[url] = true
+
+	go func() {
+		c.load(context.Background(), url)
+
+		c.mu.Lock()
+		delete(c.refreshing, url)
+		c.mu.Unlock()
+	}()
+}
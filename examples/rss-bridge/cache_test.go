@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func TestFeedCache(t *testing.T) {
+	var fetches int64
+	fetch := func(_ context.Context, url string) (*gofeed.Feed, error) {
+		n := atomic.AddInt64(&fetches, 1)
+		return &gofeed.Feed{Title: url, Items: make([]*gofeed.Item, n)}, nil
+	}
+	c := newFeedCache(10, 50*time.Millisecond, time.Minute, fetch)
+	version := func() int {
+		feed, err := c.Get(context.Background(), "https://example.com/feed")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		return len(feed.Items)
+	}
+
+	if v := version(); v != 1 {
+		t.Errorf("first get = %d; want 1", v)
+	}
+	if v := version(); v != 1 {
+		t.Errorf("cached get = %d; want 1", v)
+	}
+
+	c.Invalidate("https://example.com/feed")
+	if v := version(); v != 2 {
+		t.Errorf("get after invalidate = %d; want 2", v)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if v := version(); v != 2 {
+		t.Errorf("stale get = %d; want the stale 2", v)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if v := version(); v != 3 {
+		t.Errorf("get after refresh = %d; want 3", v)
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 2 || stats.Misses != 2 || stats.StaleServed != 1 {
+		t.Errorf("stats = %+v; want 2 hits, 2 misses, 1 stale", stats)
+	}
+}
+
+func TestFeedCacheFresh(t *testing.T) {
+	var fetches int64
+	fetch := func(_ context.Context, url string) (*gofeed.Feed, error) {
+		n := atomic.AddInt64(&fetches, 1)
+		return &gofeed.Feed{Title: url, Items: make([]*gofeed.Item, n)}, nil
+	}
+	c := newFeedCache(10, 50*time.Millisecond, time.Minute, fetch)
+	version := func(ctx context.Context) int {
+		feed, err := c.Get(ctx, "https://example.com/feed")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		return len(feed.Items)
+	}
+
+	version(context.Background())
+	if v := version(fresh(context.Background())); v != 1 {
+		t.Errorf("fresh get within the ttl = %d; want the cached 1", v)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if v := version(fresh(context.Background())); v != 2 {
+		t.Errorf("fresh get past the ttl = %d; want it fetched again", v)
+	}
+	if stats := c.Stats(); stats.StaleServed != 0 {
+		t.Errorf("stats = %+v; want nothing served stale", stats)
+	}
+}
+
+func TestFeedCacheDisk(t *testing.T) {
+	setupTestRelay(t)
+
+	var fetches int64
+	published := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)
+	fetch := func(_ context.Context, url string) (*gofeed.Feed, error) {
+		atomic.AddInt64(&fetches, 1)
+		return &gofeed.Feed{
+			Title: "test feed",
+			Link:  "https://example.com",
+			Items: []*gofeed.Item{{Title: "first", Link: "https://example.com/1", PublishedParsed: &published}},
+		}, nil
+	}
+	c := newFeedCache(1, time.Minute, time.Minute, fetch)
+	c.disk = newDiskFeedCache(relay.db, time.Hour)
+
+	get := func(url string) *gofeed.Feed {
+		feed, err := c.Get(context.Background(), url)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		return feed
+	}
+
+	get("https://example.com/feed")
+	// only one feed fits in memory, so this evicts the first
+	get("https://example.com/other")
+	if n := atomic.LoadInt64(&fetches); n != 2 {
+		t.Fatalf("fetched %d times; want 2", n)
+	}
+
+	feed := get("https://example.com/feed")
+	if n := atomic.LoadInt64(&fetches); n != 2 {
+		t.Errorf("fetched %d times after the eviction; want the disk copy", n)
+	}
+	if stats := c.Stats(); stats.DiskHits != 1 {
+		t.Errorf("stats = %+v; want 1 disk hit", stats)
+	}
+	if feed.Title != "test feed" || len(feed.Items) != 1 || feed.Items[0].Link != "https://example.com/1" ||
+		feed.Items[0].PublishedParsed == nil || !feed.Items[0].PublishedParsed.Equal(published) {
+		t.Errorf("feed from disk = %+v; want what was fetched", feed)
+	}
+
+	// a restart starts with an empty memory
+	c = newFeedCache(1, time.Minute, time.Minute, fetch)
+	c.disk = newDiskFeedCache(relay.db, time.Hour)
+	get("https://example.com/other")
+	if n := atomic.LoadInt64(&fetches); n != 2 {
+		t.Errorf("fetched %d times after a restart; want the disk copy", n)
+	}
+
+	// expired on disk
+	c = newFeedCache(1, time.Minute, time.Minute, fetch)
+	c.disk = newDiskFeedCache(relay.db, 0)
+	get("https://example.com/feed")
+	if n := atomic.LoadInt64(&fetches); n != 3 {
+		t.Errorf("fetched %d times with an expired copy; want 3", n)
+	}
+}
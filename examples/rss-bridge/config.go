@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/kelseyhightower/envconfig"
+)
+
+// minSecretLength is the shortest SECRET accepted for a new bridge. Every feed
+// key is derived from it, so a guessable one gives all of them away.
+const minSecretLength = 32
+
+// configError is everything wrong with the settings, one problem a line.
+type configError []string
+
+func (e configError) Error() string {
+	return "bad configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// loadConfig reads the settings from the environment into relay and checks
+// them, returning a configError with every problem found.
+func (relay *Relay) loadConfig() error {
+	problems := processEnv(relay)
+	problems = append(problems, relay.validate()...)
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// processEnv is envconfig.Process reporting every value that doesn't parse
+// instead of only the first one. Those are left at their defaults.
+//
+// examples/basic has the same, as every example builds on its own.
+func processEnv(spec any) configError {
+	var problems configError
+	restore := map[string]string{}
+	defer func() {
+		for key, value := range restore {
+			os.Setenv(key, value)
+		}
+	}()
+
+	for {
+		err := envconfig.Process("", spec)
+		var parseErr *envconfig.ParseError
+		if errors.As(err, &parseErr) {
+			value, set := os.LookupEnv(parseErr.KeyName)
+			if set {
+				problems = append(problems, fmt.Sprintf("%s: %q is not a valid %s", parseErr.KeyName, parseErr.Value, parseErr.TypeName))
+				// try again without it to find the next one
+				restore[parseErr.KeyName] = value
+				os.Unsetenv(parseErr.KeyName)
+				continue
+			}
+		}
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		return problems
+	}
+}
+
+// validate checks what envconfig can't tell is wrong.
+func (relay *Relay) validate() configError {
+	var problems configError
+	problem := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	// a weak one is only checked for once the db is open, see checkSecret
+	if relay.Secret == "" {
+		problem("SECRET: missing, every feed key is derived from it")
+	}
+	if relay.SecretVersion < 1 {
+		problem("SECRET_VERSION: must be 1 or more")
+	}
+
+	if relay.ServiceURL != "" {
+		if err := checkURL(relay.ServiceURL, "ws", "wss"); err != nil {
+			problem("SERVICE_URL: %s", err)
+		}
+	}
+	for _, r := range relay.Relays {
+		if err := checkURL(r, "ws", "wss"); err != nil {
+			problem("RELAYS: %s", err)
+		}
+	}
+	if relay.RedisSinkURL != "" {
+		if err := checkURL(relay.RedisSinkURL, "redis", "rediss"); err != nil {
+			problem("REDIS_SINK_URL: %s", err)
+		}
+	}
+	if relay.SearchIndexURL != "" {
+		if err := checkURL(relay.SearchIndexURL, "http", "https"); err != nil {
+			problem("SEARCH_INDEX_URL: %s", err)
+		}
+	}
+
+	if relay.LogFormat != "text" && relay.LogFormat != "json" {
+		problem("LOG_FORMAT: %q is neither text nor json", relay.LogFormat)
+	}
+	if relay.FeedPreference != "rss" && relay.FeedPreference != "atom" {
+		problem("FEED_PREFERENCE: %q is neither rss nor atom", relay.FeedPreference)
+	}
+	if relay.BackfillOrder != "newest" && relay.BackfillOrder != "oldest" {
+		problem("BACKFILL_ORDER: %q is neither newest nor oldest", relay.BackfillOrder)
+	}
+	for _, source := range relay.TimestampSource {
+		if !validTimestampSource(source) {
+			problem("TIMESTAMP_SOURCE: %q is none of published, updated, fetched or first-seen", source)
+		}
+	}
+	if _, err := tlsConfig(relay.TLSCAFile, relay.TLSCertFile, relay.TLSKeyFile, relay.TLSMinVersion); err != nil {
+		problem("TLS settings: %s", err)
+	}
+
+	for _, d := range []struct {
+		key   string
+		value int64
+	}{
+		{"POLL_INTERVAL", int64(relay.PollInterval)},
+		{"POLL_TIMEOUT", int64(relay.PollTimeout)},
+		{"FEED_CACHE_SIZE", int64(relay.FeedCacheSize)},
+		{"HOST_MAX_CONCURRENT", int64(relay.HostMaxConcurrent)},
+		{"DELIVERY_MAX_AGE", int64(relay.DeliveryMaxAge)},
+	} {
+		if d.value <= 0 {
+			problem("%s: must be more than zero", d.key)
+		}
+	}
+	for _, d := range []struct {
+		key   string
+		value int64
+	}{
+		{"MAX_FEEDS", int64(relay.MaxFeeds)},
+		{"MIN_CONTENT_LENGTH", int64(relay.MinContentLength)},
+		{"POLL_JITTER", int64(relay.PollJitter)},
+		{"DIGEST_INTERVAL", int64(relay.DigestInterval)},
+		{"FEED_INJECT_RATE", int64(relay.FeedInjectRate)},
+		{"FULL_CONTENT_MAX_LENGTH", int64(relay.FullContentMaxLength)},
+		{"MAX_PAGE_SIZE", relay.MaxPageSize},
+		{"REGISTER_HORIZON", int64(relay.RegisterHorizon)},
+		{"STALE_FEED_THRESHOLD", int64(relay.StaleFeedThreshold)},
+		{"DEAD_FEED_THRESHOLD", int64(relay.DeadFeedThreshold)},
+		{"WS_MAX_MESSAGE_SIZE", relay.WSMaxMessageSize},
+		{"WS_SEND_QUEUE", int64(relay.WSSendQueue)},
+	} {
+		if d.value < 0 {
+			problem("%s: can't be negative", d.key)
+		}
+	}
+	if relay.DeadFeedThreshold > 0 && relay.DeadFeedThreshold < relay.StaleFeedThreshold {
+		problem("DEAD_FEED_THRESHOLD: shorter than STALE_FEED_THRESHOLD")
+	}
+	if relay.PruneDeadFeeds && relay.DeadFeedThreshold == 0 {
+		problem("PRUNE_DEAD_FEEDS: needs DEAD_FEED_THRESHOLD")
+	}
+
+	return problems
+}
+
+// checkURL tells what is wrong with s as an absolute url of one of schemes.
+func checkURL(s string, schemes ...string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("%q is not a url", s)
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme && u.Host != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not a %s url", s, strings.Join(schemes, " or "))
+}
+
+// weakSecret tells whether secret is too short or repetitive for the feed keys
+// derived from it to be safe.
+func weakSecret(secret string) bool {
+	return len(secret) < minSecretLength || distinctBytes(secret) < 8
+}
+
+// checkSecret refuses a weak SECRET on a bridge without feeds yet. Bridges
+// that already have some keep starting, with a warning, as their keys were
+// derived from it: moving them to a new SECRET is a key rotation.
+func checkSecret(db *pebble.DB, secret string) error {
+	if !weakSecret(secret) {
+		return nil
+	}
+
+	iter := db.NewIter(prefixIterOptions(entityPrefix))
+	registered := iter.First()
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	if !registered {
+		return configError{fmt.Sprintf("SECRET: too weak, use at least %d random characters", minSecretLength)}
+	}
+	logger.Warn("SECRET is too weak, set a new one with SECRET_VERSION increased and rotate the feeds to it",
+		"min_length", minSecretLength)
+	return nil
+}
+
+func distinctBytes(s string) int {
+	seen := map[byte]bool{}
+	for i := 0; i < len(s); i++ {
+		seen[s[i]] = true
+	}
+	return len(seen)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const goodSecret = "7d0c9a5e3f1b8264ad9e0c7b5f3a1d86"
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("SECRET", goodSecret)
+	t.Setenv("SERVICE_URL", "wss://rss.example.com")
+	t.Setenv("RELAYS", "wss://relay.example.com,ws://localhost:7447")
+	var r Relay
+	if err := r.loadConfig(); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if r.Secret != goodSecret || r.PollInterval != 20*time.Minute || len(r.Relays) != 2 {
+		t.Errorf("loaded secret %q, poll interval %s, relays %v; want the environment over the defaults", r.Secret, r.PollInterval, r.Relays)
+	}
+}
+
+func TestLoadConfigListsEveryProblem(t *testing.T) {
+	for key, value := range map[string]string{
+		"SECRET":           "hunter2",
+		"SERVICE_URL":      "rss.example.com",
+		"RELAYS":           "wss://fine.example.com,https://relay.example.com",
+		"REDIS_SINK_URL":   "localhost:6379",
+		"SEARCH_INDEX_URL": "ftp://search.example.com",
+		"MAX_FEEDS":        "lots",
+		"POLL_INTERVAL":    "20",
+		"HEALTH_CACHE_TTL": "5x",
+		"LOG_FORMAT":       "xml",
+		"BACKFILL_ORDER":   "random",
+		"TLS_MIN_VERSION":  "1.4",
+		"POLL_TIMEOUT":     "0s",
+
+		"STALE_FEED_THRESHOLD": "720h",
+		"DEAD_FEED_THRESHOLD":  "24h",
+	} {
+		t.Setenv(key, value)
+	}
+
+	var r Relay
+	err := r.loadConfig()
+	var problems configError
+	if !errors.As(err, &problems) {
+		t.Fatalf("loadConfig = %v; want a configError", err)
+	}
+	for _, want := range []string{
+		`SERVICE_URL: "rss.example.com" is not a ws or wss url`,
+		`RELAYS: "https://relay.example.com" is not a ws or wss url`,
+		`REDIS_SINK_URL: "localhost:6379" is not a redis or rediss url`,
+		`SEARCH_INDEX_URL: "ftp://search.example.com" is not a http or https url`,
+		`MAX_FEEDS: "lots" is not a valid int`,
+		`POLL_INTERVAL: "20" is not a valid time.Duration`,
+		`HEALTH_CACHE_TTL: "5x" is not a valid time.Duration`,
+		`LOG_FORMAT: "xml" is neither text nor json`,
+		`BACKFILL_ORDER: "random" is neither newest nor oldest`,
+		`TLS settings: unknown TLS version "1.4"`,
+		"POLL_TIMEOUT: must be more than zero",
+		"DEAD_FEED_THRESHOLD: shorter than STALE_FEED_THRESHOLD",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("no %q in:\n%v", want, err)
+		}
+	}
+	if len(problems) != 12 {
+		t.Errorf("got %d problems; want 12:\n%v", len(problems), err)
+	}
+
+	// the environment is left as it was
+	if os.Getenv("MAX_FEEDS") != "lots" || os.Getenv("POLL_INTERVAL") != "20" {
+		t.Error("loadConfig changed the environment")
+	}
+}
+
+func TestLoadConfigNeedsSecret(t *testing.T) {
+	t.Setenv("SECRET", "")
+	os.Unsetenv("SECRET")
+	var r Relay
+	err := r.loadConfig()
+	if err == nil || !strings.Contains(err.Error(), "SECRET: missing") {
+		t.Errorf("loadConfig without SECRET = %v; want it missing", err)
+	}
+}
+
+func TestCheckSecret(t *testing.T) {
+	setupTestRelay(t)
+	if err := checkSecret(relay.db, goodSecret); err != nil {
+		t.Errorf("checkSecret(good) = %v; want nil", err)
+	}
+	for _, weak := range []string{"hunter2", strings.Repeat("a", 64)} {
+		if err := checkSecret(relay.db, weak); err == nil || !strings.Contains(err.Error(), "SECRET: too weak") {
+			t.Errorf("checkSecret(%q) = %v; want it too weak", weak, err)
+		}
+	}
+
+	// feeds already keyed from it keep working
+	saveEntity(relay.db, "pubkey", Entity{URL: "https://example.com/feed"})
+	if err := checkSecret(relay.db, "hunter2"); err != nil {
+		t.Errorf("checkSecret(weak) with feeds = %v; want a warning only", err)
+	}
+}
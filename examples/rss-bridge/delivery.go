@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// deliveryQueue keeps the events still to be published to other relays in the
+// db, so they survive a relay being down and the bridge restarting. Each relay
+// gets a worker delivering its events at least once, backing off exponentially
+// while it fails. Events waiting for longer than maxAge are dropped.
+//
+// Deliveries are stored under deliveryKey until made, and then remembered
+// under deliveredKey for maxAge, so that an event queued again for the same
+// relay isn't sent twice. Those older than that are forgotten every
+// expireEvery, see expire.
+type deliveryQueue struct {
+	db     *pebble.DB
+	maxAge time.Duration
+
+	// overridable in tests
+	timeout     time.Duration
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	expireEvery time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu        sync.Mutex
+	upstreams map[string]*upstream
+}
+
+// upstream is a relay events are delivered to, and how that is going.
+type upstream struct {
+	wake chan struct{}
+	// only used by the worker
+	conn *nostr.Relay
+
+	mu     sync.Mutex
+	status UpstreamStatus
+}
+
+// UpstreamStatus is what handleDeliveries tells about a relay.
+type UpstreamStatus struct {
+	Pending     int       `json:"pending"`
+	Delivered   int64     `json:"delivered"`
+	Dropped     int64     `json:"dropped"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at"`
+	RetryAt     time.Time `json:"retry_at"`
+}
+
+// queuedDelivery is what is stored under a deliveryKey.
+type queuedDelivery struct {
+	Event    nostr.Event
+	QueuedAt time.Time
+	// Feed is the pubkey of the feed Event is from, which a gift wrap doesn't tell.
+	Feed string `json:",omitempty"`
+}
+
+func deliveryKey(url, id string) []byte {
+	return []byte(deliveryPrefix + url + "\x00" + id)
+}
+
+func deliveredKey(url, id string) []byte {
+	return []byte(deliveredPrefix + url + "\x00" + id)
+}
+
+// errRejected is a relay answering that it won't take an event, which trying
+// again won't change.
+var errRejected = errors.New("rejected")
+
+func newDeliveryQueue(db *pebble.DB, maxAge time.Duration) *deliveryQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &deliveryQueue{
+		db:          db,
+		maxAge:      maxAge,
+		timeout:     10 * time.Second,
+		minBackoff:  time.Second,
+		maxBackoff:  5 * time.Minute,
+		expireEvery: time.Hour,
+		ctx:         ctx,
+		cancel:      cancel,
+		upstreams:   make(map[string]*upstream),
+	}
+}
+
+// start resumes the deliveries left over from before a restart.
+func (q *deliveryQueue) start() error {
+	iter := q.db.NewIter(prefixIterOptions(deliveryPrefix))
+	for iter.First(); iter.Valid(); iter.Next() {
+		url, _, _ := strings.Cut(string(iter.Key()[len(deliveryPrefix):]), "\x00")
+		q.upstream(url)
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	q.wg.Add(1)
+	go q.expire()
+	return nil
+}
+
+// expire forgets the deliveries made longer than maxAge ago, every
+// expireEvery, until the queue is stopped.
+func (q *deliveryQueue) expire() {
+	defer q.wg.Done()
+	ticker := time.NewTicker(q.expireEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := q.forgetDelivered(time.Now()); err != nil {
+				logger.Error("failed to forget old deliveries", "err", err)
+			}
+		case <-q.ctx.Done():
+			return
+		}
+	}
+}
+
+// forgetDelivered drops the deliveries, to any relay, made longer than maxAge
+// before now.
+func (q *deliveryQueue) forgetDelivered(now time.Time) error {
+	batch := q.db.NewBatch()
+	defer batch.Close()
+	iter := q.db.NewIter(prefixIterOptions(deliveredPrefix))
+	for iter.First(); iter.Valid(); iter.Next() {
+		at, _ := strconv.ParseInt(string(iter.Value()), 10, 64)
+		if now.Sub(time.Unix(at, 0)) > q.maxAge {
+			batch.Delete(iter.Key(), nil)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	return batch.Commit(pebble.NoSync)
+}
+
+// stop ends the workers, leaving what they didn't deliver in the db.
+func (q *deliveryQueue) stop() {
+	q.cancel()
+	q.wg.Wait()
+}
+
+// upstream returns the relay at url, starting its worker the first time.
+func (q *deliveryQueue) upstream(url string) *upstream {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u, ok := q.upstreams[url]
+	if !ok {
+		u = &upstream{wake: make(chan struct{}, 1)}
+		q.upstreams[url] = u
+		q.wg.Add(1)
+		go q.work(url, u)
+	}
+	return u
+}
+
+// add queues evt, from the feed of pubkey feed, for each of urls it wasn't
+// queued or delivered to already.
+func (q *deliveryQueue) add(urls []string, feed string, evt nostr.Event) error {
+	value, err := json.Marshal(queuedDelivery{Event: evt, QueuedAt: time.Now(), Feed: feed})
+	if err != nil {
+		return err
+	}
+
+	var queued []string
+	batch := q.db.NewBatch()
+	defer batch.Close()
+	for _, url := range urls {
+		if q.has(deliveryKey(url, evt.ID)) || q.has(deliveredKey(url, evt.ID)) {
+			continue
+		}
+		batch.Set(deliveryKey(url, evt.ID), value, nil)
+		queued = append(queued, url)
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return err
+	}
+
+	for _, url := range queued {
+		select {
+		case q.upstream(url).wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// forget drops the deliveries queued for the feed of pubkey feed.
+func (q *deliveryQueue) forget(feed string) error {
+	batch := q.db.NewBatch()
+	defer batch.Close()
+	iter := q.db.NewIter(prefixIterOptions(deliveryPrefix))
+	for iter.First(); iter.Valid(); iter.Next() {
+		var delivery queuedDelivery
+		if err := json.Unmarshal(iter.Value(), &delivery); err == nil && delivery.Feed == feed {
+			batch.Delete(iter.Key(), nil)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	return batch.Commit(pebble.Sync)
+}
+
+func (q *deliveryQueue) has(key []byte) bool {
+	_, closer, err := q.db.Get(key)
+	if err != nil {
+		return false
+	}
+	closer.Close()
+	return true
+}
+
+// work delivers the events queued for url until the queue is stopped.
+func (q *deliveryQueue) work(url string, u *upstream) {
+	defer q.wg.Done()
+	defer func() {
+		if u.conn != nil {
+			u.conn.Close()
+		}
+	}()
+
+	var backoff time.Duration
+	for {
+		err := q.deliver(url, u)
+		if err == nil {
+			backoff = 0
+			select {
+			case <-u.wake:
+				continue
+			case <-q.ctx.Done():
+				return
+			}
+		}
+		if q.ctx.Err() != nil {
+			return
+		}
+
+		backoff *= 2
+		if backoff < q.minBackoff {
+			backoff = q.minBackoff
+		}
+		if backoff > q.maxBackoff {
+			backoff = q.maxBackoff
+		}
+		u.mu.Lock()
+		u.status.LastError = err.Error()
+		u.status.LastErrorAt = time.Now()
+		u.status.RetryAt = time.Now().Add(backoff)
+		u.mu.Unlock()
+		logger.Warn("failed to deliver events", "relay", url, "err", err, "retry_in", backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-q.ctx.Done():
+			return
+		}
+	}
+}
+
+// deliver publishes everything queued for url, stopping at the first failure.
+func (q *deliveryQueue) deliver(url string, u *upstream) error {
+	for {
+		pending, err := q.pending(url, u, 100)
+		if err != nil || len(pending) == 0 {
+			return err
+		}
+
+		for _, delivery := range pending {
+			err := q.publish(url, u, delivery.Event)
+			if errors.Is(err, errRejected) {
+				logger.Warn("relay rejected event, dropping it", "relay", url, "event", delivery.Event.ID, "err", err)
+				q.remove(url, u, delivery.Event.ID, false)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			q.remove(url, u, delivery.Event.ID, true)
+		}
+	}
+}
+
+// pending reads up to n deliveries queued for url, dropping the ones older
+// than maxAge on the way.
+func (q *deliveryQueue) pending(url string, u *upstream, n int) ([]queuedDelivery, error) {
+	batch := q.db.NewBatch()
+	defer batch.Close()
+
+	var pending []queuedDelivery
+	var dropped int64
+	iter := q.db.NewIter(prefixIterOptions(deliveryPrefix + url + "\x00"))
+	for iter.First(); iter.Valid() && len(pending) < n; iter.Next() {
+		var delivery queuedDelivery
+		if err := json.Unmarshal(iter.Value(), &delivery); err != nil {
+			logger.Error("dropping undecodable delivery", "key", string(iter.Key()), "err", err)
+			batch.Delete(iter.Key(), nil)
+			continue
+		}
+		if time.Since(delivery.QueuedAt) > q.maxAge {
+			logger.Warn("dropping event not delivered in time", "relay", url, "event", delivery.Event.ID,
+				"queued_at", delivery.QueuedAt)
+			batch.Delete(iter.Key(), nil)
+			dropped++
+			continue
+		}
+		pending = append(pending, delivery)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	if dropped > 0 {
+		u.mu.Lock()
+		u.status.Dropped += dropped
+		u.mu.Unlock()
+	}
+	return pending, batch.Commit(pebble.NoSync)
+}
+
+// publish sends evt to the relay at url, which must say it got it.
+func (q *deliveryQueue) publish(url string, u *upstream, evt nostr.Event) error {
+	ctx, cancel := context.WithTimeout(q.ctx, q.timeout)
+	defer cancel()
+
+	if u.conn == nil {
+		conn := nostr.NewRelay(q.ctx, url)
+		if err := conn.Connect(ctx); err != nil {
+			return err
+		}
+		u.conn = conn
+	}
+
+	status, err := u.conn.Publish(ctx, evt)
+	if status == nostr.PublishStatusSucceeded {
+		return nil
+	}
+	if err != nil && strings.HasPrefix(err.Error(), "msg: ") {
+		// the relay answered with an OK false
+		if strings.Contains(err.Error(), "duplicate:") {
+			return nil
+		}
+		return fmt.Errorf("%w: %s", errRejected, strings.TrimPrefix(err.Error(), "msg: "))
+	}
+
+	// the connection may be gone without go-nostr noticing, so start over
+	u.conn.Close()
+	u.conn = nil
+	if err == nil {
+		err = errors.New("no answer from relay")
+	}
+	return err
+}
+
+// remove takes the delivery of id to url off the queue, remembering it as
+// made if delivered.
+func (q *deliveryQueue) remove(url string, u *upstream, id string, delivered bool) {
+	batch := q.db.NewBatch()
+	defer batch.Close()
+	batch.Delete(deliveryKey(url, id), nil)
+	if delivered {
+		batch.Set(deliveredKey(url, id), strconv.AppendInt(nil, time.Now().Unix(), 10), nil)
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		logger.Error("failed to store delivery", "relay", url, "event", id, "err", err)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if delivered {
+		u.status.Delivered++
+	} else {
+		u.status.Dropped++
+	}
+}
+
+// Status tells how the deliveries to each relay are going.
+func (q *deliveryQueue) Status() map[string]UpstreamStatus {
+	q.mu.Lock()
+	statuses := make(map[string]UpstreamStatus, len(q.upstreams))
+	for url, u := range q.upstreams {
+		u.mu.Lock()
+		statuses[url] = u.status
+		u.mu.Unlock()
+	}
+	q.mu.Unlock()
+
+	iter := q.db.NewIter(prefixIterOptions(deliveryPrefix))
+	for iter.First(); iter.Valid(); iter.Next() {
+		url, _, _ := strings.Cut(string(iter.Key()[len(deliveryPrefix):]), "\x00")
+		status := statuses[url]
+		status.Pending++
+		statuses[url] = status
+	}
+	iter.Close()
+	return statuses
+}
+
+// handleDeliveries shows how many events are waiting for each relay, and
+// why the last attempt failed. Relays nothing was sent to since the start
+// aren't listed, so it's an empty object without RELAYS or outbox relays.
+func handleDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, r, 405, "method not allowed")
+		return
+	}
+
+	statuses := map[string]UpstreamStatus{}
+	if relay.deliveries != nil {
+		statuses = relay.deliveries.Status()
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
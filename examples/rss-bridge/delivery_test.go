@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// connListener keeps the connections it accepted, websockets included, for kill.
+type connListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (ln *connListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err == nil {
+		ln.mu.Lock()
+		ln.conns = append(ln.conns, conn)
+		ln.mu.Unlock()
+	}
+	return conn, err
+}
+
+// fakeRelayAt is a fakeRelay listening on addr, to be started again there
+// once kill took it down.
+func fakeRelayAt(t *testing.T, addr string, saved chan<- nostr.Event) (srv *httptest.Server, kill func()) {
+	t.Helper()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	ln := &connListener{Listener: l}
+	srv = httptest.NewUnstartedServer(fakeRelayHandler(t, saved))
+	srv.Listener.Close()
+	srv.Listener = ln
+	srv.Start()
+
+	return srv, func() {
+		srv.Listener.Close()
+		ln.mu.Lock()
+		defer ln.mu.Unlock()
+		for _, conn := range ln.conns {
+			conn.Close()
+		}
+	}
+}
+
+func testDeliveryQueue(t *testing.T, db *pebble.DB, maxAge time.Duration) *deliveryQueue {
+	t.Helper()
+	q := newDeliveryQueue(db, maxAge)
+	// long enough for a relay's OK not to be missed on a busy machine, which
+	// would have the event sent again
+	q.timeout = 2 * time.Second
+	q.minBackoff = 20 * time.Millisecond
+	q.maxBackoff = 100 * time.Millisecond
+	if err := q.start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	return q
+}
+
+func signedNote(t *testing.T, content string) nostr.Event {
+	t.Helper()
+	evt := nostr.Event{CreatedAt: nostr.Now(), Kind: nostr.KindTextNote, Tags: nostr.Tags{}, Content: content}
+	if err := evt.Sign(nostr.GeneratePrivateKey()); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	return evt
+}
+
+// received collects the ids of the events saved gets within wait.
+func received(saved <-chan nostr.Event, wait time.Duration) map[string]int {
+	ids := make(map[string]int)
+	timeout := time.After(wait)
+	for {
+		select {
+		case evt := <-saved:
+			ids[evt.ID]++
+		case <-timeout:
+			return ids
+		}
+	}
+}
+
+func waitForStatus(t *testing.T, q *deliveryQueue, url string, ok func(UpstreamStatus) bool) UpstreamStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := q.Status()[url]
+		if ok(status) {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("delivery status of %s = %+v", url, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeliveriesSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	db, err := pebble.Open(dir, nil)
+	if err != nil {
+		t.Fatalf("pebble.Open: %v", err)
+	}
+	saved := make(chan nostr.Event, 10)
+	upstream, kill := fakeRelayAt(t, "127.0.0.1:0", saved)
+	addr := upstream.Listener.Addr().String()
+	url := "ws://" + addr
+
+	q := testDeliveryQueue(t, db, time.Hour)
+	first := signedNote(t, "first")
+	if err := q.add([]string{url}, "", first); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if got := received(saved, 500*time.Millisecond); got[first.ID] != 1 {
+		t.Fatalf("upstream got %v; want the first event", got)
+	}
+
+	// the upstream goes away, and the bridge too while it's down
+	kill()
+	second, third := signedNote(t, "second"), signedNote(t, "third")
+	q.add([]string{url}, "", second)
+	q.add([]string{url}, "", third)
+	status := waitForStatus(t, q, url, func(s UpstreamStatus) bool { return s.LastError != "" })
+	if status.Pending != 2 || status.Delivered != 1 {
+		t.Errorf("status while the upstream is down = %+v; want 2 pending and 1 delivered", status)
+	}
+	q.stop()
+	db.Close()
+
+	db, err = pebble.Open(dir, nil)
+	if err != nil {
+		t.Fatalf("pebble.Open: %v", err)
+	}
+	defer db.Close()
+	_, kill = fakeRelayAt(t, addr, saved)
+	defer kill()
+	q = testDeliveryQueue(t, db, time.Hour)
+	defer q.stop()
+
+	// what was queued gets there, and what already did isn't sent again
+	if err := q.add([]string{url}, "", first); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	got := received(saved, 2*time.Second)
+	if len(got) != 2 || got[second.ID] != 1 || got[third.ID] != 1 {
+		t.Errorf("upstream got %v after the restart; want the second and third events once", got)
+	}
+	waitForStatus(t, q, url, func(s UpstreamStatus) bool { return s.Pending == 0 && s.Delivered == 2 })
+}
+
+func TestDeliveriesWithoutRelays(t *testing.T) {
+	setupTestRelay(t)
+	q := testDeliveryQueue(t, relay.db, time.Hour)
+	defer q.stop()
+	relay.deliveries = q
+	t.Cleanup(func() { relay.deliveries = nil })
+
+	w := httptest.NewRecorder()
+	handleDeliveries(w, httptest.NewRequest("GET", "/admin/deliveries", nil))
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "{}" {
+		t.Errorf("GET /admin/deliveries without relays = %d %s; want 200 {}", w.Code, w.Body)
+	}
+}
+
+func TestForgetDelivered(t *testing.T) {
+	setupTestRelay(t)
+	q := newDeliveryQueue(relay.db, time.Hour)
+	now := time.Now()
+	relay.db.Set(deliveredKey("wss://a.example.com", "old"), strconv.AppendInt(nil, now.Add(-2*time.Hour).Unix(), 10), nil)
+	relay.db.Set(deliveredKey("wss://b.example.com", "recent"), strconv.AppendInt(nil, now.Add(-time.Minute).Unix(), 10), nil)
+
+	if err := q.forgetDelivered(now); err != nil {
+		t.Fatalf("forgetDelivered: %v", err)
+	}
+	if q.has(deliveredKey("wss://a.example.com", "old")) {
+		t.Error("a delivery older than maxAge is still remembered")
+	}
+	if !q.has(deliveredKey("wss://b.example.com", "recent")) {
+		t.Error("a recent delivery was forgotten")
+	}
+}
+
+func TestDeliveriesExpire(t *testing.T) {
+	setupTestRelay(t)
+	q := testDeliveryQueue(t, relay.db, 100*time.Millisecond)
+	defer q.stop()
+
+	// nothing listens there
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	url := "ws://" + ln.Addr().String()
+	ln.Close()
+
+	q.add([]string{url}, "", signedNote(t, "lost"))
+	waitForStatus(t, q, url, func(s UpstreamStatus) bool { return s.Dropped == 1 && s.Pending == 0 })
+
+	relay.deliveries = q
+	t.Cleanup(func() { relay.deliveries = nil })
+	w := httptest.NewRecorder()
+	handleDeliveries(w, httptest.NewRequest("GET", "/admin/deliveries", nil))
+	var statuses map[string]UpstreamStatus
+	if err := json.NewDecoder(w.Body).Decode(&statuses); err != nil {
+		t.Fatalf("deliveries aren't json: %v", err)
+	}
+	if s := statuses[url]; s.Dropped != 1 || s.LastError == "" {
+		t.Errorf("deliveries = %+v; want one dropped and the last error", statuses)
+	}
+	w = httptest.NewRecorder()
+	handleDeliveries(w, httptest.NewRequest("POST", "/admin/deliveries", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /admin/deliveries = %d; want 405", w.Code)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// With DIGEST_INTERVAL set the poller doesn't emit a note for each new item.
+// The items are collected in the db instead, and once the interval they were
+// collected in is over a single note listing all of them goes out.
+
+// pendingDigest is what is collected for a feed until its digest goes out.
+type pendingDigest struct {
+	// Started is when the first of Items was collected.
+	Started time.Time
+	Items   []digestItem
+}
+
+type digestItem struct {
+	Title     string
+	Link      string
+	CreatedAt nostr.Timestamp
+}
+
+func newDigestItem(item *gofeed.Item, createdAt nostr.Timestamp) digestItem {
+	title := item.Title
+	if len(relay.TitleRewrites) > 0 {
+		title = relay.TitleRewrites.apply(title)
+	}
+	link := item.Link
+	if relay.StripLinkParams {
+		link = cleanLink(link, relay.LinkParams)
+	}
+	return digestItem{Title: strings.TrimSpace(title), Link: link, CreatedAt: createdAt}
+}
+
+func digestKey(pubkey string) []byte {
+	return []byte(digestPrefix + pubkey)
+}
+
+// loadDigest returns what was collected for the feed of pubkey, nothing if
+// its last digest went out.
+func loadDigest(db *pebble.DB, pubkey string) (pendingDigest, error) {
+	var digest pendingDigest
+	val, closer, err := db.Get(digestKey(pubkey))
+	if err == pebble.ErrNotFound {
+		return digest, nil
+	} else if err != nil {
+		return digest, err
+	}
+	defer closer.Close()
+	return digest, json.Unmarshal(val, &digest)
+}
+
+// saveDigest stores digest synced, as the watermark moves past its items
+// right after.
+func saveDigest(db *pebble.DB, pubkey string, digest pendingDigest) error {
+	j, err := json.Marshal(digest)
+	if err != nil {
+		return err
+	}
+	return db.Set(digestKey(pubkey), j, pebble.Sync)
+}
+
+func deleteDigest(db *pebble.DB, pubkey string) error {
+	return db.Delete(digestKey(pubkey), pebble.Sync)
+}
+
+// due tells whether the interval the digest was started in is over at now.
+// Intervals that divide a day start at midnight UTC, so a 24h digest goes out at
+// midnight every day however the polls fall.
+func (digest pendingDigest) due(now time.Time, interval time.Duration) bool {
+	if len(digest.Items) == 0 {
+		return false
+	}
+	return !now.Before(digest.Started.Truncate(interval).Add(interval))
+}
+
+// note lists the collected items, oldest first, in a single note by pubkey.
+func (digest pendingDigest) note(pubkey string, now time.Time) nostr.Event {
+	var content strings.Builder
+	if len(digest.Items) == 1 {
+		content.WriteString("1 new item:\n")
+	} else {
+		fmt.Fprintf(&content, "%d new items:\n", len(digest.Items))
+	}
+
+	tags := nostr.Tags{}
+	for _, item := range digest.Items {
+		title := item.Title
+		if title == "" {
+			title = "untitled"
+		}
+		fmt.Fprintf(&content, "\n- %s", title)
+		if item.Link != "" {
+			fmt.Fprintf(&content, "\n  %s", item.Link)
+			tags = append(tags, nostr.Tag{"r", item.Link})
+		}
+	}
+
+	evt := nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: nostr.Timestamp(now.Unix()),
+		Kind:      nostr.KindTextNote,
+		Tags:      tags,
+		Content:   content.String(),
+	}
+	evt.ID = evt.GetID()
+	return evt
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestPollerDigest(t *testing.T) {
+	setupTestRelay(t)
+	second := "<item><title>second</title><link>https://example.com/2</link><description>second item</description><pubDate>Tue, 03 Jan 2023 15:04:05 GMT</pubDate></item>\n"
+	feed := strings.Replace(testFeed, second, "", 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, feed)
+	}))
+	defer srv.Close()
+
+	pubkey, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+
+	updates := make(chan nostr.Event, 10)
+	now := time.Date(2023, 1, 4, 9, 0, 0, 0, time.UTC)
+	newDigestPoller := func() *poller {
+		p := newPoller(pollerConfig{DB: relay.db, LastEmitted: &sync.Map{}, Updates: updates, Digest: 24 * time.Hour})
+		p.now = func() time.Time { return now }
+		return p
+	}
+	filters := nostr.Filters{{Authors: []string{pubkey}}}
+
+	p := newDigestPoller()
+	if strings.Contains(feed, "second") {
+		t.Fatal("testFeed changed")
+	}
+	if _, emitted, _ := p.poll(context.Background(), filters); emitted != 0 || len(updates) != 0 {
+		t.Fatalf("first poll emitted %d events; want the item collected", len(updates))
+	}
+
+	// the second item shows up later that day, after a restart
+	feed = testFeed
+	feeds.Flush()
+	now = now.Add(10 * time.Hour)
+	p = newDigestPoller()
+	loadWatermarks(relay.db, p.lastEmitted)
+	p.poll(context.Background(), filters)
+	if n := len(updates); n != 0 {
+		t.Fatalf("poll before midnight emitted %d events; want none", n)
+	}
+	if digest, err := loadDigest(relay.db, pubkey); err != nil || len(digest.Items) != 2 {
+		t.Fatalf("pending digest = %+v, %v; want both items", digest, err)
+	}
+
+	now = time.Date(2023, 1, 5, 0, 5, 0, 0, time.UTC)
+	feeds.Flush()
+	p.poll(context.Background(), filters)
+	if n := len(updates); n != 1 {
+		t.Fatalf("poll after midnight emitted %d events; want a single digest", n)
+	}
+	evt := <-updates
+	if ok, _ := evt.CheckSignature(); !ok || evt.PubKey != pubkey || evt.Kind != nostr.KindTextNote {
+		t.Errorf("digest = %+v; want a note signed by the feed", evt)
+	}
+	i1, i2 := strings.Index(evt.Content, "https://example.com/1"), strings.Index(evt.Content, "https://example.com/2")
+	if !strings.HasPrefix(evt.Content, "2 new items:") || i1 < 0 || i2 < i1 ||
+		!strings.Contains(evt.Content, "- first") || !strings.Contains(evt.Content, "- second") {
+		t.Errorf("digest content = %q; want both titles and links, oldest first", evt.Content)
+	}
+	if len(evt.Tags) != 2 || evt.CreatedAt != nostr.Timestamp(now.Unix()) {
+		t.Errorf("digest tags %v at %d; want an r tag for each item, made now", evt.Tags, evt.CreatedAt)
+	}
+
+	// nothing new, nothing more
+	feeds.Flush()
+	now = now.Add(48 * time.Hour)
+	p.poll(context.Background(), filters)
+	if n := len(updates); n != 0 {
+		t.Errorf("poll with nothing new emitted %d events; want none", n)
+	}
+}
+
+func TestDigestDue(t *testing.T) {
+	started := time.Date(2023, 1, 4, 23, 59, 0, 0, time.UTC)
+	digest := pendingDigest{Started: started, Items: []digestItem{{Title: "x"}}}
+	for _, tt := range []struct {
+		interval time.Duration
+		now      time.Time
+		want     bool
+	}{
+		{24 * time.Hour, started.Add(30 * time.Second), false},
+		{24 * time.Hour, started.Add(time.Minute), true},
+		{time.Hour, started.Add(time.Minute), true},
+	} {
+		if got := digest.due(tt.now, tt.interval); got != tt.want {
+			t.Errorf("due(%s, %s) = %v; want %v", tt.now, tt.interval, got, tt.want)
+		}
+	}
+	if (pendingDigest{Started: started}).due(started.Add(72*time.Hour), 24*time.Hour) {
+		t.Error("an empty digest is due")
+	}
+}
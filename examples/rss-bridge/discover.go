@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// FeedCandidate is a feed advertised by a page.
+type FeedCandidate struct {
+	URL   string `json:"url"`
+	Type  string `json:"type"`
+	Title string `json:"title,omitempty"`
+}
+
+var types = []string{
+	"rss+xml",
+	"atom+xml",
+	"feed+json",
+	"text/xml",
+	"application/xml",
+}
+
+// fallbackPaths are tried on the site root when a page doesn't advertise any feed.
+var fallbackPaths = []string{"/feed", "/rss.xml", "/atom.xml", "/index.xml", "/feed.xml", "/rss"}
+
+// getFeedURL returns the url of the best feed found at url, which may be the
+// feed itself or a page pointing to it, or "" if there isn't a working one.
+// With auth url must be the feed itself, so the credentials only go to it.
+func getFeedURL(url string, auth *FeedAuth) (string, error) {
+	candidates, direct, err := discoverFeeds(url, auth)
+	if err != nil {
+		return "", err
+	}
+	if direct {
+		return candidates[0].URL, nil
+	}
+	if auth != nil {
+		return "", nil
+	}
+
+	for _, candidate := range candidates {
+		if _, err := parseFeed(context.Background(), candidate.URL); err == nil {
+			return candidate.URL, nil
+		}
+	}
+
+	return "", nil
+}
+
+// discoverFeeds lists the feeds found at url from most to least preferred,
+// leaving out comment and category feeds. direct is set when url is a feed itself.
+// auth, if not nil, is only sent when requesting url. The only errors are
+// ErrPreviewNotPermitted, see robotsForbid, and ErrPageTooLarge for html pages
+// over MAX_PAGE_SIZE.
+func discoverFeeds(url string, auth *FeedAuth) (candidates []FeedCandidate, direct bool, err error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, false, nil
+	}
+	if auth != nil {
+		auth.authorize(req)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, false, nil
+	}
+
+	// use the url we ended up at after following redirects
+	url = resp.Request.URL.String()
+
+	ct := resp.Header.Get("Content-Type")
+	for _, typ := range types {
+		if strings.Contains(ct, typ) {
+			return []FeedCandidate{{URL: url, Type: ct}}, true, nil
+		}
+	}
+
+	// feeds themselves are often noindex, only pages are asked
+	if relay.RespectRobotsMeta && robotsForbid(resp.Header.Values("X-Robots-Tag"), nil) {
+		return nil, false, ErrPreviewNotPermitted
+	}
+	if strings.Contains(ct, "text/html") {
+		// reading one byte more tells pages over the limit from ones right at it
+		body := io.Reader(resp.Body)
+		if relay.MaxPageSize > 0 {
+			body = io.LimitReader(resp.Body, relay.MaxPageSize+1)
+		}
+		page, err := io.ReadAll(body)
+		if err != nil {
+			return nil, false, nil
+		}
+		if relay.MaxPageSize > 0 && int64(len(page)) > relay.MaxPageSize {
+			return nil, false, fmt.Errorf("%w: %s is over %d bytes", ErrPageTooLarge, url, relay.MaxPageSize)
+		}
+		if doc, err := goquery.NewDocumentFromReader(bytes.NewReader(page)); err == nil {
+			if relay.RespectRobotsMeta && robotsForbid(nil, doc) {
+				return nil, false, ErrPreviewNotPermitted
+			}
+			candidates = feedLinks(resp.Request.URL, doc)
+		}
+	}
+
+	if len(candidates) == 0 {
+		root := resp.Request.URL
+		for _, path := range fallbackPaths {
+			href := (&neturl.URL{Scheme: root.Scheme, Host: root.Host, Path: path}).String()
+			if !isFeedResponse(href) {
+				continue
+			}
+			candidates = append(candidates, FeedCandidate{URL: href})
+		}
+	}
+
+	return candidates, false, nil
+}
+
+// robotsForbid tells whether the X-Robots-Tag headers or the robots meta tags
+// of a page ask for it not to be indexed or shown in previews. Headers
+// addressed to a specific crawler, as in "googlebot: noindex", are ignored.
+func robotsForbid(headers []string, doc *goquery.Document) bool {
+	directives := headers
+	if doc != nil {
+		doc.Find("meta[name]").Each(func(_ int, meta *goquery.Selection) {
+			if name, _ := meta.Attr("name"); strings.EqualFold(name, "robots") {
+				content, _ := meta.Attr("content")
+				directives = append(directives, content)
+			}
+		})
+	}
+
+	for _, value := range directives {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			if name, _, ok := strings.Cut(directive, ":"); ok && !strings.HasPrefix(name, "max-") && name != "unavailable_after" {
+				// the rest is for one crawler only
+				break
+			}
+			switch directive {
+			case "noindex", "none", "nosnippet", "noimageindex", "max-snippet:0":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// feedLinks collects the alternate links of a page that point to feeds.
+func feedLinks(base *neturl.URL, doc *goquery.Document) []FeedCandidate {
+	var candidates []FeedCandidate
+	doc.Find("link[type]").Each(func(_ int, link *goquery.Selection) {
+		if rel, ok := link.Attr("rel"); ok && !strings.Contains(strings.ToLower(rel), "alternate") {
+			return
+		}
+		typ, _ := link.Attr("type")
+		href, _ := link.Attr("href")
+		title, _ := link.Attr("title")
+		if href == "" || feedTypeRank(typ) < 0 || isSecondaryFeed(href, title) {
+			return
+		}
+		href, err := urljoin(base.String(), href)
+		if err != nil {
+			return
+		}
+		for _, c := range candidates {
+			if c.URL == href {
+				return
+			}
+		}
+		candidates = append(candidates, FeedCandidate{URL: href, Type: typ, Title: title})
+	})
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return feedTypeRank(candidates[i].Type) < feedTypeRank(candidates[j].Type)
+	})
+
+	return candidates
+}
+
+// feedTypeRank orders feed mime types according to FEED_PREFERENCE, -1 means not a feed.
+func feedTypeRank(typ string) int {
+	typ = strings.ToLower(typ)
+	rss, atom := 0, 1
+	if relay.FeedPreference == "atom" {
+		rss, atom = 1, 0
+	}
+	switch {
+	case strings.Contains(typ, "rss+xml"):
+		return rss
+	case strings.Contains(typ, "atom+xml"):
+		return atom
+	case strings.Contains(typ, "feed+json"):
+		return 2
+	case strings.Contains(typ, "text/xml"), strings.Contains(typ, "application/xml"):
+		return 3
+	}
+	return -1
+}
+
+// isSecondaryFeed guesses whether a feed is just for comments, a category or a tag.
+func isSecondaryFeed(href, title string) bool {
+	href, title = strings.ToLower(href), strings.ToLower(title)
+	for _, hint := range []string{"/comments/", "/category/", "/tag/", "/author/"} {
+		if strings.Contains(href, hint) {
+			return true
+		}
+	}
+	return strings.Contains(title, "comments")
+}
+
+func isFeedResponse(url string) bool {
+	resp, err := client.Head(url)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		// some servers don't do HEAD, parsing will tell
+		_, err := parseFeed(context.Background(), url)
+		return err == nil
+	}
+	resp.Body.Close()
+
+	ct := resp.Header.Get("Content-Type")
+	for _, typ := range types {
+		if strings.Contains(ct, typ) {
+			return true
+		}
+	}
+	_, err = parseFeed(context.Background(), url)
+	return err == nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetFeedURL(t *testing.T) {
+	setupTestRelay(t)
+
+	serveFeed := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}
+	page := func(head string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprintf(w, "<html><head>%s</head><body>hello</body></html>", head)
+		}
+	}
+
+	for _, tc := range []struct {
+		name  string
+		paths map[string]http.HandlerFunc
+		want  string
+	}{
+		{
+			name: "wordpress with comments feed first",
+			paths: map[string]http.HandlerFunc{
+				"/blog/": page(`
+<link rel="alternate" type="application/rss+xml" title="Blog &raquo; Comments Feed" href="/comments/feed/">
+<link rel="alternate" type="application/rss+xml" title="Blog &raquo; Feed" href="/feed/">`),
+				"/comments/feed/": serveFeed,
+				"/feed/":          serveFeed,
+			},
+			want: "/feed/",
+		},
+		{
+			name: "ghost relative href",
+			paths: map[string]http.HandlerFunc{
+				"/blog/": page(`<link rel="alternate" type="application/rss+xml" title="Blog" href="../rss/">`),
+				"/rss/":  serveFeed,
+			},
+			want: "/rss/",
+		},
+		{
+			name: "prefers rss over atom",
+			paths: map[string]http.HandlerFunc{
+				"/blog/": page(`
+<link rel="alternate" type="application/atom+xml" href="/atom.xml">
+<link rel="alternate" type="application/rss+xml" href="/rss.xml">`),
+				"/atom.xml": serveFeed,
+				"/rss.xml":  serveFeed,
+			},
+			want: "/rss.xml",
+		},
+		{
+			name: "skips broken candidates",
+			paths: map[string]http.HandlerFunc{
+				"/blog/": page(`
+<link rel="alternate" type="application/rss+xml" href="/broken.xml">
+<link rel="alternate" type="application/atom+xml" href="/atom.xml">`),
+				"/atom.xml": serveFeed,
+			},
+			want: "/atom.xml",
+		},
+		{
+			name: "falls back to common paths",
+			paths: map[string]http.HandlerFunc{
+				"/blog/":     page(""),
+				"/index.xml": serveFeed,
+			},
+			want: "/index.xml",
+		},
+		{
+			name: "direct feed",
+			paths: map[string]http.HandlerFunc{
+				"/blog/": serveFeed,
+			},
+			want: "/blog/",
+		},
+		{
+			name: "nothing found",
+			paths: map[string]http.HandlerFunc{
+				"/blog/": page(""),
+			},
+			want: "",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			feeds.Flush()
+			mux := http.NewServeMux()
+			for path, handler := range tc.paths {
+				mux.HandleFunc(path, handler)
+			}
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+
+			want := tc.want
+			if want != "" {
+				want = srv.URL + want
+			}
+			if got, err := getFeedURL(srv.URL+"/blog/", nil); got != want || err != nil {
+				t.Errorf("getFeedURL() = %q, %v; want %q", got, err, want)
+			}
+		})
+	}
+}
+
+func TestRobotsMeta(t *testing.T) {
+	setupTestRelay(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/noindex/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, `<html><head><meta name="robots" content="noindex,noimageindex">
+<link rel="alternate" type="application/rss+xml" href="/feed.xml"></head></html>`)
+	})
+	mux.HandleFunc("/header/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("X-Robots-Tag", "nosnippet")
+		fmt.Fprint(w, `<html><head><link rel="alternate" type="application/rss+xml" href="/feed.xml"></head></html>`)
+	})
+	mux.HandleFunc("/googlebot/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("X-Robots-Tag", "googlebot: noindex")
+		fmt.Fprint(w, `<html><head><link rel="alternate" type="application/rss+xml" href="/feed.xml"></head></html>`)
+	})
+	mux.HandleFunc("/feed.xml", func(w http.ResponseWriter, r *http.Request) {
+		// feeds are often kept out of search engines, that's fine
+		w.Header().Set("Content-Type", "application/rss+xml")
+		w.Header().Set("X-Robots-Tag", "noindex")
+		fmt.Fprint(w, testFeed)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	// off by default
+	if got, err := getFeedURL(srv.URL+"/noindex/", nil); got != srv.URL+"/feed.xml" || err != nil {
+		t.Errorf("getFeedURL(noindex page) = %q, %v; want the feed without RESPECT_ROBOTS_META", got, err)
+	}
+
+	relay.RespectRobotsMeta = true
+	t.Cleanup(func() { relay.RespectRobotsMeta = false })
+	for _, path := range []string{"/noindex/", "/header/"} {
+		if got, err := getFeedURL(srv.URL+path, nil); !errors.Is(err, ErrPreviewNotPermitted) {
+			t.Errorf("getFeedURL(%s) = %q, %v; want ErrPreviewNotPermitted", path, got, err)
+		}
+	}
+	for _, path := range []string{"/googlebot/", "/feed.xml"} {
+		if got, err := getFeedURL(srv.URL+path, nil); got != srv.URL+"/feed.xml" || err != nil {
+			t.Errorf("getFeedURL(%s) = %q, %v; want the feed", path, got, err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handleCreateFeed(rec, httptest.NewRequest("POST", "/create?url="+srv.URL+"/noindex/", nil))
+	if rec.Code != 403 {
+		t.Errorf("/create of a noindex page = %d %s; want 403", rec.Code, rec.Body)
+	}
+}
+
+func TestMaxPageSize(t *testing.T) {
+	setupTestRelay(t)
+	page := `<html><head><link rel="alternate" type="application/rss+xml" href="/feed.xml"></head><body>` +
+		strings.Repeat("<p>filler</p>", 1000) + `</body></html>`
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, page)
+	})
+	mux.HandleFunc("/feed.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	t.Cleanup(func() { relay.MaxPageSize = 0 })
+	for _, size := range []int64{0, int64(len(page)), 1 << 20} {
+		relay.MaxPageSize = size
+		if got, err := getFeedURL(srv.URL+"/", nil); got != srv.URL+"/feed.xml" || err != nil {
+			t.Errorf("MAX_PAGE_SIZE=%d: getFeedURL = %q, %v; want the feed", size, got, err)
+		}
+	}
+
+	relay.MaxPageSize = int64(len(page)) - 1
+	if got, err := getFeedURL(srv.URL+"/", nil); !errors.Is(err, ErrPageTooLarge) {
+		t.Errorf("getFeedURL of a page over MAX_PAGE_SIZE = %q, %v; want ErrPageTooLarge", got, err)
+	}
+	// feeds themselves aren't pages
+	if got, err := getFeedURL(srv.URL+"/feed.xml", nil); got != srv.URL+"/feed.xml" || err != nil {
+		t.Errorf("getFeedURL(feed) = %q, %v; want the feed", got, err)
+	}
+
+	rec := httptest.NewRecorder()
+	handleCreateFeed(rec, httptest.NewRequest("POST", "/create?url="+srv.URL+"/", nil))
+	if rec.Code != 413 {
+		t.Errorf("/create of a page over MAX_PAGE_SIZE = %d %s; want 413", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/mmcdole/gofeed"
+)
+
+// diskCacheVersion is bumped whenever the layout of stored feeds changes, so
+// records written by other versions are ignored instead of misread.
+const diskCacheVersion = 1
+
+// diskFeedCache keeps gzipped parsed feeds in the db, so they outlive restarts
+// and evictions from memory.
+type diskFeedCache struct {
+	db  *pebble.DB
+	ttl time.Duration
+}
+
+type diskFeed struct {
+	Version int          `json:"v"`
+	Fetched int64        `json:"fetched"`
+	Feed    *gofeed.Feed `json:"feed"`
+}
+
+func newDiskFeedCache(db *pebble.DB, ttl time.Duration) *diskFeedCache {
+	return &diskFeedCache{db: db, ttl: ttl}
+}
+
+func feedCacheKey(url string) []byte {
+	return []byte(feedCachePrefix + url)
+}
+
+// Get returns the feed stored for url if it was fetched less than ttl ago.
+// Records that are expired or unreadable are removed.
+func (c *diskFeedCache) Get(url string) (*gofeed.Feed, bool) {
+	data, closer, err := c.db.Get(feedCacheKey(url))
+	if err != nil {
+		if err != pebble.ErrNotFound {
+			logger.Warn("failed to read cached feed", "url", url, "err", err)
+		}
+		return nil, false
+	}
+	stored, err := decodeDiskFeed(data)
+	closer.Close()
+
+	switch {
+	case err != nil:
+		logger.Warn("got invalid cached feed", "url", url, "err", err)
+	case stored.Version != diskCacheVersion || stored.Feed == nil:
+	case time.Since(time.Unix(stored.Fetched, 0)) >= c.ttl:
+	default:
+		return stored.Feed, true
+	}
+
+	c.Delete(url)
+	return nil, false
+}
+
+// Set stores feed as fetched now.
+func (c *diskFeedCache) Set(url string, feed *gofeed.Feed) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	err := json.NewEncoder(gz).Encode(diskFeed{diskCacheVersion, time.Now().Unix(), feed})
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = c.db.Set(feedCacheKey(url), buf.Bytes(), pebble.NoSync)
+	}
+	if err != nil {
+		logger.Warn("failed to cache feed on disk", "url", url, "err", err)
+	}
+}
+
+func (c *diskFeedCache) Delete(url string) {
+	if err := c.db.Delete(feedCacheKey(url), pebble.NoSync); err != nil {
+		logger.Warn("failed to drop cached feed", "url", url, "err", err)
+	}
+}
+
+func decodeDiskFeed(data []byte) (stored diskFeed, err error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return stored, err
+	}
+	defer gz.Close()
+	err = json.NewDecoder(gz).Decode(&stored)
+	return stored, err
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// entitySchemaVersion is bumped whenever the stored Entity shape changes.
+// Records without a version predate versioning.
+const entitySchemaVersion = 2
+
+// Entity is what we store, under its pubkey, for every registered feed.
+type Entity struct {
+	SchemaVersion int
+	PrivateKey    string
+	// SecretVersion is the version of the operator secret PrivateKey was derived from.
+	SecretVersion int
+	URL           string
+	// Meta overrides what the feed itself says in the profile metadata.
+	Meta       *Metadata `json:",omitempty"`
+	CreatedAt  time.Time
+	LastPolled time.Time
+	// FirstPolled is when the feed was first polled, see cutoff.
+	FirstPolled time.Time `json:",omitempty"`
+	// LastNewItem is the date of the newest item seen when polling the feed.
+	LastNewItem time.Time `json:",omitempty"`
+	// Pinned feeds are never evicted.
+	Pinned bool `json:",omitempty"`
+	// OutboxRelays also get this feed's events, instead of the global RELAYS if OutboxOnly.
+	OutboxRelays []string `json:",omitempty"`
+	OutboxOnly   bool     `json:",omitempty"`
+	// FullHistory feeds get all their items emitted on the first poll, however old.
+	FullHistory bool `json:",omitempty"`
+	// FullContent feeds keep the full text of their items, see keepsContent.
+	FullContent bool `json:",omitempty"`
+	// ContentTemplate is the text/template the feed's notes are rendered with, the default one if empty.
+	ContentTemplate string `json:",omitempty"`
+	// Auth is the FeedAuth the feed is fetched with, encrypted by sealAuth.
+	Auth []byte `json:",omitempty"`
+	// InsecureSkipVerify feeds are fetched without checking their certificate.
+	// INSECURE: meant for internal feeds with self-signed certificates only.
+	InsecureSkipVerify bool `json:",omitempty"`
+	// Private feeds have their notes gift wrapped for each of Recipients, see
+	// outgoing, instead of published for everyone.
+	Private    bool     `json:",omitempty"`
+	Recipients []string `json:",omitempty"`
+	// MovedTo is set once the key was rotated and the feed lives under another pubkey.
+	MovedTo string `json:",omitempty"`
+}
+
+// horizon is how old the items of the feed can be to be emitted, d before it
+// was registered, or 0 if there's no such limit: d is 0, the feed asked for
+// its FullHistory, or it was registered before that time was kept.
+func (entity Entity) horizon(d time.Duration) nostr.Timestamp {
+	if d <= 0 || entity.FullHistory || entity.CreatedAt.IsZero() {
+		return 0
+	}
+	return nostr.Timestamp(entity.CreatedAt.Add(-d).Unix())
+}
+
+// Metadata is the display information of a feed's profile.
+type Metadata struct {
+	Name    string `json:"name,omitempty"`
+	URL     string `json:"url,omitempty"`
+	Nip05   string `json:"nip05,omitempty"`
+	Picture string `json:"picture,omitempty"`
+	Banner  string `json:"banner,omitempty"`
+}
+
+// validate checks meta as given to POST /feed, where URL is the feed's.
+func (meta Metadata) validate() error {
+	if meta.URL == "" {
+		return errors.New("url: missing")
+	}
+	for _, field := range []struct{ name, value string }{{"picture", meta.Picture}, {"banner", meta.Banner}} {
+		if field.value == "" {
+			continue
+		}
+		if err := checkURL(field.value, "http", "https"); err != nil {
+			return fmt.Errorf("%s: %w", field.name, err)
+		}
+	}
+	if meta.Nip05 != "" {
+		if name, domain, ok := strings.Cut(meta.Nip05, "@"); !ok || name == "" || domain == "" || strings.ContainsAny(domain, "/@ ") {
+			return fmt.Errorf("nip05: %q is not a name@domain", meta.Nip05)
+		}
+	}
+	return nil
+}
+
+// polled tells whether the feed was polled yet.
+func (entity Entity) polled() bool {
+	return !entity.FirstPolled.IsZero() || !entity.LastPolled.IsZero()
+}
+
+// cutoff is how old the items of the feed can be to be emitted or served:
+// maxInitial before its first poll, or before now if it wasn't polled yet, and
+// no older than its horizon. maxInitial doesn't apply to FullHistory feeds nor
+// to those first polled before that time was kept.
+func (entity Entity) cutoff(maxInitial, horizon time.Duration, now time.Time) nostr.Timestamp {
+	var cutoff nostr.Timestamp
+	if maxInitial > 0 && !entity.FullHistory {
+		switch {
+		case !entity.FirstPolled.IsZero():
+			cutoff = nostr.Timestamp(entity.FirstPolled.Add(-maxInitial).Unix())
+		case entity.LastPolled.IsZero():
+			cutoff = nostr.Timestamp(now.Add(-maxInitial).Unix())
+		}
+	}
+	if h := entity.horizon(horizon); h > cutoff {
+		cutoff = h
+	}
+	return cutoff
+}
+
+// decodeEntity reads a stored entity in any of the shapes we ever wrote,
+// reporting whether it had to be upgraded to the current one.
+func decodeEntity(data []byte) (entity Entity, upgraded bool, err error) {
+	if err := json.Unmarshal(data, &entity); err != nil {
+		return entity, false, err
+	}
+
+	if entity.SchemaVersion < 2 && entity.SecretVersion == 0 {
+		// keys were derived from the one and only secret before versioning
+		entity.SecretVersion = 1
+	}
+	if entity.SchemaVersion < entitySchemaVersion {
+		// legacy records only had PrivateKey, URL and maybe Meta, which decode as is
+		entity.SchemaVersion = entitySchemaVersion
+		upgraded = true
+	}
+
+	return entity, upgraded, nil
+}
+
+// loadEntity reads the feed stored under pubkey, also where it was kept before
+// keys were prefixed.
+func loadEntity(db *pebble.DB, pubkey string) (Entity, error) {
+	val, closer, err := db.Get(entityKey(pubkey))
+	if err == pebble.ErrNotFound {
+		val, closer, err = db.Get([]byte(pubkey))
+	}
+	if err != nil {
+		return Entity{}, err
+	}
+	defer closer.Close()
+
+	entity, _, err := decodeEntity(val)
+	return entity, err
+}
+
+// entityLocks holds a *sync.Mutex for each feed, by pubkey, see lockEntity.
+var entityLocks sync.Map
+
+// lockEntity locks the feed stored under pubkey, returning the unlock func.
+// Whatever loads a feed to store it again, or removes it, holds it meanwhile,
+// so it doesn't undo what another one did.
+func lockEntity(pubkey string) (unlock func()) {
+	mu, _ := entityLocks.LoadOrStore(pubkey, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// updateEntity applies update to the feed stored under pubkey as it is now,
+// and stores it again. A feed that is gone stays so, with pebble.ErrNotFound
+// returned.
+func updateEntity(db *pebble.DB, pubkey string, update func(*Entity)) (Entity, error) {
+	defer lockEntity(pubkey)()
+	entity, err := loadEntity(db, pubkey)
+	if err != nil {
+		return entity, err
+	}
+	update(&entity)
+	return entity, saveEntity(db, pubkey, entity)
+}
+
+func saveEntity(db *pebble.DB, pubkey string, entity Entity) error {
+	entity.SchemaVersion = entitySchemaVersion
+	j, err := json.Marshal(entity)
+	if err != nil {
+		return err
+	}
+	return db.Set(entityKey(pubkey), j, nil)
+}
+
+// migrateEntities rewrites every stored entity that isn't in the current shape
+// and moves the ones stored under a bare pubkey to their prefixed key.
+func migrateEntities(db *pebble.DB) error {
+	batch := db.NewBatch()
+	defer batch.Close()
+
+	moved := 0
+	iter := db.NewIter(nil)
+	for iter.First(); iter.Valid(); iter.Next() {
+		legacy := isLegacyEntityKey(iter.Key())
+		if !legacy && !isEntityKey(iter.Key()) {
+			continue
+		}
+		key := iter.Key()
+		if legacy {
+			key = entityKey(string(iter.Key()))
+			batch.Delete(iter.Key(), nil)
+			moved++
+		}
+
+		value := iter.Value()
+		entity, upgraded, err := decodeEntity(value)
+		if err != nil {
+			// still moved, so it shows up as corrupt in ForEachEntity
+			logger.Error("got invalid json from db", "key", string(iter.Key()), "err", err)
+		} else if upgraded {
+			value, _ = json.Marshal(entity)
+		} else if !legacy {
+			continue
+		}
+
+		batch.Set(key, value, nil)
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	if batch.Count() > 0 {
+		logger.Info("migrating feeds", "feeds", batch.Count()-uint32(moved),
+			"schema_version", entitySchemaVersion, "prefixed", moved)
+	}
+	return batch.Commit(pebble.Sync)
+}
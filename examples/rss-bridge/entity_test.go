@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMigrateLegacyEntities(t *testing.T) {
+	setupTestRelay(t)
+
+	relay.db.Set([]byte("plain"), []byte(`{"PrivateKey":"sk1","URL":"https://example.com/feed"}`), nil)
+	relay.db.Set([]byte("withmeta"), []byte(`{"PrivateKey":"sk2","URL":"https://example.org/rss","Meta":{"name":"Example","nip05":"example@example.org"}}`), nil)
+	relay.db.Set([]byte("broken"), []byte(`{not json`), nil)
+
+	if err := migrateEntities(relay.db); err != nil {
+		t.Fatalf("migrateEntities: %v", err)
+	}
+
+	plain, err := loadEntity(relay.db, "plain")
+	if err != nil {
+		t.Fatalf("loadEntity(plain): %v", err)
+	}
+	if plain.SchemaVersion != entitySchemaVersion || plain.PrivateKey != "sk1" || plain.URL != "https://example.com/feed" || plain.Meta != nil ||
+		plain.SecretVersion != 1 {
+		t.Errorf("plain entity migrated wrong: %+v", plain)
+	}
+
+	withmeta, err := loadEntity(relay.db, "withmeta")
+	if err != nil {
+		t.Fatalf("loadEntity(withmeta): %v", err)
+	}
+	if withmeta.SchemaVersion != entitySchemaVersion || withmeta.PrivateKey != "sk2" || withmeta.Meta == nil ||
+		withmeta.Meta.Name != "Example" || withmeta.Meta.Nip05 != "example@example.org" {
+		t.Errorf("entity with meta migrated wrong: %+v", withmeta)
+	}
+
+	// the records themselves were rewritten, under prefixed keys
+	val, closer, err := relay.db.Get(entityKey("plain"))
+	if err != nil {
+		t.Fatalf("record wasn't moved to its prefixed key: %v", err)
+	}
+	_, upgraded, _ := decodeEntity(val)
+	closer.Close()
+	if upgraded {
+		t.Error("stored record wasn't rewritten in the current shape")
+	}
+	for _, key := range []string{"plain", "withmeta", "broken"} {
+		if _, closer, err := relay.db.Get([]byte(key)); err == nil {
+			closer.Close()
+			t.Errorf("legacy key %s is still there", key)
+		}
+	}
+}
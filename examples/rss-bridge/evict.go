@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// evictFeeds removes unpinned feeds with removeFeed until at most max remain. Feeds
+// whose last fetch failed go first, then the ones fetched least recently. Pinned
+// feeds are never removed, nor is the one under keep, the feed just registered.
+func evictFeeds(db *pebble.DB, max int, keep string) (evicted []string, err error) {
+	type candidate struct {
+		pubkey string
+		health FeedHealth
+	}
+
+	total := 0
+	var candidates []candidate
+	err = ForEachEntity(db, func(stored StoredEntity) error {
+		if stored.Entity.MovedTo != "" {
+			return nil
+		}
+		total++
+		if stored.Entity.Pinned || stored.Pubkey == keep {
+			return nil
+		}
+		health, _ := getFeedHealth(stored.Entity.URL)
+		candidates = append(candidates, candidate{stored.Pubkey, health})
+		return nil
+	})
+	if err := skipCorrupt(err); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		deadI, deadJ := candidates[i].health.LastError != "", candidates[j].health.LastError != ""
+		if deadI != deadJ {
+			return deadI
+		}
+		return candidates[i].health.LastFetch.Before(candidates[j].health.LastFetch)
+	})
+
+	for _, c := range candidates {
+		if total <= max {
+			break
+		}
+		if _, err := removeFeed(db, c.pubkey); err != nil {
+			return evicted, err
+		}
+		evicted = append(evicted, c.pubkey)
+		total--
+	}
+
+	return evicted, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestEvictFeedsSkipsPinned(t *testing.T) {
+	setupTestRelay(t)
+
+	seed := map[string]Entity{
+		"dead1":       {URL: "https://dead1.example.com/feed"},
+		"dead2":       {URL: "https://dead2.example.com/feed"},
+		"pinned-dead": {URL: "https://pinned.example.com/feed", Pinned: true},
+		"alive":       {URL: "https://alive.example.com/feed"},
+	}
+	for pubkey, entity := range seed {
+		saveEntity(relay.db, pubkey, entity)
+	}
+	recordFetch("https://dead1.example.com/feed", nil, errors.New("gone"))
+	recordFetch("https://dead2.example.com/feed", nil, errors.New("gone"))
+	recordFetch("https://pinned.example.com/feed", nil, errors.New("gone"))
+	recordFetch("https://alive.example.com/feed", nil, nil)
+
+	evicted, err := evictFeeds(relay.db, 2, "")
+	if err != nil {
+		t.Fatalf("evictFeeds: %v", err)
+	}
+	if len(evicted) != 2 {
+		t.Errorf("evicted %v; want 2 feeds", evicted)
+	}
+
+	for _, pubkey := range []string{"pinned-dead", "alive"} {
+		if _, closer, err := relay.db.Get(entityKey(pubkey)); err != nil {
+			t.Errorf("%s was evicted", pubkey)
+		} else {
+			closer.Close()
+		}
+	}
+	for _, pubkey := range []string{"dead1", "dead2"} {
+		if _, closer, err := relay.db.Get(entityKey(pubkey)); err == nil {
+			closer.Close()
+			t.Errorf("%s wasn't evicted", pubkey)
+		}
+	}
+	for _, url := range []string{"https://dead1.example.com/feed", "https://dead2.example.com/feed"} {
+		if _, ok := getFeedHealth(url); ok {
+			t.Errorf("the health of evicted %s wasn't forgotten", url)
+		}
+	}
+}
+
+func TestEvictFeedsKeepsRegistered(t *testing.T) {
+	setupTestRelay(t)
+	saveEntity(relay.db, "registered", Entity{URL: "https://registered.example.com/feed"})
+	saveEntity(relay.db, "fresh", Entity{URL: "https://fresh.example.com/feed"})
+	// the feed just registered was never fetched, so it would go first
+	feedHealth.Store("https://fresh.example.com/feed", FeedHealth{LastFetch: time.Now()})
+	defer feedHealth.Delete("https://fresh.example.com/feed")
+
+	evicted, err := evictFeeds(relay.db, 1, "registered")
+	if err != nil {
+		t.Fatalf("evictFeeds: %v", err)
+	}
+	if fmt.Sprint(evicted) != "[fresh]" {
+		t.Errorf("evicted %v; want [fresh]", evicted)
+	}
+	if _, err := loadEntity(relay.db, "registered"); err != nil {
+		t.Errorf("the feed just registered was evicted: %v", err)
+	}
+}
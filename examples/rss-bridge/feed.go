@@ -1,104 +1,391 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"strings"
+	"text/template"
 	"time"
 
-	"github.com/PuerkitoBio/goquery"
-	strip "github.com/grokify/html-strip-tags-go"
+	"github.com/cockroachdb/pebble"
 	"github.com/mmcdole/gofeed"
 	"github.com/nbd-wtf/go-nostr"
-	"github.com/rif/cache2go"
+	"golang.org/x/exp/slices"
 )
 
 var (
-	fp        = gofeed.NewParser()
-	feedCache = cache2go.New(512, time.Minute*19)
-	client    = &http.Client{
+	fp     = gofeed.NewParser()
+	feeds  = newFeedCache(512, time.Minute*19, time.Minute*19, fetchAndCleanFeed)
+	hosts  = newHostLimiter(0, 0)
+	client = &http.Client{
 		Timeout: 5 * time.Second,
 	}
 )
 
-type Entity struct {
-	PrivateKey string
-	URL        string
+var (
+	ErrNoFeedFound       = errors.New("couldn't find a feed url")
+	ErrBadFeed           = errors.New("bad feed")
+	ErrAlreadyRegistered = errors.New("feed already registered")
+	ErrBadTemplate       = errors.New("bad content template")
+	ErrBadRecipient      = errors.New("bad recipient")
+	// ErrPreviewNotPermitted is returned, with RESPECT_ROBOTS_META, for pages
+	// asking not to be indexed.
+	ErrPreviewNotPermitted = errors.New("the page doesn't permit previews")
+	// ErrPageTooLarge is returned for pages and feeds larger than
+	// MAX_PAGE_SIZE, which aren't looked into for feeds or parsed.
+	ErrPageTooLarge = errors.New("the page is too large")
+)
+
+func parseFeed(ctx context.Context, url string) (*gofeed.Feed, error) {
+	return feeds.Get(ctx, url)
+}
+
+func fetchAndCleanFeed(ctx context.Context, url string) (*gofeed.Feed, error) {
+	feed, warnings, err := fetchFeed(ctx, url, credentialsFor(url))
+	recordFetch(url, warnings, err)
+	if err != nil {
+		return nil, err
+	}
+
+	feed.Items = dedupeItems(feed.Items)
+
+	// cleanup a little so we don't store too much junk
+	for _, item := range feed.Items {
+		cleanContent(url, item)
+	}
+
+	return feed, nil
 }
 
-var types = []string{
-	"rss+xml",
-	"atom+xml",
-	"feed+json",
-	"text/xml",
-	"application/xml",
+// FeedOptions are the per-feed settings chosen when registering it.
+type FeedOptions struct {
+	// ContentTemplate replaces the default layout of the feed's notes, see parseContentTemplate.
+	ContentTemplate string
+	// FullHistory emits all the items of the feed on its first poll, not only the recent ones.
+	FullHistory bool
+	// FullContent bridges the full text of the items, when the feed has it,
+	// instead of their description.
+	FullContent bool
+	// Auth is sent when fetching the feed, which must then be given by its own url.
+	Auth *FeedAuth
+	// InsecureSkipVerify accepts any certificate from the feed, which must then be
+	// given by its own url. Only for internal feeds, see ALLOW_INSECURE_FEEDS.
+	InsecureSkipVerify bool
+	// Private delivers the feed's notes only to Recipients, as gift wraps.
+	Private    bool
+	Recipients []string
+	// Meta overrides what the feed says in its profile.
+	Meta *Metadata
+	// Pinned feeds are never evicted, see MAX_FEEDS.
+	Pinned bool
 }
 
-func getFeedURL(url string) string {
-	resp, err := client.Get(url)
-	if err != nil || resp.StatusCode >= 300 {
-		return ""
+// Feed validates the feed found at url and stores it, returning its pubkey.
+// If an equivalent url was already registered the existing pubkey is returned
+// along with ErrAlreadyRegistered, and nothing about that feed is changed.
+func Feed(url, secret string, db *pebble.DB, opts FeedOptions) (pubkey string, err error) {
+	if _, err := parseContentTemplate(opts.ContentTemplate); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrBadTemplate, err)
+	}
+	if opts.Private && len(opts.Recipients) == 0 {
+		return "", fmt.Errorf("%w: private feeds need at least one", ErrBadRecipient)
+	}
+
+	ctx := context.Background()
+	feedurl := url
+	if opts.InsecureSkipVerify {
+		ctx = skipVerify(ctx)
+	} else if feedurl, err = getFeedURL(url, opts.Auth); err != nil {
+		return "", err
+	} else if feedurl == "" {
+		return "", ErrNoFeedFound
+	}
+
+	var feed *gofeed.Feed
+	if opts.Auth != nil || opts.InsecureSkipVerify {
+		// skip the cache, the feed must be fetched as it is registered
+		feed, _, err = fetchFeed(ctx, feedurl, opts.Auth)
+	} else {
+		feed, err = parseFeed(context.Background(), feedurl)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrBadFeed, err)
+	}
+
+	if pubkey, _, ok := findFeedByURL(db, feedurl, feed.FeedLink); ok {
+		return pubkey, ErrAlreadyRegistered
+	}
+
+	sk := privateKeyFromFeed(secret, feedurl)
+	pubkey, err = nostr.GetPublicKey(sk)
+	if err != nil {
+		return "", fmt.Errorf("bad private key: %w", err)
+	}
+
+	entity := Entity{
+		PrivateKey:         sk,
+		SecretVersion:      relay.SecretVersion,
+		URL:                feedurl,
+		ContentTemplate:    opts.ContentTemplate,
+		FullHistory:        opts.FullHistory,
+		FullContent:        opts.FullContent,
+		CreatedAt:          time.Now(),
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+		Private:            opts.Private,
+		Meta:               opts.Meta,
+		Pinned:             opts.Pinned,
+	}
+	if opts.Private {
+		entity.Recipients = opts.Recipients
+	}
+	if opts.Auth != nil {
+		err = storeFeedAuth(db, secret, pubkey, entity, opts.Auth)
+	} else {
+		err = saveEntity(db, pubkey, entity)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to store feed: %w", err)
+	}
+	if entity.InsecureSkipVerify {
+		insecureFeeds.Store(entity.URL, true)
+	}
+	if entity.FullContent {
+		// it was cached without the content
+		fullContentFeeds.Store(entity.URL, true)
+		feeds.Invalidate(entity.URL)
 	}
 
-	ct := resp.Header.Get("Content-Type")
-	for _, typ := range types {
-		if strings.Contains(ct, typ) {
-			return url
+	if relay.MaxFeeds > 0 {
+		if evicted, err := evictFeeds(db, relay.MaxFeeds, pubkey); err != nil {
+			logger.Error("failed to evict feeds", "err", err)
+		} else if len(evicted) > 0 {
+			logger.Info("evicted feeds", "evicted", len(evicted), "max_feeds", relay.MaxFeeds)
 		}
 	}
 
-	if strings.Contains(ct, "text/html") {
-		doc, err := goquery.NewDocumentFromReader(resp.Body)
-		if err != nil {
-			return ""
+	return pubkey, nil
+}
+
+// findFeedByURL looks for a stored feed whose url is equivalent to any of the given ones.
+func findFeedByURL(db *pebble.DB, urls ...string) (pubkey string, entity Entity, ok bool) {
+	keys := make([]string, 0, len(urls))
+	for _, url := range urls {
+		if url != "" {
+			keys = append(keys, canonicalFeedKey(url))
 		}
+	}
 
-		for _, typ := range types {
-			href, _ := doc.Find(fmt.Sprintf("link[type*='%s']", typ)).Attr("href")
-			if href == "" {
-				continue
-			}
-			if !strings.HasPrefix(href, "http") {
-				href, _ = urljoin(url, href)
-			}
-			return href
+	ForEachEntity(db, func(stored StoredEntity) error {
+		if stored.Entity.MovedTo == "" && slices.Contains(keys, canonicalFeedKey(stored.Entity.URL)) {
+			pubkey, entity, ok = stored.Pubkey, stored.Entity, true
+			return ErrStopIteration
 		}
+		return nil
+	})
+
+	return pubkey, entity, ok
+}
+
+// removeFeed deletes the feed stored under pubkey, returning what it was, and
+// forgets its watermark, pending digest, first-seen times, queued deliveries,
+// credentials and cached copy so nothing more is emitted for it. The state
+// kept by url is left alone when pubkey only points to where the feed moved.
+func removeFeed(db *pebble.DB, pubkey string) (Entity, error) {
+	defer lockEntity(pubkey)()
+	entity, err := loadEntity(db, pubkey)
+	if err != nil {
+		return entity, err
 	}
 
-	return ""
+	batch := db.NewBatch()
+	defer batch.Close()
+	batch.Delete(entityKey(pubkey), nil)
+	batch.Delete([]byte(pubkey), nil)
+	batch.Delete(digestKey(pubkey), nil)
+	seen := prefixIterOptions(firstSeenPrefix + pubkey + "\x00")
+	batch.DeleteRange(seen.LowerBound, seen.UpperBound, nil)
+	if entity.MovedTo == "" {
+		batch.Delete([]byte(watermarkPrefix+entity.URL), nil)
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return entity, err
+	}
+	if relay.deliveries != nil {
+		if err := relay.deliveries.forget(pubkey); err != nil {
+			return entity, err
+		}
+	}
+
+	if entity.MovedTo == "" {
+		relay.lastEmitted.Delete(entity.URL)
+		feedAuths.Delete(entity.URL)
+		insecureFeeds.Delete(entity.URL)
+		fullContentFeeds.Delete(entity.URL)
+		feedHealth.Delete(entity.URL)
+		feeds.Invalidate(entity.URL)
+	}
+	return entity, nil
 }
 
-func parseFeed(url string) (*gofeed.Feed, error) {
-	if feed, ok := feedCache.Get(url); ok {
-		return feed.(*gofeed.Feed), nil
+// fetchFeed downloads and parses the feed at url, waiting for its turn with hosts.
+// auth, if not nil, is sent along.
+func fetchFeed(ctx context.Context, feedUrl string, auth *FeedAuth) (*gofeed.Feed, []string, error) {
+	body, err := openFeed(ctx, feedUrl, auth)
+	if err != nil {
+		return nil, nil, err
 	}
+	defer body.Close()
 
-	feed, err := fp.ParseURL(url)
+	// reading one byte more tells feeds over the limit from ones right at it
+	limited := io.Reader(body)
+	if relay.MaxPageSize > 0 {
+		limited = io.LimitReader(body, relay.MaxPageSize+1)
+	}
+	data, err := io.ReadAll(limited)
+	if err != nil {
+		return nil, nil, err
+	}
+	if relay.MaxPageSize > 0 && int64(len(data)) > relay.MaxPageSize {
+		return nil, nil, fmt.Errorf("%w: %s is over %d bytes", ErrPageTooLarge, feedUrl, relay.MaxPageSize)
+	}
+
+	return parseFeedData(data)
+}
+
+// openFeed requests the feed at url as fetchFeed does, returning the body of a
+// successful answer. The turn with hosts lasts until the body is closed.
+func openFeed(ctx context.Context, feedUrl string, auth *FeedAuth) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feedUrl, nil)
 	if err != nil {
 		return nil, err
 	}
+	if auth != nil {
+		auth.authorize(req)
+	}
 
-	// cleanup a little so we don't store too much junk
-	for i := range feed.Items {
-		feed.Items[i].Content = ""
+	release, err := hosts.acquire(ctx, req.URL.Host)
+	if err != nil {
+		return nil, err
 	}
-	feedCache.Set(url, feed)
 
-	return feed, nil
+	resp, err := clientFor(ctx, feedUrl).Do(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		hosts.backOff(req.URL.Host, retryAfter(resp.Header.Get("Retry-After")))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		release()
+		return nil, gofeed.HTTPError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+	}
+
+	return releasingBody{resp.Body, release}, nil
+}
+
+// releasingBody ends a turn with hosts when closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
 }
 
-func feedToSetMetadata(pubkey string, feed *gofeed.Feed) nostr.Event {
+func (b releasingBody) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
+
+// parseFeedData parses a raw feed document. Problems that still leave us with a
+// usable feed are returned as warnings, only unparseable input is an error.
+func parseFeedData(data []byte) (*gofeed.Feed, []string, error) {
+	var warnings []string
+
+	feed, err := fp.Parse(bytes.NewReader(data))
+	var syntaxErr *xml.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		// try again after dropping the characters XML doesn't allow
+		if recovered, rerr := fp.Parse(bytes.NewReader(sanitizeXML(data))); rerr == nil {
+			warnings = append(warnings, "recovered from malformed input: "+err.Error())
+			feed, err = recovered, nil
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i, item := range feed.Items {
+		warnings = append(warnings, itemWarnings(i, item)...)
+	}
+
+	return feed, warnings, nil
+}
+
+// itemWarnings are the problems of the i-th item of a feed that still let it be
+// bridged.
+func itemWarnings(i int, item *gofeed.Item) []string {
+	var warnings []string
+	if item.Published != "" && item.PublishedParsed == nil {
+		warnings = append(warnings, fmt.Sprintf("item %d: unparseable published date %q", i, item.Published))
+	}
+	if item.Updated != "" && item.UpdatedParsed == nil {
+		warnings = append(warnings, fmt.Sprintf("item %d: unparseable updated date %q", i, item.Updated))
+	}
+	if item.Link == "" {
+		warnings = append(warnings, fmt.Sprintf("item %d: missing link", i))
+	}
+	return warnings
+}
+
+// sanitizeXML removes runes that are not valid XML characters.
+func sanitizeXML(data []byte) []byte {
+	return bytes.Map(func(r rune) rune {
+		switch {
+		case r == '\t' || r == '\n' || r == '\r':
+			return r
+		case r < 0x20, r == 0xFFFE, r == 0xFFFF:
+			return -1
+		}
+		return r
+	}, data)
+}
+
+func feedToSetMetadata(pubkey string, feed *gofeed.Feed, meta *Metadata) nostr.Event {
 	metadata := map[string]string{
 		"name":  feed.Title,
 		"about": feed.Description + "\n\n" + feed.Link,
 	}
+	if feed.Link != "" {
+		metadata["website"] = feed.Link
+	}
 	if feed.Image != nil {
 		metadata["picture"] = feed.Image.URL
 	}
+	if meta != nil {
+		for key, value := range map[string]string{
+			"name":    meta.Name,
+			"website": meta.URL,
+			"nip05":   meta.Nip05,
+			"picture": meta.Picture,
+			"banner":  meta.Banner,
+		} {
+			if value != "" {
+				metadata[key] = value
+			}
+		}
+	}
 	content, _ := json.Marshal(metadata)
 
 	createdAt := time.Now()
@@ -113,44 +400,57 @@ func feedToSetMetadata(pubkey string, feed *gofeed.Feed) nostr.Event {
 		Tags:      nostr.Tags{},
 		Content:   string(content),
 	}
+	if feed.Link != "" {
+		evt.Tags = append(evt.Tags, nostr.Tag{"r", feed.Link})
+	}
 	evt.ID = string(evt.Serialize())
 
 	return evt
 }
 
-func itemToTextNote(pubkey string, item *gofeed.Item) nostr.Event {
-	content := ""
-	if item.Title != "" {
-		content = "**" + item.Title + "**\n\n"
+func itemToTextNote(pubkey string, item *gofeed.Item, tmpl *template.Template) nostr.Event {
+	// taken before any rewrite, so bridges configured differently agree on it
+	hash := ""
+	if relay.ContentHash {
+		hash = contentHash(item)
 	}
-	content += strip.StripTags(item.Description)
-	if len(content) > 250 {
-		content += content[0:249] + "…"
+
+	if len(relay.TitleRewrites) > 0 {
+		rewritten := *item
+		rewritten.Title = relay.TitleRewrites.apply(item.Title)
+		item = &rewritten
 	}
-	content += "\n\n" + item.Link
 
-	createdAt := time.Now()
-	if item.UpdatedParsed != nil {
-		createdAt = *item.UpdatedParsed
+	link := item.Link
+	if relay.StripLinkParams {
+		link = cleanLink(link, relay.LinkParams)
 	}
-	if item.PublishedParsed != nil {
-		createdAt = *item.PublishedParsed
+	content, err := renderContent(tmpl, item, link)
+	if err != nil {
+		logger.Warn("using the default template", "link", link, "err", err)
+		content, _ = renderContent(defaultNoteTemplate, item, link)
 	}
 
 	evt := nostr.Event{
 		PubKey:    pubkey,
-		CreatedAt: nostr.Timestamp(createdAt.Unix()),
+		CreatedAt: nostr.Timestamp(itemTime(pubkey, item).Unix()),
 		Kind:      nostr.KindTextNote,
 		Tags:      nostr.Tags{},
 		Content:   content,
 	}
+	if author := authorPubkey(item); author != "" {
+		evt.Tags = append(evt.Tags, nostr.Tag{"p", author})
+	}
+	if hash != "" {
+		evt.Tags = append(evt.Tags, nostr.Tag{"content-hash", hash})
+	}
 	evt.ID = string(evt.Serialize())
 
 	return evt
 }
 
-func privateKeyFromFeed(url string) string {
-	m := hmac.New(sha256.New, []byte(relay.Secret))
+func privateKeyFromFeed(secret, url string) string {
+	m := hmac.New(sha256.New, []byte(secret))
 	m.Write([]byte(url))
 	r := m.Sum(nil)
 	return hex.EncodeToString(r)
@@ -0,0 +1,707 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestParseFeedDataWarnings(t *testing.T) {
+	data := []byte("<?xml version=\"1.0\"?><rss version=\"2.0\"><channel><title>test</title>" +
+		"<item><title>first\x0c</title><link>https://example.com/1</link><pubDate>not a date</pubDate></item>" +
+		"<item><title>second</title><link>https://example.com/2</link></item>" +
+		"</channel></rss>")
+
+	feed, warnings, err := parseFeedData(data)
+	if err != nil {
+		t.Fatalf("parseFeedData: %v", err)
+	}
+	if len(feed.Items) != 2 {
+		t.Errorf("got %d items, want 2", len(feed.Items))
+	}
+	if len(warnings) != 2 {
+		t.Errorf("got warnings %v, want 2", warnings)
+	}
+}
+
+func TestParseFeedDataError(t *testing.T) {
+	if _, _, err := parseFeedData([]byte("this is not a feed")); err == nil {
+		t.Error("expected an error for unparseable input")
+	}
+}
+
+func TestFeedErrors(t *testing.T) {
+	setupTestRelay(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html><head><title>no feeds here</title></head></html>")
+	})
+	mux.HandleFunc("/garbage", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, "this is not a feed")
+	})
+	// not on a common feed path, or discovery would fall back to it for /page
+	mux.HandleFunc("/feeds/main.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	if _, err := Feed(srv.URL+"/page", relay.Secret, relay.db, FeedOptions{}); !errors.Is(err, ErrNoFeedFound) {
+		t.Errorf("html page without feed links: got %v; want ErrNoFeedFound", err)
+	}
+	if _, err := Feed(srv.URL+"/garbage", relay.Secret, relay.db, FeedOptions{}); !errors.Is(err, ErrBadFeed) {
+		t.Errorf("unparseable feed: got %v; want ErrBadFeed", err)
+	}
+
+	fs := vfs.NewMem()
+	if db, err := pebble.Open("", &pebble.Options{FS: fs}); err == nil {
+		db.Close()
+	}
+	readonly, err := pebble.Open("", &pebble.Options{FS: fs, ReadOnly: true})
+	if err != nil {
+		t.Fatalf("pebble.Open: %v", err)
+	}
+	defer readonly.Close()
+	if _, err := Feed(srv.URL+"/feeds/main.xml", relay.Secret, readonly, FeedOptions{}); !errors.Is(err, pebble.ErrReadOnly) {
+		t.Errorf("storage failure: got %v; want wrapped pebble.ErrReadOnly", err)
+	}
+}
+
+func TestRegisterFeedDedupes(t *testing.T) {
+	setupTestRelay(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+	defer srv.Close()
+
+	first, err := Feed(srv.URL+"/feed", relay.Secret, relay.db, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+
+	for _, variant := range []string{srv.URL + "/feed/", strings.ToUpper(srv.URL[:4]) + srv.URL[4:] + "/feed"} {
+		pubkey, err := Feed(variant, relay.Secret, relay.db, FeedOptions{})
+		if !errors.Is(err, ErrAlreadyRegistered) || pubkey != first {
+			t.Errorf("Feed(%s) = %s, %v; want %s, ErrAlreadyRegistered", variant, pubkey, err, first)
+		}
+	}
+
+	if n := countStored(t); n != 1 {
+		t.Errorf("got %d stored feeds, want 1", n)
+	}
+}
+
+const testFeed = `<?xml version="1.0"?>
+<rss version="2.0"><channel>
+<title>test feed</title>
+<link>https://example.com</link>
+<description>a feed for tests</description>
+<item><title>first</title><link>https://example.com/1</link><description>first item</description><pubDate>Mon, 02 Jan 2023 15:04:05 GMT</pubDate></item>
+<item><title>second</title><link>https://example.com/2</link><description>second item</description><pubDate>Tue, 03 Jan 2023 15:04:05 GMT</pubDate></item>
+</channel></rss>`
+
+func setupTestRelay(t *testing.T) {
+	t.Helper()
+	db, err := pebble.Open("", &pebble.Options{FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatalf("pebble.Open: %v", err)
+	}
+	relay.db = db
+	relay.Secret = "test-secret"
+	feeds.Flush()
+	t.Cleanup(func() { db.Close() })
+}
+
+func countStored(t *testing.T) int {
+	t.Helper()
+	n := 0
+	iter := relay.db.NewIter(nil)
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		if isEntityKey(iter.Key()) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestCanonicalFeedKey(t *testing.T) {
+	want := canonicalFeedKey("https://example.com/feed")
+	for _, variant := range []string{
+		"http://example.com/feed",
+		"https://www.example.com/feed",
+		"https://example.com/feed/",
+		"https://EXAMPLE.com:443/feed",
+	} {
+		if got := canonicalFeedKey(variant); got != want {
+			t.Errorf("canonicalFeedKey(%s) = %s; want %s", variant, got, want)
+		}
+	}
+	if canonicalFeedKey("https://example.com/feed?cat=1") == want {
+		t.Error("query string should be part of the key")
+	}
+}
+
+func TestSourceTags(t *testing.T) {
+	setupTestRelay(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+	defer srv.Close()
+
+	pubkey, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+
+	evts, err := store{relay.db}.QueryEvents(context.Background(), &nostr.Filter{Authors: []string{pubkey}})
+	if err != nil {
+		t.Fatalf("QueryEvents: %v", err)
+	}
+
+	notes := 0
+	for evt := range evts {
+		if ok, err := evt.CheckSignature(); !ok {
+			t.Errorf("event %s has a bad signature: %v", evt.ID, err)
+		}
+		switch evt.Kind {
+		case nostr.KindTextNote:
+			notes++
+			if r := evt.Tags.GetFirst([]string{"r"}); r == nil || r.Value() != srv.URL {
+				t.Errorf("note tags = %v; want an r tag for %s", evt.Tags, srv.URL)
+			}
+		case nostr.KindSetMetadata:
+			if r := evt.Tags.GetFirst([]string{"r"}); r == nil || r.Value() != "https://example.com" {
+				t.Errorf("profile tags = %v; want an r tag for the homepage", evt.Tags)
+			}
+			var metadata map[string]string
+			json.Unmarshal([]byte(evt.Content), &metadata)
+			if metadata["website"] != "https://example.com" {
+				t.Errorf("profile website = %q; want the homepage", metadata["website"])
+			}
+		}
+	}
+	if notes != 2 {
+		t.Errorf("got %d notes; want 2", notes)
+	}
+}
+
+func TestRegisterFeedEndpoint(t *testing.T) {
+	setupTestRelay(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/feed" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+	defer srv.Close()
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleRegisterFeed(rec, httptest.NewRequest("POST", "/feed", strings.NewReader(body)))
+		return rec
+	}
+
+	rec := post(fmt.Sprintf(`{"name":"Example News","url":%q,"nip05":"news@example.com","picture":"https://example.com/logo.png"}`, srv.URL+"/feed"))
+	var registered FeedRegistration
+	if rec.Code != 201 || json.Unmarshal(rec.Body.Bytes(), &registered) != nil {
+		t.Fatalf("POST /feed = %d %s; want 201 with the registration", rec.Code, rec.Body)
+	}
+	if registered.URL != srv.URL+"/feed" || registered.Existing || !strings.HasPrefix(registered.Npub, "npub1") {
+		t.Errorf("registration = %+v", registered)
+	}
+	entity, err := loadEntity(relay.db, registered.Pubkey)
+	if err != nil {
+		t.Fatalf("loadEntity: %v", err)
+	}
+	if want := (Metadata{Name: "Example News", Nip05: "news@example.com", Picture: "https://example.com/logo.png"}); entity.Meta == nil || *entity.Meta != want {
+		t.Errorf("stored meta = %+v; want %+v", entity.Meta, want)
+	}
+
+	// the same feed again gets the same pubkey and keeps its profile
+	rec = post(fmt.Sprintf(`{"name":"Impostor","url":%q}`, srv.URL+"/feed"))
+	var again FeedRegistration
+	if rec.Code != 200 || json.Unmarshal(rec.Body.Bytes(), &again) != nil || again.Pubkey != registered.Pubkey || !again.Existing {
+		t.Errorf("POST /feed of a registered feed = %d %s; want its pubkey back", rec.Code, rec.Body)
+	}
+	if entity, _ := loadEntity(relay.db, registered.Pubkey); entity.Meta == nil || entity.Meta.Name != "Example News" {
+		t.Errorf("stored meta = %+v; want it untouched", entity.Meta)
+	}
+
+	for _, body := range []string{
+		`{"name":"x"`,
+		`{"name":"no url"}`,
+		fmt.Sprintf(`{"url":%q,"picture":"javascript:alert(1)"}`, srv.URL+"/feed"),
+		fmt.Sprintf(`{"url":%q,"nip05":"not an address"}`, srv.URL+"/feed"),
+		fmt.Sprintf(`{"url":%q}`, srv.URL+"/nothing"),
+	} {
+		if rec := post(body); rec.Code != 400 {
+			t.Errorf("POST /feed %s = %d %s; want 400", body, rec.Code, rec.Body)
+		}
+	}
+	if n := countStored(t); n != 1 {
+		t.Errorf("got %d stored feeds, want 1", n)
+	}
+}
+
+func TestRegisterAgainChangesNothing(t *testing.T) {
+	setupTestRelay(t)
+	srv := privateFeed(t, func(*http.Request) bool { return true })
+
+	auth := &FeedAuth{Type: "basic", Credential: "reader:hunter2"}
+	pubkey, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{Auth: auth})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+	stored := func() string {
+		val, closer, err := relay.db.Get(entityKey(pubkey))
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		defer closer.Close()
+		return string(val)
+	}
+	before := stored()
+
+	again, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{
+		Auth:            &FeedAuth{Type: "bearer", Credential: "someone-elses"},
+		FullContent:     true,
+		ContentTemplate: "{{.Title}}",
+		Pinned:          true,
+	})
+	if !errors.Is(err, ErrAlreadyRegistered) || again != pubkey {
+		t.Fatalf("Feed again = %s, %v; want %s, ErrAlreadyRegistered", again, err, pubkey)
+	}
+	if stored() != before {
+		t.Error("registering the feed again changed it")
+	}
+	if got := credentialsFor(srv.URL); got == nil || got.Credential != auth.Credential {
+		t.Errorf("credentials = %+v; want the first ones", got)
+	}
+}
+
+func TestFetchFeedMaxPageSize(t *testing.T) {
+	setupTestRelay(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+	defer srv.Close()
+
+	t.Cleanup(func() { relay.MaxPageSize = 0 })
+	for _, size := range []int64{0, int64(len(testFeed))} {
+		relay.MaxPageSize = size
+		if _, _, err := fetchFeed(context.Background(), srv.URL, nil); err != nil {
+			t.Errorf("MAX_PAGE_SIZE=%d: fetchFeed = %v; want the feed", size, err)
+		}
+	}
+
+	// rather than parsing what fits
+	relay.MaxPageSize = int64(len(testFeed)) - 1
+	if _, _, err := fetchFeed(context.Background(), srv.URL, nil); !errors.Is(err, ErrPageTooLarge) {
+		t.Errorf("fetchFeed of a feed over MAX_PAGE_SIZE = %v; want ErrPageTooLarge", err)
+	}
+}
+
+func TestRegisterPrivateFeedAgain(t *testing.T) {
+	setupTestRelay(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+	defer srv.Close()
+
+	recipient, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	pubkey, err := Feed(srv.URL+"/feed", relay.Secret, relay.db, FeedOptions{Private: true, Recipients: []string{recipient}})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+
+	// answered as a url without a feed would be, its pubkey left out
+	rec := httptest.NewRecorder()
+	handleRegisterFeed(rec, httptest.NewRequest("POST", "/feed", strings.NewReader(fmt.Sprintf(`{"url":%q}`, srv.URL+"/feed"))))
+	if rec.Code != 400 || strings.Contains(rec.Body.String(), pubkey) {
+		t.Errorf("POST /feed = %d %s; want 400 without the pubkey", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	handleCreateFeed(rec, httptest.NewRequest("POST", "/create?url="+srv.URL+"/feed", nil))
+	if rec.Code != 400 || strings.Contains(rec.Body.String(), pubkey) {
+		t.Errorf("/create = %d %s; want 400 without the pubkey", rec.Code, rec.Body)
+	}
+}
+
+func TestCreatePrivateFeedNeedsAdmin(t *testing.T) {
+	setupTestRelay(t)
+	relay.AdminToken = "admin-token"
+	t.Cleanup(func() { relay.AdminToken = "" })
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+	defer srv.Close()
+
+	recipient, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	create := "/create?private=true&recipient=" + recipient + "&url=" + srv.URL + "/feed"
+
+	rec := httptest.NewRecorder()
+	handleCreateFeed(rec, httptest.NewRequest("POST", create, nil))
+	if rec.Code != 403 || countStored(t) != 0 {
+		t.Fatalf("anonymous private /create = %d %s, %d feeds stored; want 403 and none", rec.Code, rec.Body, countStored(t))
+	}
+
+	// the url is still free for the public feed
+	rec = httptest.NewRecorder()
+	handleCreateFeed(rec, httptest.NewRequest("POST", "/create?url="+srv.URL+"/feed", nil))
+	if rec.Code != 200 {
+		t.Fatalf("public /create = %d %s; want 200", rec.Code, rec.Body)
+	}
+
+	// admins can, on a relay where the url isn't taken yet
+	setupTestRelay(t)
+
+	req := httptest.NewRequest("POST", create, nil)
+	req.Header.Set("Authorization", "Bearer admin-token")
+	rec = httptest.NewRecorder()
+	handleCreateFeed(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("admin private /create = %d %s; want 200", rec.Code, rec.Body)
+	}
+}
+
+func TestDeleteFeedEndpoint(t *testing.T) {
+	setupTestRelay(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+	defer srv.Close()
+
+	pubkey, err := Feed(srv.URL+"/feed", relay.Secret, relay.db, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+	profile := &nostr.Filter{Authors: []string{pubkey}, Kinds: []int{nostr.KindSetMetadata}}
+	if evts := feedEvents(context.Background(), pubkey, profile); len(evts) != 1 {
+		t.Fatalf("got %d profiles before removing the feed; want 1", len(evts))
+	}
+	relay.lastEmitted.Store(srv.URL+"/feed", nostr.Timestamp(100))
+	saveWatermark(relay.db, srv.URL+"/feed", 100)
+
+	del := func(pubkey string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleDeleteFeed(rec, httptest.NewRequest("DELETE", "/feed/"+pubkey, nil))
+		return rec
+	}
+
+	rec := del(pubkey)
+	var removed FeedRemoval
+	if rec.Code != 200 || json.Unmarshal(rec.Body.Bytes(), &removed) != nil || removed.URL != srv.URL+"/feed" || removed.Pubkey != pubkey {
+		t.Fatalf("DELETE /feed/%s = %d %s; want 200 with its url", pubkey, rec.Code, rec.Body)
+	}
+	if n := countStored(t); n != 0 {
+		t.Errorf("got %d stored feeds after removing it, want 0", n)
+	}
+	if _, ok := relay.lastEmitted.Load(srv.URL + "/feed"); ok {
+		t.Error("watermark kept in memory")
+	}
+	if _, closer, err := relay.db.Get([]byte(watermarkPrefix + srv.URL + "/feed")); err == nil {
+		closer.Close()
+		t.Error("watermark kept in the db")
+	}
+	if evts := feedEvents(context.Background(), pubkey, profile); len(evts) != 0 {
+		t.Errorf("got %d profiles after removing the feed; want none", len(evts))
+	}
+
+	if rec := del(pubkey); rec.Code != 404 {
+		t.Errorf("DELETE of a removed feed = %d; want 404", rec.Code)
+	}
+	if rec := del(""); rec.Code != 404 {
+		t.Errorf("DELETE /feed/ = %d; want 404", rec.Code)
+	}
+}
+
+func TestRemoveFeedForgetsItsState(t *testing.T) {
+	setupTestRelay(t)
+	var authorized atomic.Bool
+	srv := privateFeed(t, func(r *http.Request) bool {
+		_, _, ok := r.BasicAuth()
+		authorized.Store(ok)
+		return true
+	})
+	auth := &FeedAuth{Type: "basic", Credential: "reader:hunter2"}
+	pubkey, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{Auth: auth})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+
+	relay.deliveries = testDeliveryQueue(t, relay.db, time.Hour)
+	defer func() { relay.deliveries.stop(); relay.deliveries = nil }()
+	// nothing listens there, so it stays queued
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	upstream := "ws://" + ln.Addr().String()
+	ln.Close()
+	relay.deliveries.add([]string{upstream}, pubkey, signedNote(t, "queued"))
+	relay.deliveries.add([]string{upstream}, "another", signedNote(t, "another feed's"))
+	firstSeen(relay.db, pubkey, &gofeed.Item{GUID: "seen"})
+
+	if _, err := removeFeed(relay.db, pubkey); err != nil {
+		t.Fatalf("removeFeed: %v", err)
+	}
+	if credentialsFor(srv.URL) != nil {
+		t.Error("credentials kept in memory")
+	}
+	if status := relay.deliveries.Status()[upstream]; status.Pending != 1 {
+		t.Errorf("%d deliveries pending; want only the other feed's", status.Pending)
+	}
+	iter := relay.db.NewIter(prefixIterOptions(firstSeenPrefix + pubkey + "\x00"))
+	if iter.First() {
+		t.Errorf("first-seen time kept at %s", iter.Key())
+	}
+	iter.Close()
+
+	// registered again, it carries no credentials
+	if _, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{}); err != nil {
+		t.Fatalf("Feed again: %v", err)
+	}
+	feeds.Flush()
+	if _, err := parseFeed(context.Background(), srv.URL); err != nil {
+		t.Fatalf("parseFeed: %v", err)
+	}
+	if authorized.Load() {
+		t.Error("the feed registered again was fetched with the removed one's credentials")
+	}
+}
+
+func TestListFeedsEndpoint(t *testing.T) {
+	setupTestRelay(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+	defer srv.Close()
+
+	news, err := Feed(srv.URL+"/news", relay.Secret, relay.db, FeedOptions{Meta: &Metadata{Name: "Example News", Nip05: "news@example.com"}})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+	blog, err := Feed(srv.URL+"/blog", relay.Secret, relay.db, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+	saveEntity(relay.db, "private", Entity{URL: srv.URL + "/private", Private: true, Recipients: []string{news}})
+	recordFetch(srv.URL+"/blog", nil, errors.New("gone"))
+
+	list := func(query string) []FeedListing {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handleListFeeds(rec, httptest.NewRequest("GET", "/feeds"+query, nil))
+		var listings []FeedListing
+		if rec.Code != 200 || json.Unmarshal(rec.Body.Bytes(), &listings) != nil {
+			t.Fatalf("GET /feeds%s = %d %s", query, rec.Code, rec.Body)
+		}
+		if strings.Contains(rec.Body.String(), "PrivateKey") || strings.Contains(strings.ToLower(rec.Body.String()), "private_key") {
+			t.Errorf("GET /feeds%s leaks private keys: %s", query, rec.Body)
+		}
+		return listings
+	}
+
+	listings := list("")
+	if len(listings) != 2 {
+		t.Fatalf("listed %+v; want the 2 public feeds", listings)
+	}
+	byPubkey := map[string]FeedListing{}
+	for _, listing := range listings {
+		byPubkey[listing.Pubkey] = listing
+	}
+	if listing := byPubkey[news]; listing.URL != srv.URL+"/news" || listing.Name != "Example News" || listing.Nip05 != "news@example.com" ||
+		!strings.HasPrefix(listing.Npub, "npub1") || listing.LastFetch == nil || listing.LastError != "" {
+		t.Errorf("news listed as %+v", listing)
+	}
+	// named after the feed itself, which was fetched when registering it
+	if listing := byPubkey[blog]; listing.Name != "test feed" || listing.LastError != "gone" {
+		t.Errorf("blog listed as %+v", listing)
+	}
+
+	if listings := list("?q=NEWS"); len(listings) != 1 || listings[0].Pubkey != news {
+		t.Errorf("?q=NEWS listed %+v; want only the news feed", listings)
+	}
+	if listings := list("?q=/blog"); len(listings) != 1 || listings[0].Pubkey != blog {
+		t.Errorf("?q=/blog listed %+v; want only the blog", listings)
+	}
+	if listings := list("?q=nothing"); len(listings) != 0 {
+		t.Errorf("?q=nothing listed %+v", listings)
+	}
+}
+
+func TestFeedDetailEndpoint(t *testing.T) {
+	setupTestRelay(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone" {
+			http.Error(w, "gone", 410)
+			return
+		}
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+	defer srv.Close()
+
+	pubkey, err := Feed(srv.URL+"/feed", relay.Secret, relay.db, FeedOptions{Meta: &Metadata{Name: "Example News"}})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+	relay.lastEmitted.Store(srv.URL+"/feed", nostr.Timestamp(1672758245))
+	saveEntity(relay.db, "private", Entity{URL: srv.URL + "/private", Private: true, Recipients: []string{pubkey}})
+
+	// GET and DELETE share the path
+	handler := routeHandlers(routes())["/feed/"]
+	request := func(method, pubkey string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(method, "/feed/"+pubkey, nil))
+		return rec
+	}
+
+	rec := request("GET", pubkey)
+	var detail FeedDetail
+	if rec.Code != 200 || json.Unmarshal(rec.Body.Bytes(), &detail) != nil {
+		t.Fatalf("GET /feed/%s = %d %s", pubkey, rec.Code, rec.Body)
+	}
+	if detail.URL != srv.URL+"/feed" || detail.Meta == nil || detail.Meta.Name != "Example News" || !strings.HasPrefix(detail.Npub, "npub1") ||
+		detail.LastEmitted != 1672758245 || detail.Items != 2 || detail.ParseError != "" {
+		t.Errorf("detail = %+v", detail)
+	}
+	if strings.Contains(rec.Body.String(), "PrivateKey") || strings.Contains(rec.Body.String(), "private_key") {
+		t.Errorf("GET /feed/%s leaks the private key: %s", pubkey, rec.Body)
+	}
+
+	saveEntity(relay.db, "gone", Entity{URL: srv.URL + "/gone"})
+	detail = FeedDetail{}
+	if rec := request("GET", "gone"); json.Unmarshal(rec.Body.Bytes(), &detail) != nil || detail.ParseError == "" || detail.Items != 0 {
+		t.Errorf("detail of a broken feed = %d %s; want its parse error", rec.Code, rec.Body)
+	}
+
+	for _, unknown := range []string{"unknown", "private", ""} {
+		if rec := request("GET", unknown); rec.Code != 404 {
+			t.Errorf("GET /feed/%s = %d; want 404", unknown, rec.Code)
+		}
+	}
+	if rec := request("DELETE", pubkey); rec.Code != 401 {
+		t.Errorf("DELETE without the admin token = %d; want 401", rec.Code)
+	}
+	if rec := request("PUT", pubkey); rec.Code != 405 {
+		t.Errorf("PUT = %d; want 405", rec.Code)
+	}
+}
+
+func TestCleanContent(t *testing.T) {
+	setupTestRelay(t)
+	article := "<p>" + strings.Repeat("é", maxItemContent) + "</p>"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprintf(w, `<?xml version="1.0"?>
+<rss version="2.0" xmlns:content="http://purl.org/rss/1.0/modules/content/"><channel><title>t</title>
+<item><title>short</title><link>https://example.com/short</link><content:encoded><![CDATA[<p>the whole story</p>]]></content:encoded></item>
+<item><title>long</title><link>https://example.com/long</link><content:encoded><![CDATA[%s]]></content:encoded></item>
+</channel></rss>`, article)
+	}))
+	defer srv.Close()
+
+	fullURL, plainURL := srv.URL+"/full", srv.URL+"/plain"
+	fullContentFeeds.Store(fullURL, true)
+	t.Cleanup(func() { fullContentFeeds.Delete(fullURL) })
+
+	plain, err := fetchAndCleanFeed(context.Background(), plainURL)
+	if err != nil {
+		t.Fatalf("fetchAndCleanFeed: %v", err)
+	}
+	for _, item := range plain.Items {
+		if item.Content != "" {
+			t.Errorf("%s kept its content", item.Title)
+		}
+	}
+
+	full, err := fetchAndCleanFeed(context.Background(), fullURL)
+	if err != nil {
+		t.Fatalf("fetchAndCleanFeed: %v", err)
+	}
+	if got := full.Items[0].Content; got != "<p>the whole story</p>" {
+		t.Errorf("content = %q; want it whole", got)
+	}
+	long := full.Items[1].Content
+	if len(long) > maxItemContent || len(long) < maxItemContent-1 || !utf8.ValidString(long) || !strings.HasPrefix(long, "<p>é") {
+		t.Errorf("long content of %d bytes, valid utf-8 %v; want it cut at %d", len(long), utf8.ValidString(long), maxItemContent)
+	}
+
+	// and the same when streaming
+	var streamed []string
+	if _, err := streamFeed(context.Background(), fullURL, func(item *gofeed.Item) bool {
+		streamed = append(streamed, item.Content)
+		return true
+	}); err != nil {
+		t.Fatalf("streamFeed: %v", err)
+	}
+	if len(streamed) != 2 || streamed[0] != "<p>the whole story</p>" || streamed[1] != long {
+		t.Errorf("streamed contents differ from the parsed ones")
+	}
+}
+
+func TestExportOPML(t *testing.T) {
+	setupTestRelay(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+	defer srv.Close()
+
+	if _, err := Feed(srv.URL+"/news", relay.Secret, relay.db, FeedOptions{Meta: &Metadata{Name: "News & Views"}}); err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+	saveEntity(relay.db, "unnamed", Entity{URL: srv.URL + "/unnamed"})
+	saveEntity(relay.db, "private", Entity{URL: srv.URL + "/private", Private: true})
+
+	rec := httptest.NewRecorder()
+	handleExportOPML(rec, httptest.NewRequest("GET", "/feeds/export.opml", nil))
+	if rec.Code != 200 || !strings.HasPrefix(rec.Header().Get("content-type"), "text/x-opml") ||
+		!strings.Contains(rec.Header().Get("content-disposition"), `filename="`+opmlFilename+`"`) {
+		t.Fatalf("GET /feeds/export.opml = %d %v", rec.Code, rec.Header())
+	}
+
+	var doc OPML
+	if err := xml.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid OPML: %v\n%s", err, rec.Body)
+	}
+	if doc.Version != "2.0" || len(doc.Feeds) != 2 {
+		t.Fatalf("exported %+v; want the 2 public feeds", doc)
+	}
+	byURL := map[string]OPMLOutline{}
+	for _, outline := range doc.Feeds {
+		byURL[outline.XMLURL] = outline
+	}
+	if outline := byURL[srv.URL+"/news"]; outline.Text != "News & Views" || outline.Title != "News & Views" || outline.Type != "rss" {
+		t.Errorf("news exported as %+v", outline)
+	}
+	if outline := byURL[srv.URL+"/unnamed"]; outline.Text != srv.URL+"/unnamed" {
+		t.Errorf("unnamed feed exported as %+v", outline)
+	}
+}
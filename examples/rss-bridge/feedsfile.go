@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// startupFeed is an entry of FEEDS_FILE, with its index there to tell which
+// one it was when registering it fails.
+type startupFeed struct {
+	index int
+	meta  Metadata
+}
+
+// readFeedsFile reads FEEDS_FILE, an array of the metadata POST /feed takes,
+// in YAML if its name ends in .yaml or .yml and in JSON otherwise. Only a file
+// that can't be read or isn't an array is an error, bad entries are logged
+// with their index and skipped.
+func readFeedsFile(path string) ([]startupFeed, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []json.RawMessage
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if entries, err = yamlEntries(data); err != nil {
+			return nil, fmt.Errorf("not a YAML array of feeds: %w", err)
+		}
+	default:
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("not a JSON array of feeds: %w", err)
+		}
+	}
+
+	list := make([]startupFeed, 0, len(entries))
+	for i, entry := range entries {
+		var meta Metadata
+		if err := json.Unmarshal(entry, &meta); err != nil {
+			logger.Warn("skipping bad entry of FEEDS_FILE", "index", i, "err", err)
+			continue
+		}
+		if err := meta.validate(); err != nil {
+			logger.Warn("skipping bad entry of FEEDS_FILE", "index", i, "err", err)
+			continue
+		}
+		list = append(list, startupFeed{i, meta})
+	}
+	return list, nil
+}
+
+// yamlEntries reads a YAML array, each entry turned into JSON so that it's
+// decoded by the json names of Metadata as the entries of a JSON file are. An
+// entry that can't be is left empty, to be skipped as bad.
+func yamlEntries(data []byte) ([]json.RawMessage, error) {
+	var values []any
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	entries := make([]json.RawMessage, len(values))
+	for i, value := range values {
+		entries[i], _ = json.Marshal(value)
+	}
+	return entries, nil
+}
+
+// registerStartupFeeds registers the feeds of FEEDS_FILE that aren't yet,
+// with their metadata as their profile, the same as POST /feed does. They are
+// all pinned, so MAX_FEEDS doesn't evict what the operator asked for.
+func registerStartupFeeds(list []startupFeed) {
+	for _, sf := range list {
+		meta := sf.meta
+		opts := FeedOptions{Pinned: true}
+		if profile := (Metadata{Name: meta.Name, Nip05: meta.Nip05, Picture: meta.Picture, Banner: meta.Banner}); profile != (Metadata{}) {
+			opts.Meta = &profile
+		}
+		pubkey, err := Feed(meta.URL, relay.Secret, relay.db, opts)
+		switch {
+		case errors.Is(err, ErrAlreadyRegistered):
+			// Feed leaves registered feeds alone, pinning them is up to us
+			if _, err := updateEntity(relay.db, pubkey, func(entity *Entity) { entity.Pinned = true }); err != nil {
+				logger.Warn("failed to pin feed of FEEDS_FILE", "index", sf.index, "url", meta.URL, "err", err)
+			}
+		case err != nil:
+			logger.Warn("failed to register feed of FEEDS_FILE", "index", sf.index, "url", meta.URL, "err", err)
+		default:
+			logger.Info("registered feed of FEEDS_FILE", "index", sf.index, "url", meta.URL, "pubkey", pubkey)
+		}
+	}
+}
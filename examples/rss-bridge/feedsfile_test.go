@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFeedsFile(t *testing.T) {
+	setupTestRelay(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "feeds.json")
+	os.WriteFile(path, []byte(`[
+		{"url": "`+srv.URL+`/news", "name": "Example News"},
+		{"name": "no url"},
+		{"url": "`+srv.URL+`/pic", "picture": "ftp://example.com/logo.png"},
+		{"url": "`+srv.URL+`/typo", "name": 3},
+		{"url": "`+srv.URL+`/gone"},
+		{"url": "`+srv.URL+`/blog"}
+	]`), 0o644)
+
+	startup, err := readFeedsFile(path)
+	if err != nil {
+		t.Fatalf("readFeedsFile: %v", err)
+	}
+	var indexes []int
+	for _, sf := range startup {
+		indexes = append(indexes, sf.index)
+	}
+	if fmt.Sprint(indexes) != "[0 4 5]" {
+		t.Fatalf("read entries %v; want [0 4 5]", indexes)
+	}
+
+	registerStartupFeeds(startup)
+	if n := countStored(t); n != 2 {
+		t.Fatalf("stored %d feeds, want 2", n)
+	}
+	pubkey, entity, ok := findFeedByURL(relay.db, srv.URL+"/news", "")
+	if !ok || entity.Meta == nil || entity.Meta.Name != "Example News" {
+		t.Errorf("news stored as %s %+v", pubkey, entity)
+	}
+	if !entity.Pinned {
+		t.Error("news wasn't pinned")
+	}
+
+	// registering them again on the next startup changes nothing, but pins
+	// those that were registered before they were listed
+	entity.Pinned = false
+	saveEntity(relay.db, pubkey, entity)
+	registerStartupFeeds(startup)
+	if n := countStored(t); n != 2 {
+		t.Errorf("stored %d feeds after a restart, want 2", n)
+	}
+	if entity, _ := loadEntity(relay.db, pubkey); !entity.Pinned {
+		t.Error("news wasn't pinned again")
+	}
+
+	os.WriteFile(path, []byte(`{"url": "`+srv.URL+`/news"}`), 0o644)
+	if _, err := readFeedsFile(path); err == nil {
+		t.Error("readFeedsFile took an object rather than an array")
+	}
+	if _, err := readFeedsFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("readFeedsFile took a missing file")
+	}
+}
+
+func TestFeedsFileYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "feeds.yml")
+	os.WriteFile(path, []byte(`
+- url: https://example.com/news
+  name: Example News
+  picture: https://example.com/logo.png
+- name: no url
+- url: https://example.com/typo
+  name: [3]
+- url: https://example.com/blog
+`), 0o644)
+
+	startup, err := readFeedsFile(path)
+	if err != nil {
+		t.Fatalf("readFeedsFile: %v", err)
+	}
+	var indexes []int
+	for _, sf := range startup {
+		indexes = append(indexes, sf.index)
+	}
+	if fmt.Sprint(indexes) != "[0 3]" {
+		t.Fatalf("read entries %v; want [0 3]", indexes)
+	}
+	if want := (Metadata{URL: "https://example.com/news", Name: "Example News", Picture: "https://example.com/logo.png"}); startup[0].meta != want {
+		t.Errorf("read %+v; want %+v", startup[0].meta, want)
+	}
+
+	os.WriteFile(path, []byte("url: https://example.com/news\n"), 0o644)
+	if _, err := readFeedsFile(path); err == nil {
+		t.Error("readFeedsFile took a mapping rather than a sequence")
+	}
+}
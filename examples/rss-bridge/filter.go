@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"unicode/utf8"
+
+	strip "github.com/grokify/html-strip-tags-go"
+	"github.com/mmcdole/gofeed"
+)
+
+// keepItem tells whether an item is worth bridging at all.
+func keepItem(item *gofeed.Item) bool {
+	if relay.MinContentLength > 0 && utf8.RuneCountInString(itemText(item)) < relay.MinContentLength {
+		return false
+	}
+	if len(relay.CategoryFilter) > 0 && !hasCategory(item, relay.CategoryFilter) {
+		return false
+	}
+	return true
+}
+
+// hasCategory tells whether any of the categories of item is one of categories,
+// ignoring case and surrounding spaces.
+func hasCategory(item *gofeed.Item, categories []string) bool {
+	for _, category := range item.Categories {
+		for _, wanted := range categories {
+			if strings.EqualFold(strings.TrimSpace(category), strings.TrimSpace(wanted)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// itemText is the description of item without markup, treating placeholder
+// content made only of whitespace and ellipses as empty.
+func itemText(item *gofeed.Item) string {
+	text := strings.TrimSpace(strip.StripTags(item.Description))
+	if strings.Trim(text, " \t\r\n.…") == "" {
+		return ""
+	}
+	return text
+}
+
+// dedupeItems drops the items that repeat an earlier one of the same feed,
+// by link or by title and content, as feeds listing a story under several
+// sections do.
+func dedupeItems(items []*gofeed.Item) []*gofeed.Item {
+	d := newItemDeduper(len(items))
+	kept := items[:0]
+	for _, item := range items {
+		if !d.seen(item) {
+			kept = append(kept, item)
+		}
+	}
+
+	return kept
+}
+
+// itemDeduper remembers the items of a feed, see dedupeItems.
+type itemDeduper struct {
+	links  map[string]bool
+	hashes map[[32]byte]bool
+}
+
+func newItemDeduper(size int) *itemDeduper {
+	return &itemDeduper{
+		links:  make(map[string]bool, size),
+		hashes: make(map[[32]byte]bool, size),
+	}
+}
+
+// seen tells whether item repeats one seen before, remembering it if not.
+func (d *itemDeduper) seen(item *gofeed.Item) bool {
+	link := ""
+	if item.Link != "" {
+		link = canonicalFeedKey(cleanLink(strings.TrimSpace(item.Link), relay.LinkParams))
+	}
+
+	var hash [32]byte
+	title := strings.ToLower(strings.TrimSpace(item.Title))
+	text := strings.TrimSpace(strip.StripTags(item.Description + item.Content))
+	hasText := title != "" || text != ""
+	if hasText {
+		hash = sha256.Sum256([]byte(title + "\n" + text))
+	}
+
+	if (link != "" && d.links[link]) || (hasText && d.hashes[hash]) {
+		return true
+	}
+	if link != "" {
+		d.links[link] = true
+	}
+	if hasText {
+		d.hashes[hash] = true
+	}
+	return false
+}
+
+// hashLinkParams are the tracking parameters contentHash drops from links. It
+// doesn't follow LINK_PARAMS so that the hash is the same on every bridge.
+var hashLinkParams = []string{"utm_*", "fbclid", "gclid", "dclid", "msclkid",
+	"mc_cid", "mc_eid", "_hsenc", "_hsmi", "igshid", "yclid"}
+
+// contentHash identifies an item across bridges, for clients to dedupe the notes
+// different bridges make of it. It is the hex sha256 of the normalized title and
+// link joined by a newline:
+//
+//   - the title as found in the feed, lowercased, with whitespace runs turned
+//     into single spaces and trimmed.
+//   - the link without the hashLinkParams, scheme, "www.", default port,
+//     trailing slash and fragment, as in canonicalFeedKey.
+//
+// The item's dates aren't part of it since feeds change them on every edit.
+// Items with neither title nor link get no hash.
+func contentHash(item *gofeed.Item) string {
+	title := strings.Join(strings.Fields(strings.ToLower(item.Title)), " ")
+	link := ""
+	if item.Link != "" {
+		link = canonicalFeedKey(cleanLink(strings.TrimSpace(item.Link), hashLinkParams))
+	}
+	if title == "" && link == "" {
+		return ""
+	}
+
+	hash := sha256.Sum256([]byte(title + "\n" + link))
+	return hex.EncodeToString(hash[:])
+}
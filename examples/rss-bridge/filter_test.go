@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestKeepItemMinContentLength(t *testing.T) {
+	relay.MinContentLength = 20
+	defer func() { relay.MinContentLength = 0 }()
+
+	feed, err := fp.Parse(strings.NewReader(`<?xml version="1.0"?>
+<rss version="2.0"><channel><title>test</title>
+<item><title>empty</title><link>https://example.com/1</link><description></description></item>
+<item><title>placeholder</title><link>https://example.com/2</link><description><![CDATA[<p> … </p>]]></description></item>
+<item><title>short</title><link>https://example.com/3</link><description>too short</description></item>
+<item><title>substantive</title><link>https://example.com/4</link><description><![CDATA[<p>This one has <b>enough</b> text to be worth bridging.</p>]]></description></item>
+</channel></rss>`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	var kept []string
+	for _, item := range feed.Items {
+		if keepItem(item) {
+			kept = append(kept, item.Title)
+		}
+	}
+	if len(kept) != 1 || kept[0] != "substantive" {
+		t.Errorf("kept %v; want only the substantive item", kept)
+	}
+
+	relay.MinContentLength = 0
+	for _, item := range feed.Items {
+		if !keepItem(item) {
+			t.Errorf("%s was skipped with no minimum set", item.Title)
+		}
+	}
+}
+
+func TestKeepItemCategoryFilter(t *testing.T) {
+	defer func() { relay.CategoryFilter, relay.MinContentLength = nil, 0 }()
+
+	feed, err := fp.Parse(strings.NewReader(`<?xml version="1.0"?>
+<rss version="2.0"><channel><title>test</title>
+<item><title>gadgets</title><link>https://example.com/1</link><description>a new phone was announced today</description><category>Technology</category></item>
+<item><title>elections</title><link>https://example.com/2</link><description>the votes are being counted</description><category>Politics</category></item>
+<item><title>chips</title><link>https://example.com/3</link><description>short</description><category>World</category><category> technology </category></item>
+<item><title>uncategorized</title><link>https://example.com/4</link><description>nothing to file this under</description></item>
+</channel></rss>`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	kept := func() (titles []string) {
+		for _, item := range feed.Items {
+			if keepItem(item) {
+				titles = append(titles, item.Title)
+			}
+		}
+		return titles
+	}
+
+	relay.CategoryFilter = []string{"TECHNOLOGY", "science"}
+	if got := kept(); fmt.Sprint(got) != "[gadgets chips]" {
+		t.Errorf("kept %v; want the technology items", got)
+	}
+
+	// both filters have to let an item through
+	relay.MinContentLength = 10
+	if got := kept(); fmt.Sprint(got) != "[gadgets]" {
+		t.Errorf("kept %v with a minimum length; want only gadgets", got)
+	}
+
+	relay.CategoryFilter, relay.MinContentLength = nil, 0
+	if got := kept(); len(got) != len(feed.Items) {
+		t.Errorf("kept %v with no filter; want everything", got)
+	}
+}
+
+func TestDedupeItems(t *testing.T) {
+	setupTestRelay(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>sections</title>
+<item><title>Story</title><link>https://example.com/story</link><description>the story</description><pubDate>Mon, 02 Jan 2023 15:04:05 GMT</pubDate></item>
+<item><title>Story, in Politics</title><link>https://www.example.com/story/?utm_source=politics</link><description>the story again</description><pubDate>Mon, 02 Jan 2023 15:05:05 GMT</pubDate></item>
+<item><title>story</title><link>https://example.com/story?section=world</link><description><![CDATA[<p>the story</p>]]></description><pubDate>Mon, 02 Jan 2023 15:06:05 GMT</pubDate></item>
+<item><title>Another story</title><link>https://example.com/another</link><description>something else</description><pubDate>Tue, 03 Jan 2023 15:04:05 GMT</pubDate></item>
+</channel></rss>`)
+	}))
+	defer srv.Close()
+
+	defer func(params []string) { relay.LinkParams = params }(relay.LinkParams)
+	relay.LinkParams = []string{"utm_*"}
+
+	pubkey, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{FullHistory: true})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+
+	updates := make(chan nostr.Event, 10)
+	p := newPoller(pollerConfig{DB: relay.db, LastEmitted: &sync.Map{}, Updates: updates})
+	p.poll(context.Background(), nostr.Filters{{Authors: []string{pubkey}, Kinds: []int{nostr.KindTextNote}}})
+	close(updates)
+
+	var titles []string
+	for evt := range updates {
+		titles = append(titles, strings.SplitN(evt.Content, "\n", 2)[0])
+	}
+	sort.Strings(titles)
+	if want := []string{"**Another story**", "**Story**"}; fmt.Sprint(titles) != fmt.Sprint(want) {
+		t.Errorf("bridged %v; want %v", titles, want)
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	defer func(enabled, strip bool, params []string, rules TitleRewrites) {
+		relay.ContentHash, relay.StripLinkParams, relay.LinkParams, relay.TitleRewrites = enabled, strip, params, rules
+	}(relay.ContentHash, relay.StripLinkParams, relay.LinkParams, relay.TitleRewrites)
+	relay.ContentHash = true
+
+	hashTag := func(evt nostr.Event) string {
+		if tag := evt.Tags.GetFirst([]string{"content-hash", ""}); tag != nil {
+			return tag.Value()
+		}
+		return ""
+	}
+
+	// one bridge with the defaults
+	published := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)
+	first := hashTag(itemToTextNote("pubkey1", &gofeed.Item{
+		Title:           "Story  Title",
+		Link:            "https://example.com/a/story?id=1",
+		PublishedParsed: &published,
+	}, defaultNoteTemplate))
+
+	// another, configured differently, seeing the item later in another feed
+	relay.StripLinkParams = false
+	relay.LinkParams = []string{"id"}
+	if err := relay.TitleRewrites.Decode("^Story => News"); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	linkOnly, err := parseContentTemplate("{{.Link}}")
+	if err != nil {
+		t.Fatalf("parseContentTemplate: %v", err)
+	}
+	updated := published.Add(time.Hour)
+	second := hashTag(itemToTextNote("pubkey2", &gofeed.Item{
+		Title:           "\n story title ",
+		Link:            "http://www.example.com:80/a/story/?id=1&utm_source=rss#comments",
+		PublishedParsed: &updated,
+	}, linkOnly))
+
+	want := sha256.Sum256([]byte("story title\nexample.com/a/story?id=1"))
+	if first != hex.EncodeToString(want[:]) {
+		t.Errorf("content-hash = %q; want %x", first, want)
+	}
+	if second != first {
+		t.Errorf("content-hash = %q on the second bridge; want %q", second, first)
+	}
+
+	if other := contentHash(&gofeed.Item{Title: "Story Title", Link: "https://example.com/a/story?id=2"}); other == first {
+		t.Errorf("items with different links share the hash %q", other)
+	}
+	if empty := contentHash(&gofeed.Item{}); empty != "" {
+		t.Errorf("contentHash of an empty item = %q; want none", empty)
+	}
+
+	relay.ContentHash = false
+	if tag := hashTag(itemToTextNote("pubkey1", &gofeed.Item{Title: "Story Title"}, defaultNoteTemplate)); tag != "" {
+		t.Errorf("content-hash = %q with CONTENT_HASH unset; want none", tag)
+	}
+}
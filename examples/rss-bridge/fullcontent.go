@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"unicode/utf8"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/mmcdole/gofeed"
+)
+
+// fullContentFeeds has the urls of the feeds registered with FullContent,
+// whose items keep their Content when fetched.
+var fullContentFeeds sync.Map
+
+func loadFullContentFeeds(db *pebble.DB) error {
+	return skipCorrupt(ForEachEntity(db, func(stored StoredEntity) error {
+		if stored.Entity.FullContent && stored.Entity.MovedTo == "" {
+			fullContentFeeds.Store(stored.Entity.URL, true)
+		}
+		return nil
+	}))
+}
+
+// keepsContent tells whether the items of the feed at url keep their Content,
+// which is otherwise dropped to not store too much.
+func keepsContent(url string) bool {
+	_, ok := fullContentFeeds.Load(url)
+	return ok
+}
+
+// maxItemContent caps, in bytes, the Content kept of each item of
+// FullContent feeds, so caching them doesn't take too much memory. It leaves
+// plenty of html for notes of FULL_CONTENT_MAX_LENGTH characters.
+const maxItemContent = 256 << 10
+
+// cleanContent drops the Content of item, from the feed at url, unless the
+// feed keeps it, in which case it is cut at maxItemContent.
+func cleanContent(url string, item *gofeed.Item) {
+	if !keepsContent(url) {
+		item.Content = ""
+		return
+	}
+	if len(item.Content) > maxItemContent {
+		cut := maxItemContent
+		for cut > 0 && !utf8.RuneStart(item.Content[cut]) {
+			cut--
+		}
+		item.Content = item.Content[:cut]
+	}
+}
+
+// noteLength is how long the note of item can get: FULL_CONTENT_MAX_LENGTH
+// for the items of FullContent feeds, the only ones with a Content, else
+// maxNoteLength.
+func noteLength(item *gofeed.Item) int {
+	if item.Content != "" && relay.FullContentMaxLength > maxNoteLength {
+		return relay.FullContentMaxLength
+	}
+	return maxNoteLength
+}
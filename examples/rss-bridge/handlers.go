@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/cockroachdb/pebble"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
 	. "github.com/stevelacy/daz"
 )
 
@@ -21,25 +26,23 @@ var head = H("head",
 
 func handleWebpage(w http.ResponseWriter, r *http.Request) {
 	items := make([]HTML, 0, 200)
-	iter := relay.db.NewIter(nil)
-	for iter.First(); iter.Valid(); iter.Next() {
-		pubkey := string(iter.Key())
-		var entity Entity
-		if err := json.Unmarshal(iter.Value(), &entity); err != nil {
-			continue
+	ForEachEntity(relay.db, func(stored StoredEntity) error {
+		if stored.Entity.Private {
+			return nil
 		}
 		items = append(items, H("tr",
 			H("td",
 				H("code",
-					pubkey),
+					stored.Pubkey),
 			),
 			H("td",
 				H("a", Attr{
-					"href": entity.URL,
-				}, entity.URL),
+					"href": stored.Entity.URL,
+				}, stored.Entity.URL),
 			),
 		))
-	}
+		return nil
+	})
 
 	body := H("body",
 		H("h1", "rsslay"),
@@ -89,42 +92,314 @@ func handleWebpage(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleCreateFeed(w http.ResponseWriter, r *http.Request) {
-	url := r.URL.Query().Get("url")
+	url := r.FormValue("url")
+
+	// credentials are better POSTed, so they stay out of access logs
+	auth, err := parseFeedAuth(r.FormValue("auth"), r.FormValue("auth_name"), r.FormValue("auth_credential"))
+	if err != nil {
+		httpError(w, r, 400, err.Error())
+		return
+	}
+
+	insecure := r.FormValue("insecure_skip_verify") == "true"
+	if insecure && !relay.AllowInsecureFeeds {
+		httpError(w, r, 403, "feeds with unverified certificates are not allowed here")
+		return
+	}
+
+	// a private feed hides its url from everyone else, so anyone registering
+	// one could keep a public feed out of the bridge
+	private := r.FormValue("private") == "true"
+	if private && !isAdmin(r) {
+		httpError(w, r, 403, "private feeds can only be registered with the ADMIN_TOKEN")
+		return
+	}
+
+	r.ParseForm()
+	recipients, err := parseRecipients(r.Form["recipient"])
+	if err != nil {
+		httpError(w, r, 400, err.Error())
+		return
+	}
+
+	pubkey, err := Feed(url, relay.Secret, relay.db, FeedOptions{
+		ContentTemplate:    r.FormValue("template"),
+		FullHistory:        r.FormValue("history") == "full",
+		FullContent:        r.FormValue("content") == "full",
+		Auth:               auth,
+		InsecureSkipVerify: insecure,
+		Private:            private,
+		Recipients:         recipients,
+	})
+	existing := errors.Is(err, ErrAlreadyRegistered)
+	switch {
+	case errors.Is(err, ErrNoFeedFound), errors.Is(err, ErrBadFeed), errors.Is(err, ErrBadTemplate), errors.Is(err, ErrBadRecipient):
+		httpError(w, r, 400, err.Error())
+		return
+	case errors.Is(err, ErrPreviewNotPermitted):
+		httpError(w, r, 403, err.Error())
+		return
+	case errors.Is(err, ErrPageTooLarge):
+		httpError(w, r, 413, err.Error())
+		return
+	case err != nil && !existing:
+		httpError(w, r, 500, err.Error())
+		return
+	}
 
-	feedurl := getFeedURL(url)
-	if feedurl == "" {
-		w.WriteHeader(400)
-		fmt.Fprint(w, "couldn't find a feed url")
+	entity, err := loadEntity(relay.db, pubkey)
+	if err != nil {
+		httpError(w, r, 500, err.Error())
+		return
+	}
+	if existing && entity.Private {
+		// as if it weren't there, like everywhere else
+		httpError(w, r, 400, ErrNoFeedFound.Error())
+		return
+	}
+
+	if existing {
+		requestLogger(r.Context()).Info("feed already registered", "url", url, "registered_url", entity.URL, "pubkey", pubkey)
+		fmt.Fprintf(w, "url   : %s\npubkey: %s\n(already registered)", entity.URL, pubkey)
 		return
 	}
 
-	if _, err := parseFeed(feedurl); err != nil {
-		w.WriteHeader(400)
-		fmt.Fprint(w, "bad feed: "+err.Error())
+	if insecure {
+		requestLogger(r.Context()).Warn("saved feed without certificate verification", "url", entity.URL, "pubkey", pubkey)
+	} else {
+		requestLogger(r.Context()).Info("saved feed", "url", entity.URL, "pubkey", pubkey)
+	}
+
+	fmt.Fprintf(w, "url   : %s\npubkey: %s", entity.URL, pubkey)
+}
+
+// FeedRegistration is what POST /feed answers with.
+type FeedRegistration struct {
+	URL    string `json:"url"`
+	Pubkey string `json:"pubkey"`
+	Npub   string `json:"npub"`
+	// Existing is set when the feed was already registered, in which case
+	// nothing about it was changed.
+	Existing bool `json:"existing,omitempty"`
+}
+
+// handleRegisterFeed is /create for programs. It takes a Metadata as JSON,
+// whose url is the feed's and the rest overrides the feed's profile.
+func handleRegisterFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, 405, "method not allowed")
+		return
+	}
+
+	var meta Metadata
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&meta); err != nil {
+		httpError(w, r, 400, "invalid metadata: "+err.Error())
+		return
+	}
+	if err := meta.validate(); err != nil {
+		httpError(w, r, 400, err.Error())
+		return
+	}
+
+	opts := FeedOptions{}
+	// the profile keeps the feed's homepage as its website
+	if profile := (Metadata{Name: meta.Name, Nip05: meta.Nip05, Picture: meta.Picture, Banner: meta.Banner}); profile != (Metadata{}) {
+		opts.Meta = &profile
+	}
+	pubkey, err := Feed(meta.URL, relay.Secret, relay.db, opts)
+	existing := errors.Is(err, ErrAlreadyRegistered)
+	switch {
+	case errors.Is(err, ErrNoFeedFound), errors.Is(err, ErrBadFeed):
+		httpError(w, r, 400, err.Error())
+		return
+	case errors.Is(err, ErrPreviewNotPermitted):
+		httpError(w, r, 403, err.Error())
+		return
+	case errors.Is(err, ErrPageTooLarge):
+		httpError(w, r, 413, err.Error())
+		return
+	case err != nil && !existing:
+		httpError(w, r, 500, err.Error())
 		return
 	}
 
-	sk := privateKeyFromFeed(feedurl)
-	pubkey, err := nostr.GetPublicKey(sk)
+	entity, err := loadEntity(relay.db, pubkey)
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprint(w, "bad private key: "+err.Error())
+		httpError(w, r, 500, err.Error())
+		return
+	}
+	if existing && entity.Private {
+		// as if it weren't there, like everywhere else
+		httpError(w, r, 400, ErrNoFeedFound.Error())
 		return
 	}
+	npub, _ := nip19.EncodePublicKey(pubkey)
+
+	w.Header().Set("content-type", "application/json")
+	if existing {
+		requestLogger(r.Context()).Info("feed already registered", "url", meta.URL, "registered_url", entity.URL, "pubkey", pubkey)
+	} else {
+		requestLogger(r.Context()).Info("saved feed", "url", entity.URL, "pubkey", pubkey)
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(FeedRegistration{URL: entity.URL, Pubkey: pubkey, Npub: npub, Existing: existing})
+}
 
-	j, _ := json.Marshal(Entity{
-		PrivateKey: sk,
-		URL:        feedurl,
+// FeedListing is a feed as GET /feeds lists it. Name and Picture come from
+// the feed itself when it was fetched lately and the profile doesn't override
+// them.
+type FeedListing struct {
+	Pubkey    string     `json:"pubkey"`
+	Npub      string     `json:"npub"`
+	URL       string     `json:"url"`
+	Name      string     `json:"name,omitempty"`
+	Nip05     string     `json:"nip05,omitempty"`
+	Picture   string     `json:"picture,omitempty"`
+	LastFetch *time.Time `json:"last_fetch,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// listFeeds lists the public feeds whose name or url contains q, ignoring
+// case, or all of them if q is empty.
+func listFeeds(db *pebble.DB, q string) ([]FeedListing, error) {
+	q = strings.ToLower(q)
+	listings := []FeedListing{}
+	err := ForEachEntity(db, func(stored StoredEntity) error {
+		entity := stored.Entity
+		if entity.Private || entity.MovedTo != "" {
+			return nil
+		}
+
+		listing := FeedListing{Pubkey: stored.Pubkey, URL: entity.URL}
+		listing.Npub, _ = nip19.EncodePublicKey(stored.Pubkey)
+		if feed, ok := feeds.Peek(entity.URL); ok {
+			listing.Name = feed.Title
+			if feed.Image != nil {
+				listing.Picture = feed.Image.URL
+			}
+		}
+		if meta := entity.Meta; meta != nil {
+			listing.Nip05 = meta.Nip05
+			if meta.Name != "" {
+				listing.Name = meta.Name
+			}
+			if meta.Picture != "" {
+				listing.Picture = meta.Picture
+			}
+		}
+		if health, ok := getFeedHealth(entity.URL); ok {
+			listing.LastFetch = &health.LastFetch
+			listing.LastError = health.LastError
+		}
+
+		if q != "" && !strings.Contains(strings.ToLower(listing.Name), q) && !strings.Contains(strings.ToLower(listing.URL), q) {
+			return nil
+		}
+		listings = append(listings, listing)
+		return nil
 	})
+	return listings, skipCorrupt(err)
+}
+
+func handleListFeeds(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, r, 405, "method not allowed")
+		return
+	}
+
+	listings, err := listFeeds(relay.db, r.URL.Query().Get("q"))
+	if err != nil {
+		httpError(w, r, 500, err.Error())
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(listings)
+}
+
+// feedDetailTimeout bounds how long GET /feed/{pubkey} waits for the feed
+// to be fetched.
+const feedDetailTimeout = 10 * time.Second
+
+// FeedDetail is what GET /feed/{pubkey} answers with.
+type FeedDetail struct {
+	Pubkey string    `json:"pubkey"`
+	Npub   string    `json:"npub"`
+	URL    string    `json:"url"`
+	Meta   *Metadata `json:"meta,omitempty"`
+	// LastEmitted is the created_at of the newest note emitted, the feed's
+	// watermark, if any was.
+	LastEmitted nostr.Timestamp `json:"last_emitted,omitempty"`
+	// Items is how many items the feed has, if it parses, else ParseError
+	// tells why not.
+	Items      int    `json:"items"`
+	ParseError string `json:"parse_error,omitempty"`
+	// MovedTo is set for feeds whose key was rotated, which aren't parsed.
+	MovedTo string `json:"moved_to,omitempty"`
+}
+
+// handleFeedDetail shows what the bridge has of the public feed under the
+// pubkey at the end of the path, parsing it again if it isn't cached.
+func handleFeedDetail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, r, 405, "method not allowed")
+		return
+	}
 
-	if err := relay.db.Set([]byte(pubkey), j, nil); err != nil {
-		w.WriteHeader(500)
-		fmt.Fprint(w, "failure: "+err.Error())
+	pubkey := strings.TrimPrefix(r.URL.Path, "/feed/")
+	entity, err := loadEntity(relay.db, pubkey)
+	if err == pebble.ErrNotFound || (err == nil && entity.Private) {
+		httpError(w, r, 404, "unknown feed")
+		return
+	} else if err != nil {
+		httpError(w, r, 500, err.Error())
 		return
 	}
 
-	log.Printf("saved feed at url %q as pubkey %s", feedurl, pubkey)
+	detail := FeedDetail{Pubkey: pubkey, URL: entity.URL, Meta: entity.Meta, MovedTo: entity.MovedTo}
+	detail.Npub, _ = nip19.EncodePublicKey(pubkey)
+	if entity.MovedTo == "" {
+		if last, ok := relay.lastEmitted.Load(entity.URL); ok {
+			detail.LastEmitted = last.(nostr.Timestamp)
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), feedDetailTimeout)
+		defer cancel()
+		if feed, err := parseFeed(ctx, entity.URL); err != nil {
+			detail.ParseError = err.Error()
+		} else {
+			detail.Items = len(feed.Items)
+		}
+	}
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(detail)
+}
+
+// FeedRemoval is what DELETE /feed/{pubkey} answers with.
+type FeedRemoval struct {
+	URL    string `json:"url"`
+	Pubkey string `json:"pubkey"`
+}
+
+// handleDeleteFeed takes the feed under the pubkey at the end of the path out
+// of the bridge, see removeFeed. Its profile and notes are gone right away.
+func handleDeleteFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		httpError(w, r, 405, "method not allowed")
+		return
+	}
+
+	pubkey := strings.TrimPrefix(r.URL.Path, "/feed/")
+	entity, err := removeFeed(relay.db, pubkey)
+	if err == pebble.ErrNotFound {
+		httpError(w, r, 404, "unknown feed")
+		return
+	} else if err != nil {
+		httpError(w, r, 500, err.Error())
+		return
+	}
 
-	fmt.Fprintf(w, "url   : %s\npubkey: %s", feedurl, pubkey)
-	return
+	requestLogger(r.Context()).Info("removed feed", "url", entity.URL, "pubkey", pubkey)
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(FeedRemoval{URL: entity.URL, Pubkey: pubkey})
 }
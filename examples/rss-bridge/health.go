@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// FeedHealth is what we know about the last attempt to fetch a feed.
+type FeedHealth struct {
+	LastFetch time.Time `json:"last_fetch"`
+	LastError string    `json:"last_error,omitempty"`
+	// TLSError is set when LastError is the feed's certificate being refused, see tlsErrorKind.
+	TLSError string   `json:"tls_error,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+	// Dropped counts the new items that weren't emitted because of FEED_INJECT_RATE.
+	Dropped int64 `json:"dropped,omitempty"`
+	// LastNewItem is the date of the feed's newest item, known once it's polled.
+	LastNewItem time.Time `json:"last_new_item,omitempty"`
+	// Stale is set when that is older than STALE_FEED_THRESHOLD.
+	Stale bool `json:"stale,omitempty"`
+}
+
+var (
+	feedHealth sync.Map // feed url -> FeedHealth
+	// feedHealthMu is held to update an entry of feedHealth from its previous value.
+	feedHealthMu sync.Mutex
+)
+
+func recordFetch(url string, warnings []string, err error) {
+	feedHealthMu.Lock()
+	defer feedHealthMu.Unlock()
+
+	previous, _ := getFeedHealth(url)
+	health := FeedHealth{
+		LastFetch: time.Now(),
+		Warnings:  warnings,
+		Dropped:   previous.Dropped,
+
+		LastNewItem: previous.LastNewItem,
+	}
+	if err != nil {
+		health.LastError = err.Error()
+		health.TLSError = tlsErrorKind(err)
+	}
+	feedHealth.Store(url, health)
+}
+
+func recordDropped(url string, n int) {
+	feedHealthMu.Lock()
+	defer feedHealthMu.Unlock()
+
+	health, _ := getFeedHealth(url)
+	health.Dropped += int64(n)
+	feedHealth.Store(url, health)
+}
+
+func recordNewItem(url string, date time.Time) {
+	feedHealthMu.Lock()
+	defer feedHealthMu.Unlock()
+
+	health, _ := getFeedHealth(url)
+	health.LastNewItem = date
+	feedHealth.Store(url, health)
+}
+
+func getFeedHealth(url string) (FeedHealth, bool) {
+	if health, ok := feedHealth.Load(url); ok {
+		return health.(FeedHealth), true
+	}
+	return FeedHealth{}, false
+}
+
+// HealthReport is what /health answers with.
+type HealthReport struct {
+	Feeds map[string]FeedHealth `json:"feeds"`
+	Cache CacheStats            `json:"cache"`
+}
+
+// handleHealth writes the HealthReport. /health is public, so the feeds that
+// are only registered as private ones, whose urls aren't listed anywhere else,
+// are left out.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	private, err := privateFeedURLs(relay.db)
+	if err != nil {
+		httpError(w, r, 500, err.Error())
+		return
+	}
+
+	report := HealthReport{
+		Feeds: make(map[string]FeedHealth),
+		Cache: feeds.Stats(),
+	}
+	now := time.Now()
+	feedHealth.Range(func(key, value any) bool {
+		if private[key.(string)] {
+			return true
+		}
+		health := value.(FeedHealth)
+		health.Stale = relay.StaleFeedThreshold > 0 && !health.LastNewItem.IsZero() &&
+			now.Sub(health.LastNewItem) > relay.StaleFeedThreshold
+		report.Feeds[key.(string)] = health
+		return true
+	})
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// privateFeedURLs are the urls of the feeds registered as private ones only.
+func privateFeedURLs(db *pebble.DB) (map[string]bool, error) {
+	private := make(map[string]bool)
+	public := make(map[string]bool)
+	err := ForEachEntity(db, func(stored StoredEntity) error {
+		if stored.Entity.Private {
+			private[stored.Entity.URL] = true
+		} else {
+			public[stored.Entity.URL] = true
+		}
+		return nil
+	})
+	if err := skipCorrupt(err); err != nil {
+		return nil, err
+	}
+	for url := range public {
+		delete(private, url)
+	}
+	return private, nil
+}
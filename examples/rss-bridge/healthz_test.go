@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+type healthzReport struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentHealth `json:"components"`
+}
+
+func getHealthz(t *testing.T, h http.Handler) (int, healthzReport) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	var report healthzReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return w.Code, report
+}
+
+func TestHealthz(t *testing.T) {
+	defer atomic.StoreInt64(&lastPollPass, atomic.LoadInt64(&lastPollPass))
+	atomic.StoreInt64(&lastPollPass, 0)
+
+	db, err := pebble.Open("", &pebble.Options{FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatalf("pebble.Open: %v", err)
+	}
+	started := time.Now()
+	h := newHealthChecker(0, map[string]func() ComponentHealth{
+		"db":     func() ComponentHealth { return checkDB(db) },
+		"poller": func() ComponentHealth { return checkPoller(started, time.Minute) },
+	})
+
+	// no pass yet, but it's early
+	code, report := getHealthz(t, h)
+	if code != http.StatusOK || report.Status != "ok" || !report.Components["db"].Healthy || !report.Components["poller"].Healthy {
+		t.Errorf("healthz = %d %+v; want everything ok", code, report)
+	}
+
+	// the poller is wedged
+	recordPollPass(time.Now().Add(-time.Hour))
+	code, report = getHealthz(t, h)
+	if poller := report.Components["poller"]; code != http.StatusServiceUnavailable || report.Status != "unhealthy" ||
+		poller.Healthy || poller.Error == "" || poller.LastSuccess == nil || poller.MaxAge != "1m0s" {
+		t.Errorf("healthz = %d %+v; want the poller unhealthy", code, report)
+	}
+	if !report.Components["db"].Healthy {
+		t.Errorf("db = %+v; want it healthy", report.Components["db"])
+	}
+
+	recordPollPass(time.Now())
+	if code, report = getHealthz(t, h); code != http.StatusOK {
+		t.Errorf("healthz = %d %+v after a pass; want ok", code, report)
+	}
+
+	// the db is gone
+	db.Close()
+	code, report = getHealthz(t, h)
+	if status := report.Components["db"]; code != http.StatusServiceUnavailable || status.Healthy || status.Error == "" {
+		t.Errorf("healthz = %d %+v; want the db unhealthy", code, report)
+	}
+}
+
+func TestHealthzCached(t *testing.T) {
+	var checks int64
+	h := newHealthChecker(time.Hour, map[string]func() ComponentHealth{
+		"counted": func() ComponentHealth {
+			atomic.AddInt64(&checks, 1)
+			return ComponentHealth{Healthy: true}
+		},
+	})
+	for i := 0; i < 3; i++ {
+		getHealthz(t, h)
+	}
+	if n := atomic.LoadInt64(&checks); n != 1 {
+		t.Errorf("checked %d times; want the result reused", n)
+	}
+}
@@ -2,19 +2,71 @@ package main
 
 import (
 	"net/url"
-	"path"
+	"strings"
 )
 
-func urljoin(baseUrl string, elem ...string) (result string, err error) {
-	u, err := url.Parse(baseUrl)
+// urljoin resolves href against baseUrl the way a browser would, so root-relative,
+// parent-relative and protocol-relative hrefs work and their query is kept.
+func urljoin(baseUrl string, href string) (result string, err error) {
+	base, err := url.Parse(baseUrl)
 	if err != nil {
 		return
 	}
 
-	if len(elem) > 0 {
-		elem = append([]string{u.Path}, elem...)
-		u.Path = path.Join(elem...)
+	u, err := base.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return
 	}
 
 	return u.String(), nil
 }
+
+// canonicalFeedKey normalizes a feed url so that variants pointing to the same
+// feed (http/https, www or not, trailing slash, default port) compare equal.
+func canonicalFeedKey(feedUrl string) string {
+	u, err := url.Parse(strings.TrimSpace(feedUrl))
+	if err != nil || u.Host == "" {
+		return feedUrl
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host += ":" + port
+	}
+
+	key := host + strings.TrimSuffix(u.EscapedPath(), "/")
+	if u.RawQuery != "" {
+		key += "?" + u.RawQuery
+	}
+	return key
+}
+
+// cleanLink removes tracking query parameters from link. Names in params ending
+// with "*" match any parameter with that prefix.
+func cleanLink(link string, params []string) string {
+	u, err := url.Parse(link)
+	if err != nil || u.RawQuery == "" {
+		return link
+	}
+
+	// filter the raw pairs so the remaining ones keep their order and encoding
+	kept := make([]string, 0, strings.Count(u.RawQuery, "&")+1)
+	for _, pair := range strings.Split(u.RawQuery, "&") {
+		name, _, _ := strings.Cut(pair, "=")
+		if name, err := url.QueryUnescape(name); err != nil || !matchesParam(name, params) {
+			kept = append(kept, pair)
+		}
+	}
+	u.RawQuery = strings.Join(kept, "&")
+
+	return u.String()
+}
+
+func matchesParam(name string, params []string) bool {
+	for _, param := range params {
+		if name == param || (strings.HasSuffix(param, "*") && strings.HasPrefix(name, param[:len(param)-1])) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestCleanLink(t *testing.T) {
+	params := []string{"utm_*", "fbclid"}
+	var tests = []struct {
+		link string
+		want string
+	}{
+		{"https://example.com/post?utm_source=rss&utm_medium=feed", "https://example.com/post"},
+		{"https://example.com/post?id=42&utm_source=rss&fbclid=abc", "https://example.com/post?id=42"},
+		{"https://example.com/watch?v=xyz&t=10", "https://example.com/watch?v=xyz&t=10"},
+		{"https://example.com/post#section", "https://example.com/post#section"},
+		{"https://example.com/post?utm_campaign=x#section", "https://example.com/post#section"},
+	}
+
+	for _, tt := range tests {
+		if got := cleanLink(tt.link, params); got != tt.want {
+			t.Errorf("cleanLink(%s) = %s; want %s", tt.link, got, tt.want)
+		}
+	}
+}
+
+func TestUrljoin(t *testing.T) {
+	base := "https://example.com/blog/posts/page.html?p=2"
+	var tests = []struct {
+		href string
+		want string
+	}{
+		{"/feeds/all.atom.xml", "https://example.com/feeds/all.atom.xml"},
+		{"feed.xml", "https://example.com/blog/posts/feed.xml"},
+		{"./feed.xml", "https://example.com/blog/posts/feed.xml"},
+		{"../feed", "https://example.com/blog/feed"},
+		{"../../../feed", "https://example.com/feed"},
+		{"/feed?format=rss&lang=en", "https://example.com/feed?format=rss&lang=en"},
+		{"feed.xml#latest", "https://example.com/blog/posts/feed.xml#latest"},
+		{"//cdn.example.org/feed.xml", "https://cdn.example.org/feed.xml"},
+		{"http://other.example.com/rss", "http://other.example.com/rss"},
+		{"", base},
+	}
+
+	for _, tt := range tests {
+		got, err := urljoin(base, tt.href)
+		if err != nil {
+			t.Errorf("urljoin(%s) failed: %v", tt.href, err)
+		} else if got != tt.want {
+			t.Errorf("urljoin(%s) = %s; want %s", tt.href, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/mmcdole/gofeed"
+)
+
+// articleImage picks the main image out of the html of item, for templates
+// to prefer over the item's own image, which feeds often set to the site's
+// logo. It is the largest <img> inside <article> or <main>, or anywhere if
+// there's neither, by the width and height it is declared with, else the
+// first one. The item's own image and tracking pixels are skipped.
+func articleImage(item *gofeed.Item) string {
+	body := item.Content
+	if body == "" {
+		body = item.Description
+	}
+	if !strings.Contains(body, "<img") {
+		return ""
+	}
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	images := doc.Find("article img, main img")
+	if images.Length() == 0 {
+		images = doc.Find("img")
+	}
+
+	logo := ""
+	if item.Image != nil {
+		logo = item.Image.URL
+	}
+	best, bestArea := "", -1
+	images.Each(func(_ int, img *goquery.Selection) {
+		src, _ := img.Attr("src")
+		if src == "" || strings.HasPrefix(src, "data:") {
+			return
+		}
+		if item.Link != "" {
+			if resolved, err := urljoin(item.Link, src); err == nil {
+				src = resolved
+			}
+		}
+		if src == logo {
+			return
+		}
+
+		// undeclared sizes count as 0, so declared ones win over them
+		area := 0
+		width, werr := strconv.Atoi(strings.TrimSuffix(img.AttrOr("width", ""), "px"))
+		height, herr := strconv.Atoi(strings.TrimSuffix(img.AttrOr("height", ""), "px"))
+		if (werr == nil && width <= 1) || (herr == nil && height <= 1) {
+			return
+		}
+		if werr == nil && herr == nil {
+			area = width * height
+		}
+		if area > bestArea {
+			best, bestArea = src, area
+		}
+	})
+	return best
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+var ErrAlreadyCurrent = errors.New("feed key already derived from the current secret")
+
+// rotateFeedKey derives a new key for the feed at pubkey from the current secret
+// and stores the feed under it. The old entity stays behind, pointing at the new
+// one, so its followers get a final profile telling them where the feed went.
+// That profile, and an announcement note if asked to, are returned for emitting.
+func rotateFeedKey(db *pebble.DB, pubkey string, announce bool) (newPubkey string, events []nostr.Event, err error) {
+	defer lockEntity(pubkey)()
+	entity, err := loadEntity(db, pubkey)
+	if err != nil {
+		return "", nil, err
+	}
+	if entity.MovedTo != "" {
+		return entity.MovedTo, nil, ErrAlreadyCurrent
+	}
+	if entity.SecretVersion == relay.SecretVersion {
+		return pubkey, nil, ErrAlreadyCurrent
+	}
+
+	rotated := entity
+	rotated.PrivateKey = privateKeyFromFeed(relay.Secret, entity.URL)
+	rotated.SecretVersion = relay.SecretVersion
+	newPubkey, err = nostr.GetPublicKey(rotated.PrivateKey)
+	if err != nil {
+		return "", nil, fmt.Errorf("bad private key: %w", err)
+	}
+
+	if newPubkey == pubkey {
+		// SECRET_VERSION was bumped but SECRET is the same: the key is current
+		if err := saveEntity(db, pubkey, rotated); err != nil {
+			return "", nil, fmt.Errorf("failed to store feed: %w", err)
+		}
+		return pubkey, nil, ErrAlreadyCurrent
+	}
+
+	entity.MovedTo = newPubkey
+
+	batch := db.NewBatch()
+	defer batch.Close()
+	for key, value := range map[string]Entity{newPubkey: rotated, pubkey: entity} {
+		value.SchemaVersion = entitySchemaVersion
+		j, _ := json.Marshal(value)
+		batch.Set(entityKey(key), j, nil)
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return "", nil, fmt.Errorf("failed to store rotated feed: %w", err)
+	}
+
+	moved := movedMetadata(pubkey, entity)
+	moved.Sign(entity.PrivateKey)
+	events = append(events, moved)
+
+	if announce {
+		npub, _ := nip19.EncodePublicKey(newPubkey)
+		note := nostr.Event{
+			PubKey:    pubkey,
+			CreatedAt: nostr.Now(),
+			Kind:      nostr.KindTextNote,
+			Tags:      nostr.Tags{{"p", newPubkey}},
+			Content:   "This feed has moved, follow nostr:" + npub + " to keep getting its updates.",
+		}
+		note.Sign(entity.PrivateKey)
+		events = append(events, note)
+	}
+
+	return newPubkey, events, nil
+}
+
+// movedMetadata is the profile served for a feed key that was rotated away.
+func movedMetadata(pubkey string, entity Entity) nostr.Event {
+	npub, _ := nip19.EncodePublicKey(entity.MovedTo)
+	name := entity.URL
+	if entity.Meta != nil && entity.Meta.Name != "" {
+		name = entity.Meta.Name
+	}
+	content, _ := json.Marshal(map[string]string{
+		"name":  name + " (moved)",
+		"about": "This feed is now published as nostr:" + npub + "\n\n" + entity.URL,
+	})
+
+	return nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: nostr.Timestamp(time.Now().Unix()),
+		Kind:      nostr.KindSetMetadata,
+		Tags:      nostr.Tags{},
+		Content:   string(content),
+	}
+}
+
+// keyAudit is what auditKeys reports for each stored feed, private keys left out.
+type keyAudit struct {
+	URL           string
+	Pubkey        string
+	DerivedPubkey string
+	SecretVersion int
+	MovedTo       string
+	Match         bool
+}
+
+// auditKeys derives again the key of every stored feed from the current secret
+// and tells which feeds are stored under a different one.
+func auditKeys(db *pebble.DB) ([]keyAudit, error) {
+	var audits []keyAudit
+	err := ForEachEntity(db, func(stored StoredEntity) error {
+		audit := keyAudit{
+			URL:           stored.Entity.URL,
+			Pubkey:        stored.Pubkey,
+			SecretVersion: stored.Entity.SecretVersion,
+			MovedTo:       stored.Entity.MovedTo,
+		}
+		derived, err := nostr.GetPublicKey(privateKeyFromFeed(relay.Secret, stored.Entity.URL))
+		if err != nil {
+			return fmt.Errorf("bad private key for %q: %w", stored.Entity.URL, err)
+		}
+		audit.DerivedPubkey = derived
+		audit.Match = derived == stored.Pubkey
+		audits = append(audits, audit)
+		return nil
+	})
+	return audits, skipCorrupt(err)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestRotateFeedKey(t *testing.T) {
+	setupTestRelay(t)
+	defer func() { relay.SecretVersion = 0 }()
+
+	// a feed registered under the first secret
+	relay.SecretVersion = 1
+	url := "https://example.com/feed"
+	oldSk := privateKeyFromFeed(relay.Secret, url)
+	oldPubkey, _ := nostr.GetPublicKey(oldSk)
+	saveEntity(relay.db, oldPubkey, Entity{PrivateKey: oldSk, SecretVersion: 1, URL: url})
+
+	// the secret leaks and gets replaced
+	relay.Secret, relay.SecretVersion = "the-new-secret", 2
+	defer func() { relay.Secret = "test-secret" }()
+
+	newPubkey, events, err := rotateFeedKey(relay.db, oldPubkey, true)
+	if err != nil {
+		t.Fatalf("rotateFeedKey: %v", err)
+	}
+	if newPubkey == oldPubkey {
+		t.Fatal("key didn't change")
+	}
+
+	rotated, err := loadEntity(relay.db, newPubkey)
+	if err != nil {
+		t.Fatalf("loadEntity(new): %v", err)
+	}
+	if rotated.SecretVersion != 2 || rotated.URL != url || rotated.PrivateKey != privateKeyFromFeed("the-new-secret", url) {
+		t.Errorf("rotated entity = %+v", rotated)
+	}
+
+	old, err := loadEntity(relay.db, oldPubkey)
+	if err != nil {
+		t.Fatalf("loadEntity(old): %v", err)
+	}
+	if old.MovedTo != newPubkey || old.PrivateKey != oldSk {
+		t.Errorf("old entity = %+v; want it moved to %s with its key kept", old, newPubkey)
+	}
+
+	npub, _ := nip19.EncodePublicKey(newPubkey)
+	if len(events) != 2 {
+		t.Fatalf("got %d events; want the moved profile and an announcement", len(events))
+	}
+	for _, evt := range events {
+		if ok, _ := evt.CheckSignature(); !ok || evt.PubKey != oldPubkey {
+			t.Errorf("event %v isn't signed by the old key", evt)
+		}
+		if !strings.Contains(evt.Content, npub) {
+			t.Errorf("event content %q doesn't point at %s", evt.Content, npub)
+		}
+	}
+	if events[0].Kind != nostr.KindSetMetadata || events[1].Kind != nostr.KindTextNote {
+		t.Errorf("got kinds %d and %d; want 0 and 1", events[0].Kind, events[1].Kind)
+	}
+
+	// the old key is now ignored for polling and dedupe, and rotating again is a no-op
+	if pubkey, _, ok := findFeedByURL(relay.db, url); !ok || pubkey != newPubkey {
+		t.Errorf("findFeedByURL = %s; want %s", pubkey, newPubkey)
+	}
+	if _, _, err := rotateFeedKey(relay.db, oldPubkey, false); err != ErrAlreadyCurrent {
+		t.Errorf("second rotation: %v; want ErrAlreadyCurrent", err)
+	}
+}
+
+func TestRotateFeedKeySameSecret(t *testing.T) {
+	setupTestRelay(t)
+	defer func() { relay.SecretVersion = 0 }()
+
+	relay.SecretVersion = 1
+	url := "https://example.com/feed"
+	sk := privateKeyFromFeed(relay.Secret, url)
+	pubkey, _ := nostr.GetPublicKey(sk)
+	saveEntity(relay.db, pubkey, Entity{PrivateKey: sk, SecretVersion: 1, URL: url})
+
+	// SECRET_VERSION is bumped, SECRET isn't
+	relay.SecretVersion = 2
+	newPubkey, events, err := rotateFeedKey(relay.db, pubkey, true)
+	if err != ErrAlreadyCurrent || newPubkey != pubkey || len(events) != 0 {
+		t.Fatalf("rotateFeedKey = %s, %d events, %v; want the same pubkey and ErrAlreadyCurrent", newPubkey, len(events), err)
+	}
+	entity, err := loadEntity(relay.db, pubkey)
+	if err != nil {
+		t.Fatalf("loadEntity: %v", err)
+	}
+	if entity.MovedTo != "" || entity.SecretVersion != 2 || entity.PrivateKey != sk {
+		t.Errorf("entity = %+v; want it unmoved at secret version 2", entity)
+	}
+}
+
+func TestRotateFeedKeyDuringPoll(t *testing.T) {
+	setupTestRelay(t)
+	defer func() { relay.SecretVersion, relay.Secret = 0, "test-secret" }()
+	var pubkey, newPubkey string
+	var polling atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if polling.Load() {
+			// the key is rotated while the feed is being polled
+			relay.Secret, relay.SecretVersion = "the-new-secret", 2
+			var err error
+			if newPubkey, _, err = rotateFeedKey(relay.db, pubkey, false); err != nil {
+				t.Errorf("rotateFeedKey: %v", err)
+			}
+		}
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+	defer srv.Close()
+
+	relay.SecretVersion = 1
+	pubkey, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+
+	p := newPoller(pollerConfig{
+		DB:          relay.db,
+		LastEmitted: &sync.Map{},
+		Updates:     make(chan nostr.Event, 10),
+	})
+	feeds.Flush()
+	polling.Store(true)
+	if _, err := p.pollFeed(context.Background(), pubkey); err != nil {
+		t.Fatalf("pollFeed: %v", err)
+	}
+	if old, err := loadEntity(relay.db, pubkey); err != nil || old.MovedTo != newPubkey {
+		t.Errorf("old entity = %+v, %v; want it still moved to %s", old, err, newPubkey)
+	}
+}
+
+func TestAuditKeys(t *testing.T) {
+	setupTestRelay(t)
+
+	current := "https://current.example.com/feed"
+	currentSk := privateKeyFromFeed(relay.Secret, current)
+	currentPubkey, _ := nostr.GetPublicKey(currentSk)
+	saveEntity(relay.db, currentPubkey, Entity{PrivateKey: currentSk, SecretVersion: 1, URL: current})
+
+	orphaned := "https://orphaned.example.com/feed"
+	orphanedSk := privateKeyFromFeed("an-old-secret", orphaned)
+	orphanedPubkey, _ := nostr.GetPublicKey(orphanedSk)
+	saveEntity(relay.db, orphanedPubkey, Entity{PrivateKey: orphanedSk, SecretVersion: 1, URL: orphaned})
+	saveWatermark(relay.db, current, 1)
+
+	audits, err := auditKeys(relay.db)
+	if err != nil {
+		t.Fatalf("auditKeys: %v", err)
+	}
+	if len(audits) != 2 {
+		t.Fatalf("got %d audits; want 2", len(audits))
+	}
+	for _, audit := range audits {
+		switch audit.URL {
+		case current:
+			if !audit.Match || audit.Pubkey != currentPubkey || audit.DerivedPubkey != currentPubkey {
+				t.Errorf("current feed audit = %+v; want a match", audit)
+			}
+		case orphaned:
+			wantDerived, _ := nostr.GetPublicKey(privateKeyFromFeed(relay.Secret, orphaned))
+			if audit.Match || audit.Pubkey != orphanedPubkey || audit.DerivedPubkey != wantDerived {
+				t.Errorf("orphaned feed audit = %+v; want a mismatch", audit)
+			}
+		default:
+			t.Errorf("unexpected audit %+v", audit)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handleAuditKeys(w, httptest.NewRequest("GET", "/admin/keys/audit", nil))
+	body := w.Body.String()
+	if !strings.Contains(body, "2 feeds, 1 mismatched") {
+		t.Errorf("audit report = %q; want a summary of 1 mismatch", body)
+	}
+	for _, sk := range []string{currentSk, orphanedSk} {
+		if strings.Contains(body, sk) {
+			t.Error("audit report leaks a private key")
+		}
+	}
+}
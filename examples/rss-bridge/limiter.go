@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrHostBackedOff is returned for requests to a host that answered 429 until
+// the time it asked us to wait is over.
+var ErrHostBackedOff = errors.New("host asked us to back off")
+
+// defaultBackoff is how long a host is left alone after a 429 without Retry-After.
+const defaultBackoff = 5 * time.Minute
+
+// hostLimiter keeps feed fetches polite: at most maxConcurrent requests at once
+// and minInterval between the start of two requests to the same host. Zero
+// values mean no limit.
+type hostLimiter struct {
+	maxConcurrent int
+	minInterval   time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostState
+}
+
+type hostState struct {
+	slots        chan struct{}
+	next         time.Time
+	backoffUntil time.Time
+}
+
+func newHostLimiter(maxConcurrent int, minInterval time.Duration) *hostLimiter {
+	return &hostLimiter{
+		maxConcurrent: maxConcurrent,
+		minInterval:   minInterval,
+		hosts:         make(map[string]*hostState),
+	}
+}
+
+func (l *hostLimiter) state(host string) *hostState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st, ok := l.hosts[host]
+	if !ok {
+		st = &hostState{}
+		if l.maxConcurrent > 0 {
+			st.slots = make(chan struct{}, l.maxConcurrent)
+		}
+		l.hosts[host] = st
+	}
+	return st
+}
+
+// acquire waits until a request to host can be made, which must be followed
+// by a call to release once it's done.
+func (l *hostLimiter) acquire(ctx context.Context, host string) (release func(), err error) {
+	st := l.state(host)
+
+	release = func() {}
+	if st.slots != nil {
+		select {
+		case st.slots <- struct{}{}:
+			release = func() { <-st.slots }
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if now.Before(st.backoffUntil) {
+		l.mu.Unlock()
+		release()
+		return nil, ErrHostBackedOff
+	}
+	start := now
+	if st.next.After(start) {
+		start = st.next
+	}
+	st.next = start.Add(l.minInterval)
+	l.mu.Unlock()
+
+	if wait := time.Until(start); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+
+	return release, nil
+}
+
+// backOff stops requests to host for d.
+func (l *hostLimiter) backOff(host string, d time.Duration) {
+	st := l.state(host)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := time.Now().Add(d); until.After(st.backoffUntil) {
+		st.backoffUntil = until
+	}
+}
+
+// retryAfter reads a Retry-After header, given either in seconds or as a date.
+func retryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return defaultBackoff
+}
+
+// injectLimiter is a token bucket for each feed, bounding how many events the
+// poller injects for it: up to rate at once, refilled at rate per period.
+type injectLimiter struct {
+	rate   int
+	period time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*injectBucket
+}
+
+type injectBucket struct {
+	tokens float64
+	filled time.Time
+}
+
+func newInjectLimiter(rate int, period time.Duration) *injectLimiter {
+	return &injectLimiter{rate: rate, period: period, buckets: make(map[string]*injectBucket)}
+}
+
+// take spends up to n tokens of the feed at url, returning how many it had.
+func (l *injectLimiter) take(url string, n int, now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[url]
+	if !ok {
+		b = &injectBucket{tokens: float64(l.rate), filled: now}
+		l.buckets[url] = b
+	}
+	if elapsed := now.Sub(b.filled); elapsed > 0 && l.period > 0 {
+		b.tokens += float64(l.rate) * float64(elapsed) / float64(l.period)
+		if b.tokens > float64(l.rate) {
+			b.tokens = float64(l.rate)
+		}
+		b.filled = now
+	}
+
+	granted := int(b.tokens)
+	if granted > n {
+		granted = n
+	}
+	b.tokens -= float64(granted)
+	return granted
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func withHostLimiter(t *testing.T, maxConcurrent int, minInterval time.Duration) {
+	t.Helper()
+	previous := hosts
+	hosts = newHostLimiter(maxConcurrent, minInterval)
+	t.Cleanup(func() { hosts = previous })
+}
+
+func TestHostLimiterSpacesRequests(t *testing.T) {
+	const gap = 100 * time.Millisecond
+	withHostLimiter(t, 1, gap)
+
+	var (
+		mu       sync.Mutex
+		starts   []time.Time
+		inflight int64
+	)
+	began := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := hosts.acquire(context.Background(), "example.com")
+			if err != nil {
+				t.Errorf("acquire: %v", err)
+				return
+			}
+			defer release()
+			if atomic.AddInt64(&inflight, 1) > 1 {
+				t.Error("more than one request at once to the same host")
+			}
+			defer atomic.AddInt64(&inflight, -1)
+			mu.Lock()
+			starts = append(starts, time.Now())
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+		}()
+	}
+	wg.Wait()
+
+	// each request gets its own slot, which a busy scheduler can only make it
+	// miss late, so gaps between two requests may shrink but no slot comes early
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	for i, start := range starts {
+		if d := start.Sub(began); d < time.Duration(i)*gap {
+			t.Errorf("request %d started %s in; want no earlier than %s", i, d, time.Duration(i)*gap)
+		}
+	}
+}
+
+func TestHostLimiterHonorsContext(t *testing.T) {
+	withHostLimiter(t, 1, time.Hour)
+
+	release, err := hosts.acquire(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := hosts.acquire(ctx, "example.com"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("acquire = %v; want it to give up with the context", err)
+	}
+	if release, err := hosts.acquire(context.Background(), "other.example.com"); err != nil {
+		t.Errorf("acquire(other host) = %v; want no wait", err)
+	} else {
+		release()
+	}
+}
+
+func TestHostLimiterBacksOffOn429(t *testing.T) {
+	withHostLimiter(t, 0, 0)
+
+	var requests int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	if _, _, err := fetchFeed(context.Background(), srv.URL+"/a", nil); err == nil {
+		t.Fatal("fetchFeed succeeded on a 429")
+	}
+	// another feed on the same host isn't even requested while backed off
+	if _, _, err := fetchFeed(context.Background(), srv.URL+"/b", nil); !errors.Is(err, ErrHostBackedOff) {
+		t.Errorf("fetchFeed while backed off = %v; want ErrHostBackedOff", err)
+	}
+	if n := atomic.LoadInt64(&requests); n != 1 {
+		t.Errorf("host got %d requests; want 1", n)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	fetchFeed(context.Background(), srv.URL+"/b", nil)
+	if n := atomic.LoadInt64(&requests); n != 2 {
+		t.Errorf("host got %d requests after the backoff; want 2", n)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	var tests = []struct {
+		value string
+		min   time.Duration
+		max   time.Duration
+	}{
+		{"120", 120 * time.Second, 120 * time.Second},
+		{time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), 59 * time.Minute, time.Hour},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, 0},
+		{"", defaultBackoff, defaultBackoff},
+		{"soon", defaultBackoff, defaultBackoff},
+	}
+
+	for _, tt := range tests {
+		if got := retryAfter(tt.value); got < tt.min || got > tt.max {
+			t.Errorf("retryAfter(%q) = %s; want between %s and %s", tt.value, got, tt.min, tt.max)
+		}
+	}
+}
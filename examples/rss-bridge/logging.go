@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"github.com/fiatjaf/relayer/v2"
+	"golang.org/x/exp/slog"
+)
+
+// logger is what the bridge logs with, set up by Init from LOG_LEVEL and LOG_FORMAT.
+var logger = slog.New(slog.NewTextHandler(os.Stderr))
+
+// newLogger makes a logger writing lines of format, "text" or "json", to w for
+// messages at level and above.
+func newLogger(w io.Writer, level slog.Level, format string) (*slog.Logger, error) {
+	opts := slog.HandlerOptions{Level: level}
+	switch format {
+	case "text":
+		return slog.New(opts.NewTextHandler(w)), nil
+	case "json":
+		return slog.New(opts.NewJSONHandler(w)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, use text or json", format)
+	}
+}
+
+// fatal logs msg as an error and exits.
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// serverLogger hands what relayer.Server logs to a slog.Logger.
+type serverLogger struct{ log *slog.Logger }
+
+func (l serverLogger) Infof(format string, v ...any)    { l.log.Info(fmt.Sprintf(format, v...)) }
+func (l serverLogger) Warningf(format string, v ...any) { l.log.Warn(fmt.Sprintf(format, v...)) }
+func (l serverLogger) Errorf(format string, v ...any)   { l.log.Error(fmt.Sprintf(format, v...)) }
+
+type requestKey struct{}
+
+// request is what logRequests keeps in the context of a request.
+type request struct {
+	id  string
+	log *slog.Logger
+}
+
+// requestLogger is logger with the id of the request ctx belongs to, if any.
+func requestLogger(ctx context.Context) *slog.Logger {
+	if req, ok := ctx.Value(requestKey{}).(request); ok {
+		return req.log
+	}
+	return logger
+}
+
+// httpError answers r with status and a JSON body of msg and the request id,
+// which is what every handler does when things go wrong.
+func httpError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	body := struct {
+		Error     string `json:"error"`
+		RequestID string `json:"request_id,omitempty"`
+	}{Error: msg}
+	if req, ok := r.Context().Value(requestKey{}).(request); ok {
+		body.RequestID = req.id
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// statusRecorder remembers the status a handler answered with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.wrote = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(b)
+}
+
+// logRequests gives every request an id, the one relayer.Server gave it or else
+// the X-Request-Id it came with or a random one, that requestLogger adds to
+// everything logged while serving it.
+// Requests are logged once served, at debug level unless they failed. A handler
+// that panics is logged with its stack and answered with a 500, if it hadn't
+// answered yet, instead of taking the connection down.
+func logRequests(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := relayer.RequestID(r.Context())
+		if id == "" {
+			id = r.Header.Get("X-Request-Id")
+		}
+		if id == "" {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		l := logger.With("request_id", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestKey{}, request{id, l}))
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				l.Error("handler panicked", "panic", p, "stack", string(debug.Stack()))
+				if !rec.wrote {
+					httpError(rec, r, http.StatusInternalServerError, "internal error")
+				}
+				rec.status = http.StatusInternalServerError
+			}
+
+			level := slog.LevelDebug
+			if rec.status >= 500 {
+				level = slog.LevelWarn
+			}
+			l.Log(r.Context(), level, "served request", "method", r.Method, "path", r.URL.Path,
+				"status", rec.status, "duration", time.Since(start))
+		}()
+
+		handler(rec, r)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slog"
+)
+
+// captureLogs points logger at a buffer of JSON lines for the rest of the test.
+func captureLogs(t *testing.T, level slog.Level) func() []map[string]any {
+	t.Helper()
+	var buf bytes.Buffer
+	l, err := newLogger(&buf, level, "json")
+	if err != nil {
+		t.Fatalf("newLogger: %v", err)
+	}
+	previous := logger
+	logger = l
+	t.Cleanup(func() { logger = previous })
+
+	return func() []map[string]any {
+		var records []map[string]any
+		dec := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+		for dec.More() {
+			var record map[string]any
+			if err := dec.Decode(&record); err != nil {
+				t.Fatalf("log line isn't json: %v", err)
+			}
+			records = append(records, record)
+		}
+		return records
+	}
+}
+
+func TestLogSettings(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "warn")
+	t.Setenv("LOG_FORMAT", "json")
+	var settings struct {
+		LogLevel  slog.Level `envconfig:"LOG_LEVEL" default:"info"`
+		LogFormat string     `envconfig:"LOG_FORMAT" default:"text"`
+	}
+	if err := envconfig.Process("", &settings); err != nil {
+		t.Fatalf("envconfig: %v", err)
+	}
+	if settings.LogLevel != slog.LevelWarn || settings.LogFormat != "json" {
+		t.Errorf("settings = %+v; want warn and json", settings)
+	}
+
+	if _, err := newLogger(&bytes.Buffer{}, slog.LevelInfo, "xml"); err == nil {
+		t.Error("newLogger accepted an unknown format")
+	}
+}
+
+func TestLogRequests(t *testing.T) {
+	logs := captureLogs(t, slog.LevelDebug)
+
+	handler := logRequests(func(w http.ResponseWriter, r *http.Request) {
+		requestLogger(r.Context()).Info("handling", "pubkey", "abc")
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	r := httptest.NewRequest("POST", "/create", nil)
+	r.Header.Set("X-Request-Id", "req-1")
+	handler(httptest.NewRecorder(), r)
+	logRequests(func(w http.ResponseWriter, r *http.Request) {})(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	records := logs()
+	if len(records) != 3 {
+		t.Fatalf("got %d log records; want 3: %v", len(records), records)
+	}
+	if got := records[0]; got["level"] != "INFO" || got["request_id"] != "req-1" || got["pubkey"] != "abc" {
+		t.Errorf("handler record = %v; want it at info with the request id", got)
+	}
+	if got := records[1]; got["level"] != "WARN" || got["request_id"] != "req-1" ||
+		got["status"] != float64(502) || got["path"] != "/create" || got["duration"] == nil {
+		t.Errorf("failed request record = %v; want it at warn with status, path and duration", got)
+	}
+	if got := records[2]; got["level"] != "DEBUG" || got["request_id"] == "" || got["request_id"] == "req-1" {
+		t.Errorf("request record = %v; want it at debug with an id of its own", got)
+	}
+
+	// at info level the requests that went fine aren't logged
+	logs = captureLogs(t, slog.LevelInfo)
+	logRequests(func(w http.ResponseWriter, r *http.Request) {})(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if records := logs(); len(records) != 0 {
+		t.Errorf("got %v at info level; want nothing", records)
+	}
+}
+
+func TestPollFailureLogged(t *testing.T) {
+	setupTestRelay(t)
+	logs := captureLogs(t, slog.LevelInfo)
+
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	if err := saveEntity(relay.db, pubkey, Entity{PrivateKey: sk, URL: srv.URL}); err != nil {
+		t.Fatalf("saveEntity: %v", err)
+	}
+
+	p := newPoller(pollerConfig{DB: relay.db, LastEmitted: &sync.Map{}, Updates: make(chan nostr.Event, 10)})
+	p.filters = func() nostr.Filters { return nostr.Filters{{Authors: []string{pubkey}}} }
+	p.pass(context.Background())
+
+	var failure, pass map[string]any
+	for _, record := range logs() {
+		switch record["msg"] {
+		case "failed to poll feed":
+			failure = record
+		case "poll pass":
+			pass = record
+		}
+	}
+	if failure == nil || failure["level"] != "WARN" || failure["pubkey"] != pubkey || failure["err"] == nil {
+		t.Errorf("poll failure record = %v; want it at warn with the pubkey and error", failure)
+	}
+	if pass == nil || pass["failures"] != float64(1) || pass["duration"] == nil {
+		t.Errorf("poll pass record = %v; want one failure and a duration", pass)
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	logs := captureLogs(t, slog.LevelInfo)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", logRequests(func(w http.ResponseWriter, r *http.Request) {
+		var entity *Entity
+		fmt.Fprint(w, entity.URL)
+	}))
+	mux.HandleFunc("/ok", logRequests(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/panic", nil)
+	req.Header.Set("X-Request-Id", "req-panic")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /panic: %v", err)
+	}
+	var body struct {
+		Error     string `json:"error"`
+		RequestID string `json:"request_id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("response isn't json: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 500 || body.Error == "" || body.RequestID != "req-panic" {
+		t.Errorf("GET /panic = %d %+v; want a 500 with the request id", resp.StatusCode, body)
+	}
+
+	// and the server keeps serving
+	resp, err = http.Get(srv.URL + "/ok")
+	if err != nil {
+		t.Fatalf("GET /ok after a panic: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("GET /ok after a panic = %d; want 200", resp.StatusCode)
+	}
+
+	stacks := 0
+	for _, record := range logs() {
+		if record["msg"] == "handler panicked" {
+			stacks++
+			if record["level"] != "ERROR" || record["request_id"] != "req-panic" ||
+				!strings.Contains(fmt.Sprint(record["stack"]), "TestRecoverPanics") {
+				t.Errorf("panic record = %v; want it at error with the request id and stack", record)
+			}
+		}
+	}
+	if stacks != 1 {
+		t.Errorf("panic logged %d times; want once", stacks)
+	}
+}
+
+func TestHandlerErrorsAreJSON(t *testing.T) {
+	setupTestRelay(t)
+	w := httptest.NewRecorder()
+	logRequests(handlePinFeed)(w, httptest.NewRequest("POST", "/admin/pin?pubkey=nope", nil))
+
+	var body map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("error response isn't json: %v", err)
+	}
+	if w.Code != 404 || body["error"] != "unknown feed" || body["request_id"] == "" {
+		t.Errorf("pinning an unknown feed = %d %v; want a 404 json error with a request id", w.Code, body)
+	}
+}
@@ -2,18 +2,20 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/cockroachdb/pebble"
 	"github.com/fiatjaf/relayer/v2"
-	"github.com/kelseyhightower/envconfig"
+	"github.com/fiatjaf/relayer/v2/sink/redis"
+	"github.com/mmcdole/gofeed"
 	"github.com/nbd-wtf/go-nostr"
 	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
 )
 
 var relay = &Relay{
@@ -21,11 +23,98 @@ var relay = &Relay{
 }
 
 type Relay struct {
-	Secret string `envconfig:"SECRET" required:"true"`
+	Secret        string   `envconfig:"SECRET"`
+	SecretVersion int      `envconfig:"SECRET_VERSION" default:"1"`
+	ServiceURL    string   `envconfig:"SERVICE_URL"`
+	AdminToken    string   `envconfig:"ADMIN_TOKEN"`
+	Relays        []string `envconfig:"RELAYS"`
+	MaxFeeds      int      `envconfig:"MAX_FEEDS"`
+	FeedsFile     string   `envconfig:"FEEDS_FILE"`
+	// events not delivered to a relay by then are dropped
+	DeliveryMaxAge time.Duration `envconfig:"DELIVERY_MAX_AGE" default:"24h"`
+
+	LogLevel  slog.Level `envconfig:"LOG_LEVEL" default:"info"`
+	LogFormat string     `envconfig:"LOG_FORMAT" default:"text"`
+	// believed about X-Forwarded-For in the access log
+	TrustedProxies []string `envconfig:"TRUSTED_PROXIES"`
+
+	PollInterval time.Duration `envconfig:"POLL_INTERVAL" default:"20m"`
+	PollJitter   time.Duration `envconfig:"POLL_JITTER" default:"1m"`
+	PollTimeout  time.Duration `envconfig:"POLL_TIMEOUT" default:"5m"`
+
+	StaleFeedThreshold time.Duration `envconfig:"STALE_FEED_THRESHOLD"`
+	DeadFeedThreshold  time.Duration `envconfig:"DEAD_FEED_THRESHOLD"`
+	PruneDeadFeeds     bool          `envconfig:"PRUNE_DEAD_FEEDS"`
+
+	// zero means two intervals and a timeout
+	HealthPollMaxAge time.Duration `envconfig:"HEALTH_POLL_MAX_AGE"`
+	HealthCacheTTL   time.Duration `envconfig:"HEALTH_CACHE_TTL" default:"5s"`
+
+	FeedCacheSize  int           `envconfig:"FEED_CACHE_SIZE" default:"512"`
+	FeedCacheTTL   time.Duration `envconfig:"FEED_CACHE_TTL" default:"19m"`
+	FeedCacheStale time.Duration `envconfig:"FEED_CACHE_STALE" default:"19m"`
+	FeedDiskTTL    time.Duration `envconfig:"FEED_DISK_CACHE_TTL"`
+	StreamFeeds    bool          `envconfig:"STREAM_FEEDS"`
+
+	HostMaxConcurrent int           `envconfig:"HOST_MAX_CONCURRENT" default:"2"`
+	HostMinInterval   time.Duration `envconfig:"HOST_MIN_INTERVAL" default:"1s"`
+
+	MinContentLength int           `envconfig:"MIN_CONTENT_LENGTH"`
+	CategoryFilter   []string      `envconfig:"CATEGORY_FILTER"`
+	MaxInitialAge    time.Duration `envconfig:"MAX_INITIAL_AGE" default:"168h"`
+	RegisterHorizon  time.Duration `envconfig:"REGISTER_HORIZON"`
+	DigestInterval   time.Duration `envconfig:"DIGEST_INTERVAL"`
+	FeedInjectRate   int           `envconfig:"FEED_INJECT_RATE"`
+	TimestampSource  []string      `envconfig:"TIMESTAMP_SOURCE" default:"published,updated"`
+
+	StripLinkParams bool     `envconfig:"STRIP_LINK_PARAMS" default:"true"`
+	LinkParams      []string `envconfig:"LINK_PARAMS" default:"utm_*,fbclid,gclid,dclid,msclkid,mc_cid,mc_eid,_hsenc,_hsmi,igshid,yclid"`
+
+	TitleRewrites TitleRewrites `envconfig:"TITLE_REWRITES"`
+	ContentHash   bool          `envconfig:"CONTENT_HASH"`
+	// caps the notes of FullContent feeds instead of maxNoteLength
+	FullContentMaxLength int  `envconfig:"FULL_CONTENT_MAX_LENGTH" default:"20000"`
+	Nip05Footer          bool `envconfig:"NIP05_FOOTER"`
+	// looks for the main image in items' html, for templates, see articleImage
+	RespectArticleImage bool `envconfig:"RESPECT_ARTICLE_IMAGE"`
+
+	TLSCAFile     string `envconfig:"TLS_CA_FILE"`
+	TLSCertFile   string `envconfig:"TLS_CERT_FILE"`
+	TLSKeyFile    string `envconfig:"TLS_KEY_FILE"`
+	TLSMinVersion string `envconfig:"TLS_MIN_VERSION" default:"1.2"`
+	// lets /create register feeds fetched without checking their certificate
+	AllowInsecureFeeds bool `envconfig:"ALLOW_INSECURE_FEEDS"`
+	// refuses to register feeds from pages whose robots directives say noindex
+	RespectRobotsMeta bool `envconfig:"RESPECT_ROBOTS_META"`
+	// html pages and feeds larger than this, in bytes, aren't read
+	MaxPageSize int64 `envconfig:"MAX_PAGE_SIZE" default:"2097152"`
+
+	// serves /openapi.json describing the HTTP endpoints
+	OpenAPI bool `envconfig:"OPENAPI"`
+
+	// zero leaves the relayer defaults, see relayer.WebSocketOptions
+	WSMaxMessageSize int64         `envconfig:"WS_MAX_MESSAGE_SIZE"`
+	WSWriteWait      time.Duration `envconfig:"WS_WRITE_WAIT"`
+	WSPingPeriod     time.Duration `envconfig:"WS_PING_PERIOD"`
+	WSPongWait       time.Duration `envconfig:"WS_PONG_WAIT"`
+	WSSendQueue      int           `envconfig:"WS_SEND_QUEUE"`
+
+	RedisSinkURL     string `envconfig:"REDIS_SINK_URL"`
+	RedisSinkChannel string `envconfig:"REDIS_SINK_CHANNEL" default:"nostr:events"`
+	// bridged notes are POSTed here as they are made, see SearchIndexer
+	SearchIndexURL string `envconfig:"SEARCH_INDEX_URL"`
+
+	FeedPreference string `envconfig:"FEED_PREFERENCE" default:"rss"`
+	BackfillOrder  string `envconfig:"BACKFILL_ORDER" default:"newest"`
 
 	updates     chan nostr.Event
 	lastEmitted sync.Map
 	db          *pebble.DB
+	stopPolling func()
+	health      *healthChecker
+	sink        *redis.Sink
+	index       *indexSink
+	deliveries  *deliveryQueue
 }
 
 func (relay *Relay) Name() string {
@@ -33,59 +122,155 @@ func (relay *Relay) Name() string {
 }
 
 func (relay *Relay) Init() error {
-	err := envconfig.Process("", relay)
+	err := relay.loadConfig()
 	if err != nil {
-		return fmt.Errorf("couldn't process envconfig: %w", err)
+		return err
 	}
 
+	if logger, err = newLogger(os.Stderr, relay.LogLevel, relay.LogFormat); err != nil {
+		return err
+	}
+
+	feeds = newFeedCache(relay.FeedCacheSize, relay.FeedCacheTTL, relay.FeedCacheStale, fetchAndCleanFeed)
+	hosts = newHostLimiter(relay.HostMaxConcurrent, relay.HostMinInterval)
+
+	tlsCfg, err := tlsConfig(relay.TLSCAFile, relay.TLSCertFile, relay.TLSKeyFile, relay.TLSMinVersion)
+	if err != nil {
+		return fmt.Errorf("bad TLS settings: %w", err)
+	}
+	client.Transport = feedTransport(tlsCfg)
+	indexClient.Transport = feedTransport(tlsCfg)
+	insecureClient.Transport = insecureTransport(tlsCfg)
+
 	if db, err := pebble.Open("db", nil); err != nil {
-		log.Fatalf("failed to open db: %v", err)
+		return fmt.Errorf("failed to open db: %w", err)
 	} else {
 		relay.db = db
 	}
+	if relay.FeedDiskTTL > 0 {
+		feeds.disk = newDiskFeedCache(relay.db, relay.FeedDiskTTL)
+	}
 
-	go func() {
-		time.Sleep(20 * time.Minute)
-
-		filters := relayer.GetListeningFilters()
-		log.Printf("checking for updates; %d filters active", len(filters))
-
-		for _, filter := range filters {
-			if filter.Kinds == nil || slices.Contains(filter.Kinds, nostr.KindTextNote) {
-				for _, pubkey := range filter.Authors {
-					if val, closer, err := relay.db.Get([]byte(pubkey)); err == nil {
-						defer closer.Close()
-
-						var entity Entity
-						if err := json.Unmarshal(val, &entity); err != nil {
-							log.Printf("got invalid json from db at key %s: %v", pubkey, err)
-							continue
-						}
-
-						feed, err := parseFeed(entity.URL)
-						if err != nil {
-							log.Printf("failed to parse feed at url %q: %v", entity.URL, err)
-							continue
-						}
-
-						for _, item := range feed.Items {
-							evt := itemToTextNote(pubkey, item)
-							last, ok := relay.lastEmitted.Load(entity.URL)
-							if !ok || time.Unix(last.(int64), 0).Before(evt.CreatedAt.Time()) {
-								evt.Sign(entity.PrivateKey)
-								relay.updates <- evt
-								relay.lastEmitted.Store(entity.URL, last)
-							}
-						}
-					}
-				}
-			}
+	if err := checkSecret(relay.db, relay.Secret); err != nil {
+		return err
+	}
+
+	if err := migrateEntities(relay.db); err != nil {
+		return fmt.Errorf("failed to migrate feeds: %w", err)
+	}
+
+	if err := loadWatermarks(relay.db, &relay.lastEmitted); err != nil {
+		return fmt.Errorf("failed to load watermarks: %w", err)
+	}
+
+	if err := loadFeedAuths(relay.db, relay.Secret); err != nil {
+		return fmt.Errorf("failed to load feed credentials: %w", err)
+	}
+	if err := loadInsecureFeeds(relay.db); err != nil {
+		return fmt.Errorf("failed to load insecure feeds: %w", err)
+	}
+	if err := loadFullContentFeeds(relay.db); err != nil {
+		return fmt.Errorf("failed to load full content feeds: %w", err)
+	}
+
+	if relay.RedisSinkURL != "" {
+		if relay.sink, err = redis.New(relay.RedisSinkURL, relay.RedisSinkChannel); err != nil {
+			return fmt.Errorf("bad REDIS_SINK_URL: %w", err)
 		}
-	}()
+	}
+	if relay.SearchIndexURL != "" {
+		relay.index = newIndexSink(webhookIndexer{relay.SearchIndexURL, indexClient})
+	}
+
+	if relay.FeedsFile != "" {
+		startup, err := readFeedsFile(relay.FeedsFile)
+		if err != nil {
+			return fmt.Errorf("bad FEEDS_FILE: %w", err)
+		}
+		// they are fetched to be registered, which mustn't hold up the relay
+		go registerStartupFeeds(startup)
+	}
+
+	broadcaster := newBroadcaster(context.Background(), relay.Relays)
+	relay.deliveries = newDeliveryQueue(relay.db, relay.DeliveryMaxAge)
+	if err := relay.deliveries.start(); err != nil {
+		return fmt.Errorf("failed to resume deliveries: %w", err)
+	}
+	broadcaster.queue = relay.deliveries
+
+	relay.stopPolling = newPoller(pollerConfig{
+		DB:          relay.db,
+		LastEmitted: &relay.lastEmitted,
+		Updates:     relay.updates,
+		Broadcaster: broadcaster,
+		Interval:    relay.PollInterval,
+		Jitter:      relay.PollJitter,
+		Timeout:     relay.PollTimeout,
+
+		MaxInitialAge:   relay.MaxInitialAge,
+		RegisterHorizon: relay.RegisterHorizon,
+		Digest:          relay.DigestInterval,
+		InjectRate:      relay.FeedInjectRate,
+		DeadThreshold:   relay.DeadFeedThreshold,
+		PruneDead:       relay.PruneDeadFeeds,
+		StreamFeeds:     relay.StreamFeeds,
+	}).start()
+
+	pollMaxAge := relay.HealthPollMaxAge
+	if pollMaxAge == 0 {
+		pollMaxAge = 2*(relay.PollInterval+relay.PollJitter) + relay.PollTimeout
+	}
+	started := time.Now()
+	relay.health = newHealthChecker(relay.HealthCacheTTL, map[string]func() ComponentHealth{
+		"db":     func() ComponentHealth { return checkDB(relay.db) },
+		"poller": func() ComponentHealth { return checkPoller(started, pollMaxAge) },
+	})
 
 	return nil
 }
 
+func (relay *Relay) OnShutdown(ctx context.Context) {
+	if relay.stopPolling != nil {
+		relay.stopPolling()
+	}
+	if relay.deliveries != nil {
+		relay.deliveries.stop()
+	}
+	if relay.index != nil {
+		relay.index.Close()
+	}
+}
+
+// EventSink is where the bridged events are published, if REDIS_SINK_URL is
+// set, and indexed, if SEARCH_INDEX_URL is.
+func (relay *Relay) EventSink() relayer.EventSink {
+	var sinks eventSinks
+	if relay.sink != nil {
+		sinks = append(sinks, relay.sink)
+	}
+	if relay.index != nil {
+		sinks = append(sinks, relay.index)
+	}
+	switch len(sinks) {
+	case 0:
+		return nil
+	case 1:
+		return sinks[0]
+	}
+	return sinks
+}
+
+// WebSocketOptions are the WS_* settings clients are served with.
+func (relay *Relay) WebSocketOptions() relayer.WebSocketOptions {
+	return relayer.WebSocketOptions{
+		MaxMessageSize: relay.WSMaxMessageSize,
+		WriteWait:      relay.WSWriteWait,
+		PingPeriod:     relay.WSPingPeriod,
+		PongWait:       relay.WSPongWait,
+		SendQueue:      relay.WSSendQueue,
+	}
+}
+
 func (relay *Relay) AcceptEvent(ctx context.Context, _ *nostr.Event) bool {
 	return false
 }
@@ -112,61 +297,27 @@ func (b store) QueryEvents(ctx context.Context, filter *nostr.Filter) (chan *nos
 		return nil, nil
 	}
 
+	var events []nostr.Event
+	for _, pubkey := range filter.Authors {
+		if ctx.Err() != nil {
+			// nobody is waiting for the rest of the feeds
+			return nil, ctx.Err()
+		}
+		events = append(events, feedEvents(ctx, pubkey, filter)...)
+	}
+	sortBackfill(events, relay.BackfillOrder)
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+
 	evts := make(chan *nostr.Event)
 	go func() {
-		for _, pubkey := range filter.Authors {
-			if val, closer, err := relay.db.Get([]byte(pubkey)); err == nil {
-				defer closer.Close()
-
-				var entity Entity
-				if err := json.Unmarshal(val, &entity); err != nil {
-					log.Printf("got invalid json from db at key %s: %v", pubkey, err)
-					continue
-				}
-
-				feed, err := parseFeed(entity.URL)
-				if err != nil {
-					log.Printf("failed to parse feed at url %q: %v", entity.URL, err)
-					continue
-				}
-
-				if filter.Kinds == nil || slices.Contains(filter.Kinds, nostr.KindSetMetadata) {
-					evt := feedToSetMetadata(pubkey, feed)
-
-					if filter.Since != nil && evt.CreatedAt.Time().Before(filter.Since.Time()) {
-						continue
-					}
-					if filter.Until != nil && evt.CreatedAt.Time().After(filter.Until.Time()) {
-						continue
-					}
-
-					evt.Sign(entity.PrivateKey)
-					evts <- &evt
-				}
-
-				if filter.Kinds == nil || slices.Contains(filter.Kinds, nostr.KindTextNote) {
-					var last uint32 = 0
-					for _, item := range feed.Items {
-						evt := itemToTextNote(pubkey, item)
-
-						if filter.Since != nil && evt.CreatedAt.Time().Before(filter.Since.Time()) {
-							continue
-						}
-						if filter.Until != nil && evt.CreatedAt.Time().After(filter.Until.Time()) {
-							continue
-						}
-
-						evt.Sign(entity.PrivateKey)
-
-						if evt.CreatedAt.Time().After(time.Unix(int64(last), 0)) {
-							last = uint32(evt.CreatedAt.Time().Unix())
-						}
-
-						evts <- &evt
-					}
-
-					relay.lastEmitted.Store(entity.URL, last)
-				}
+		defer close(evts)
+		for i := range events {
+			select {
+			case evts <- &events[i]:
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
@@ -174,18 +325,127 @@ func (b store) QueryEvents(ctx context.Context, filter *nostr.Filter) (chan *nos
 	return evts, nil
 }
 
+// feedEvents synthesizes the events of the feed stored under pubkey that match filter.
+func feedEvents(ctx context.Context, pubkey string, filter *nostr.Filter) []nostr.Event {
+	entity, err := loadEntity(relay.db, pubkey)
+	if err != nil {
+		if err != pebble.ErrNotFound {
+			logger.Error("got invalid json from db", "pubkey", pubkey, "err", err)
+		}
+		return nil
+	}
+
+	if entity.MovedTo != "" {
+		if filter.Kinds == nil || slices.Contains(filter.Kinds, nostr.KindSetMetadata) {
+			evt := movedMetadata(pubkey, entity)
+			evt.Sign(entity.PrivateKey)
+			return []nostr.Event{evt}
+		}
+		return nil
+	}
+
+	inRange := func(evt nostr.Event) bool {
+		return (filter.Since == nil || !evt.CreatedAt.Time().Before(filter.Since.Time())) &&
+			(filter.Until == nil || !evt.CreatedAt.Time().After(filter.Until.Time()))
+	}
+	// the notes of private feeds only go out gift wrapped, as they are polled,
+	// and in digest mode items only go out in digests
+	wantNotes := !entity.Private && relay.DigestInterval == 0 &&
+		(filter.Kinds == nil || slices.Contains(filter.Kinds, nostr.KindTextNote))
+
+	// a streamed feed is only read as far as the filter needs, taking it to
+	// list its newest items first as feeds do
+	stream := relay.StreamFeeds
+	limit := 0
+	if relay.BackfillOrder != "oldest" {
+		limit = filter.Limit
+	}
+
+	// notes from before the cutoff are never served, as they are never emitted
+	cutoff := entity.cutoff(relay.MaxInitialAge, relay.RegisterHorizon, time.Now())
+
+	stored, _ := relay.lastEmitted.Load(entity.URL)
+	last, _ := stored.(nostr.Timestamp)
+	var notes []nostr.Event
+	feed, err := feedItems(ctx, pubkey, entity, func(thread *threader, item *gofeed.Item) bool {
+		if !wantNotes {
+			return false
+		}
+		evt := thread.note(item)
+		if !inRange(evt) {
+			return !stream || filter.Since == nil || evt.CreatedAt >= *filter.Since
+		}
+		if evt.CreatedAt < cutoff {
+			return !stream
+		}
+
+		evt.Sign(entity.PrivateKey)
+		if evt.CreatedAt > last {
+			last = evt.CreatedAt
+		}
+		notes = append(notes, evt)
+		return !stream || limit == 0 || len(notes) < limit
+	})
+	if err != nil {
+		logger.Warn("failed to parse feed", "pubkey", pubkey, "url", entity.URL, "err", err)
+		return nil
+	}
+
+	var events []nostr.Event
+	if filter.Kinds == nil || slices.Contains(filter.Kinds, nostr.KindSetMetadata) {
+		evt := feedToSetMetadata(pubkey, feed, entity.Meta)
+		if inRange(evt) {
+			evt.Sign(entity.PrivateKey)
+			events = append(events, evt)
+		}
+	}
+
+	if len(notes) > 0 {
+		events = append(events, notes...)
+		relay.lastEmitted.Store(entity.URL, last)
+		if err := saveWatermark(relay.db, entity.URL, last); err != nil {
+			logger.Error("failed to store watermark", "url", entity.URL, "err", err)
+		}
+	}
+
+	return events
+}
+
 func (relay *Relay) InjectEvents() chan nostr.Event {
 	return relay.updates
 }
 
 func main() {
+	checkConfig := flag.Bool("check-config", false, "check the settings in the environment and exit")
+	flag.Parse()
+
+	// before anything else, so that every problem is listed readably
+	if err := relay.loadConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *checkConfig {
+		if weakSecret(relay.Secret) {
+			// the db isn't opened here to tell whether that fails the startup
+			fmt.Fprintf(os.Stderr, "SECRET: too weak, use at least %d random characters; only bridges with feeds already registered start with it\n", minSecretLength)
+		}
+		fmt.Println("configuration ok")
+		return
+	}
+
 	server, err := relayer.NewServer(relay)
 	if err != nil {
-		log.Fatalf("failed to create server: %v", err)
+		fatal("failed to create server", "err", err)
+	}
+	server.Log = serverLogger{logger}
+	if server.TrustedProxies, err = relayer.ParseTrustedProxies(relay.TrustedProxies); err != nil {
+		fatal("bad TRUSTED_PROXIES", "err", err)
+	}
+	mux := server.Router()
+	for path, handler := range routeHandlers(routes()) {
+		mux.HandleFunc(path, handler)
 	}
-	server.Router().HandleFunc("/", handleWebpage)
-	server.Router().HandleFunc("/create", handleCreateFeed)
 	if err := server.Start("0.0.0.0", 7447); err != nil {
-		log.Fatalf("server terminated: %v", err)
+		fatal("server terminated", "err", err)
 	}
 }
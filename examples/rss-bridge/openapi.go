@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// route is an HTTP endpoint of the bridge. They are all registered from
+// routes, and /openapi.json, if OPENAPI is set, describes them from there too.
+// Routes of the same path are told apart by method, see routeHandlers.
+type route struct {
+	// paths ending in / take the rest of the path as their path param.
+	path    string
+	methods []string
+	summary string
+	// admin routes need the ADMIN_TOKEN, see requireAdmin.
+	admin  bool
+	params []routeParam
+	// body is the JSON the route takes, if any.
+	body any
+	// response is the JSON the route answers with; if nil it answers with
+	// contentType, plain text by default.
+	response    any
+	contentType string
+	handler     http.HandlerFunc
+}
+
+type routeParam struct {
+	name        string
+	description string
+	required    bool
+	// multi params can be given more than once.
+	multi bool
+	// inPath is set for the param that ends the path rather than being in the
+	// query.
+	inPath bool
+}
+
+// apiPath is rt's path as OpenAPI writes it, with its path param.
+func (rt route) apiPath() string {
+	for _, p := range rt.params {
+		if p.inPath {
+			return rt.path + "{" + p.name + "}"
+		}
+	}
+	return rt.path
+}
+
+func routes() []route {
+	pubkey := routeParam{name: "pubkey", description: "hex pubkey of the feed", required: true}
+	rs := []route{
+		{path: "/", methods: []string{"GET"}, summary: "web page listing the public feeds; websocket and NIP-11 requests are answered by the relay",
+			contentType: "text/html", handler: handleWebpage},
+		{path: "/create", methods: []string{"GET", "POST"}, summary: "register a feed, answering with its url and pubkey; credentials are better POSTed as a form",
+			params: []routeParam{
+				{name: "url", description: "the feed, or a page linking to it", required: true},
+				{name: "template", description: "text/template the notes are rendered with"},
+				{name: "history", description: `"full" to emit all the items on the first poll`},
+				{name: "content", description: `"full" to bridge the full text of the items the feed has it for`},
+				{name: "auth", description: "basic, bearer or header"},
+				{name: "auth_name", description: "user, or header name"},
+				{name: "auth_credential", description: "password, token or header value"},
+				{name: "insecure_skip_verify", description: `"true" to not check the feed's certificate, if ALLOW_INSECURE_FEEDS`},
+				{name: "private", description: `"true" to deliver the notes only to the recipients, gift wrapped; needs the ADMIN_TOKEN`},
+				{name: "recipient", description: "hex or npub pubkey private notes go to", multi: true},
+			},
+			handler: handleCreateFeed},
+		{path: "/preview", methods: []string{"GET"}, summary: "the events a feed would be bridged as, signed with a throwaway key, without registering it",
+			params: []routeParam{
+				{name: "url", description: "the feed, or a page linking to it", required: true},
+				{name: "template", description: "text/template the notes are rendered with"},
+				{name: "limit", description: "how many notes, 5 by default and 20 at most"},
+			},
+			response: FeedPreview{}, handler: handlePreviewFeed},
+		{path: "/feed", methods: []string{"POST"}, summary: "register a feed, overriding its profile with the rest of the metadata",
+			body: Metadata{}, response: FeedRegistration{}, handler: handleRegisterFeed},
+		{path: "/feeds", methods: []string{"GET"}, summary: "the public feeds with their profile and last fetch",
+			params:   []routeParam{{name: "q", description: "only the feeds whose name or url contains it"}},
+			response: []FeedListing{}, handler: handleListFeeds},
+		{path: "/feeds/export.opml", methods: []string{"GET"}, summary: "the public feeds as an OPML file to subscribe to them elsewhere",
+			contentType: "text/x-opml", handler: handleExportOPML},
+		{path: "/feed/", methods: []string{"GET"}, summary: "a feed's profile, watermark and whether it parses right now",
+			params:   []routeParam{{name: "pubkey", description: "hex pubkey of the feed", required: true, inPath: true}},
+			response: FeedDetail{}, handler: handleFeedDetail},
+		{path: "/feed/", methods: []string{"DELETE"}, summary: "remove a feed, which stops being polled and served", admin: true,
+			params:   []routeParam{{name: "pubkey", description: "hex pubkey of the feed", required: true, inPath: true}},
+			response: FeedRemoval{}, handler: handleDeleteFeed},
+		{path: "/health", methods: []string{"GET"}, summary: "last fetch of every feed and feed cache stats",
+			response: HealthReport{}, handler: handleHealth},
+		{path: "/healthz", methods: []string{"GET"}, summary: "status of the db, poller and relays, 503 if unhealthy",
+			response: HealthzReport{}, handler: func(w http.ResponseWriter, r *http.Request) { relay.health.ServeHTTP(w, r) }},
+		{path: "/admin/pin", methods: []string{"POST"}, summary: "keep a feed from being evicted", admin: true,
+			params: []routeParam{pubkey, {name: "pinned", description: `"false" to unpin`}}, handler: handlePinFeed},
+		{path: "/admin/outbox", methods: []string{"POST"}, summary: "set the relays a feed's events also go to", admin: true,
+			params: []routeParam{pubkey,
+				{name: "relays", description: "comma separated ws or wss urls, none to clear"},
+				{name: "only", description: `"true" to not send to RELAYS`}},
+			handler: handleSetOutbox},
+		{path: "/admin/refresh", methods: []string{"POST"}, summary: "fetch a feed again right away", admin: true,
+			params: []routeParam{pubkey}, handler: handleRefreshFeed},
+		{path: "/admin/rotate", methods: []string{"POST"}, summary: "move a feed to the key derived from the current SECRET", admin: true,
+			params: []routeParam{pubkey, {name: "announce", description: `"true" to tell followers with a note`}}, handler: handleRotateKey},
+		{path: "/admin/keys/audit", methods: []string{"GET"}, summary: "every feed's stored and derived pubkeys", admin: true,
+			handler: handleAuditKeys},
+		{path: "/admin/export", methods: []string{"GET"}, summary: "dump every registered feed", admin: true,
+			response: RegistryDump{}, handler: handleExportRegistry},
+		{path: "/admin/import", methods: []string{"POST"}, summary: "restore the feeds of a dump made with the same ADMIN_TOKEN", admin: true,
+			body: RegistryDump{}, response: ImportResult{}, handler: handleImportRegistry},
+		{path: "/admin/deliveries", methods: []string{"GET"}, summary: "events waiting for each relay, none listed without RELAYS or outbox relays", admin: true,
+			response: map[string]UpstreamStatus{}, handler: handleDeliveries},
+	}
+	if relay.OpenAPI {
+		rs = append(rs, route{path: "/openapi.json", methods: []string{"GET"}, summary: "this description",
+			contentType: "application/json", handler: handleOpenAPI})
+	}
+	return rs
+}
+
+func (rt route) handle() http.HandlerFunc {
+	if rt.admin {
+		return logRequests(requireAdmin(rt.handler))
+	}
+	return logRequests(rt.handler)
+}
+
+// routeHandlers are the handlers of rs by path, each passing requests on to
+// the route of their path taking their method.
+func routeHandlers(rs []route) map[string]http.HandlerFunc {
+	byPath := map[string][]route{}
+	for _, rt := range rs {
+		byPath[rt.path] = append(byPath[rt.path], rt)
+	}
+
+	handlers := make(map[string]http.HandlerFunc, len(byPath))
+	for path, rs := range byPath {
+		if len(rs) == 1 {
+			handlers[path] = rs[0].handle()
+			continue
+		}
+		byMethod := map[string]http.HandlerFunc{}
+		for _, rt := range rs {
+			for _, method := range rt.methods {
+				byMethod[method] = rt.handle()
+			}
+		}
+		notAllowed := logRequests(func(w http.ResponseWriter, r *http.Request) {
+			httpError(w, r, 405, "method not allowed")
+		})
+		handlers[path] = func(w http.ResponseWriter, r *http.Request) {
+			if handler, ok := byMethod[r.Method]; ok {
+				handler(w, r)
+			} else {
+				notAllowed(w, r)
+			}
+		}
+	}
+	return handlers
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(openAPI(routes()))
+}
+
+// openAPI is the OpenAPI 3 document describing rs.
+func openAPI(rs []route) map[string]any {
+	errorResponse := map[string]any{
+		"description": "error",
+		"content": map[string]any{"application/json": map[string]any{"schema": map[string]any{
+			"type":     "object",
+			"required": []string{"error"},
+			"properties": map[string]any{
+				"error":      map[string]any{"type": "string"},
+				"request_id": map[string]any{"type": "string"},
+			},
+		}}},
+	}
+
+	paths := map[string]any{}
+	for _, rt := range rs {
+		contentType, schema := rt.contentType, map[string]any{"type": "string"}
+		if rt.response != nil {
+			contentType, schema = "application/json", jsonSchema(reflect.TypeOf(rt.response), map[reflect.Type]bool{})
+		} else if contentType == "" {
+			contentType = "text/plain"
+		}
+
+		var params []any
+		for _, p := range rt.params {
+			in := "query"
+			if p.inPath {
+				in = "path"
+			}
+			param := map[string]any{
+				"name":        p.name,
+				"in":          in,
+				"description": p.description,
+				"required":    p.required,
+				"schema":      map[string]any{"type": "string"},
+			}
+			if p.multi {
+				param["schema"] = map[string]any{"type": "array", "items": map[string]any{"type": "string"}}
+			}
+			params = append(params, param)
+		}
+
+		item, _ := paths[rt.apiPath()].(map[string]any)
+		if item == nil {
+			item = map[string]any{}
+		}
+		for _, method := range rt.methods {
+			op := map[string]any{
+				"summary": rt.summary,
+				"responses": map[string]any{
+					"200":     map[string]any{"description": "ok", "content": map[string]any{contentType: map[string]any{"schema": schema}}},
+					"default": errorResponse,
+				},
+			}
+			if params != nil {
+				op["parameters"] = params
+			}
+			if rt.body != nil {
+				op["requestBody"] = map[string]any{
+					"required": true,
+					"content":  map[string]any{"application/json": map[string]any{"schema": jsonSchema(reflect.TypeOf(rt.body), map[reflect.Type]bool{})}},
+				}
+			}
+			if rt.admin {
+				op["security"] = []any{map[string]any{"adminToken": []string{}}}
+			}
+			item[strings.ToLower(method)] = op
+		}
+		paths[rt.apiPath()] = item
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "rss-bridge",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"securitySchemes": map[string]any{
+				"adminToken": map[string]any{"type": "http", "scheme": "bearer", "description": "the ADMIN_TOKEN"},
+			},
+		},
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// jsonSchema describes the JSON encoding/json makes of t. Types already being
+// described further up, seen, are left open to not recurse forever.
+func jsonSchema(t reflect.Type, seen map[reflect.Type]bool) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": jsonSchema(t.Elem(), seen)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": jsonSchema(t.Elem(), seen)}
+	case reflect.Struct:
+		if seen[t] {
+			return map[string]any{"type": "object"}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+
+		properties := map[string]any{}
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = jsonSchema(field.Type, seen)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+		schema := map[string]any{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			sort.Strings(required)
+			schema["required"] = required
+		}
+		return schema
+	}
+	// interfaces and the like can be anything
+	return map[string]any{}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPI(t *testing.T) {
+	setupTestRelay(t)
+	for _, rt := range routes() {
+		if rt.path == "/openapi.json" {
+			t.Fatal("/openapi.json is served without OPENAPI")
+		}
+	}
+
+	relay.OpenAPI = true
+	t.Cleanup(func() { relay.OpenAPI = false })
+	mux := http.NewServeMux()
+	for path, handler := range routeHandlers(routes()) {
+		mux.HandleFunc(path, handler)
+	}
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/openapi.json")
+	if err != nil {
+		t.Fatalf("GET /openapi.json: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("content-type") != "application/json" {
+		t.Fatalf("GET /openapi.json = %d %s", resp.StatusCode, resp.Header.Get("content-type"))
+	}
+
+	var doc struct {
+		OpenAPI string `json:"openapi"`
+		Info    struct {
+			Title   string `json:"title"`
+			Version string `json:"version"`
+		} `json:"info"`
+		Paths map[string]map[string]struct {
+			Summary    string `json:"summary"`
+			Parameters []struct {
+				Name   string         `json:"name"`
+				In     string         `json:"in"`
+				Schema map[string]any `json:"schema"`
+			} `json:"parameters"`
+			Responses map[string]struct {
+				Description string                    `json:"description"`
+				Content     map[string]map[string]any `json:"content"`
+			} `json:"responses"`
+			Security []map[string][]string `json:"security"`
+		} `json:"paths"`
+		Components struct {
+			SecuritySchemes map[string]any `json:"securitySchemes"`
+		} `json:"components"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatalf("decoding the document: %v", err)
+	}
+
+	// what the spec requires of it
+	if !strings.HasPrefix(doc.OpenAPI, "3.") || doc.Info.Title == "" || doc.Info.Version == "" {
+		t.Errorf("openapi %q, info %+v; want 3.x with a title and version", doc.OpenAPI, doc.Info)
+	}
+	for path, item := range doc.Paths {
+		if !strings.HasPrefix(path, "/") {
+			t.Errorf("path %q doesn't start with /", path)
+		}
+		for method, op := range item {
+			if method != "get" && method != "post" && method != "delete" {
+				t.Errorf("%s: unexpected method %q", path, method)
+			}
+			if len(op.Responses) == 0 {
+				t.Errorf("%s %s: no responses", path, method)
+			}
+			for status, response := range op.Responses {
+				if response.Description == "" {
+					t.Errorf("%s %s %s: no description", path, method, status)
+				}
+				for contentType, media := range response.Content {
+					if media["schema"] == nil {
+						t.Errorf("%s %s %s %s: no schema", path, method, status, contentType)
+					}
+				}
+			}
+			for _, param := range op.Parameters {
+				if param.Name == "" || (param.In != "query" && param.In != "path") || param.Schema == nil {
+					t.Errorf("%s %s: bad parameter %+v", path, method, param)
+				}
+				if param.In == "path" && !strings.Contains(path, "{"+param.Name+"}") {
+					t.Errorf("%s %s: path parameter %s isn't in the path", path, method, param.Name)
+				}
+			}
+			for _, requirement := range op.Security {
+				for scheme := range requirement {
+					if doc.Components.SecuritySchemes[scheme] == nil {
+						t.Errorf("%s %s: undefined security scheme %q", path, method, scheme)
+					}
+				}
+			}
+		}
+	}
+
+	// every registered route is there
+	for _, rt := range routes() {
+		item, ok := doc.Paths[rt.apiPath()]
+		if !ok {
+			t.Errorf("%s is missing", rt.apiPath())
+			continue
+		}
+		for _, method := range rt.methods {
+			op, ok := item[strings.ToLower(method)]
+			if !ok {
+				t.Errorf("%s %s is missing", method, rt.path)
+			} else if rt.admin != (len(op.Security) > 0) {
+				t.Errorf("%s %s: security %v; want it only on admin routes", method, rt.path, op.Security)
+			}
+		}
+	}
+	for _, core := range []string{"/", "/create", "/feed/{pubkey}", "/health", "/healthz", "/admin/export", "/openapi.json"} {
+		if _, ok := doc.Paths[core]; !ok {
+			t.Errorf("%s is missing", core)
+		}
+	}
+
+	create := doc.Paths["/create"]["post"]
+	if len(create.Parameters) == 0 || create.Parameters[0].Name != "url" {
+		t.Errorf("/create parameters = %+v; want url first", create.Parameters)
+	}
+	health, _ := json.Marshal(doc.Paths["/health"]["get"].Responses["200"].Content["application/json"]["schema"])
+	for _, want := range []string{`"feeds"`, `"last_fetch"`, `"date-time"`, `"stale_served"`} {
+		if !strings.Contains(string(health), want) {
+			t.Errorf("/health schema %s doesn't have %s", health, want)
+		}
+	}
+}
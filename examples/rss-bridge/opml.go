@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"time"
+)
+
+// opmlFilename is what GET /feeds/export.opml is saved as.
+const opmlFilename = "rss-bridge-feeds.opml"
+
+// OPML is an OPML 2.0 subscription list, one outline per feed.
+type OPML struct {
+	XMLName xml.Name      `xml:"opml"`
+	Version string        `xml:"version,attr"`
+	Title   string        `xml:"head>title"`
+	Created string        `xml:"head>dateCreated"`
+	Feeds   []OPMLOutline `xml:"body>outline"`
+}
+
+type OPMLOutline struct {
+	Type   string `xml:"type,attr"`
+	Text   string `xml:"text,attr"`
+	Title  string `xml:"title,attr,omitempty"`
+	XMLURL string `xml:"xmlUrl,attr"`
+}
+
+// feedsOPML is the OPML of listings. Feeds without a name are named after
+// their url, as OPML wants every outline to have some text.
+func feedsOPML(listings []FeedListing, now time.Time) OPML {
+	doc := OPML{Version: "2.0", Title: "rss-bridge feeds", Created: now.UTC().Format(time.RFC1123Z), Feeds: []OPMLOutline{}}
+	for _, listing := range listings {
+		outline := OPMLOutline{Type: "rss", Text: listing.Name, Title: listing.Name, XMLURL: listing.URL}
+		if outline.Text == "" {
+			outline.Text = listing.URL
+		}
+		doc.Feeds = append(doc.Feeds, outline)
+	}
+	return doc
+}
+
+// handleExportOPML writes the public feeds, as GET /feeds lists them, as an
+// OPML file to subscribe to them elsewhere.
+func handleExportOPML(w http.ResponseWriter, r *http.Request) {
+	listings, err := listFeeds(relay.db, "")
+	if err != nil {
+		httpError(w, r, 500, err.Error())
+		return
+	}
+	body, err := xml.MarshalIndent(feedsOPML(listings, time.Now()), "", "  ")
+	if err != nil {
+		httpError(w, r, 500, err.Error())
+		return
+	}
+	w.Header().Set("content-type", "text/x-opml; charset=utf-8")
+	w.Header().Set("content-disposition", `attachment; filename="`+opmlFilename+`"`)
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+	w.Write([]byte("\n"))
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/fiatjaf/relayer/v2"
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+type pollerConfig struct {
+	DB *pebble.DB
+	// LastEmitted holds, for each feed url, the nostr.Timestamp of the newest item emitted.
+	// It is also kept in DB, see loadWatermarks.
+	LastEmitted *sync.Map
+	Updates     chan<- nostr.Event
+	// Broadcaster, if set, also publishes emitted events to other relays.
+	Broadcaster *broadcaster
+	// Interval between passes, each one randomly delayed by up to Jitter more.
+	Interval time.Duration
+	Jitter   time.Duration
+	// Timeout bounds a single pass over all the feeds, defaults to Interval.
+	Timeout time.Duration
+	// MaxInitialAge, if set, skips items older than this on the first poll of a feed,
+	// unless the feed asked for its FullHistory.
+	MaxInitialAge time.Duration
+	// RegisterHorizon, if set, skips items older than this before the feed
+	// was registered, see Entity.horizon.
+	RegisterHorizon time.Duration
+	// InjectRate, if set, is how many events of a single feed are emitted per
+	// Interval at most. The oldest new items beyond that are dropped.
+	InjectRate int
+	// Digest, if set, collects new items and emits a single note listing them
+	// once per Digest instead of a note for each, see pendingDigest.
+	Digest time.Duration
+	// DeadThreshold, if set, stops polling the feeds that are dead for it, see
+	// Entity.dead, and PruneDead removes them after each pass.
+	DeadThreshold time.Duration
+	PruneDead     bool
+	// StreamFeeds reads each feed only up to its first item that won't be
+	// emitted, see STREAM_FEEDS.
+	StreamFeeds bool
+}
+
+// poller checks the feeds clients are currently listening to and emits their new items.
+type poller struct {
+	db          *pebble.DB
+	lastEmitted *sync.Map
+	updates     chan<- nostr.Event
+	broadcaster *broadcaster
+	interval    time.Duration
+	jitter      time.Duration
+	timeout     time.Duration
+	maxInitial  time.Duration
+	horizon     time.Duration
+	digest      time.Duration
+	inject      *injectLimiter
+	dead        time.Duration
+	prune       bool
+	stream      bool
+
+	// overridable in tests
+	after   func(time.Duration) <-chan time.Time
+	filters func() nostr.Filters
+	now     func() time.Time
+}
+
+func newPoller(cfg pollerConfig) *poller {
+	p := &poller{
+		db:          cfg.DB,
+		lastEmitted: cfg.LastEmitted,
+		updates:     cfg.Updates,
+		broadcaster: cfg.Broadcaster,
+		interval:    cfg.Interval,
+		jitter:      cfg.Jitter,
+		timeout:     cfg.Timeout,
+		maxInitial:  cfg.MaxInitialAge,
+		horizon:     cfg.RegisterHorizon,
+		digest:      cfg.Digest,
+		dead:        cfg.DeadThreshold,
+		prune:       cfg.PruneDead,
+		stream:      cfg.StreamFeeds,
+		after:       time.After,
+		filters:     relayer.GetListeningFilters,
+		now:         time.Now,
+	}
+	if p.timeout == 0 {
+		p.timeout = p.interval
+	}
+	if cfg.InjectRate > 0 {
+		p.inject = newInjectLimiter(cfg.InjectRate, cfg.Interval)
+	}
+	return p
+}
+
+// start runs passes periodically in the background until the returned function is called.
+func (p *poller) start() (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+		for {
+			delay := p.interval
+			if p.jitter > 0 {
+				delay += time.Duration(rand.Int63n(int64(p.jitter)))
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.after(delay):
+			}
+
+			passCtx, passCancel := context.WithTimeout(ctx, p.timeout)
+			p.pass(passCtx)
+			passCancel()
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-finished
+	}
+}
+
+func (p *poller) pass(ctx context.Context) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("poll pass panicked", "panic", r)
+		}
+	}()
+
+	start := time.Now()
+	filters := p.filters()
+	feeds, emitted, failed := p.poll(ctx, filters)
+	recordPollPass(time.Now())
+	logger.Info("poll pass", "filters", len(filters), "feeds", feeds, "emitted", emitted,
+		"failures", failed, "duration", time.Since(start).Round(time.Millisecond))
+
+	if p.prune && p.dead > 0 {
+		pruned, err := pruneDeadFeeds(p.db, p.dead, p.now())
+		if err != nil {
+			logger.Error("failed to prune dead feeds", "err", err)
+		}
+		for _, pubkey := range pruned {
+			logger.Info("pruned dead feed", "pubkey", pubkey)
+		}
+	}
+}
+
+// poll emits new items from every feed that is being listened to by the given filters.
+func (p *poller) poll(ctx context.Context, filters nostr.Filters) (feeds, emitted, failed int) {
+	pubkeys := make([]string, 0, len(filters))
+	for _, filter := range filters {
+		if filter.Kinds == nil || slices.Contains(filter.Kinds, nostr.KindTextNote) {
+			for _, pubkey := range filter.Authors {
+				if !slices.Contains(pubkeys, pubkey) {
+					pubkeys = append(pubkeys, pubkey)
+				}
+			}
+		}
+	}
+
+	for _, pubkey := range pubkeys {
+		if ctx.Err() != nil {
+			logger.Warn("poll pass interrupted", "err", ctx.Err())
+			break
+		}
+
+		n, err := p.pollFeed(ctx, pubkey)
+		emitted += n
+		if err == errNotAFeed || err == errDeadFeed {
+			continue
+		}
+		feeds++
+		if err != nil {
+			logger.Warn("failed to poll feed", "pubkey", pubkey, "err", err)
+			failed++
+		}
+	}
+
+	return feeds, emitted, failed
+}
+
+var (
+	errNotAFeed = errors.New("not a feed")
+	errDeadFeed = errors.New("dead feed")
+)
+
+func (p *poller) pollFeed(ctx context.Context, pubkey string) (emitted int, err error) {
+	// one bad feed shouldn't take the whole loop down
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	entity, err := loadEntity(p.db, pubkey)
+	if err == pebble.ErrNotFound || entity.MovedTo != "" {
+		return 0, errNotAFeed
+	} else if err != nil {
+		return 0, fmt.Errorf("got invalid json from db: %w", err)
+	}
+	if entity.dead(p.dead, p.now()) {
+		return 0, errDeadFeed
+	}
+
+	last, _ := p.lastEmitted.Load(entity.URL)
+	watermark, _ := last.(nostr.Timestamp)
+
+	// on the first poll, don't flood followers with the feed's whole archive
+	first := !entity.polled()
+	var cutoff, skipped nostr.Timestamp
+	if first {
+		cutoff = entity.cutoff(p.maxInitial, p.horizon, p.now())
+	}
+
+	// a streamed feed is read up to its first item that won't be emitted,
+	// taking it to list its newest items first as feeds do
+	more := !p.stream
+
+	var events []nostr.Event
+	var items []digestItem
+	var newest nostr.Timestamp
+	// the first-seen times of what is in the feed, when all of it is read
+	var current map[string]bool
+	if more && usesFirstSeen() {
+		current = make(map[string]bool)
+	}
+	_, err = feedItems(fresh(ctx), pubkey, entity, func(thread *threader, item *gofeed.Item) bool {
+		if key := firstSeenKey(pubkey, item); current != nil && key != nil {
+			current[string(key)] = true
+		}
+		evt := thread.note(item)
+		if evt.CreatedAt > newest {
+			newest = evt.CreatedAt
+		}
+		if evt.CreatedAt < cutoff {
+			if evt.CreatedAt > skipped {
+				skipped = evt.CreatedAt
+			}
+			return more
+		}
+		if evt.CreatedAt <= watermark {
+			return more
+		}
+		events = append(events, evt)
+		if p.digest > 0 {
+			items = append(items, newDigestItem(item, evt.CreatedAt))
+		}
+		return true
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse feed at url %q: %w", entity.URL, err)
+	}
+
+	// so the skipped items don't show up on later polls either, unless feedEvents
+	// or an earlier poll already moved the watermark past them
+	last, _ = p.lastEmitted.Load(entity.URL)
+	if current, _ := last.(nostr.Timestamp); skipped > current {
+		p.setWatermark(entity.URL, skipped)
+	}
+
+	if p.digest > 0 {
+		if emitted, err = p.collectDigest(ctx, pubkey, entity, items); err != nil {
+			return emitted, err
+		}
+	} else {
+		// oldest first, so the watermark stays correct if we're interrupted
+		sort.SliceStable(events, func(i, j int) bool { return events[i].CreatedAt < events[j].CreatedAt })
+
+		if p.inject != nil && len(events) > 0 {
+			if allowed := p.inject.take(entity.URL, len(events), p.now()); allowed < len(events) {
+				dropped := len(events) - allowed
+				logger.Warn("dropping items over FEED_INJECT_RATE", "url", entity.URL, "dropped", dropped)
+				recordDropped(entity.URL, dropped)
+				// the watermark still moves past them
+				p.setWatermark(entity.URL, events[dropped-1].CreatedAt)
+				events = events[dropped:]
+			}
+		}
+
+		for _, evt := range events {
+			evt.Sign(entity.PrivateKey)
+			if err := p.emit(ctx, entity, evt); err != nil {
+				return emitted, err
+			}
+			emitted++
+			p.setWatermark(entity.URL, evt.CreatedAt)
+		}
+	}
+
+	if current != nil {
+		last, _ = p.lastEmitted.Load(entity.URL)
+		watermark, _ := last.(nostr.Timestamp)
+		if err := pruneFirstSeen(p.db, pubkey, current, watermark); err != nil {
+			logger.Error("failed to prune first-seen times", "url", entity.URL, "err", err)
+		}
+	}
+
+	// only what the poll learnt is stored, on the feed as it is now: it may have
+	// been changed, or removed, meanwhile
+	now := p.now()
+	entity, err = updateEntity(p.db, pubkey, func(stored *Entity) {
+		if date := newest.Time(); newest > 0 && date.After(stored.LastNewItem) {
+			stored.LastNewItem = date
+		}
+		stored.LastPolled = now
+		if first {
+			stored.FirstPolled = now
+		}
+	})
+	if err == pebble.ErrNotFound {
+		return emitted, nil
+	} else if err != nil {
+		return emitted, fmt.Errorf("failed to store feed: %w", err)
+	}
+	if !entity.LastNewItem.IsZero() {
+		recordNewItem(entity.URL, entity.LastNewItem)
+	}
+
+	return emitted, nil
+}
+
+// emit sends out the signed event evt of entity.
+func (p *poller) emit(ctx context.Context, entity Entity, evt nostr.Event) error {
+	feed := evt.PubKey
+	out, err := outgoing(entity, evt)
+	if err != nil {
+		return err
+	}
+	for _, evt := range out {
+		select {
+		case p.updates <- evt:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		// queued before the watermark moves past it, so it isn't lost to a crash
+		if p.broadcaster != nil {
+			p.broadcaster.send(feed, entity, evt)
+		}
+	}
+	return nil
+}
+
+func (p *poller) setWatermark(url string, ts nostr.Timestamp) {
+	p.lastEmitted.Store(url, ts)
+	if err := saveWatermark(p.db, url, ts); err != nil {
+		logger.Error("failed to store watermark", "url", url, "err", err)
+	}
+}
+
+// collectDigest adds the new items to the feed's pending digest and emits the
+// digest if its interval is over, returning how many were emitted.
+func (p *poller) collectDigest(ctx context.Context, pubkey string, entity Entity, items []digestItem) (int, error) {
+	digest, err := loadDigest(p.db, pubkey)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load digest: %w", err)
+	}
+
+	if len(items) > 0 {
+		sort.SliceStable(items, func(i, j int) bool { return items[i].CreatedAt < items[j].CreatedAt })
+		if len(digest.Items) == 0 {
+			digest.Started = p.now()
+		}
+		digest.Items = append(digest.Items, items...)
+		if err := saveDigest(p.db, pubkey, digest); err != nil {
+			return 0, fmt.Errorf("failed to store digest: %w", err)
+		}
+		p.setWatermark(entity.URL, items[len(items)-1].CreatedAt)
+	}
+
+	now := p.now()
+	if !digest.due(now, p.digest) {
+		return 0, nil
+	}
+	evt := digest.note(pubkey, now)
+	evt.Sign(entity.PrivateKey)
+	if err := p.emit(ctx, entity, evt); err != nil {
+		return 0, err
+	}
+	// a crash right here sends the digest again, which beats losing it
+	if err := deleteDigest(p.db, pubkey); err != nil {
+		return 1, fmt.Errorf("failed to clear digest: %w", err)
+	}
+	return 1, nil
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestPollerEmitsOnce(t *testing.T) {
+	setupTestRelay(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+	defer srv.Close()
+
+	pubkey, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+
+	updates := make(chan nostr.Event, 10)
+	p := newPoller(pollerConfig{
+		DB:          relay.db,
+		LastEmitted: &sync.Map{},
+		Updates:     updates,
+	})
+	filters := nostr.Filters{{Authors: []string{pubkey}}, {Authors: []string{pubkey}, Kinds: []int{1}}}
+
+	p.poll(context.Background(), filters)
+	if n := len(updates); n != 2 {
+		t.Fatalf("first poll emitted %d events, want 2", n)
+	}
+	for i := 0; i < 2; i++ {
+		evt := <-updates
+		if evt.PubKey != pubkey {
+			t.Errorf("event pubkey = %s; want %s", evt.PubKey, pubkey)
+		}
+		if ok, _ := evt.CheckSignature(); !ok {
+			t.Error("event isn't signed")
+		}
+	}
+
+	p.poll(context.Background(), filters)
+	if n := len(updates); n != 0 {
+		t.Errorf("second poll emitted %d events, want 0", n)
+	}
+}
+
+func TestPollerKeepsRemovedFeedRemoved(t *testing.T) {
+	setupTestRelay(t)
+	var pubkey string
+	var polling atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if polling.Load() {
+			// DELETE /feed/{pubkey} lands while the feed is being polled
+			if _, err := removeFeed(relay.db, pubkey); err != nil {
+				t.Errorf("removeFeed: %v", err)
+			}
+		}
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+	defer srv.Close()
+
+	pubkey, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+
+	p := newPoller(pollerConfig{
+		DB:          relay.db,
+		LastEmitted: &sync.Map{},
+		Updates:     make(chan nostr.Event, 10),
+	})
+	feeds.Flush()
+	polling.Store(true)
+	if _, err := p.pollFeed(context.Background(), pubkey); err != nil {
+		t.Fatalf("pollFeed: %v", err)
+	}
+	if _, err := loadEntity(relay.db, pubkey); err == nil {
+		t.Error("the poll stored the removed feed again")
+	}
+}
+
+func TestPollerPeriodic(t *testing.T) {
+	ticks := make(chan time.Time)
+	passes := 0
+	p := newPoller(pollerConfig{Interval: time.Minute, Jitter: time.Second})
+	p.after = func(time.Duration) <-chan time.Time { return ticks }
+	p.filters = func() nostr.Filters {
+		passes++
+		if passes == 2 {
+			panic("passes must survive bad feeds")
+		}
+		return nil
+	}
+
+	stop := p.start()
+	for i := 0; i < 3; i++ {
+		select {
+		case ticks <- time.Now():
+		case <-time.After(time.Second):
+			t.Fatalf("pass %d didn't start", i+1)
+		}
+	}
+
+	stopped := make(chan struct{})
+	go func() { stop(); close(stopped) }()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("stop didn't return")
+	}
+
+	if passes != 3 {
+		t.Errorf("got %d passes, want 3", passes)
+	}
+}
+
+func TestPollerSkipsOldItemsOnFirstPoll(t *testing.T) {
+	recent := time.Now().Add(-time.Hour).UTC().Format(time.RFC1123)
+	feed := `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>archive</title><link>https://example.com</link>
+<item><title>ancient</title><link>https://example.com/1</link><description>ancient item</description><pubDate>Mon, 02 Jan 2006 15:04:05 GMT</pubDate></item>
+<item><title>old</title><link>https://example.com/2</link><description>old item</description><pubDate>Tue, 03 Jan 2023 15:04:05 GMT</pubDate></item>
+<item><title>recent</title><link>https://example.com/3</link><description>recent item</description><pubDate>` + recent + `</pubDate></item>
+</channel></rss>`
+
+	for _, tt := range []struct {
+		name        string
+		fullHistory bool
+		want        int
+	}{
+		{"recent only", false, 1},
+		{"full history", true, 3},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestRelay(t)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/rss+xml")
+				fmt.Fprint(w, feed)
+			}))
+			defer srv.Close()
+
+			pubkey, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{FullHistory: tt.fullHistory})
+			if err != nil {
+				t.Fatalf("Feed: %v", err)
+			}
+
+			updates := make(chan nostr.Event, 10)
+			lastEmitted := &sync.Map{}
+			p := newPoller(pollerConfig{
+				DB:            relay.db,
+				LastEmitted:   lastEmitted,
+				Updates:       updates,
+				MaxInitialAge: 7 * 24 * time.Hour,
+			})
+			filters := nostr.Filters{{Authors: []string{pubkey}, Kinds: []int{1}}}
+
+			p.poll(context.Background(), filters)
+			if n := len(updates); n != tt.want {
+				t.Fatalf("first poll emitted %d events, want %d", n, tt.want)
+			}
+			for len(updates) > 0 {
+				<-updates
+			}
+
+			// the skipped items don't come back later, even after a restart
+			p.poll(context.Background(), filters)
+			lastEmitted = &sync.Map{}
+			loadWatermarks(relay.db, lastEmitted)
+			p.lastEmitted = lastEmitted
+			p.poll(context.Background(), filters)
+			if n := len(updates); n != 0 {
+				t.Errorf("later polls emitted %d events, want 0", n)
+			}
+		})
+	}
+}
+
+func TestPollerUsesItsClock(t *testing.T) {
+	setupTestRelay(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>archive</title><link>https://example.com</link>
+<item><title>ancient</title><link>https://example.com/1</link><description>ancient item</description><pubDate>Mon, 02 Jan 2006 15:04:05 GMT</pubDate></item>
+<item><title>old</title><link>https://example.com/2</link><description>old item</description><pubDate>Tue, 03 Jan 2023 15:04:05 GMT</pubDate></item>
+</channel></rss>`)
+	}))
+	defer srv.Close()
+
+	pubkey, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+
+	updates := make(chan nostr.Event, 10)
+	p := newPoller(pollerConfig{
+		DB:            relay.db,
+		LastEmitted:   &sync.Map{},
+		Updates:       updates,
+		MaxInitialAge: 7 * 24 * time.Hour,
+	})
+	now := time.Date(2023, 1, 5, 0, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+
+	p.poll(context.Background(), nostr.Filters{{Authors: []string{pubkey}, Kinds: []int{1}}})
+	if n := len(updates); n != 1 {
+		t.Errorf("first poll emitted %d events, want the one within a week of the poller's now", n)
+	}
+	entity, err := loadEntity(relay.db, pubkey)
+	if err != nil {
+		t.Fatalf("loadEntity: %v", err)
+	}
+	if !entity.LastPolled.Equal(now) || !entity.FirstPolled.Equal(now) {
+		t.Errorf("polled at %v, first at %v; want the poller's now %v", entity.LastPolled, entity.FirstPolled, now)
+	}
+}
+
+func TestPollerCutoffSurvivesEarlyREQ(t *testing.T) {
+	setupTestRelay(t)
+	relay.MaxInitialAge = 7 * 24 * time.Hour
+	t.Cleanup(func() { relay.MaxInitialAge = 0 })
+	recent := time.Now().Add(-time.Hour).UTC().Format(time.RFC1123)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>archive</title><link>https://example.com</link>
+<item><title>old</title><link>https://example.com/1</link><description>old item</description><pubDate>Tue, 03 Jan 2023 15:04:05 GMT</pubDate></item>
+<item><title>recent</title><link>https://example.com/2</link><description>recent item</description><pubDate>`+recent+`</pubDate></item>
+</channel></rss>`)
+	}))
+	defer srv.Close()
+
+	pubkey, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+
+	// a REQ matching nothing, before the feed was ever polled
+	future := nostr.Timestamp(time.Now().Add(time.Hour).Unix())
+	if evts := feedEvents(context.Background(), pubkey, &nostr.Filter{Authors: []string{pubkey}, Kinds: []int{1}, Since: &future}); len(evts) != 0 {
+		t.Fatalf("served %d notes from the future", len(evts))
+	}
+	if _, ok := relay.lastEmitted.Load(srv.URL); ok {
+		t.Error("a REQ serving nothing stored a watermark")
+	}
+
+	updates := make(chan nostr.Event, 10)
+	p := newPoller(pollerConfig{
+		DB:            relay.db,
+		LastEmitted:   &relay.lastEmitted,
+		Updates:       updates,
+		MaxInitialAge: relay.MaxInitialAge,
+	})
+	p.poll(context.Background(), nostr.Filters{{Authors: []string{pubkey}, Kinds: []int{1}}})
+	if n := len(updates); n != 1 {
+		t.Errorf("first poll emitted %d events, want only the recent one", n)
+	}
+
+	// REQs don't serve what the first poll skipped either
+	feeds.Flush()
+	if evts := feedEvents(context.Background(), pubkey, &nostr.Filter{Authors: []string{pubkey}, Kinds: []int{1}}); len(evts) != 1 {
+		t.Errorf("served %d notes, want only the recent one", len(evts))
+	}
+}
+
+func TestPollerSkipsAllOldItems(t *testing.T) {
+	setupTestRelay(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+	defer srv.Close()
+
+	pubkey, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+
+	updates := make(chan nostr.Event, 10)
+	lastEmitted := &sync.Map{}
+	p := newPoller(pollerConfig{
+		DB:            relay.db,
+		LastEmitted:   lastEmitted,
+		Updates:       updates,
+		MaxInitialAge: 7 * 24 * time.Hour,
+	})
+	filters := nostr.Filters{{Authors: []string{pubkey}, Kinds: []int{1}}}
+
+	p.poll(context.Background(), filters)
+	if n := len(updates); n != 0 {
+		t.Fatalf("first poll emitted %d events, want 0", n)
+	}
+	if last, ok := lastEmitted.Load(srv.URL); !ok || last.(nostr.Timestamp) == 0 {
+		t.Errorf("watermark = %v; want the newest skipped item", last)
+	}
+
+	p.poll(context.Background(), filters)
+	if n := len(updates); n != 0 {
+		t.Errorf("second poll emitted %d events, want 0", n)
+	}
+}
+
+func TestPollerKeepsNewerWatermark(t *testing.T) {
+	setupTestRelay(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+	defer srv.Close()
+
+	pubkey, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+
+	// already moved past the old items the first poll skips
+	ahead := nostr.Timestamp(time.Now().Unix())
+	lastEmitted := &sync.Map{}
+	lastEmitted.Store(srv.URL, ahead)
+	p := newPoller(pollerConfig{
+		DB:            relay.db,
+		LastEmitted:   lastEmitted,
+		Updates:       make(chan nostr.Event, 10),
+		MaxInitialAge: 7 * 24 * time.Hour,
+	})
+	p.poll(context.Background(), nostr.Filters{{Authors: []string{pubkey}, Kinds: []int{1}}})
+	if last, _ := lastEmitted.Load(srv.URL); last != ahead {
+		t.Errorf("watermark = %v; want it left at %v", last, ahead)
+	}
+}
+
+func TestPollerRegisterHorizon(t *testing.T) {
+	old := time.Now().Add(-72 * time.Hour).UTC().Format(time.RFC1123)
+	recent := time.Now().Add(-time.Hour).UTC().Format(time.RFC1123)
+	feed := `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>archive</title><link>https://example.com</link>
+<item><title>old</title><link>https://example.com/1</link><description>old item</description><pubDate>` + old + `</pubDate></item>
+<item><title>recent</title><link>https://example.com/2</link><description>recent item</description><pubDate>` + recent + `</pubDate></item>
+</channel></rss>`
+
+	for _, tt := range []struct {
+		name        string
+		fullHistory bool
+		want        int
+	}{
+		{"within the horizon", false, 1},
+		{"full history", true, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestRelay(t)
+			relay.RegisterHorizon = 24 * time.Hour
+			t.Cleanup(func() { relay.RegisterHorizon = 0 })
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/rss+xml")
+				fmt.Fprint(w, feed)
+			}))
+			defer srv.Close()
+
+			pubkey, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{FullHistory: tt.fullHistory})
+			if err != nil {
+				t.Fatalf("Feed: %v", err)
+			}
+
+			updates := make(chan nostr.Event, 10)
+			p := newPoller(pollerConfig{
+				DB:              relay.db,
+				LastEmitted:     &sync.Map{},
+				Updates:         updates,
+				RegisterHorizon: relay.RegisterHorizon,
+			})
+			filters := nostr.Filters{{Authors: []string{pubkey}, Kinds: []int{1}}}
+
+			p.poll(context.Background(), filters)
+			if n := len(updates); n != tt.want {
+				t.Errorf("first poll emitted %d events, want %d", n, tt.want)
+			}
+
+			feeds.Flush()
+			evts := feedEvents(context.Background(), pubkey, &nostr.Filter{Authors: []string{pubkey}, Kinds: []int{1}})
+			if len(evts) != tt.want {
+				t.Errorf("served %d notes, want %d", len(evts), tt.want)
+			}
+		})
+	}
+}
+
+func TestPollerInjectRate(t *testing.T) {
+	setupTestRelay(t)
+	base := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	items := 10
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, `<?xml version="1.0"?><rss version="2.0"><channel><title>noisy</title><link>https://example.com</link>`)
+		for i := 0; i < items; i++ {
+			fmt.Fprintf(w, `<item><title>item %d</title><link>https://example.com/%d</link><description>item %d</description><pubDate>%s</pubDate></item>`,
+				i, i, i, base.Add(time.Duration(i)*time.Hour).Format(time.RFC1123))
+		}
+		fmt.Fprint(w, `</channel></rss>`)
+	}))
+	defer srv.Close()
+
+	pubkey, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+	feedHealth.Delete(srv.URL)
+	t.Cleanup(func() { feedHealth.Delete(srv.URL) })
+
+	updates := make(chan nostr.Event, 20)
+	now := time.Now()
+	p := newPoller(pollerConfig{
+		DB:          relay.db,
+		LastEmitted: &sync.Map{},
+		Updates:     updates,
+		Interval:    time.Hour,
+		InjectRate:  3,
+	})
+	p.now = func() time.Time { return now }
+	filters := nostr.Filters{{Authors: []string{pubkey}}}
+
+	p.poll(context.Background(), filters)
+	if n := len(updates); n != 3 {
+		t.Fatalf("poll of 10 new items emitted %d; want 3", n)
+	}
+	for i := 7; i < 10; i++ {
+		if evt := <-updates; !strings.Contains(evt.Content, fmt.Sprintf("https://example.com/%d", i)) {
+			t.Errorf("emitted %q; want the newest items, item %d", evt.Content, i)
+		}
+	}
+	if health, _ := getFeedHealth(srv.URL); health.Dropped != 7 {
+		t.Errorf("health = %+v; want 7 dropped", health)
+	}
+
+	// a third of the interval later the feed has two more, only one fits
+	items = 12
+	feeds.Flush()
+	now = now.Add(20 * time.Minute)
+	p.poll(context.Background(), filters)
+	if n := len(updates); n != 1 {
+		t.Fatalf("poll of 2 new items with 1 token emitted %d; want 1", n)
+	}
+	if evt := <-updates; !strings.Contains(evt.Content, "https://example.com/11") {
+		t.Errorf("emitted %q; want the newest item", evt.Content)
+	}
+	if health, _ := getFeedHealth(srv.URL); health.Dropped != 8 {
+		t.Errorf("health = %+v; want 8 dropped in all", health)
+	}
+
+	// and the dropped ones don't come back
+	feeds.Flush()
+	now = now.Add(time.Hour)
+	p.poll(context.Background(), filters)
+	if n := len(updates); n != 0 {
+		t.Errorf("poll with nothing new emitted %d", n)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	defaultPreviewLimit = 5
+	maxPreviewLimit     = 20
+)
+
+// previewKeys are the pubkeys of the throwaway keys GET /preview is making
+// notes with, whose items aren't recorded as first seen, see itemTime.
+var previewKeys sync.Map // pubkey -> true
+
+// FeedPreview is what GET /preview answers with: the events a feed would be
+// bridged as, signed with a throwaway key rather than the feed's own.
+type FeedPreview struct {
+	// URL is the feed found at the url asked for.
+	URL     string        `json:"url"`
+	Pubkey  string        `json:"pubkey"`
+	Profile nostr.Event   `json:"profile"`
+	Notes   []nostr.Event `json:"notes"`
+}
+
+// previewFeed makes the FeedPreview of the feed found at url, with up to limit
+// notes in the order of the feed. Nothing is stored: the feed is fetched past
+// the feed cache and the health of feeds.
+func previewFeed(ctx context.Context, url, tmpl string, limit int) (*FeedPreview, error) {
+	candidates, direct, err := discoverFeeds(url, nil)
+	if err != nil {
+		return nil, err
+	} else if len(candidates) == 0 {
+		return nil, ErrNoFeedFound
+	}
+
+	// the first that works, as getFeedURL picks it, but past the feed cache
+	var feedurl string
+	var feed *gofeed.Feed
+	for _, candidate := range candidates {
+		if feed, _, err = fetchFeed(ctx, candidate.URL, nil); err == nil {
+			feedurl = candidate.URL
+			break
+		}
+	}
+	switch {
+	case feed == nil && direct:
+		return nil, fmt.Errorf("%w: %s", ErrBadFeed, err)
+	case feed == nil:
+		return nil, ErrNoFeedFound
+	}
+	feed.Items = dedupeItems(feed.Items)
+
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	previewKeys.Store(pubkey, true)
+	defer previewKeys.Delete(pubkey)
+
+	preview := &FeedPreview{URL: feedurl, Pubkey: pubkey, Notes: []nostr.Event{}}
+	preview.Profile = feedToSetMetadata(pubkey, feed, nil)
+	preview.Profile.Sign(sk)
+
+	entity := Entity{URL: feedurl, ContentTemplate: tmpl}
+	thread := newThreader(pubkey, feedurl, feed, noteTemplate(entity), noteFooter(entity))
+	for _, item := range feed.Items {
+		if len(preview.Notes) == limit {
+			break
+		}
+		cleanContent(feedurl, item)
+		if !keepItem(item) {
+			continue
+		}
+		evt := thread.note(item)
+		evt.Sign(sk)
+		preview.Notes = append(preview.Notes, evt)
+	}
+	return preview, nil
+}
+
+func handlePreviewFeed(w http.ResponseWriter, r *http.Request) {
+	url := r.FormValue("url")
+	if url == "" {
+		httpError(w, r, 400, "missing url")
+		return
+	}
+	tmpl := r.FormValue("template")
+	if _, err := parseContentTemplate(tmpl); err != nil {
+		httpError(w, r, 400, ErrBadTemplate.Error()+": "+err.Error())
+		return
+	}
+	limit := defaultPreviewLimit
+	if s := r.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPreviewLimit {
+			httpError(w, r, 400, "limit: must be from 1 to "+strconv.Itoa(maxPreviewLimit))
+			return
+		}
+		limit = n
+	}
+
+	preview, err := previewFeed(r.Context(), url, tmpl, limit)
+	switch {
+	case errors.Is(err, ErrNoFeedFound), errors.Is(err, ErrBadFeed):
+		httpError(w, r, 400, err.Error())
+		return
+	case errors.Is(err, ErrPreviewNotPermitted):
+		httpError(w, r, 403, err.Error())
+		return
+	case errors.Is(err, ErrPageTooLarge):
+		httpError(w, r, 413, err.Error())
+		return
+	case err != nil:
+		httpError(w, r, 500, err.Error())
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(preview)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestPreviewFeed(t *testing.T) {
+	setupTestRelay(t)
+	relay.TimestampSource = []string{"first-seen"}
+	t.Cleanup(func() { relay.TimestampSource = nil })
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/page" {
+			fmt.Fprint(w, `<html><head><link rel="alternate" type="application/rss+xml" href="/feed.xml"></head></html>`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+	defer srv.Close()
+
+	countKeys := func() int {
+		n := 0
+		iter := relay.db.NewIter(nil)
+		defer iter.Close()
+		for iter.First(); iter.Valid(); iter.Next() {
+			n++
+		}
+		return n
+	}
+	before := countKeys()
+
+	preview := func(query string) (int, FeedPreview) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handlePreviewFeed(rec, httptest.NewRequest("GET", "/preview"+query, nil))
+		var preview FeedPreview
+		if rec.Code == 200 {
+			if err := json.Unmarshal(rec.Body.Bytes(), &preview); err != nil {
+				t.Fatalf("GET /preview%s: %v", query, err)
+			}
+		}
+		return rec.Code, preview
+	}
+
+	code, got := preview("?url=" + srv.URL + "/page")
+	if code != 200 || got.URL != srv.URL+"/feed.xml" || len(got.Notes) != 2 {
+		t.Fatalf("GET /preview = %d %+v; want the 2 notes of the discovered feed", code, got)
+	}
+	if got.Profile.Kind != nostr.KindSetMetadata || !strings.Contains(got.Profile.Content, "test feed") {
+		t.Errorf("profile = %+v", got.Profile)
+	}
+	for _, evt := range append([]nostr.Event{got.Profile}, got.Notes...) {
+		if ok, _ := evt.CheckSignature(); !ok || evt.PubKey != got.Pubkey {
+			t.Errorf("event %s isn't signed by %s", evt.ID, got.Pubkey)
+		}
+	}
+	if got.Pubkey == privateKeyPubkey(t, srv.URL+"/feed.xml") {
+		t.Error("preview signed with the feed's derived key")
+	}
+
+	if _, got := preview("?limit=1&template={{.Link}}&url=" + srv.URL + "/feed.xml"); len(got.Notes) != 1 || strings.Contains(got.Notes[0].Content, "Item") {
+		t.Errorf("?limit=1&template= previewed %+v", got.Notes)
+	}
+	for _, query := range []string{"", "?url=" + srv.URL + "&limit=21", "?url=" + srv.URL + "&limit=0", "?url=" + srv.URL + "&template={{.Nope}}"} {
+		if code, _ := preview(query); code != 400 {
+			t.Errorf("GET /preview%s = %d; want 400", query, code)
+		}
+	}
+
+	if n := countKeys(); n != before {
+		t.Errorf("previews stored %d keys", n-before)
+	}
+	if _, cached := feeds.Peek(srv.URL + "/feed.xml"); cached {
+		t.Error("previews cached the feed")
+	}
+}
+
+func privateKeyPubkey(t *testing.T, url string) string {
+	t.Helper()
+	pubkey, err := nostr.GetPublicKey(privateKeyFromFeed(relay.Secret, url))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pubkey
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"math/bits"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Private feeds have their notes delivered only to their recipients, each note
+// gift wrapped (NIP-59) for each of them: the unsigned note is sealed in a kind
+// 13 event signed by the feed, which is wrapped in a kind 1059 event signed by
+// a throwaway key, both encrypted with NIP-44.
+const (
+	kindSeal     = 13
+	kindGiftWrap = 1059
+)
+
+// parseRecipients reads the pubkeys private notes are delivered to, as hex or npub.
+func parseRecipients(values []string) ([]string, error) {
+	var recipients []string
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if strings.HasPrefix(value, "npub1") {
+			_, decoded, err := nip19.Decode(value)
+			if err != nil {
+				return nil, fmt.Errorf("%w %q: %s", ErrBadRecipient, value, err)
+			}
+			value = decoded.(string)
+		}
+		if b, err := hex.DecodeString(value); err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("%w %q: not a pubkey", ErrBadRecipient, value)
+		}
+		recipients = append(recipients, strings.ToLower(value))
+	}
+	return recipients, nil
+}
+
+// outgoing is what is sent out for the signed note evt of entity: evt itself,
+// or a gift wrap of it for each recipient if the feed is private.
+func outgoing(entity Entity, evt nostr.Event) ([]nostr.Event, error) {
+	if !entity.Private {
+		return []nostr.Event{evt}, nil
+	}
+	wraps := make([]nostr.Event, 0, len(entity.Recipients))
+	for _, recipient := range entity.Recipients {
+		wrap, err := giftWrap(evt, entity.PrivateKey, recipient)
+		if err != nil {
+			return nil, fmt.Errorf("failed to wrap for %s: %w", recipient, err)
+		}
+		wraps = append(wraps, wrap)
+	}
+	return wraps, nil
+}
+
+// giftWrap seals evt, signed by sk, for recipient as NIP-59 says.
+func giftWrap(evt nostr.Event, sk, recipient string) (nostr.Event, error) {
+	// the rumor can't be passed around as coming from the feed
+	evt.Sig = ""
+	rumor, err := evt.MarshalJSON()
+	if err != nil {
+		return nostr.Event{}, err
+	}
+
+	seal := nostr.Event{CreatedAt: randomPast(), Kind: kindSeal, Tags: nostr.Tags{}}
+	if seal.Content, err = nip44EncryptFor(string(rumor), sk, recipient); err != nil {
+		return nostr.Event{}, err
+	}
+	if err := seal.Sign(sk); err != nil {
+		return nostr.Event{}, err
+	}
+	sealed, err := seal.MarshalJSON()
+	if err != nil {
+		return nostr.Event{}, err
+	}
+
+	throwaway := nostr.GeneratePrivateKey()
+	wrap := nostr.Event{CreatedAt: randomPast(), Kind: kindGiftWrap, Tags: nostr.Tags{{"p", recipient}}}
+	if wrap.Content, err = nip44EncryptFor(string(sealed), throwaway, recipient); err != nil {
+		return nostr.Event{}, err
+	}
+	return wrap, wrap.Sign(throwaway)
+}
+
+// randomPast is a time up to two days ago, so that seals and wraps don't tell
+// when the note was made.
+func randomPast() nostr.Timestamp {
+	n, _ := rand.Int(rand.Reader, big.NewInt(int64(2*24*time.Hour/time.Second)))
+	return nostr.Timestamp(time.Now().Unix() - n.Int64())
+}
+
+func nip44EncryptFor(plaintext, sk, pubkey string) (string, error) {
+	key, err := nip44ConversationKey(sk, pubkey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return nip44Encrypt(plaintext, key, nonce)
+}
+
+// nip44ConversationKey is the NIP-44 (version 2) key between sk and pubkey,
+// the same both ways.
+func nip44ConversationKey(sk, pubkey string) ([]byte, error) {
+	shared, err := nip04.ComputeSharedSecret(pubkey, sk)
+	if err != nil {
+		return nil, err
+	}
+	return hkdf.Extract(sha256.New, shared, []byte("nip44-v2")), nil
+}
+
+// nip44Encrypt encrypts plaintext with the conversation key and a 32-byte
+// nonce, which must be random, returning the base64 payload.
+func nip44Encrypt(plaintext string, key, nonce []byte) (string, error) {
+	if len(plaintext) < 1 || len(plaintext) > 65535 {
+		return "", fmt.Errorf("can't encrypt %d bytes", len(plaintext))
+	}
+	chachaKey, chachaNonce, hmacKey := nip44MessageKeys(key, nonce)
+
+	padded := make([]byte, 2+nip44PaddedLen(len(plaintext)))
+	binary.BigEndian.PutUint16(padded, uint16(len(plaintext)))
+	copy(padded[2:], plaintext)
+	cipher, err := chacha20.NewUnauthenticatedCipher(chachaKey, chachaNonce)
+	if err != nil {
+		return "", err
+	}
+	cipher.XORKeyStream(padded, padded)
+
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(nonce)
+	mac.Write(padded)
+
+	payload := make([]byte, 0, 1+len(nonce)+len(padded)+sha256.Size)
+	payload = append(payload, 2)
+	payload = append(payload, nonce...)
+	payload = append(payload, padded...)
+	payload = mac.Sum(payload)
+	return base64.StdEncoding.EncodeToString(payload), nil
+}
+
+// nip44Decrypt reverses nip44Encrypt.
+func nip44Decrypt(payload string, key []byte) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < 1+32+2+32+sha256.Size || data[0] != 2 {
+		return "", errors.New("not a nip-44 version 2 payload")
+	}
+	nonce, ciphertext, sum := data[1:33], data[33:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	chachaKey, chachaNonce, hmacKey := nip44MessageKeys(key, nonce)
+
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(nonce)
+	mac.Write(ciphertext)
+	if !hmac.Equal(mac.Sum(nil), sum) {
+		return "", errors.New("invalid mac")
+	}
+
+	padded := make([]byte, len(ciphertext))
+	cipher, err := chacha20.NewUnauthenticatedCipher(chachaKey, chachaNonce)
+	if err != nil {
+		return "", err
+	}
+	cipher.XORKeyStream(padded, ciphertext)
+	n := int(binary.BigEndian.Uint16(padded))
+	if n < 1 || len(padded) != 2+nip44PaddedLen(n) {
+		return "", errors.New("invalid padding")
+	}
+	return string(padded[2 : 2+n]), nil
+}
+
+func nip44MessageKeys(key, nonce []byte) (chachaKey, chachaNonce, hmacKey []byte) {
+	keys := make([]byte, 76)
+	io.ReadFull(hkdf.Expand(sha256.New, key, nonce), keys)
+	return keys[:32], keys[32:44], keys[44:]
+}
+
+// nip44PaddedLen is how long a plaintext of n bytes is once padded.
+func nip44PaddedLen(n int) int {
+	if n <= 32 {
+		return 32
+	}
+	next := 1 << bits.Len(uint(n-1))
+	chunk := 32
+	if next > 256 {
+		chunk = next / 8
+	}
+	return chunk * ((n-1)/chunk + 1)
+}
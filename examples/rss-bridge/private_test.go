@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestNIP44(t *testing.T) {
+	// from the test vectors of NIP-44
+	key, err := nip44ConversationKey(fmt.Sprintf("%064x", 1), "c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5")
+	if err != nil {
+		t.Fatalf("nip44ConversationKey: %v", err)
+	}
+	if got := hex.EncodeToString(key); got != "c41c775356fd92eadc63ff5a0dc1da211b268cbea22316767095b2871ea1412d" {
+		t.Errorf("conversation key = %s", got)
+	}
+	nonce, _ := hex.DecodeString(fmt.Sprintf("%064x", 1))
+	payload, err := nip44Encrypt("a", key, nonce)
+	if err != nil {
+		t.Fatalf("nip44Encrypt: %v", err)
+	}
+	if want := "AgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAABee0G5VSK0/9YypIObAtDKfYEAjD35uVkHyB0F4DwrcNaCXlCWZKaArsGrY6M9wnuTMxWfp1RTN9Xga8no+kF5Vsb"; payload != want {
+		t.Errorf("payload = %s; want %s", payload, want)
+	}
+
+	for _, n := range []int{1, 32, 33, 257, 1000, 65535} {
+		plaintext := strings.Repeat("x", n)
+		payload, err := nip44EncryptFor(plaintext, fmt.Sprintf("%064x", 2), mustPublicKey(t, fmt.Sprintf("%064x", 3)))
+		if err != nil {
+			t.Fatalf("nip44EncryptFor(%d bytes): %v", n, err)
+		}
+		key, _ := nip44ConversationKey(fmt.Sprintf("%064x", 3), mustPublicKey(t, fmt.Sprintf("%064x", 2)))
+		if got, err := nip44Decrypt(payload, key); err != nil || got != plaintext {
+			t.Errorf("round trip of %d bytes = %d bytes, %v", n, len(got), err)
+		}
+	}
+}
+
+func mustPublicKey(t *testing.T, sk string) string {
+	t.Helper()
+	pubkey, err := nostr.GetPublicKey(sk)
+	if err != nil {
+		t.Fatalf("GetPublicKey: %v", err)
+	}
+	return pubkey
+}
+
+// unwrap opens a gift wrap with the key of its recipient, checking the seal on
+// the way.
+func unwrap(t *testing.T, wrap nostr.Event, sk string) (seal, rumor nostr.Event) {
+	t.Helper()
+	key, err := nip44ConversationKey(sk, wrap.PubKey)
+	if err != nil {
+		t.Fatalf("nip44ConversationKey: %v", err)
+	}
+	sealed, err := nip44Decrypt(wrap.Content, key)
+	if err != nil {
+		t.Fatalf("opening the wrap: %v", err)
+	}
+	if err := seal.UnmarshalJSON([]byte(sealed)); err != nil {
+		t.Fatalf("seal isn't an event: %v", err)
+	}
+	if ok, _ := seal.CheckSignature(); !ok || seal.Kind != kindSeal {
+		t.Fatalf("seal = %+v; want a signed kind 13", seal)
+	}
+
+	if key, err = nip44ConversationKey(sk, seal.PubKey); err != nil {
+		t.Fatalf("nip44ConversationKey: %v", err)
+	}
+	inner, err := nip44Decrypt(seal.Content, key)
+	if err != nil {
+		t.Fatalf("opening the seal: %v", err)
+	}
+	if err := rumor.UnmarshalJSON([]byte(inner)); err != nil {
+		t.Fatalf("rumor isn't an event: %v", err)
+	}
+	return seal, rumor
+}
+
+func TestPrivateFeed(t *testing.T) {
+	setupTestRelay(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+	defer srv.Close()
+
+	if _, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{Private: true}); !errors.Is(err, ErrBadRecipient) {
+		t.Fatalf("Feed(private without recipients) = %v; want ErrBadRecipient", err)
+	}
+
+	recipientSK, otherSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	recipient := mustPublicKey(t, recipientSK)
+	npub, _ := nip19.EncodePublicKey(recipient)
+	recipients, err := parseRecipients([]string{npub})
+	if err != nil || len(recipients) != 1 || recipients[0] != recipient {
+		t.Fatalf("parseRecipients(npub) = %v, %v; want the hex pubkey", recipients, err)
+	}
+	if _, err := parseRecipients([]string{"npub1nope"}); !errors.Is(err, ErrBadRecipient) {
+		t.Errorf("parseRecipients(garbage) = %v; want ErrBadRecipient", err)
+	}
+
+	pubkey, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{Private: true, Recipients: recipients})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+
+	updates := make(chan nostr.Event, 10)
+	p := newPoller(pollerConfig{DB: relay.db, LastEmitted: &sync.Map{}, Updates: updates})
+	p.poll(context.Background(), nostr.Filters{{Authors: []string{pubkey}}})
+	if n := len(updates); n != 2 {
+		t.Fatalf("poll emitted %d events; want a wrap for each of the 2 items", n)
+	}
+
+	var contents []string
+	for len(updates) > 0 {
+		wrap := <-updates
+		if wrap.Kind != kindGiftWrap || wrap.PubKey == pubkey || wrap.Tags.GetFirst([]string{"p", recipient}) == nil {
+			t.Fatalf("emitted %+v; want a kind 1059 for the recipient from a throwaway key", wrap)
+		}
+		if ok, _ := wrap.CheckSignature(); !ok {
+			t.Error("wrap isn't signed")
+		}
+		if strings.Contains(wrap.Content, "https://example.com/") {
+			t.Error("wrap content is in the clear")
+		}
+
+		seal, rumor := unwrap(t, wrap, recipientSK)
+		if seal.PubKey != pubkey || rumor.PubKey != pubkey || rumor.Kind != nostr.KindTextNote || rumor.Sig != "" {
+			t.Errorf("seal by %s, rumor %+v; want an unsigned note, both from the feed", seal.PubKey, rumor)
+		}
+		if rumor.ID != rumor.GetID() {
+			t.Errorf("rumor id = %s; want %s", rumor.ID, rumor.GetID())
+		}
+		contents = append(contents, rumor.Content)
+
+		key, _ := nip44ConversationKey(otherSK, wrap.PubKey)
+		if _, err := nip44Decrypt(wrap.Content, key); err == nil {
+			t.Error("someone else opened the wrap")
+		}
+	}
+	if got := strings.Join(contents, "\n"); !strings.Contains(got, "https://example.com/1") || !strings.Contains(got, "https://example.com/2") {
+		t.Errorf("rumors = %q; want both items", got)
+	}
+
+	// and the notes can't be had by querying the feed either
+	for _, evt := range feedEvents(context.Background(), pubkey, &nostr.Filter{Authors: []string{pubkey}}) {
+		if evt.Kind != nostr.KindSetMetadata {
+			t.Errorf("query got a kind %d event of a private feed", evt.Kind)
+		}
+	}
+}
+
+func TestHealthLeavesOutPrivateFeeds(t *testing.T) {
+	setupTestRelay(t)
+	saveEntity(relay.db, "private", Entity{URL: "https://example.com/private", Private: true})
+	saveEntity(relay.db, "public", Entity{URL: "https://example.com/public"})
+	for _, url := range []string{"https://example.com/private", "https://example.com/public"} {
+		recordFetch(url, nil, nil)
+		defer feedHealth.Delete(url)
+	}
+
+	rec := httptest.NewRecorder()
+	handleHealth(rec, httptest.NewRequest("GET", "/health", nil))
+	var report HealthReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("GET /health: %v", err)
+	}
+	if _, ok := report.Feeds["https://example.com/private"]; ok {
+		t.Error("/health lists the private feed")
+	}
+	if _, ok := report.Feeds["https://example.com/public"]; !ok {
+		t.Error("/health doesn't list the public feed")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// registryVersion is bumped whenever the shape of a RegistryDump changes.
+const registryVersion = 1
+
+// RegistryDump is every registered feed, as /admin/export writes it and
+// /admin/import reads it.
+type RegistryDump struct {
+	Version    int             `json:"version"`
+	ExportedAt time.Time       `json:"exported_at"`
+	Feeds      []RegistryEntry `json:"feeds"`
+}
+
+// RegistryEntry is one feed of a RegistryDump. Its Entity has the private key
+// and credentials taken out, they are in Secrets instead, sealed with the
+// admin token so they can be moved to a deployment with another SECRET.
+type RegistryEntry struct {
+	Pubkey  string `json:"pubkey"`
+	Entity  Entity `json:"entity"`
+	Secrets []byte `json:"secrets"`
+}
+
+type registrySecrets struct {
+	PrivateKey string    `json:"private_key"`
+	Auth       *FeedAuth `json:"auth,omitempty"`
+}
+
+// ImportResult tells what importRegistry did with the feeds it was given.
+type ImportResult struct {
+	Imported   int      `json:"imported"`
+	Duplicates int      `json:"duplicates"`
+	Invalid    []string `json:"invalid,omitempty"`
+}
+
+// exportRegistry dumps every stored feed, moved ones included. Credentials that
+// can't be opened with secret are left out, the feed is exported without them.
+func exportRegistry(db *pebble.DB, secret, token string) (*RegistryDump, error) {
+	aead, err := secretCipher(token, "registry export")
+	if err != nil {
+		return nil, err
+	}
+
+	dump := &RegistryDump{Version: registryVersion, ExportedAt: time.Now().UTC(), Feeds: []RegistryEntry{}}
+	err = ForEachEntity(db, func(stored StoredEntity) error {
+		secrets := registrySecrets{PrivateKey: stored.Entity.PrivateKey}
+		if len(stored.Entity.Auth) > 0 {
+			if auth, err := openAuth(secret, stored.Entity.Auth); err == nil {
+				secrets.Auth = auth
+			}
+		}
+		plain, err := json.Marshal(secrets)
+		if err != nil {
+			return err
+		}
+		sealed, err := seal(aead, plain)
+		if err != nil {
+			return err
+		}
+
+		entity := stored.Entity
+		entity.PrivateKey = ""
+		entity.Auth = nil
+		dump.Feeds = append(dump.Feeds, RegistryEntry{Pubkey: stored.Pubkey, Entity: entity, Secrets: sealed})
+		return nil
+	})
+	return dump, skipCorrupt(err)
+}
+
+// importRegistry stores the feeds of dump that aren't registered yet, either
+// under the same pubkey or, unless moved, with an equivalent url. Entries whose
+// secrets don't open with token or whose key doesn't match their pubkey are
+// reported as invalid.
+func importRegistry(db *pebble.DB, secret, token string, dump *RegistryDump) (ImportResult, error) {
+	var result ImportResult
+	if dump.Version != registryVersion {
+		return result, fmt.Errorf("unsupported registry version %d", dump.Version)
+	}
+	aead, err := secretCipher(token, "registry export")
+	if err != nil {
+		return result, err
+	}
+
+	for _, entry := range dump.Feeds {
+		entity, auth, err := openRegistryEntry(aead, entry)
+		if err != nil {
+			result.Invalid = append(result.Invalid, fmt.Sprintf("%s: %v", entry.Pubkey, err))
+			continue
+		}
+
+		if _, err := loadEntity(db, entry.Pubkey); err == nil {
+			result.Duplicates++
+			continue
+		} else if err != pebble.ErrNotFound {
+			return result, err
+		}
+		if entity.MovedTo == "" {
+			if _, _, ok := findFeedByURL(db, entity.URL); ok {
+				result.Duplicates++
+				continue
+			}
+		}
+
+		if auth != nil {
+			err = storeFeedAuth(db, secret, entry.Pubkey, entity, auth)
+		} else {
+			err = saveEntity(db, entry.Pubkey, entity)
+		}
+		if err != nil {
+			return result, err
+		}
+		if entity.InsecureSkipVerify && entity.MovedTo == "" {
+			insecureFeeds.Store(entity.URL, true)
+		}
+		if entity.FullContent && entity.MovedTo == "" {
+			fullContentFeeds.Store(entity.URL, true)
+		}
+		result.Imported++
+	}
+
+	return result, nil
+}
+
+func openRegistryEntry(aead cipher.AEAD, entry RegistryEntry) (Entity, *FeedAuth, error) {
+	entity := entry.Entity
+	if entity.URL == "" {
+		return entity, nil, errors.New("no url")
+	}
+
+	plain, err := unseal(aead, entry.Secrets)
+	if err != nil {
+		return entity, nil, errors.New("secrets don't open with this admin token")
+	}
+	var secrets registrySecrets
+	if err := json.Unmarshal(plain, &secrets); err != nil {
+		return entity, nil, err
+	}
+	if pubkey, err := nostr.GetPublicKey(secrets.PrivateKey); err != nil || pubkey != entry.Pubkey {
+		return entity, nil, errors.New("private key doesn't match the pubkey")
+	}
+
+	entity.PrivateKey = secrets.PrivateKey
+	entity.Auth = nil
+	return entity, secrets.Auth, nil
+}
+
+// handleExportRegistry writes every registered feed as a RegistryDump.
+func handleExportRegistry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, r, 405, "method not allowed")
+		return
+	}
+
+	dump, err := exportRegistry(relay.db, relay.Secret, relay.AdminToken)
+	if err != nil {
+		httpError(w, r, 500, err.Error())
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("content-disposition", `attachment; filename="registry.json"`)
+	json.NewEncoder(w).Encode(dump)
+}
+
+// handleImportRegistry restores the feeds of a RegistryDump made by
+// handleExportRegistry with the same admin token.
+func handleImportRegistry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, 405, "method not allowed")
+		return
+	}
+
+	var dump RegistryDump
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<20)).Decode(&dump); err != nil {
+		httpError(w, r, 400, "invalid registry: "+err.Error())
+		return
+	}
+
+	result, err := importRegistry(relay.db, relay.Secret, relay.AdminToken, &dump)
+	if err != nil {
+		httpError(w, r, 500, err.Error())
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
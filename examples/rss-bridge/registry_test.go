@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func registerTestFeeds(t *testing.T) map[string]Entity {
+	t.Helper()
+	feeds := map[string]Entity{}
+	for i, url := range []string{"https://example.com/a.xml", "https://example.com/b.xml"} {
+		sk := nostr.GeneratePrivateKey()
+		pubkey, _ := nostr.GetPublicKey(sk)
+		entity := Entity{
+			PrivateKey:    sk,
+			SecretVersion: 1,
+			URL:           url,
+			CreatedAt:     time.Unix(1700000000, 0).UTC(),
+			Pinned:        i == 0,
+			Meta:          &Metadata{Name: "feed " + url},
+		}
+		var err error
+		if i == 1 {
+			err = storeFeedAuth(relay.db, relay.Secret, pubkey, entity, &FeedAuth{Type: "bearer", Credential: "hunter2"})
+		} else {
+			err = saveEntity(relay.db, pubkey, entity)
+		}
+		if err != nil {
+			t.Fatalf("saving %s: %v", url, err)
+		}
+		feeds[pubkey] = entity
+	}
+	return feeds
+}
+
+func TestRegistryRoundTrip(t *testing.T) {
+	setupTestRelay(t)
+	relay.AdminToken = "admin-token"
+	t.Cleanup(func() { relay.AdminToken = ""; feedAuths = sync.Map{} })
+	registered := registerTestFeeds(t)
+
+	w := httptest.NewRecorder()
+	handleExportRegistry(w, httptest.NewRequest("GET", "/admin/export", nil))
+	if w.Code != 200 {
+		t.Fatalf("export = %d %s", w.Code, w.Body)
+	}
+	exported := w.Body.Bytes()
+	for _, entity := range registered {
+		if bytes.Contains(exported, []byte(entity.PrivateKey)) || bytes.Contains(exported, []byte("hunter2")) {
+			t.Fatal("the export has secrets in the clear")
+		}
+	}
+
+	// a bridge with another SECRET but the same admin token
+	setupTestRelay(t)
+	relay.Secret = "another-secret"
+	feedAuths = sync.Map{}
+
+	importDump := func(body []byte) ImportResult {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handleImportRegistry(w, httptest.NewRequest("POST", "/admin/import", bytes.NewReader(body)))
+		if w.Code != 200 {
+			t.Fatalf("import = %d %s", w.Code, w.Body)
+		}
+		var result ImportResult
+		json.NewDecoder(w.Body).Decode(&result)
+		return result
+	}
+
+	if result := importDump(exported); result.Imported != 2 || result.Duplicates != 0 || len(result.Invalid) != 0 {
+		t.Errorf("import = %+v; want 2 imported", result)
+	}
+	for pubkey, want := range registered {
+		got, err := loadEntity(relay.db, pubkey)
+		if err != nil {
+			t.Fatalf("loadEntity(%s): %v", pubkey, err)
+		}
+		if got.PrivateKey != want.PrivateKey || got.URL != want.URL || got.Pinned != want.Pinned ||
+			!got.CreatedAt.Equal(want.CreatedAt) || got.Meta == nil || got.Meta.Name != want.Meta.Name {
+			t.Errorf("imported %+v; want %+v", got, want)
+		}
+		if len(got.Auth) > 0 {
+			if auth, err := openAuth(relay.Secret, got.Auth); err != nil || auth.Credential != "hunter2" {
+				t.Errorf("imported credentials = %v, %v; want them sealed with the new secret", auth, err)
+			}
+		}
+	}
+	if auth, ok := feedAuths.Load("https://example.com/b.xml"); !ok || auth.(*FeedAuth).Credential != "hunter2" {
+		t.Errorf("credentials of the imported feed aren't in use")
+	}
+
+	if result := importDump(exported); result.Imported != 0 || result.Duplicates != 2 {
+		t.Errorf("importing again = %+v; want 2 duplicates", result)
+	}
+}
+
+func TestImportRegistryValidates(t *testing.T) {
+	setupTestRelay(t)
+	registerTestFeeds(t)
+	dump, err := exportRegistry(relay.db, relay.Secret, "admin-token")
+	if err != nil {
+		t.Fatalf("exportRegistry: %v", err)
+	}
+
+	setupTestRelay(t)
+	if _, err := importRegistry(relay.db, relay.Secret, "admin-token", &RegistryDump{Version: 99}); err == nil {
+		t.Error("importRegistry accepted an unknown version")
+	}
+
+	result, err := importRegistry(relay.db, relay.Secret, "another-token", dump)
+	if err != nil {
+		t.Fatalf("importRegistry: %v", err)
+	}
+	if result.Imported != 0 || len(result.Invalid) != 2 {
+		t.Errorf("import with another token = %+v; want all invalid", result)
+	}
+
+	// a pubkey swapped for the other one, and a feed whose url is already
+	// registered under another key
+	dump.Feeds[0].Pubkey = dump.Feeds[1].Pubkey
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	sameURL := strings.Replace(dump.Feeds[1].Entity.URL, "https://", "https://www.", 1)
+	if err := saveEntity(relay.db, pubkey, Entity{PrivateKey: sk, URL: sameURL}); err != nil {
+		t.Fatalf("saveEntity: %v", err)
+	}
+
+	result, err = importRegistry(relay.db, relay.Secret, "admin-token", dump)
+	if err != nil {
+		t.Fatalf("importRegistry: %v", err)
+	}
+	if len(result.Invalid) != 1 || !strings.Contains(result.Invalid[0], "doesn't match") {
+		t.Errorf("invalid = %v; want the swapped pubkey", result.Invalid)
+	}
+	if result.Imported != 0 || result.Duplicates != 1 {
+		t.Errorf("import = %+v; want the feed with a registered url deduped", result)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// TitleRewrites are find/replace rules applied, in order, to item titles. They
+// are read from TITLE_REWRITES as lines of "pattern => replacement", where
+// pattern is a regexp and replacement may use $1 and the like, or be empty.
+type TitleRewrites []titleRewrite
+
+type titleRewrite struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// Decode implements envconfig.Decoder, so bad rules fail Init.
+func (rules *TitleRewrites) Decode(value string) error {
+	*rules = nil
+	for i, line := range strings.Split(value, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		pattern, replacement, ok := strings.Cut(line, "=>")
+		if !ok {
+			return fmt.Errorf("rule %d: missing \"=>\" in %q", i+1, line)
+		}
+		re, err := regexp.Compile(strings.TrimSpace(pattern))
+		if err != nil {
+			return fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		*rules = append(*rules, titleRewrite{re, strings.TrimSpace(replacement)})
+	}
+	return nil
+}
+
+// apply runs title through every rule.
+func (rules TitleRewrites) apply(title string) string {
+	for _, rule := range rules {
+		title = rule.pattern.ReplaceAllString(title, rule.replacement)
+	}
+	return title
+}
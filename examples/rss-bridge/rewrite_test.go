@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func TestTitleRewrites(t *testing.T) {
+	var rules TitleRewrites
+	err := rules.Decode("^(BREAKING|\\[Sponsored\\]):?\\s* =>\n\n(?i)covid-(\\d+) => COVID $1\n\\s+\\|\\s+Example News$ =>")
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	var tests = []struct {
+		title string
+		want  string
+	}{
+		{"BREAKING: Something happened", "Something happened"},
+		{"[Sponsored] Buy this", "Buy this"},
+		{"Not BREAKING: news", "Not BREAKING: news"},
+		{"Covid-19 numbers | Example News", "COVID 19 numbers"},
+		{"[Sponsored] covid-19 | Example News", "COVID 19"},
+	}
+	for _, tt := range tests {
+		if got := rules.apply(tt.title); got != tt.want {
+			t.Errorf("apply(%q) = %q; want %q", tt.title, got, tt.want)
+		}
+	}
+
+	defer func(rules TitleRewrites) { relay.TitleRewrites = rules }(relay.TitleRewrites)
+	relay.TitleRewrites = rules
+	item := &gofeed.Item{Title: "BREAKING: Something happened", Link: "https://example.com/1"}
+	evt := itemToTextNote("pubkey", item, defaultNoteTemplate)
+	if !strings.HasPrefix(evt.Content, "**Something happened**") {
+		t.Errorf("note content = %q; want the rewritten title", evt.Content)
+	}
+	if item.Title != "BREAKING: Something happened" {
+		t.Errorf("item title changed to %q", item.Title)
+	}
+}
+
+func TestTitleRewritesInvalid(t *testing.T) {
+	for _, value := range []string{"no arrow", "([unclosed => x"} {
+		var rules TitleRewrites
+		if err := rules.Decode(value); err == nil {
+			t.Errorf("Decode(%q) succeeded", value)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/relayer/v2"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	// indexQueueSize is how many notes can wait to be indexed before new ones
+	// are dropped.
+	indexQueueSize = 1024
+	indexTimeout   = 10 * time.Second
+	// indexMaxRedirects bounds the redirects SEARCH_INDEX_URL is followed through.
+	indexMaxRedirects = 3
+)
+
+// indexClient sends notes to SEARCH_INDEX_URL. Init gives it the transport
+// feeds are fetched with, so it goes by the TLS_* settings too.
+var indexClient = &http.Client{
+	Timeout: indexTimeout,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) > indexMaxRedirects {
+			return fmt.Errorf("stopped after %d redirects", indexMaxRedirects)
+		}
+		return nil
+	},
+}
+
+// SearchIndexer indexes the bridged notes, as they are made, for searching.
+type SearchIndexer interface {
+	Index(evt nostr.Event) error
+}
+
+// indexSink is the relayer.EventSink handing notes to a SearchIndexer, one at a
+// time from a goroutine of its own, so a slow indexer doesn't hold up the
+// bridge. Notes that don't fit in its queue are dropped and counted. Only
+// plain notes are indexed: profiles are rebuilt on every query and private
+// feeds only go out gift wrapped.
+type indexSink struct {
+	indexer SearchIndexer
+
+	mu     sync.Mutex
+	closed bool
+	queue  chan nostr.Event
+	done   chan struct{}
+
+	dropped int64
+}
+
+func newIndexSink(indexer SearchIndexer) *indexSink {
+	s := &indexSink{
+		indexer: indexer,
+		queue:   make(chan nostr.Event, indexQueueSize),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *indexSink) Publish(evt *nostr.Event) {
+	if evt.Kind != nostr.KindTextNote {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- *evt:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+// Close indexes what is queued.
+func (s *indexSink) Close() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+	<-s.done
+}
+
+func (s *indexSink) run() {
+	defer close(s.done)
+	for evt := range s.queue {
+		if err := s.indexer.Index(evt); err != nil {
+			logger.Warn("failed to index note", "id", evt.ID, "pubkey", evt.PubKey, "err", err)
+		}
+	}
+}
+
+// webhookIndexer is the SearchIndexer of SEARCH_INDEX_URL, POSTing every note
+// as JSON to a search service or anything else taking them.
+type webhookIndexer struct {
+	url    string
+	client *http.Client
+}
+
+func (ix webhookIndexer) Index(evt nostr.Event) error {
+	body, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), indexTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", ix.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+	resp, err := ix.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", ix.url, resp.Status)
+	}
+	return nil
+}
+
+// eventSinks passes events on to each of them.
+type eventSinks []relayer.EventSink
+
+func (sinks eventSinks) Publish(evt *nostr.Event) {
+	for _, sink := range sinks {
+		sink.Publish(evt)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+type fakeIndexer struct {
+	mu      sync.Mutex
+	indexed []nostr.Event
+	err     error
+}
+
+func (ix *fakeIndexer) Index(evt nostr.Event) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.indexed = append(ix.indexed, evt)
+	return ix.err
+}
+
+func TestIndexSink(t *testing.T) {
+	setupTestRelay(t)
+	indexer := &fakeIndexer{}
+	relay.index = newIndexSink(indexer)
+	t.Cleanup(func() { relay.index = nil })
+
+	sink := relay.EventSink()
+	if sink == nil {
+		t.Fatal("no EventSink with an indexer")
+	}
+	note := itemToTextNote("pubkey", &gofeed.Item{Title: "Hello search", Link: "https://example.com/hello"}, defaultNoteTemplate)
+	sink.Publish(&note)
+	sink.Publish(&nostr.Event{Kind: nostr.KindSetMetadata, Content: "{}"})
+	sink.Publish(&nostr.Event{Kind: 1059, Content: "sealed"})
+
+	// indexing failures are logged, not retried
+	indexer.mu.Lock()
+	indexer.err = errors.New("down")
+	indexer.mu.Unlock()
+	failing := note
+	failing.ID = "other"
+	sink.Publish(&failing)
+
+	relay.index.Close()
+	if len(indexer.indexed) != 2 || indexer.indexed[0].ID != note.ID || indexer.indexed[0].Content != note.Content {
+		t.Fatalf("indexed %+v; want the note, once, with its content", indexer.indexed)
+	}
+	// nothing more once closed
+	sink.Publish(&note)
+	if len(indexer.indexed) != 2 {
+		t.Error("indexed after Close")
+	}
+}
+
+func TestIndexSinkDoesNotBlock(t *testing.T) {
+	setupTestRelay(t)
+	release := make(chan struct{})
+	sink := newIndexSink(blockingIndexer(release))
+
+	for i := 0; i < indexQueueSize+10; i++ {
+		sink.Publish(&nostr.Event{Kind: nostr.KindTextNote})
+	}
+	if atomic.LoadInt64(&sink.dropped) == 0 {
+		t.Error("nothing dropped with the indexer stuck")
+	}
+	close(release)
+	sink.Close()
+}
+
+type blockingIndexer chan struct{}
+
+func (ix blockingIndexer) Index(nostr.Event) error {
+	<-ix
+	return nil
+}
+
+func TestWebhookIndexer(t *testing.T) {
+	var got nostr.Event
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("content-type") != "application/json" {
+			http.Error(w, "bad request", 400)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	evt := nostr.Event{ID: "id", Kind: nostr.KindTextNote, Content: "hello"}
+	if err := (webhookIndexer{srv.URL, srv.Client()}).Index(evt); err != nil {
+		t.Fatalf("Index: %v", err)
+	}
+	if got.ID != "id" || got.Content != "hello" {
+		t.Errorf("POSTed %+v", got)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", 503)
+	}))
+	defer failing.Close()
+	if err := (webhookIndexer{failing.URL, failing.Client()}).Index(evt); err == nil {
+		t.Error("Index succeeded against a 503")
+	}
+}
+
+func TestIndexClientRedirects(t *testing.T) {
+	var hits int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		http.Redirect(w, r, "/again", http.StatusTemporaryRedirect)
+	}))
+	defer srv.Close()
+
+	if err := (webhookIndexer{srv.URL, indexClient}).Index(nostr.Event{Kind: nostr.KindTextNote}); err == nil {
+		t.Fatal("Index succeeded through endless redirects")
+	}
+	// the request itself and each redirect followed
+	if n := atomic.LoadInt64(&hits); n != indexMaxRedirects+1 {
+		t.Errorf("made %d requests; want %d", n, indexMaxRedirects+1)
+	}
+}
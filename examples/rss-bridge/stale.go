@@ -0,0 +1,44 @@
+package main
+
+import (
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// idle is how long the feed has gone without a new item as of now, by the
+// date of its newest one, or 0 if it wasn't polled since that was kept.
+func (entity Entity) idle(now time.Time) time.Duration {
+	if entity.LastNewItem.IsZero() {
+		return 0
+	}
+	return now.Sub(entity.LastNewItem)
+}
+
+// dead tells whether the feed went without a new item for longer than d, if d
+// is set. Pinned feeds never die.
+func (entity Entity) dead(d time.Duration, now time.Time) bool {
+	return d > 0 && !entity.Pinned && entity.idle(now) > d
+}
+
+// pruneDeadFeeds removes the feeds that are dead for d, see Entity.dead.
+func pruneDeadFeeds(db *pebble.DB, d time.Duration, now time.Time) (pruned []string, err error) {
+	var dead []string
+	err = ForEachEntity(db, func(stored StoredEntity) error {
+		if stored.Entity.MovedTo == "" && stored.Entity.dead(d, now) {
+			dead = append(dead, stored.Pubkey)
+		}
+		return nil
+	})
+	if err := skipCorrupt(err); err != nil {
+		return nil, err
+	}
+
+	for _, pubkey := range dead {
+		if _, err := removeFeed(db, pubkey); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, pubkey)
+	}
+	return pruned, nil
+}
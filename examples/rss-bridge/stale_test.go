@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestStaleAndDeadFeeds(t *testing.T) {
+	setupTestRelay(t)
+	relay.StaleFeedThreshold = 30 * 24 * time.Hour
+	t.Cleanup(func() { relay.StaleFeedThreshold = 0 })
+
+	old := time.Now().Add(-400 * 24 * time.Hour).UTC()
+	recent := time.Now().Add(-time.Hour).UTC()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		date := old
+		if r.URL.Path == "/live" {
+			date = recent
+		}
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprintf(w, `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>%s</title><link>https://example.com%s</link>
+<item><title>item</title><link>https://example.com%s/1</link><description>an item</description><pubDate>%s</pubDate></item>
+</channel></rss>`, r.URL.Path, r.URL.Path, r.URL.Path, date.Format(time.RFC1123))
+	}))
+	defer srv.Close()
+
+	pubkeys := map[string]string{}
+	for _, name := range []string{"dead", "live", "pinned"} {
+		pubkey, err := Feed(srv.URL+"/"+name, relay.Secret, relay.db, FeedOptions{FullHistory: true})
+		if err != nil {
+			t.Fatalf("Feed(%s): %v", name, err)
+		}
+		pubkeys[name] = pubkey
+	}
+	pinned, _ := loadEntity(relay.db, pubkeys["pinned"])
+	pinned.Pinned = true
+	saveEntity(relay.db, pubkeys["pinned"], pinned)
+
+	updates := make(chan nostr.Event, 10)
+	p := newPoller(pollerConfig{
+		DB:            relay.db,
+		LastEmitted:   &sync.Map{},
+		Updates:       updates,
+		DeadThreshold: 365 * 24 * time.Hour,
+		PruneDead:     true,
+	})
+	var filters nostr.Filters
+	for _, pubkey := range pubkeys {
+		filters = append(filters, nostr.Filter{Authors: []string{pubkey}, Kinds: []int{1}})
+	}
+	p.filters = func() nostr.Filters { return filters }
+
+	// not known to be dead before being polled
+	if _, emitted, _ := p.poll(context.Background(), filters); emitted != 3 {
+		t.Fatalf("first poll emitted %d events, want 3", emitted)
+	}
+	entity, _ := loadEntity(relay.db, pubkeys["dead"])
+	if !entity.LastNewItem.Equal(old.Truncate(time.Second)) {
+		t.Errorf("dead feed's last new item = %s; want %s", entity.LastNewItem, old)
+	}
+
+	rec := httptest.NewRecorder()
+	handleHealth(rec, httptest.NewRequest("GET", "/health", nil))
+	var report HealthReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("GET /health: %v", err)
+	}
+	for name, want := range map[string]bool{"dead": true, "live": false, "pinned": true} {
+		if health := report.Feeds[srv.URL+"/"+name]; health.Stale != want || health.LastNewItem.IsZero() {
+			t.Errorf("%s feed's health = %+v; want stale %v", name, health, want)
+		}
+	}
+
+	if _, err := p.pollFeed(context.Background(), pubkeys["dead"]); err != errDeadFeed {
+		t.Errorf("polling the dead feed = %v; want errDeadFeed", err)
+	}
+	if _, err := p.pollFeed(context.Background(), pubkeys["pinned"]); err != nil {
+		t.Errorf("polling the pinned feed = %v; want it polled", err)
+	}
+
+	p.pass(context.Background())
+	if _, err := loadEntity(relay.db, pubkeys["dead"]); err == nil {
+		t.Error("the dead feed wasn't pruned")
+	}
+	for _, name := range []string{"live", "pinned"} {
+		if _, err := loadEntity(relay.db, pubkeys[name]); err != nil {
+			t.Errorf("the %s feed was pruned: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// Every record in the db lives under a prefix telling what it is. Entities
+// written before prefixes existed are stored under the bare pubkey and get
+// moved by migrateEntities.
+const (
+	entityPrefix    = "entity:"
+	watermarkPrefix = "watermark:"
+	feedCachePrefix = "feedcache:"
+	deliveryPrefix  = "delivery:"
+	deliveredPrefix = "delivered:"
+	digestPrefix    = "digest:"
+	firstSeenPrefix = "firstseen:"
+)
+
+// ErrStopIteration can be returned from a ForEachEntity callback to end the scan early.
+var ErrStopIteration = errors.New("stop iteration")
+
+// StoredEntity is a feed as found in the db, along with the pubkey it's stored under.
+type StoredEntity struct {
+	Pubkey string
+	Entity Entity
+}
+
+// CorruptEntitiesError reports the stored records that were skipped because
+// they don't decode.
+type CorruptEntitiesError struct {
+	Pubkeys []string
+}
+
+func (err *CorruptEntitiesError) Error() string {
+	return fmt.Sprintf("%d corrupt entities: %s", len(err.Pubkeys), strings.Join(err.Pubkeys, ", "))
+}
+
+func entityKey(pubkey string) []byte {
+	return []byte(entityPrefix + pubkey)
+}
+
+func isEntityKey(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(entityPrefix))
+}
+
+// isLegacyEntityKey tells whether key is a bare pubkey, from before prefixes.
+func isLegacyEntityKey(key []byte) bool {
+	return len(key) > 0 && !bytes.Contains(key, []byte(":"))
+}
+
+// prefixIterOptions bounds an iterator to the keys starting with prefix.
+func prefixIterOptions(prefix string) *pebble.IterOptions {
+	upper := []byte(prefix)
+	upper[len(upper)-1]++
+	return &pebble.IterOptions{LowerBound: []byte(prefix), UpperBound: upper}
+}
+
+// ForEachEntity calls fn with every stored feed in pubkey order, stopping at the
+// first error fn returns, which is returned unless it's ErrStopIteration.
+// Records that don't decode are skipped and, once the scan is over, reported
+// with a *CorruptEntitiesError.
+func ForEachEntity(db *pebble.DB, fn func(StoredEntity) error) error {
+	var corrupt []string
+	iter := db.NewIter(prefixIterOptions(entityPrefix))
+	for iter.First(); iter.Valid(); iter.Next() {
+		pubkey := string(iter.Key()[len(entityPrefix):])
+		entity, _, err := decodeEntity(iter.Value())
+		if err != nil {
+			logger.Error("got invalid json from db", "key", string(iter.Key()), "err", err)
+			corrupt = append(corrupt, pubkey)
+			continue
+		}
+
+		if err := fn(StoredEntity{Pubkey: pubkey, Entity: entity}); err != nil {
+			iter.Close()
+			if err == ErrStopIteration {
+				return nil
+			}
+			return err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	if len(corrupt) > 0 {
+		return &CorruptEntitiesError{Pubkeys: corrupt}
+	}
+	return nil
+}
+
+// ListEntities returns every stored feed. When some records are corrupt the
+// others are still returned, along with a *CorruptEntitiesError.
+func ListEntities(db *pebble.DB) ([]StoredEntity, error) {
+	var entities []StoredEntity
+	err := ForEachEntity(db, func(stored StoredEntity) error {
+		entities = append(entities, stored)
+		return nil
+	})
+	return entities, err
+}
+
+// skipCorrupt drops a *CorruptEntitiesError, for scans that only care about the
+// records that do decode.
+func skipCorrupt(err error) error {
+	var corrupt *CorruptEntitiesError
+	if errors.As(err, &corrupt) {
+		return nil
+	}
+	return err
+}
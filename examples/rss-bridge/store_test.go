@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestListEntities(t *testing.T) {
+	setupTestRelay(t)
+
+	saveEntity(relay.db, "aaa", Entity{URL: "https://a.example.com/feed"})
+	saveEntity(relay.db, "bbb", Entity{URL: "https://b.example.com/feed"})
+	relay.db.Set(entityKey("broken"), []byte(`{not json`), nil)
+	saveWatermark(relay.db, "https://a.example.com/feed", 1234)
+	relay.db.Set([]byte("cache:https://a.example.com/feed"), []byte(`{"URL":"not an entity"}`), nil)
+
+	entities, err := ListEntities(relay.db)
+	var corrupt *CorruptEntitiesError
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("ListEntities error = %v; want a *CorruptEntitiesError", err)
+	}
+	if len(corrupt.Pubkeys) != 1 || corrupt.Pubkeys[0] != "broken" {
+		t.Errorf("corrupt = %v; want [broken]", corrupt.Pubkeys)
+	}
+	if len(entities) != 2 ||
+		entities[0].Pubkey != "aaa" || entities[0].Entity.URL != "https://a.example.com/feed" ||
+		entities[1].Pubkey != "bbb" || entities[1].Entity.URL != "https://b.example.com/feed" {
+		t.Errorf("entities = %+v; want aaa and bbb", entities)
+	}
+}
+
+func TestForEachEntityStops(t *testing.T) {
+	setupTestRelay(t)
+
+	for _, pubkey := range []string{"aaa", "bbb", "ccc"} {
+		saveEntity(relay.db, pubkey, Entity{URL: "https://" + pubkey + ".example.com/feed"})
+	}
+
+	var seen []string
+	err := ForEachEntity(relay.db, func(stored StoredEntity) error {
+		seen = append(seen, stored.Pubkey)
+		if stored.Pubkey == "bbb" {
+			return ErrStopIteration
+		}
+		return nil
+	})
+	if err != nil || len(seen) != 2 {
+		t.Errorf("ForEachEntity = %v after %v; want nil after aaa and bbb", err, seen)
+	}
+
+	failure := errors.New("failure")
+	err = ForEachEntity(relay.db, func(StoredEntity) error { return failure })
+	if err != failure {
+		t.Errorf("ForEachEntity = %v; want the callback's error", err)
+	}
+}
+
+func TestLoadLegacyEntity(t *testing.T) {
+	setupTestRelay(t)
+
+	relay.db.Set([]byte("legacy"), []byte(`{"PrivateKey":"sk","URL":"https://example.com/feed"}`), nil)
+	entity, err := loadEntity(relay.db, "legacy")
+	if err != nil || entity.URL != "https://example.com/feed" {
+		t.Errorf("loadEntity(legacy) = %+v, %v; want it read from the bare key", entity, err)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// feedNamespaces are the namespaces the items of RSS and Atom feeds are in.
+var feedNamespaces = map[string]bool{
+	"":                            true, // RSS 2.0
+	"http://purl.org/rss/1.0/":    true,
+	"http://www.w3.org/2005/Atom": true,
+}
+
+// feedItems calls fn with the items of entity's feed that keepItem lets through,
+// in the order of the feed, until fn returns false, and returns the feed.
+// thread builds the notes of the items.
+//
+// With STREAM_FEEDS the feed is downloaded as it is parsed, so stopping early
+// saves reading the rest of it, and the feed returned has no items. Items are
+// then only threaded under the ones that came before them.
+func feedItems(ctx context.Context, pubkey string, entity Entity, fn func(thread *threader, item *gofeed.Item) bool) (*gofeed.Feed, error) {
+	if !relay.StreamFeeds {
+		feed, err := parseFeed(ctx, entity.URL)
+		if err != nil {
+			return nil, err
+		}
+		thread := newThreader(pubkey, entity.URL, feed, noteTemplate(entity), noteFooter(entity))
+		for _, item := range feed.Items {
+			if keepItem(item) && !fn(thread, item) {
+				break
+			}
+		}
+		return feed, nil
+	}
+
+	thread := newThreader(pubkey, entity.URL, &gofeed.Feed{}, noteTemplate(entity), noteFooter(entity))
+	return streamFeed(ctx, entity.URL, func(item *gofeed.Item) bool {
+		thread.add(item)
+		return !keepItem(item) || fn(thread, item)
+	})
+}
+
+// streamFeed is fetchAndCleanFeed parsing the feed as it is downloaded, see
+// streamFeedData. It doesn't go through the feed cache.
+func streamFeed(ctx context.Context, url string, fn func(item *gofeed.Item) bool) (*gofeed.Feed, error) {
+	body, err := openFeed(ctx, url, credentialsFor(url))
+	if err != nil {
+		recordFetch(url, nil, err)
+		return nil, err
+	}
+	defer body.Close()
+
+	seen := newItemDeduper(0)
+	feed, warnings, err := streamFeedData(body, func(item *gofeed.Item) bool {
+		if seen.seen(item) {
+			return true
+		}
+		cleanContent(url, item)
+		return fn(item)
+	})
+	recordFetch(url, warnings, err)
+	return feed, err
+}
+
+// streamFeedData parses a feed document an item at a time, calling fn with each
+// until it returns false, and returns the feed without its items. Only the item
+// being parsed is kept in memory, so huge feeds don't need much of it, and r is
+// only read up to the item fn stops at.
+//
+// Each item is parsed on its own, wrapped in the elements it was found in.
+// Documents that can't be read like this up to their first item, like JSON
+// feeds or ones in charsets other than UTF-8, are read whole by parseFeedData.
+// Malformed input after the first item ends the feed with a warning.
+func streamFeedData(r io.Reader, fn func(item *gofeed.Item) bool) (*gofeed.Feed, []string, error) {
+	c := &captureReader{r: r}
+	dec := xml.NewDecoder(c)
+	dec.Strict = false
+
+	var (
+		head     *gofeed.Feed
+		prolog   []byte   // what comes before the root element
+		open     [][]byte // start tags of the elements the next item is in
+		warnings []string
+		n        int
+	)
+	end := func(err error) (*gofeed.Feed, []string, error) {
+		var syntaxErr *xml.SyntaxError
+		switch {
+		case err == io.EOF:
+			return head, warnings, nil
+		case err == io.ErrUnexpectedEOF || errors.As(err, &syntaxErr):
+			return head, append(warnings, "stopped at malformed input: "+err.Error()), nil
+		}
+		return head, warnings, err
+	}
+
+stream:
+	for {
+		offset := dec.InputOffset()
+		token, err := dec.Token()
+		if err != nil && head == nil {
+			break
+		} else if err != nil {
+			return end(err)
+		}
+
+		switch t := token.(type) {
+		case xml.EndElement:
+			if len(open) > 0 {
+				open = open[:len(open)-1]
+			}
+		case xml.StartElement:
+			if len(open) == 0 {
+				prolog = append([]byte(nil), c.slice(0, offset)...)
+			}
+			if len(open) == 0 || !(t.Name.Local == "item" || t.Name.Local == "entry") || !feedNamespaces[t.Name.Space] {
+				open = append(open, append([]byte(nil), c.slice(offset, dec.InputOffset())...))
+				continue
+			}
+
+			if head == nil {
+				doc := closeTags(append([]byte(nil), c.slice(0, offset)...), open)
+				if head, err = fp.Parse(bytes.NewReader(doc)); err != nil {
+					head = nil
+					break stream
+				}
+				head.Items = nil
+			}
+
+			if err := dec.Skip(); err == io.EOF {
+				return end(io.ErrUnexpectedEOF)
+			} else if err != nil {
+				return end(err)
+			}
+			doc := append([]byte(nil), prolog...)
+			for _, tag := range open {
+				doc = append(doc, tag...)
+			}
+			doc = closeTags(append(doc, c.slice(offset, dec.InputOffset())...), open)
+			c.discard(dec.InputOffset())
+
+			parsed, err := fp.Parse(bytes.NewReader(doc))
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("item %d: %v", n, err))
+				n++
+				continue
+			}
+			for _, item := range parsed.Items {
+				warnings = append(warnings, itemWarnings(n, item)...)
+				n++
+				if !fn(item) {
+					return head, warnings, nil
+				}
+			}
+		}
+	}
+
+	// start over with all of it
+	data, err := io.ReadAll(io.MultiReader(bytes.NewReader(c.buf), c.r))
+	if err != nil {
+		return nil, nil, err
+	}
+	feed, warnings, err := parseFeedData(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, item := range feed.Items {
+		if !fn(item) {
+			break
+		}
+	}
+	feed.Items = nil
+	return feed, warnings, nil
+}
+
+// closeTags appends to doc the end tags of the elements the start tags of open
+// begin, innermost first.
+func closeTags(doc []byte, open [][]byte) []byte {
+	for i := len(open) - 1; i >= 0; i-- {
+		name := open[i][1:]
+		if end := bytes.IndexAny(name, " \t\r\n/>"); end >= 0 {
+			name = name[:end]
+		}
+		doc = append(append(append(doc, "</"...), name...), '>')
+	}
+	return doc
+}
+
+// captureReader keeps what is read from r since the offset start, so the raw
+// bytes of the tokens an xml.Decoder reads can be had by their offsets.
+type captureReader struct {
+	r     io.Reader
+	buf   []byte
+	start int64
+}
+
+func (c *captureReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.buf = append(c.buf, p[:n]...)
+	return n, err
+}
+
+// slice is what was read between the offsets from and to.
+func (c *captureReader) slice(from, to int64) []byte {
+	return c.buf[from-c.start : to-c.start]
+}
+
+// discard forgets what was read before the offset to.
+func (c *captureReader) discard(to int64) {
+	c.buf = append(c.buf[:0], c.buf[to-c.start:]...)
+	c.start = to
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// hugeFeed is an RSS feed of n items, the newest first, published an hour apart
+// until an hour ago.
+func hugeFeed(n int) []byte {
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>
+<rss version="2.0" xmlns:dc="http://purl.org/dc/elements/1.1/"><channel>
+<title>huge feed</title><link>https://example.com</link><description>a lot of items</description>
+`)
+	newest := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, `<item><title>item %d</title><link>https://example.com/%d</link><dc:creator>someone</dc:creator>`+
+			`<description>%s</description><pubDate>%s</pubDate></item>
+`, i, i, strings.Repeat("words ", 50), newest.Add(-time.Duration(i)*time.Hour).UTC().Format(time.RFC1123))
+	}
+	b.WriteString("</channel></rss>")
+	return b.Bytes()
+}
+
+// countingReader counts what is read from it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestStreamFeedStopsEarly(t *testing.T) {
+	data := hugeFeed(20000)
+	full, _, err := parseFeedData(data)
+	if err != nil {
+		t.Fatalf("parseFeedData: %v", err)
+	}
+
+	r := &countingReader{r: bytes.NewReader(data)}
+	var items []*gofeed.Item
+	head, warnings, err := streamFeedData(r, func(item *gofeed.Item) bool {
+		items = append(items, item)
+		return len(items) < 3
+	})
+	if err != nil {
+		t.Fatalf("streamFeedData: %v", err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("warnings = %v; want none", warnings)
+	}
+	if head.Title != "huge feed" || head.Link != "https://example.com" || len(head.Items) != 0 {
+		t.Errorf("head = %q %q with %d items; want the channel without items", head.Title, head.Link, len(head.Items))
+	}
+	if r.n > len(data)/100 {
+		t.Errorf("read %d of %d bytes to get 3 items; want parsing to stop early", r.n, len(data))
+	}
+
+	if len(items) != 3 {
+		t.Fatalf("got %d items; want 3", len(items))
+	}
+	for i, item := range items {
+		want := full.Items[i]
+		if item.Title != want.Title || item.Link != want.Link || item.Description != want.Description ||
+			!item.PublishedParsed.Equal(*want.PublishedParsed) || item.Author == nil || item.Author.Name != "someone" {
+			t.Errorf("item %d = %+v; want %+v", i, item, want)
+		}
+	}
+}
+
+func TestStreamFeedWhole(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		data string
+	}{
+		{"rss", testFeed},
+		{"atom", `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom"><title>test feed</title><link href="https://example.com"/>
+<entry><title>first</title><link href="https://example.com/1"/><updated>2023-01-02T15:04:05Z</updated></entry>
+<entry><title>second</title><link href="https://example.com/2"/><updated>2023-01-03T15:04:05Z</updated></entry>
+</feed>`},
+		{"latin-1", `<?xml version="1.0" encoding="ISO-8859-1"?>
+<rss version="2.0"><channel><title>test feed</title><link>https://example.com</link>
+<item><title>first</title><link>https://example.com/1</link></item>
+<item><title>second</title><link>https://example.com/2</link></item>
+</channel></rss>`},
+		{"json", `{"version": "https://jsonfeed.org/version/1.1", "title": "test feed", "home_page_url": "https://example.com",
+"items": [{"id": "1", "title": "first", "url": "https://example.com/1"}, {"id": "2", "title": "second", "url": "https://example.com/2"}]}`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var titles []string
+			head, _, err := streamFeedData(strings.NewReader(tt.data), func(item *gofeed.Item) bool {
+				titles = append(titles, item.Title)
+				return true
+			})
+			if err != nil {
+				t.Fatalf("streamFeedData: %v", err)
+			}
+			if head.Title != "test feed" {
+				t.Errorf("feed title = %q; want test feed", head.Title)
+			}
+			if strings.Join(titles, ",") != "first,second" {
+				t.Errorf("items = %v; want first and second", titles)
+			}
+		})
+	}
+}
+
+func TestStreamFeedMalformedItem(t *testing.T) {
+	data := `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>test feed</title>
+<item><title>first</title><link>https://example.com/1</link></item>
+<item><title>second</title><link>https://example.com/2</link></itm>`
+
+	var titles []string
+	_, warnings, err := streamFeedData(strings.NewReader(data), func(item *gofeed.Item) bool {
+		titles = append(titles, item.Title)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("streamFeedData: %v", err)
+	}
+	if len(titles) == 0 || titles[0] != "first" {
+		t.Errorf("items = %v; want first one at least", titles)
+	}
+	if len(warnings) == 0 || !strings.Contains(warnings[len(warnings)-1], "malformed") {
+		t.Errorf("warnings = %v; want the malformed input reported", warnings)
+	}
+}
+
+func TestPollerStreamsFeeds(t *testing.T) {
+	setupTestRelay(t)
+	relay.StreamFeeds = true
+	t.Cleanup(func() { relay.StreamFeeds = false })
+
+	data := hugeFeed(2000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	pubkey, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+
+	updates := make(chan nostr.Event, 10)
+	lastEmitted := &sync.Map{}
+	p := newPoller(pollerConfig{
+		DB:            relay.db,
+		LastEmitted:   lastEmitted,
+		Updates:       updates,
+		MaxInitialAge: 4*time.Hour + time.Minute,
+		StreamFeeds:   true,
+	})
+	filters := nostr.Filters{{Authors: []string{pubkey}, Kinds: []int{1}}}
+
+	p.poll(context.Background(), filters)
+	if n := len(updates); n != 4 {
+		t.Fatalf("first poll emitted %d events, want the 4 recent ones", n)
+	}
+	var titles []string
+	for len(updates) > 0 {
+		evt := <-updates
+		title, _, _ := strings.Cut(strings.TrimPrefix(evt.Content, "**"), "**")
+		titles = append(titles, title)
+	}
+	if want := "item 3,item 2,item 1,item 0"; strings.Join(titles, ",") != want {
+		t.Errorf("emitted %v; want %s, oldest first", titles, want)
+	}
+
+	p.poll(context.Background(), filters)
+	if n := len(updates); n != 0 {
+		t.Errorf("second poll emitted %d events, want 0", n)
+	}
+
+	// queries stop at their limit too
+	events := feedEvents(context.Background(), pubkey, &nostr.Filter{Kinds: []int{0, 1}, Limit: 5})
+	if len(events) != 6 {
+		t.Errorf("query got %d events; want the metadata and 5 notes", len(events))
+	}
+}
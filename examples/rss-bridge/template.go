@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	strip "github.com/grokify/html-strip-tags-go"
+	"github.com/mmcdole/gofeed"
+)
+
+// defaultContentTemplate is used for feeds registered without a ContentTemplate.
+const defaultContentTemplate = "{{with .Title}}**{{.}}**{{end}}{{with .Author}} by {{.}}{{end}}\n\n{{truncate 250 .Description}}\n\n{{.Link}}"
+
+// defaultFullContentTemplate is used for FullContent feeds registered
+// without a ContentTemplate.
+const defaultFullContentTemplate = "{{with .Title}}**{{.}}**{{end}}{{with .Author}} by {{.}}{{end}}\n\n{{.Content}}\n\n{{.Link}}"
+
+// maxNoteLength caps whatever a template renders, but for FullContent feeds,
+// see noteLength.
+const maxNoteLength = 4000
+
+var templateFuncs = template.FuncMap{
+	"truncate": truncate,
+	"join":     strings.Join,
+}
+
+var defaultNoteTemplate = template.Must(parseContentTemplate(""))
+
+// noteFields is what content templates get to render an item with.
+type noteFields struct {
+	Title       string
+	Description string
+	// Content is the full text of the item for FullContent feeds, else or if
+	// the feed doesn't have it, the Description.
+	Content    string
+	Link       string
+	Author     string
+	Categories []string
+	Published  time.Time
+	// Image is the item's own image, often just the site's logo.
+	Image string
+	// ArticleImage is the main image in the item's html with
+	// RESPECT_ARTICLE_IMAGE set, see articleImage.
+	ArticleImage string
+}
+
+// parseContentTemplate parses the text/template a feed's notes are rendered with,
+// an empty text means the default one.
+func parseContentTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = defaultContentTemplate
+	}
+	tmpl, err := template.New("content").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	// catch references to fields we don't have before any real item does
+	if err := tmpl.Execute(&strings.Builder{}, noteFields{}); err != nil {
+		return nil, err
+	}
+
+	return tmpl, nil
+}
+
+// noteTemplate returns the parsed ContentTemplate of entity, falling back to the
+// default one if it doesn't parse anymore.
+func noteTemplate(entity Entity) *template.Template {
+	text := entity.ContentTemplate
+	if text == "" && entity.FullContent {
+		text = defaultFullContentTemplate
+	}
+	tmpl, err := parseContentTemplate(text)
+	if err != nil {
+		return defaultNoteTemplate
+	}
+	return tmpl
+}
+
+// noteFooter is what the notes of the feed end with: with NIP05_FOOTER set, its
+// configured NIP-05, if it has one.
+func noteFooter(entity Entity) string {
+	if !relay.Nip05Footer || entity.Meta == nil || entity.Meta.Nip05 == "" {
+		return ""
+	}
+	return "✓ " + entity.Meta.Nip05
+}
+
+// appendFooter ends content with footer on a paragraph of its own, cutting
+// content so the note stays within limit.
+func appendFooter(content, footer string, limit int) string {
+	if footer == "" {
+		return content
+	}
+	return truncate(limit-utf8.RuneCountInString(footer)-2, content) + "\n\n" + footer
+}
+
+// renderContent renders item with tmpl, decoding html entities in the result and
+// capping it at its noteLength.
+func renderContent(tmpl *template.Template, item *gofeed.Item, link string) (string, error) {
+	fields := noteFields{
+		Title:       item.Title,
+		Description: strings.TrimSpace(strip.StripTags(item.Description)),
+		Content:     strings.TrimSpace(strip.StripTags(item.Content)),
+		Link:        link,
+		Author:      itemAuthor(item),
+		Categories:  item.Categories,
+	}
+	if fields.Content == "" {
+		fields.Content = fields.Description
+	}
+	if item.UpdatedParsed != nil {
+		fields.Published = *item.UpdatedParsed
+	}
+	if item.PublishedParsed != nil {
+		fields.Published = *item.PublishedParsed
+	}
+	if item.Image != nil {
+		fields.Image = item.Image.URL
+	}
+	if relay.RespectArticleImage {
+		fields.ArticleImage = articleImage(item)
+	}
+
+	var content strings.Builder
+	if err := tmpl.Execute(&content, fields); err != nil {
+		return "", fmt.Errorf("failed to render %q: %w", item.Link, err)
+	}
+
+	return truncate(noteLength(item), html.UnescapeString(strings.TrimSpace(content.String()))), nil
+}
+
+// truncate cuts s to at most n runes, marking the cut with an ellipsis.
+func truncate(n int, s string) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const testTemplateFeed = `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>test</title>
+<item>
+<title>Hello &amp; welcome</title>
+<link>https://example.com/hello</link>
+<author>jane@example.com (Jane)</author>
+<category>news</category><category>tech</category>
+<description><![CDATA[<p>The <b>first</b> post &amp; more.</p>]]></description>
+<pubDate>Mon, 02 Jan 2023 15:04:05 GMT</pubDate>
+</item>
+</channel></rss>`
+
+func TestRenderContent(t *testing.T) {
+	feed, err := fp.Parse(strings.NewReader(testTemplateFeed))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	item := feed.Items[0]
+
+	var tests = []struct {
+		template string
+		want     string
+	}{
+		{"", "**Hello & welcome** by Jane\n\nThe first post & more.\n\nhttps://example.com/hello"},
+		{"{{.Link}}", "https://example.com/hello"},
+		{"{{.Title}}: {{.Description}}", "Hello & welcome: The first post & more."},
+		{"{{.Title}} by {{.Author}} [{{join .Categories \", \"}}] {{.Published.Format \"2006-01-02\"}}", "Hello & welcome by Jane [news, tech] 2023-01-02"},
+		{"{{truncate 10 .Description}}", "The first…"},
+	}
+
+	for _, tt := range tests {
+		tmpl, err := parseContentTemplate(tt.template)
+		if err != nil {
+			t.Errorf("parseContentTemplate(%q): %v", tt.template, err)
+			continue
+		}
+		got, err := renderContent(tmpl, item, item.Link)
+		if err != nil {
+			t.Errorf("renderContent(%q): %v", tt.template, err)
+		} else if got != tt.want {
+			t.Errorf("renderContent(%q) = %q; want %q", tt.template, got, tt.want)
+		}
+	}
+
+	long, _ := parseContentTemplate(strings.Repeat("{{.Description}}", 200))
+	if got, _ := renderContent(long, item, item.Link); len([]rune(got)) != maxNoteLength {
+		t.Errorf("rendered %d runes; want them capped at %d", len([]rune(got)), maxNoteLength)
+	}
+}
+
+func TestFeedRejectsBadTemplate(t *testing.T) {
+	setupTestRelay(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("a bad template shouldn't get as far as fetching the feed")
+	}))
+	defer srv.Close()
+
+	for _, tmpl := range []string{"{{.Title", "{{.Summary}}", "{{nope .Title}}"} {
+		if _, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{ContentTemplate: tmpl}); !errors.Is(err, ErrBadTemplate) {
+			t.Errorf("Feed with template %q = %v; want ErrBadTemplate", tmpl, err)
+		}
+	}
+	if n := countStored(t); n != 0 {
+		t.Errorf("stored %d feeds; want 0", n)
+	}
+}
+
+func TestNip05Footer(t *testing.T) {
+	setupTestRelay(t)
+	defer func() { relay.Nip05Footer = false }()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testTemplateFeed)
+	}))
+	defer srv.Close()
+
+	store := func(path string, meta *Metadata) string {
+		sk := nostr.GeneratePrivateKey()
+		pubkey, _ := nostr.GetPublicKey(sk)
+		if err := saveEntity(relay.db, pubkey, Entity{PrivateKey: sk, URL: srv.URL + path, Meta: meta}); err != nil {
+			t.Fatalf("saveEntity: %v", err)
+		}
+		return pubkey
+	}
+	withNip05 := store("/a", &Metadata{Name: "Guardian", Nip05: "guardian@newstr.id"})
+	withoutNip05 := store("/b", &Metadata{Name: "Other"})
+	withoutMeta := store("/c", nil)
+
+	notes := func(pubkey string) []nostr.Event {
+		t.Helper()
+		events := feedEvents(context.Background(), pubkey, &nostr.Filter{Kinds: []int{nostr.KindTextNote}})
+		if len(events) == 0 {
+			t.Fatalf("no notes for %s", pubkey)
+		}
+		return events
+	}
+
+	for _, evt := range notes(withNip05) {
+		if strings.Contains(evt.Content, "✓") {
+			t.Errorf("note has a footer without NIP05_FOOTER: %q", evt.Content)
+		}
+	}
+
+	relay.Nip05Footer = true
+	for _, evt := range notes(withNip05) {
+		if !strings.HasSuffix(evt.Content, "\n\n✓ guardian@newstr.id") {
+			t.Errorf("note = %q; want it to end with the nip05", evt.Content)
+		}
+		if evt.GetID() != evt.ID {
+			t.Error("footer added after the id was computed")
+		}
+	}
+	for _, pubkey := range []string{withoutNip05, withoutMeta} {
+		for _, evt := range notes(pubkey) {
+			if strings.Contains(evt.Content, "✓") {
+				t.Errorf("note of a feed without nip05 = %q; want no footer", evt.Content)
+			}
+		}
+	}
+
+	footer := "✓ guardian@newstr.id"
+	long := appendFooter(strings.Repeat("a", maxNoteLength), footer, maxNoteLength)
+	if n := utf8.RuneCountInString(long); n != maxNoteLength || !strings.HasSuffix(long, footer) {
+		t.Errorf("footer on a full note gave %d runes ending %q; want %d ending with the footer",
+			n, long[len(long)-30:], maxNoteLength)
+	}
+}
+
+func TestArticleImage(t *testing.T) {
+	item := &gofeed.Item{
+		Title: "story",
+		Link:  "https://example.com/posts/story",
+		Image: &gofeed.Image{URL: "https://example.com/logo.png"},
+		Content: `<header><img src="/banner.png" width="2000" height="400"></header>
+<main><article>
+<img src="https://example.com/logo.png" width="64" height="64">
+<img src="https://tracker.example.net/pixel.gif" width="1" height="1">
+<p>text <img src="/icons/share.svg" width="16" height="16"></p>
+<figure><img src="/images/hero.jpg" width="1200" height="630"></figure>
+</article></main>`,
+	}
+	tmpl, err := parseContentTemplate("{{or .ArticleImage .Image}}")
+	if err != nil {
+		t.Fatalf("parseContentTemplate: %v", err)
+	}
+
+	if got, _ := renderContent(tmpl, item, item.Link); got != "https://example.com/logo.png" {
+		t.Errorf("without RESPECT_ARTICLE_IMAGE = %q; want the item's image", got)
+	}
+
+	relay.RespectArticleImage = true
+	t.Cleanup(func() { relay.RespectArticleImage = false })
+	if got, _ := renderContent(tmpl, item, item.Link); got != "https://example.com/images/hero.jpg" {
+		t.Errorf("rendered %q; want the hero image of the article", got)
+	}
+
+	for _, tt := range []struct {
+		content string
+		want    string
+	}{
+		{`<p><img src="a.jpg"><img src="b.jpg"></p>`, "https://example.com/posts/a.jpg"},
+		{`<img src="small.jpg" width="100" height="100"><img src="big.jpg" width="800" height="600">`, "https://example.com/posts/big.jpg"},
+		{`<img src="https://example.com/logo.png">`, ""},
+		{`<p>no images</p>`, ""},
+	} {
+		item := &gofeed.Item{Link: item.Link, Image: item.Image, Description: tt.content}
+		if got := articleImage(item); got != tt.want {
+			t.Errorf("articleImage(%s) = %q; want %q", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestFullContent(t *testing.T) {
+	setupTestRelay(t)
+	relay.FullContentMaxLength = 20000
+	t.Cleanup(func() { relay.FullContentMaxLength = 0 })
+
+	article := strings.Repeat("All the words of the article. ", 200) + "The end."
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprintf(w, `<?xml version="1.0"?>
+<rss version="2.0" xmlns:content="http://purl.org/rss/1.0/modules/content/"><channel>
+<title>long reads</title><link>https://example.com</link>
+<item><title>story</title><link>https://example.com/story</link>
+<description>a summary</description>
+<content:encoded><![CDATA[<p>%s</p>]]></content:encoded></item>
+</channel></rss>`, article)
+	}))
+	defer srv.Close()
+
+	note := func(url string, opts FeedOptions) string {
+		t.Helper()
+		pubkey, err := Feed(url, relay.Secret, relay.db, opts)
+		if err != nil && !errors.Is(err, ErrAlreadyRegistered) {
+			t.Fatalf("Feed(%s): %v", url, err)
+		}
+		evts := feedEvents(context.Background(), pubkey, &nostr.Filter{Kinds: []int{nostr.KindTextNote}})
+		if len(evts) != 1 {
+			t.Fatalf("%s: got %d notes; want 1", url, len(evts))
+		}
+		return evts[0].Content
+	}
+
+	full := note(srv.URL+"/full", FeedOptions{FullContent: true})
+	if !strings.Contains(full, strings.TrimSpace(article)) || strings.Contains(full, "<p>") || strings.Contains(full, "a summary") {
+		t.Errorf("full content note = %q; want the complete article, as text", full)
+	}
+	if utf8.RuneCountInString(full) <= maxNoteLength {
+		t.Errorf("full content note of %d runes; want it past maxNoteLength", utf8.RuneCountInString(full))
+	}
+
+	summary := note(srv.URL+"/summary", FeedOptions{})
+	if !strings.Contains(summary, "a summary") || strings.Contains(summary, "The end.") {
+		t.Errorf("note = %q; want the summary only", summary)
+	}
+
+	// and up to FULL_CONTENT_MAX_LENGTH
+	relay.FullContentMaxLength = 5000
+	feeds.Flush()
+	if capped := note(srv.URL+"/full", FeedOptions{FullContent: true}); utf8.RuneCountInString(capped) != 5000 {
+		t.Errorf("note of %d runes; want it cut at 5000", utf8.RuneCountInString(capped))
+	}
+}
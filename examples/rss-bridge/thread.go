@@ -0,0 +1,110 @@
+package main
+
+import (
+	"text/template"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// threader builds text notes for the items of a feed, marking items that reply to
+// other items of the same feed (Atom threading extension, RFC 4685) with NIP-10
+// "root" and "reply" e tags, and pointing them at the feed with an "r" tag.
+type threader struct {
+	pubkey    string
+	source    string
+	relayHint string
+	template  *template.Template
+	footer    string
+	items     map[string]*gofeed.Item // guid or link -> item
+	ids       map[*gofeed.Item]string
+}
+
+func newThreader(pubkey, source string, feed *gofeed.Feed, tmpl *template.Template, footer string) *threader {
+	t := &threader{
+		pubkey:    pubkey,
+		source:    source,
+		relayHint: relay.ServiceURL,
+		template:  tmpl,
+		footer:    footer,
+		items:     make(map[string]*gofeed.Item, len(feed.Items)),
+		ids:       make(map[*gofeed.Item]string, len(feed.Items)),
+	}
+	for _, item := range feed.Items {
+		t.add(item)
+	}
+	return t
+}
+
+// add makes item one that others can be threaded under.
+func (t *threader) add(item *gofeed.Item) {
+	if item.Link != "" {
+		t.items[item.Link] = item
+	}
+	if item.GUID != "" {
+		t.items[item.GUID] = item
+	}
+}
+
+// note returns the text note for item, with its thread tags and id set.
+func (t *threader) note(item *gofeed.Item) nostr.Event {
+	return t.build(item, map[*gofeed.Item]bool{})
+}
+
+func (t *threader) build(item *gofeed.Item, seen map[*gofeed.Item]bool) nostr.Event {
+	seen[item] = true
+
+	evt := itemToTextNote(t.pubkey, item, t.template)
+	evt.Content = appendFooter(evt.Content, t.footer, noteLength(item))
+	if t.source != "" {
+		evt.Tags = append(evt.Tags, nostr.Tag{"r", t.source})
+	}
+
+	// walk up to the root, collecting the event id of the direct parent on the way
+	var root, parent string
+	for i, ancestor := 0, t.parent(item); ancestor != nil && !seen[ancestor]; i, ancestor = i+1, t.parent(ancestor) {
+		id := t.eventID(ancestor, seen)
+		if i == 0 {
+			parent = id
+		}
+		root = id
+	}
+
+	if root != "" {
+		evt.Tags = append(evt.Tags, nostr.Tag{"e", root, t.relayHint, "root"})
+		if parent != root {
+			evt.Tags = append(evt.Tags, nostr.Tag{"e", parent, t.relayHint, "reply"})
+		}
+	}
+	evt.ID = evt.GetID()
+
+	return evt
+}
+
+func (t *threader) eventID(item *gofeed.Item, seen map[*gofeed.Item]bool) string {
+	if id, ok := t.ids[item]; ok {
+		return id
+	}
+
+	// copy so sibling branches don't see each other as cycles
+	branch := make(map[*gofeed.Item]bool, len(seen))
+	for k := range seen {
+		branch[k] = true
+	}
+
+	id := t.build(item, branch).ID
+	t.ids[item] = id
+	return id
+}
+
+// parent returns the item this one replies to, if it is in the same feed.
+func (t *threader) parent(item *gofeed.Item) *gofeed.Item {
+	for _, ext := range item.Extensions["thr"]["in-reply-to"] {
+		for _, ref := range []string{ext.Attrs["ref"], ext.Attrs["href"]} {
+			if parent, ok := t.items[ref]; ok && ref != "" && parent != item {
+				return parent
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const testThreadFeed = `<?xml version="1.0"?>
+<feed xmlns="http://www.w3.org/2005/Atom" xmlns:thr="http://purl.org/syndication/thread/1.0">
+<title>comments</title>
+<entry><id>tag:example.com,1</id><title>root</title><link href="https://example.com/1"/><updated>2023-01-01T00:00:00Z</updated></entry>
+<entry><id>tag:example.com,2</id><title>reply</title><link href="https://example.com/2"/><updated>2023-01-02T00:00:00Z</updated><thr:in-reply-to ref="tag:example.com,1"/></entry>
+<entry><id>tag:example.com,3</id><title>nested reply</title><link href="https://example.com/3"/><updated>2023-01-03T00:00:00Z</updated><thr:in-reply-to ref="tag:example.com,2"/></entry>
+</feed>`
+
+func TestThreaderMarkedTags(t *testing.T) {
+	relay.ServiceURL = "wss://bridge.example.com"
+	defer func() { relay.ServiceURL = "" }()
+
+	feed, err := fp.Parse(strings.NewReader(testThreadFeed))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	thread := newThreader("pubkey", "", feed, defaultNoteTemplate, "")
+	root := thread.note(feed.Items[0])
+	reply := thread.note(feed.Items[1])
+	nested := thread.note(feed.Items[2])
+
+	if len(root.Tags) != 0 {
+		t.Errorf("root tags = %v; want none", root.Tags)
+	}
+
+	want := nostr.Tags{{"e", root.ID, relay.ServiceURL, "root"}}
+	if !tagsEqual(reply.Tags, want) {
+		t.Errorf("reply tags = %v; want %v", reply.Tags, want)
+	}
+
+	want = nostr.Tags{
+		{"e", root.ID, relay.ServiceURL, "root"},
+		{"e", reply.ID, relay.ServiceURL, "reply"},
+	}
+	if !tagsEqual(nested.Tags, want) {
+		t.Errorf("nested reply tags = %v; want %v", nested.Tags, want)
+	}
+}
+
+func tagsEqual(a, b nostr.Tags) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if strings.Join(a[i], "\x00") != strings.Join(b[i], "\x00") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// The sources TIMESTAMP_SOURCE picks the created_at of notes from, the first
+// one giving a time winning. If none does the note is made now.
+const (
+	// timestampPublished and timestampUpdated are the dates the feed gives the item.
+	timestampPublished = "published"
+	timestampUpdated   = "updated"
+	// timestampFetched is when the bridge first read the item, or now for items
+	// that can't be told apart, which then are new every time the feed is read.
+	timestampFetched = "fetched"
+	// timestampFirstSeen is when the bridge first read the item, kept in the db,
+	// and gives no time for items that can't be told apart.
+	timestampFirstSeen = "first-seen"
+)
+
+// defaultTimestampSource is used when TIMESTAMP_SOURCE is empty.
+var defaultTimestampSource = []string{timestampPublished, timestampUpdated}
+
+func validTimestampSource(source string) bool {
+	switch source {
+	case timestampPublished, timestampUpdated, timestampFetched, timestampFirstSeen:
+		return true
+	}
+	return false
+}
+
+// itemTime is the time the note of item, from the feed of pubkey, is made at.
+func itemTime(pubkey string, item *gofeed.Item) time.Time {
+	sources := relay.TimestampSource
+	if len(sources) == 0 {
+		sources = defaultTimestampSource
+	}
+
+	for _, source := range sources {
+		switch source {
+		case timestampPublished:
+			if item.PublishedParsed != nil {
+				return *item.PublishedParsed
+			}
+		case timestampUpdated:
+			if item.UpdatedParsed != nil {
+				return *item.UpdatedParsed
+			}
+		case timestampFetched:
+			if seen, ok := seenAt(pubkey, item); ok {
+				return seen
+			}
+			return time.Now()
+		case timestampFirstSeen:
+			if seen, ok := seenAt(pubkey, item); ok {
+				return seen
+			}
+		}
+	}
+	return time.Now()
+}
+
+// seenAt is firstSeen, or now for a feed that is only previewed.
+func seenAt(pubkey string, item *gofeed.Item) (time.Time, bool) {
+	if _, previewing := previewKeys.Load(pubkey); previewing {
+		return time.Now(), true
+	}
+	return firstSeen(relay.db, pubkey, item)
+}
+
+// usesFirstSeen tells whether TIMESTAMP_SOURCE keeps first-seen times.
+func usesFirstSeen() bool {
+	for _, source := range relay.TimestampSource {
+		if source == timestampFetched || source == timestampFirstSeen {
+			return true
+		}
+	}
+	return false
+}
+
+// firstSeen returns when item was first read from the feed of pubkey,
+// recording now if it wasn't before. Items without a guid, link or title
+// can't be told apart and aren't recorded.
+func firstSeen(db *pebble.DB, pubkey string, item *gofeed.Item) (time.Time, bool) {
+	key := firstSeenKey(pubkey, item)
+	if db == nil || key == nil {
+		return time.Time{}, false
+	}
+
+	val, closer, err := db.Get(key)
+	if err == nil {
+		seen, err := strconv.ParseInt(string(val), 10, 64)
+		closer.Close()
+		if err == nil {
+			return time.Unix(seen, 0), true
+		}
+		logger.Error("got invalid first-seen time from db", "key", string(key), "err", err)
+	} else if err != pebble.ErrNotFound {
+		logger.Error("failed to load first-seen time", "key", string(key), "err", err)
+		return time.Time{}, false
+	}
+
+	now := time.Now()
+	if err := db.Set(key, strconv.AppendInt(nil, now.Unix(), 10), pebble.NoSync); err != nil {
+		logger.Error("failed to store first-seen time", "key", string(key), "err", err)
+	}
+	return now, true
+}
+
+// firstSeenKey is where the first-seen time of item, from the feed of pubkey,
+// is kept, nil if the item can't be told apart.
+func firstSeenKey(pubkey string, item *gofeed.Item) []byte {
+	id := item.GUID
+	if id == "" {
+		id = item.Link
+	}
+	if id == "" {
+		id = contentHash(item)
+	}
+	if id == "" {
+		return nil
+	}
+	return []byte(firstSeenPrefix + pubkey + "\x00" + id)
+}
+
+// pruneFirstSeen forgets the first-seen times of the feed of pubkey that the
+// watermark passed, but for those of the items still in the feed, whose keys
+// are in current: the others won't be emitted again anyway.
+func pruneFirstSeen(db *pebble.DB, pubkey string, current map[string]bool, watermark nostr.Timestamp) error {
+	batch := db.NewBatch()
+	defer batch.Close()
+	iter := db.NewIter(prefixIterOptions(firstSeenPrefix + pubkey + "\x00"))
+	for iter.First(); iter.Valid(); iter.Next() {
+		if current[string(iter.Key())] {
+			continue
+		}
+		if seen, err := strconv.ParseInt(string(iter.Value()), 10, 64); err != nil || nostr.Timestamp(seen) <= watermark {
+			batch.Delete(iter.Key(), nil)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	return batch.Commit(pebble.NoSync)
+}
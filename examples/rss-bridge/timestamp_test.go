@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestTimestampSource(t *testing.T) {
+	setupTestRelay(t)
+	t.Cleanup(func() { relay.TimestampSource = nil })
+
+	published := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)
+	updated := time.Date(2023, 1, 3, 15, 4, 5, 0, time.UTC)
+	item := func(published, updated *time.Time) *gofeed.Item {
+		return &gofeed.Item{Title: "x", Link: "https://example.com/x", PublishedParsed: published, UpdatedParsed: updated}
+	}
+	isNow := func(ts nostr.Timestamp) bool {
+		return time.Since(ts.Time()) < time.Minute
+	}
+
+	for _, tt := range []struct {
+		name    string
+		sources []string
+		item    *gofeed.Item
+		check   func(nostr.Timestamp) bool
+	}{
+		{"default", nil, item(&published, &updated), func(ts nostr.Timestamp) bool { return ts.Time().Equal(published) }},
+		{"default without published", nil, item(nil, &updated), func(ts nostr.Timestamp) bool { return ts.Time().Equal(updated) }},
+		{"default without dates", nil, item(nil, nil), isNow},
+		{"updated", []string{"updated", "published"}, item(&published, &updated), func(ts nostr.Timestamp) bool { return ts.Time().Equal(updated) }},
+		{"updated falling back", []string{"updated", "published"}, item(&published, nil), func(ts nostr.Timestamp) bool { return ts.Time().Equal(published) }},
+		{"fetched", []string{"fetched"}, item(&published, &updated), isNow},
+		{"first-seen", []string{"first-seen"}, item(&published, &updated), isNow},
+	} {
+		relay.TimestampSource = tt.sources
+		if ts := itemToTextNote("pubkey", tt.item, defaultNoteTemplate).CreatedAt; !tt.check(ts) {
+			t.Errorf("%s: created at %s", tt.name, ts.Time().UTC())
+		}
+	}
+}
+
+func TestTimestampFirstSeen(t *testing.T) {
+	setupTestRelay(t)
+	relay.TimestampSource = []string{"first-seen"}
+	t.Cleanup(func() { relay.TimestampSource = nil })
+
+	// recorded the first time, as if a while ago
+	item := &gofeed.Item{Title: "x", Link: "https://example.com/x"}
+	seen := time.Now().Add(-time.Hour).Truncate(time.Second)
+	relay.db.Set([]byte(firstSeenPrefix+"pubkey\x00https://example.com/x"), strconv.AppendInt(nil, seen.Unix(), 10), nil)
+
+	first := itemToTextNote("pubkey", item, defaultNoteTemplate)
+	if !first.CreatedAt.Time().Equal(seen) {
+		t.Fatalf("created at %s; want when first seen, %s", first.CreatedAt.Time(), seen)
+	}
+	// the same note, and so the same id, every time it's made
+	if again := itemToTextNote("pubkey", item, defaultNoteTemplate); again.ID != first.ID {
+		t.Error("the note changed")
+	}
+	// but only for its own feed
+	if other := itemToTextNote("other", item, defaultNoteTemplate); other.CreatedAt == first.CreatedAt {
+		t.Error("first seen by another feed")
+	}
+
+	// a new item is first seen now, and that is kept
+	fresh := &gofeed.Item{GUID: "fresh", Title: "y"}
+	note := itemToTextNote("pubkey", fresh, defaultNoteTemplate)
+	val, closer, err := relay.db.Get([]byte(firstSeenPrefix + "pubkey\x00fresh"))
+	if err != nil {
+		t.Fatalf("first-seen time not stored: %v", err)
+	}
+	defer closer.Close()
+	if string(val) != strconv.FormatInt(int64(note.CreatedAt), 10) {
+		t.Errorf("stored %s; want %d", val, note.CreatedAt)
+	}
+}
+
+func TestTimestampFetchedPolledOnce(t *testing.T) {
+	setupTestRelay(t)
+	relay.TimestampSource = []string{"fetched"}
+	t.Cleanup(func() { relay.TimestampSource = nil })
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+	defer srv.Close()
+
+	pubkey, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+	updates := make(chan nostr.Event, 10)
+	p := newPoller(pollerConfig{
+		DB:          relay.db,
+		LastEmitted: &sync.Map{},
+		Updates:     updates,
+	})
+	filters := nostr.Filters{{Authors: []string{pubkey}, Kinds: []int{1}}}
+
+	p.poll(context.Background(), filters)
+	if n := len(updates); n != 2 {
+		t.Fatalf("first poll emitted %d events, want 2", n)
+	}
+	time.Sleep(time.Second) // so that now is past the watermark
+	p.poll(context.Background(), filters)
+	if n := len(updates); n != 2 {
+		t.Errorf("second poll emitted %d more events, want none", n-2)
+	}
+
+	// the times of items gone from the feed go once the watermark passed them
+	set := func(id string, ts int64) []byte {
+		key := []byte(firstSeenPrefix + pubkey + "\x00" + id)
+		relay.db.Set(key, strconv.AppendInt(nil, ts, 10), nil)
+		return key
+	}
+	gone := set("gone", 100)
+	pending := set("pending", time.Now().Add(time.Hour).Unix())
+	p.poll(context.Background(), filters)
+	has := func(key []byte) bool {
+		_, closer, err := relay.db.Get(key)
+		if err == nil {
+			closer.Close()
+		}
+		return err == nil
+	}
+	if has(gone) {
+		t.Error("first-seen time of an item gone from the feed kept")
+	}
+	if !has(pending) {
+		t.Error("first-seen time past the watermark forgotten")
+	}
+	if n := countFirstSeen(t, pubkey); n != 3 {
+		t.Errorf("%d first-seen times kept, want the 2 items of the feed and the pending one", n)
+	}
+}
+
+func countFirstSeen(t *testing.T, pubkey string) int {
+	t.Helper()
+	n := 0
+	iter := relay.db.NewIter(prefixIterOptions(firstSeenPrefix + pubkey + "\x00"))
+	for iter.First(); iter.Valid(); iter.Next() {
+		n++
+	}
+	iter.Close()
+	return n
+}
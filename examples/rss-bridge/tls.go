@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsConfig builds the TLS settings feeds are fetched with: the system roots,
+// plus the CAs in caFile if given, an optional client certificate and the
+// lowest TLS version accepted.
+func tlsConfig(caFile, certFile, keyFile, minVersion string) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version %q, use 1.0, 1.1, 1.2 or 1.3", minVersion)
+	}
+	cfg := &tls.Config{MinVersion: version}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		cfg.RootCAs = roots
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("a client certificate needs both a cert and a key file")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// feedTransport is the default transport using cfg.
+func feedTransport(cfg *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+	return transport
+}
+
+// insecureClient fetches the feeds registered with InsecureSkipVerify, which
+// have their url in insecureFeeds. It accepts any certificate.
+var insecureClient = &http.Client{
+	Timeout:   5 * time.Second,
+	Transport: insecureTransport(nil),
+}
+
+var insecureFeeds sync.Map
+
+// insecureTransport is feedTransport without certificate verification.
+func insecureTransport(cfg *tls.Config) *http.Transport {
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	cfg = cfg.Clone()
+	cfg.InsecureSkipVerify = true
+	return feedTransport(cfg)
+}
+
+type insecureKey struct{}
+
+// skipVerify makes fetches with ctx accept any certificate, for registering an
+// InsecureSkipVerify feed.
+func skipVerify(ctx context.Context) context.Context {
+	return context.WithValue(ctx, insecureKey{}, true)
+}
+
+// clientFor is the client the feed at url is fetched with.
+func clientFor(ctx context.Context, url string) *http.Client {
+	if insecure, _ := ctx.Value(insecureKey{}).(bool); insecure {
+		return insecureClient
+	}
+	if _, ok := insecureFeeds.Load(url); ok {
+		return insecureClient
+	}
+	return client
+}
+
+// loadInsecureFeeds fills insecureFeeds with the feeds registered with
+// InsecureSkipVerify.
+func loadInsecureFeeds(db *pebble.DB) error {
+	return skipCorrupt(ForEachEntity(db, func(stored StoredEntity) error {
+		if stored.Entity.InsecureSkipVerify && stored.Entity.MovedTo == "" {
+			insecureFeeds.Store(stored.Entity.URL, true)
+		}
+		return nil
+	}))
+}
+
+// tlsErrorKind tells why a feed's certificate was refused, if that is what err
+// is about: "expired", "invalid", "unknown_authority" or "hostname_mismatch".
+func tlsErrorKind(err error) string {
+	var invalid x509.CertificateInvalidError
+	var unknown x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	switch {
+	case errors.As(err, &invalid):
+		if invalid.Reason == x509.Expired {
+			return "expired"
+		}
+		return "invalid"
+	case errors.As(err, &unknown):
+		return "unknown_authority"
+	case errors.As(err, &hostname):
+		return "hostname_mismatch"
+	}
+	return ""
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePEM saves blocks of typ to a new file in dir.
+func writePEM(t *testing.T, dir, name, typ string, blocks ...[]byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	var data []byte
+	for _, block := range blocks {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: block})...)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+// useTLSConfig makes feeds be fetched with cfg until the end of the test.
+func useTLSConfig(t *testing.T, cfg *tls.Config) {
+	old := client.Transport
+	client.Transport = feedTransport(cfg)
+	t.Cleanup(func() { client.Transport = old })
+}
+
+func feedServer() *httptest.Server {
+	return httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+}
+
+func TestTLSConfigCustomCA(t *testing.T) {
+	srv := feedServer()
+	srv.StartTLS()
+	defer srv.Close()
+	ca := writePEM(t, t.TempDir(), "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+
+	cfg, err := tlsConfig("", "", "", "1.2")
+	if err != nil {
+		t.Fatalf("tlsConfig: %v", err)
+	}
+	useTLSConfig(t, cfg)
+	if _, _, err := fetchFeed(context.Background(), srv.URL, nil); err == nil {
+		t.Fatal("fetchFeed succeeded without trusting the server's CA")
+	}
+
+	cfg, err = tlsConfig(ca, "", "", "1.2")
+	if err != nil {
+		t.Fatalf("tlsConfig: %v", err)
+	}
+	useTLSConfig(t, cfg)
+	if _, _, err := fetchFeed(context.Background(), srv.URL, nil); err != nil {
+		t.Fatalf("fetchFeed: %v", err)
+	}
+}
+
+func TestTLSConfigClientCert(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "rss-bridge"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	clientCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+
+	clients := x509.NewCertPool()
+	clients.AddCert(clientCert)
+	srv := feedServer()
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clients}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	ca := writePEM(t, dir, "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+	certFile := writePEM(t, dir, "cert.pem", "CERTIFICATE", der)
+	keyFile := writePEM(t, dir, "key.pem", "EC PRIVATE KEY", keyDER)
+
+	cfg, err := tlsConfig(ca, "", "", "1.2")
+	if err != nil {
+		t.Fatalf("tlsConfig: %v", err)
+	}
+	useTLSConfig(t, cfg)
+	if _, _, err := fetchFeed(context.Background(), srv.URL, nil); err == nil {
+		t.Fatal("fetchFeed succeeded without a client certificate")
+	}
+
+	cfg, err = tlsConfig(ca, certFile, keyFile, "1.3")
+	if err != nil {
+		t.Fatalf("tlsConfig: %v", err)
+	}
+	useTLSConfig(t, cfg)
+	if _, _, err := fetchFeed(context.Background(), srv.URL, nil); err != nil {
+		t.Fatalf("fetchFeed: %v", err)
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.pem")
+	os.WriteFile(empty, []byte("not a certificate"), 0o600)
+
+	for _, tt := range []struct {
+		name                   string
+		ca, cert, key, version string
+	}{
+		{"unknown version", "", "", "", "1.4"},
+		{"missing ca file", filepath.Join(dir, "missing.pem"), "", "", "1.2"},
+		{"no certificates in ca file", empty, "", "", "1.2"},
+		{"cert without key", "", empty, "", "1.2"},
+		{"bad key pair", "", empty, empty, "1.2"},
+	} {
+		if _, err := tlsConfig(tt.ca, tt.cert, tt.key, tt.version); err == nil {
+			t.Errorf("%s: tlsConfig succeeded", tt.name)
+		}
+	}
+}
+
+// expiredServer is a feedServer whose certificate, for 127.0.0.1, expired an hour ago.
+func expiredServer(t *testing.T) (srv *httptest.Server, certDER []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "expired feed"},
+		NotBefore:             time.Now().Add(-48 * time.Hour),
+		NotAfter:              time.Now().Add(-time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	certDER, err = x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+
+	srv = feedServer()
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{certDER}, PrivateKey: key}}}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv, certDER
+}
+
+func TestExpiredCertificateReported(t *testing.T) {
+	setupTestRelay(t)
+	srv, certDER := expiredServer(t)
+	cfg, err := tlsConfig(writePEM(t, t.TempDir(), "ca.pem", "CERTIFICATE", certDER), "", "", "1.2")
+	if err != nil {
+		t.Fatalf("tlsConfig: %v", err)
+	}
+	useTLSConfig(t, cfg)
+
+	if _, err := fetchAndCleanFeed(context.Background(), srv.URL); err == nil {
+		t.Fatal("fetched a feed with an expired certificate")
+	}
+	missing := feedServer()
+	missing.Config.Handler = http.NotFoundHandler()
+	missing.Start()
+	defer missing.Close()
+	fetchAndCleanFeed(context.Background(), missing.URL)
+
+	w := httptest.NewRecorder()
+	handleHealth(w, httptest.NewRequest("GET", "/health", nil))
+	var report struct {
+		Feeds map[string]FeedHealth `json:"feeds"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatalf("health report isn't json: %v", err)
+	}
+	if got := report.Feeds[srv.URL]; got.TLSError != "expired" || got.LastError == "" {
+		t.Errorf("expired feed health = %+v; want tls_error expired", got)
+	}
+	if got := report.Feeds[missing.URL]; got.TLSError != "" || got.LastError == "" {
+		t.Errorf("missing feed health = %+v; want an error that isn't about TLS", got)
+	}
+}
+
+func TestInsecureSkipVerify(t *testing.T) {
+	setupTestRelay(t)
+	srv := feedServer()
+	srv.StartTLS()
+	defer srv.Close()
+	t.Cleanup(func() { insecureFeeds.Delete(srv.URL) })
+
+	if _, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{}); err == nil {
+		t.Fatal("registered a feed with a self-signed certificate without opting in")
+	}
+	fetchAndCleanFeed(context.Background(), srv.URL)
+	if got, _ := getFeedHealth(srv.URL); got.TLSError != "unknown_authority" {
+		t.Errorf("self-signed feed health = %+v; want tls_error unknown_authority", got)
+	}
+
+	// only where the operator allows it
+	w := httptest.NewRecorder()
+	logRequests(handleCreateFeed)(w, httptest.NewRequest("POST", "/create?insecure_skip_verify=true&url="+srv.URL, nil))
+	if w.Code != 403 {
+		t.Errorf("insecure registration not allowed got %d; want 403", w.Code)
+	}
+
+	pubkey, err := Feed(srv.URL, relay.Secret, relay.db, FeedOptions{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Feed with InsecureSkipVerify: %v", err)
+	}
+	entity, err := loadEntity(relay.db, pubkey)
+	if err != nil {
+		t.Fatalf("loadEntity: %v", err)
+	}
+	if !entity.InsecureSkipVerify {
+		t.Error("stored feed isn't flagged InsecureSkipVerify")
+	}
+
+	// and it keeps being fetched so, also after a restart
+	insecureFeeds.Delete(srv.URL)
+	if err := loadInsecureFeeds(relay.db); err != nil {
+		t.Fatalf("loadInsecureFeeds: %v", err)
+	}
+	feeds.Flush()
+	if _, err := parseFeed(context.Background(), entity.URL); err != nil {
+		t.Errorf("polling the insecure feed: %v", err)
+	}
+
+	// which other feeds aren't
+	other := feedServer()
+	other.StartTLS()
+	defer other.Close()
+	if _, _, err := fetchFeed(context.Background(), other.URL, nil); err == nil {
+		t.Error("fetched another self-signed feed")
+	}
+}
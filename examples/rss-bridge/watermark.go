@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// saveWatermark records ts as the timestamp of the newest item emitted for the
+// feed at url, so restarts don't replay what was already sent.
+func saveWatermark(db *pebble.DB, url string, ts nostr.Timestamp) error {
+	return db.Set([]byte(watermarkPrefix+url), strconv.AppendInt(nil, int64(ts), 10), pebble.NoSync)
+}
+
+// loadWatermarks fills lastEmitted with every watermark stored in db.
+func loadWatermarks(db *pebble.DB, lastEmitted *sync.Map) error {
+	iter := db.NewIter(prefixIterOptions(watermarkPrefix))
+	for iter.First(); iter.Valid(); iter.Next() {
+		ts, err := strconv.ParseInt(string(iter.Value()), 10, 64)
+		if err != nil {
+			logger.Error("got invalid watermark from db", "key", string(iter.Key()), "err", err)
+			continue
+		}
+		lastEmitted.Store(string(iter.Key()[len(watermarkPrefix):]), nostr.Timestamp(ts))
+	}
+	return iter.Close()
+}
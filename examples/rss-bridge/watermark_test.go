@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestWatermarkSurvivesRestart(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testFeed)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	db, err := pebble.Open(dir, nil)
+	if err != nil {
+		t.Fatalf("pebble.Open: %v", err)
+	}
+	relay.Secret = "test-secret"
+	feeds.Flush()
+
+	pubkey, err := Feed(srv.URL, relay.Secret, db, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+	filters := nostr.Filters{{Authors: []string{pubkey}, Kinds: []int{1}}}
+
+	updates := make(chan nostr.Event, 10)
+	newPoller(pollerConfig{DB: db, LastEmitted: &sync.Map{}, Updates: updates}).
+		poll(context.Background(), filters)
+	if n := len(updates); n != 2 {
+		t.Fatalf("first poll emitted %d events, want 2", n)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("db.Close: %v", err)
+	}
+
+	db, err = pebble.Open(dir, nil)
+	if err != nil {
+		t.Fatalf("pebble.Open: %v", err)
+	}
+	defer db.Close()
+
+	var lastEmitted sync.Map
+	if err := loadWatermarks(db, &lastEmitted); err != nil {
+		t.Fatalf("loadWatermarks: %v", err)
+	}
+	updates = make(chan nostr.Event, 10)
+	newPoller(pollerConfig{DB: db, LastEmitted: &lastEmitted, Updates: updates}).
+		poll(context.Background(), filters)
+	if n := len(updates); n != 0 {
+		t.Errorf("poll after restart emitted %d events, want 0", n)
+	}
+}
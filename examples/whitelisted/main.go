@@ -14,6 +14,7 @@ import (
 type Relay struct {
 	PostgresDatabase string   `envconfig:"POSTGRESQL_DATABASE"`
 	Whitelist        []string `envconfig:"WHITELIST"`
+	MinPoW           int      `envconfig:"MIN_POW"`
 
 	storage *postgresql.PostgresBackend
 }
@@ -31,25 +32,37 @@ func (r *Relay) Init() error {
 }
 
 func (r *Relay) AcceptEvent(ctx context.Context, evt *nostr.Event) bool {
-	// disallow anything from non-authorized pubkeys
-	found := false
-	for _, pubkey := range r.Whitelist {
-		if pubkey == evt.PubKey {
-			found = true
-			break
+	reject, _ := r.RejectEvent(ctx, evt)
+	return !reject
+}
+
+func (r *Relay) RejectEvent(ctx context.Context, evt *nostr.Event) (reject bool, msg string) {
+	// disallow anything from non-authorized pubkeys, unless only proof of work is required
+	if len(r.Whitelist) > 0 || r.MinPoW <= 0 {
+		found := false
+		for _, pubkey := range r.Whitelist {
+			if pubkey == evt.PubKey {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return true, "blocked: pubkey not whitelisted"
 		}
 	}
-	if !found {
-		return false
+
+	// require a minimum proof of work
+	if ok, msg := relayer.CheckPoW(evt, r.MinPoW); !ok {
+		return true, msg
 	}
 
 	// block events that are too large
 	jsonb, _ := json.Marshal(evt)
 	if len(jsonb) > 100000 {
-		return false
+		return true, "blocked: event too large"
 	}
 
-	return true
+	return false, ""
 }
 
 func main() {
@@ -0,0 +1,47 @@
+package relayer
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ExpiredPurgeInterval is how often an [Expirer] storage is asked to delete the
+// events that expired.
+var ExpiredPurgeInterval = time.Hour
+
+// Expiration is the time set by the NIP-40 expiration tag of evt. ok is false
+// when it has none, or the first one isn't a unix timestamp.
+func Expiration(evt *nostr.Event) (ts nostr.Timestamp, ok bool) {
+	tag := evt.Tags.GetFirst([]string{"expiration", ""})
+	if tag == nil {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(tag.Value(), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return nostr.Timestamp(v), true
+}
+
+// purgeExpired calls DeleteExpired on exp every ExpiredPurgeInterval until stop
+// is closed.
+func (s *Server) purgeExpired(exp Expirer, stop <-chan struct{}) {
+	ticker := time.NewTicker(ExpiredPurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n, err := exp.DeleteExpired(context.Background(), nostr.Now())
+			if err != nil {
+				s.Log.Errorf("failed to delete expired events: %v", err)
+			} else if n > 0 {
+				s.Log.Infof("deleted %d expired events", n)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
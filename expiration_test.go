@@ -0,0 +1,109 @@
+package relayer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"golang.org/x/exp/slices"
+)
+
+// expiringStorage reports the calls to DeleteExpired on purged, when someone
+// is listening.
+type expiringStorage struct {
+	*testStorage
+	purged chan nostr.Timestamp
+}
+
+func (st expiringStorage) DeleteExpired(ctx context.Context, before nostr.Timestamp) (int64, error) {
+	select {
+	case st.purged <- before:
+	default:
+	}
+	return 1, nil
+}
+
+func TestExpiration(t *testing.T) {
+	for _, tt := range []struct {
+		tags nostr.Tags
+		want nostr.Timestamp
+		ok   bool
+	}{
+		{nil, 0, false},
+		{nostr.Tags{{"expiration", "1700000000"}}, 1700000000, true},
+		{nostr.Tags{{"t", "x"}, {"expiration", "1700000000"}, {"expiration", "1"}}, 1700000000, true},
+		{nostr.Tags{{"expiration", "tomorrow"}}, 0, false},
+		{nostr.Tags{{"expiration"}}, 0, false},
+	} {
+		got, ok := Expiration(&nostr.Event{Tags: tt.tags})
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Expiration(%v) = %d, %v; want %d, %v", tt.tags, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestAddEventExpired(t *testing.T) {
+	saved := 0
+	relay := &testRelay{storage: &testStorage{saveEvent: func(context.Context, *nostr.Event) error { saved++; return nil }}}
+	expiring := func(ts nostr.Timestamp) *nostr.Event {
+		return &nostr.Event{Kind: nostr.KindTextNote, Tags: nostr.Tags{{"expiration", strconv.FormatInt(int64(ts), 10)}}}
+	}
+
+	ok, msg := AddEvent(context.Background(), relay, expiring(nostr.Now()-1))
+	if ok || msg != "invalid: event has expired" {
+		t.Errorf("AddEvent(expired) = %v, %q; want an invalid: rejection", ok, msg)
+	}
+
+	ok, msg = AddEvent(context.Background(), relay, expiring(nostr.Now()+60))
+	if !ok || msg != "" {
+		t.Errorf("AddEvent(expiring later) = %v, %q; want it accepted", ok, msg)
+	}
+	if saved != 1 {
+		t.Errorf("saved %d events; want 1", saved)
+	}
+}
+
+func TestPurgeExpired(t *testing.T) {
+	defer func(d time.Duration) { ExpiredPurgeInterval = d }(ExpiredPurgeInterval)
+	ExpiredPurgeInterval = 10 * time.Millisecond
+
+	st := expiringStorage{&testStorage{}, make(chan nostr.Timestamp)}
+	s := &Server{Log: defaultLogger(""), relay: &testRelay{storage: st}}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.purgeExpired(st, stop)
+		close(done)
+	}()
+
+	select {
+	case before := <-st.purged:
+		if now := nostr.Now(); before > now || before < now-1 {
+			t.Errorf("DeleteExpired(%d); want the current time %d", before, now)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("DeleteExpired wasn't called")
+	}
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("purgeExpired didn't stop")
+	}
+
+	w := httptest.NewRecorder()
+	s.HandleNIP11(w, httptest.NewRequest("GET", "/", nil))
+	var info nip11.RelayInformationDocument
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !slices.Contains(info.SupportedNIPs, 40) {
+		t.Errorf("supported_nips %v; want 40", info.SupportedNIPs)
+	}
+}
@@ -22,7 +22,9 @@ require (
 	github.com/stevelacy/daz v0.1.4
 	github.com/stretchr/testify v1.8.0
 	github.com/tidwall/gjson v1.14.4
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
 	golang.org/x/exp v0.0.0-20230425010034-47ecfdc1ba53
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -85,10 +87,8 @@ require (
 	github.com/puzpuzpuz/xsync v1.5.2 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.0 // indirect
-	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519 // indirect
 	golang.org/x/net v0.0.0-20211015210444-4f30a5c0130f // indirect
 	golang.org/x/sys v0.8.0 // indirect
 	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1 // indirect
 	golang.org/x/text v0.3.7 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
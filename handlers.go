@@ -8,6 +8,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"runtime/debug"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -17,17 +19,14 @@ import (
 	"golang.org/x/exp/slices"
 )
 
-// TODO: consider moving these to Server as config params
+// Defaults for the WebSocketOptions a WebSocketTuner leaves zero.
 const (
-	// Time allowed to write a message to the peer.
+	// Time allowed for the last writes to a peer being dropped.
 	writeWait = 10 * time.Second
 
 	// Time allowed to read the next pong message from the peer.
 	pongWait = 60 * time.Second
 
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = pongWait / 2
-
 	// Maximum message size allowed from peer.
 	maxMessageSize = 512000
 )
@@ -52,7 +51,8 @@ func (s *Server) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 	s.clientsMu.Lock()
 	defer s.clientsMu.Unlock()
 	s.clients[conn] = struct{}{}
-	ticker := time.NewTicker(pingPeriod)
+	opts := s.webSocketOptions()
+	ticker := time.NewTicker(opts.PingPeriod)
 
 	// NIP-42 challenge
 	challenge := make([]byte, 8)
@@ -61,25 +61,38 @@ func (s *Server) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 	ws := &WebSocket{
 		conn:      conn,
 		challenge: hex.EncodeToString(challenge),
+		writeWait: opts.WriteWait,
+	}
+	if opts.SendQueue > 0 {
+		ws.queue = make(chan queuedMessage, opts.SendQueue)
+		ws.overflow = make(chan struct{})
+	}
+	if limiter, ok := s.relay.(RequestRateLimiter); ok {
+		ws.requests = newTokenBucket(limiter.RequestRate())
 	}
 
+	// cancels the queries still running when the client goes away
+	connCtx, cancelConn := context.WithCancel(context.Background())
+
 	// reader
 	go func() {
 		defer func() {
+			cancelConn()
 			ticker.Stop()
 			s.clientsMu.Lock()
 			if _, ok := s.clients[conn]; ok {
 				conn.Close()
 				delete(s.clients, conn)
-				removeListener(ws)
 			}
 			s.clientsMu.Unlock()
+			// also when Shutdown got to the connection first
+			removeListener(ws)
 		}()
 
-		conn.SetReadLimit(maxMessageSize)
-		conn.SetReadDeadline(time.Now().Add(pongWait))
+		conn.SetReadLimit(opts.MaxMessageSize)
+		conn.SetReadDeadline(time.Now().Add(opts.PongWait))
 		conn.SetPongHandler(func(string) error {
-			conn.SetReadDeadline(time.Now().Add(pongWait))
+			conn.SetReadDeadline(time.Now().Add(opts.PongWait))
 			return nil
 		})
 
@@ -108,7 +121,7 @@ func (s *Server) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 			}
 
 			go func(message []byte) {
-				ctx = context.Background()
+				ctx := context.Background()
 				var notice string
 				defer func() {
 					if notice != "" {
@@ -234,7 +247,7 @@ func (s *Server) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 							}
 						}
 
-						count, err := counter.CountEvents(ctx, filter)
+						count, err := counter.CountEvents(withAuthedPubkey(ctx, ws.authed), filter)
 						if err != nil {
 							s.Log.Errorf("store: %v", err)
 							continue
@@ -250,6 +263,27 @@ func (s *Server) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 						notice = "REQ has no <id>"
 						return
 					}
+					if ws.requests != nil && !ws.requests.take() {
+						atomic.AddInt64(&throttledRequests, 1)
+						// the client takes the subscription for closed, so it is
+						removeListenerId(ws, id)
+						ws.WriteJSON([]interface{}{"CLOSED", id, "rate-limited: slow down, too many REQs"})
+						return
+					}
+					maxSubs := 0
+					if limiter, ok := s.relay.(SubscriptionLimiter); ok {
+						maxSubs = limiter.MaxSubscriptions()
+					}
+					if !reserveListener(ws, id, maxSubs) {
+						notice = fmt.Sprintf("restricted: too many subscriptions, close one of the %d open first", maxSubs)
+						return
+					}
+					subscribed := false
+					defer func() {
+						if !subscribed {
+							removeListenerId(ws, id)
+						}
+					}()
 
 					filters := make(nostr.Filters, len(request)-2)
 					for i, filterReq := range request[2:] {
@@ -288,9 +322,13 @@ func (s *Server) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 							}
 						}
 
-						events, err := store.QueryEvents(ctx, filter)
-						if err != nil {
-							s.Log.Errorf("store: %v", err)
+						queryCtx, cancelQuery := context.WithCancel(withAuthedPubkey(connCtx, ws.authed))
+						events, err := store.QueryEvents(queryCtx, filter)
+						if err != nil || events == nil {
+							cancelQuery()
+							if err != nil {
+								s.Log.Errorf("store: %v", err)
+							}
 							continue
 						}
 
@@ -300,20 +338,24 @@ func (s *Server) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 						}
 						i := 0
 						for event := range events {
-							ws.WriteJSON(nostr.EventEnvelope{SubscriptionID: &id, Event: *event})
-							i++
-							if i > filter.Limit {
+							if i >= filter.Limit || queryCtx.Err() != nil {
+								break
+							}
+							if err := ws.WriteJSON(nostr.EventEnvelope{SubscriptionID: &id, Event: *event}); err != nil {
 								break
 							}
+							i++
 						}
 
-						// exhaust the channel (in case we broke out of it early) so it is closed by the storage
+						// tell the storage to stop, then exhaust the channel so it is closed by the storage
+						cancelQuery()
 						for range events {
 						}
 					}
 
 					ws.WriteJSON(nostr.EOSEEnvelope(id))
 					setListener(id, ws, filters)
+					subscribed = true
 				case "CLOSE":
 					var id string
 					json.Unmarshal(request[1], &id)
@@ -357,6 +399,15 @@ func (s *Server) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 		}()
 
 		for {
+			// a nil queue and overflow, when there is no SendQueue, are never ready
+			select {
+			case <-ws.overflow:
+				s.Log.Warningf("dropping websocket from %s: %d messages waiting to be sent", s.clientIP(r), opts.SendQueue)
+				ws.drop()
+				return
+			default:
+			}
+
 			select {
 			case <-ticker.C:
 				err := ws.WriteMessage(websocket.PingMessage, nil)
@@ -364,6 +415,13 @@ func (s *Server) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 					s.Log.Errorf("error writing ping: %v; closing websocket", err)
 					return
 				}
+			case msg := <-ws.queue:
+				if err := ws.writeQueued(msg); err != nil {
+					return
+				}
+			case <-ws.overflow:
+			case <-connCtx.Done():
+				return
 			}
 		}
 	}()
@@ -372,29 +430,91 @@ func (s *Server) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 func (s *Server) HandleNIP11(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	supportedNIPs := []int{9, 11, 12, 15, 16, 20, 33}
-	if _, ok := s.relay.(Auther); ok {
-		supportedNIPs = append(supportedNIPs, 42)
-	}
-	if storage, ok := s.relay.(Storage); ok && storage != nil {
-		if _, ok = storage.(EventCounter); ok {
-			supportedNIPs = append(supportedNIPs, 45)
-		}
-	}
-
 	info := nip11.RelayInformationDocument{
-		Name:          s.relay.Name(),
-		Description:   "relay powered by the relayer framework",
-		PubKey:        "~",
-		Contact:       "~",
-		SupportedNIPs: supportedNIPs,
-		Software:      "https://github.com/fiatjaf/relayer",
-		Version:       "~",
+		Name:        s.relay.Name(),
+		Description: "relay powered by the relayer framework",
+		PubKey:      "~",
+		Contact:     "~",
 	}
 
 	if ifmer, ok := s.relay.(Informationer); ok {
 		info = ifmer.GetNIP11InformationDocument()
 	}
 
+	// fill in what the relay left for us to tell
+	if info.SupportedNIPs == nil {
+		info.SupportedNIPs = s.supportedNIPs(r.Context())
+	}
+	if info.Software == "" {
+		info.Software = "https://github.com/fiatjaf/relayer"
+	}
+	if info.Version == "" {
+		info.Version = version()
+	}
+	if limiter, ok := s.relay.Storage(r.Context()).(QueryLimiter); ok {
+		if info.Limitation == nil {
+			info.Limitation = &nip11.RelayLimitationDocument{}
+		}
+		if info.Limitation.MaxLimit == 0 {
+			info.Limitation.MaxLimit = limiter.MaxLimit()
+		}
+	}
+	if limiter, ok := s.relay.(SubscriptionLimiter); ok {
+		if info.Limitation == nil {
+			info.Limitation = &nip11.RelayLimitationDocument{}
+		}
+		if info.Limitation.MaxSubscriptions == 0 {
+			info.Limitation.MaxSubscriptions = limiter.MaxSubscriptions()
+		}
+	}
+	if _, ok := s.relay.(WebSocketTuner); ok {
+		if info.Limitation == nil {
+			info.Limitation = &nip11.RelayLimitationDocument{}
+		}
+		if info.Limitation.MaxMessageLength == 0 {
+			info.Limitation.MaxMessageLength = int(s.webSocketOptions().MaxMessageSize)
+		}
+	}
+
 	json.NewEncoder(w).Encode(info)
 }
+
+// Version is reported in the NIP-11 document. Set it at build time with
+//
+//	go build -ldflags "-X github.com/fiatjaf/relayer/v2.Version=v1.2.3"
+//
+// Otherwise the version of this module found in the build info is used.
+var Version string
+
+func version() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Path == "github.com/fiatjaf/relayer/v2" && info.Main.Version != "" {
+			return info.Main.Version
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/fiatjaf/relayer/v2" {
+				return dep.Version
+			}
+		}
+	}
+	return "dev"
+}
+
+// supportedNIPs lists the NIPs the server implements, along with the optional
+// ones the relay and its storage enable by implementing their interfaces.
+func (s *Server) supportedNIPs(ctx context.Context) []int {
+	nips := []int{9, 11, 12, 15, 16, 20, 33}
+	if _, ok := s.relay.(Auther); ok {
+		nips = append(nips, 42)
+	}
+	if _, ok := s.relay.Storage(ctx).(Expirer); ok {
+		nips = append(nips, 40)
+	}
+	if _, ok := s.relay.Storage(ctx).(EventCounter); ok {
+		nips = append(nips, 45)
+	}
+	return nips
+}
@@ -0,0 +1,423 @@
+package relayer
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"golang.org/x/exp/slices"
+)
+
+type testAuthRelay struct{ *testRelay }
+
+func (testAuthRelay) ServiceURL() string { return "wss://relay.example.com" }
+
+// uncountedStorage hides the EventCounter of the storage it wraps.
+type uncountedStorage struct{ Storage }
+
+func TestNIP11SupportedNIPs(t *testing.T) {
+	countable := &testStorage{}
+	tests := []struct {
+		name    string
+		relay   Relay
+		auth    bool
+		counter bool
+	}{
+		{"plain", &testRelay{storage: uncountedStorage{countable}}, false, false},
+		{"count", &testRelay{storage: countable}, false, true},
+		{"auth", testAuthRelay{&testRelay{storage: uncountedStorage{countable}}}, true, false},
+		{"auth and count", testAuthRelay{&testRelay{storage: countable}}, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{relay: tt.relay}
+			w := httptest.NewRecorder()
+			s.HandleNIP11(w, httptest.NewRequest("GET", "/", nil))
+
+			var info nip11.RelayInformationDocument
+			if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if got := slices.Contains(info.SupportedNIPs, 42); got != tt.auth {
+				t.Errorf("supported_nips %v: has 42 = %v; want %v", info.SupportedNIPs, got, tt.auth)
+			}
+			if got := slices.Contains(info.SupportedNIPs, 45); got != tt.counter {
+				t.Errorf("supported_nips %v: has 45 = %v; want %v", info.SupportedNIPs, got, tt.counter)
+			}
+			if info.Software == "" || info.Version == "" {
+				t.Errorf("software = %q, version = %q; want both set", info.Software, info.Version)
+			}
+		})
+	}
+}
+
+func TestNIP11Version(t *testing.T) {
+	defer func(v string) { Version = v }(Version)
+	Version = "v1.2.3"
+
+	s := &Server{relay: &testRelay{storage: &testStorage{}}}
+	if got := s.supportedNIPs(context.Background()); !slices.Contains(got, 11) {
+		t.Errorf("supportedNIPs() = %v; want it to include 11", got)
+	}
+
+	w := httptest.NewRecorder()
+	s.HandleNIP11(w, httptest.NewRequest("GET", "/", nil))
+	var info nip11.RelayInformationDocument
+	json.NewDecoder(w.Body).Decode(&info)
+	if info.Version != "v1.2.3" {
+		t.Errorf("version = %q; want v1.2.3", info.Version)
+	}
+}
+
+// limitedStorage adds a QueryLimiter to the storage it wraps.
+type limitedStorage struct{ Storage }
+
+func (limitedStorage) MaxLimit() int { return 500 }
+
+func TestNIP11MaxLimit(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		storage Storage
+		want    int
+	}{
+		{"unlimited", &testStorage{}, 0},
+		{"limited", limitedStorage{&testStorage{}}, 500},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{relay: &testRelay{storage: tt.storage}}
+			w := httptest.NewRecorder()
+			s.HandleNIP11(w, httptest.NewRequest("GET", "/", nil))
+
+			var info nip11.RelayInformationDocument
+			if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			var got int
+			if info.Limitation != nil {
+				got = info.Limitation.MaxLimit
+			}
+			if got != tt.want {
+				t.Errorf("max_limit = %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// endlessStorage streams events until the query's context is done, which it
+// reports on stopped.
+func endlessStorage(stopped chan<- struct{}) *testStorage {
+	return &testStorage{queryEvents: func(ctx context.Context, f *nostr.Filter) (chan *nostr.Event, error) {
+		ch := make(chan *nostr.Event)
+		go func() {
+			defer close(ch)
+			defer func() { stopped <- struct{}{} }()
+			for i := 0; ; i++ {
+				evt := &nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Timestamp(i), Tags: nostr.Tags{}}
+				select {
+				case ch <- evt:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return ch, nil
+	}}
+}
+
+func dialTestRelay(t *testing.T, srv *Server) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+srv.Addr, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	return conn
+}
+
+func TestQueryStopsAtLimit(t *testing.T) {
+	stopped := make(chan struct{}, 1)
+	srv := startTestRelay(t, &testRelay{storage: endlessStorage(stopped)})
+	defer srv.Shutdown(context.Background())
+
+	conn := dialTestRelay(t, srv)
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte(`["REQ","sub",{"limit":3}]`))
+
+	events := 0
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %v", err)
+		}
+		var envelope []json.RawMessage
+		json.Unmarshal(message, &envelope)
+		if string(envelope[0]) == `"EOSE"` {
+			break
+		}
+		events++
+	}
+	if events != 3 {
+		t.Errorf("got %d events; want 3", events)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the storage wasn't told to stop")
+	}
+}
+
+func TestQueryStopsOnDisconnect(t *testing.T) {
+	stopped := make(chan struct{}, 1)
+	srv := startTestRelay(t, &testRelay{storage: endlessStorage(stopped)})
+	defer srv.Shutdown(context.Background())
+
+	conn := dialTestRelay(t, srv)
+	conn.WriteMessage(websocket.TextMessage, []byte(`["REQ","sub",{}]`))
+	if _, message, err := conn.ReadMessage(); err != nil || !strings.HasPrefix(string(message), `["EVENT"`) {
+		t.Fatalf("ReadMessage = %s, %v; want an event", message, err)
+	}
+	conn.Close()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the storage wasn't told to stop")
+	}
+}
+
+type subLimitedRelay struct {
+	*testRelay
+	max int
+}
+
+func (r subLimitedRelay) MaxSubscriptions() int { return r.max }
+
+// readTypes reads n messages from conn, returning the type of each.
+func readTypes(t *testing.T, conn *websocket.Conn, n int) []string {
+	t.Helper()
+	types := make([]string, n)
+	for i := range types {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %v", err)
+		}
+		var envelope []json.RawMessage
+		json.Unmarshal(message, &envelope)
+		json.Unmarshal(envelope[0], &types[i])
+	}
+	return types
+}
+
+func waitForSubscriptions(t *testing.T, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for ActiveSubscriptions() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d active subscriptions; want %d", ActiveSubscriptions(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSubscriptionLimit(t *testing.T) {
+	srv := startTestRelay(t, subLimitedRelay{&testRelay{storage: &testStorage{}}, 2})
+	defer srv.Shutdown(context.Background())
+	waitForSubscriptions(t, 0)
+
+	conn := dialTestRelay(t, srv)
+	req := func(id string) string {
+		conn.WriteMessage(websocket.TextMessage, []byte(`["REQ","`+id+`",{}]`))
+		return readTypes(t, conn, 1)[0]
+	}
+	if got := []string{req("a"), req("b"), req("c")}; !slices.Equal(got, []string{"EOSE", "EOSE", "NOTICE"}) {
+		t.Errorf("REQs got %v; want the third refused", got)
+	}
+	if got := req("a"); got != "EOSE" {
+		t.Errorf("replacing a subscription got %s; want EOSE", got)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte(`["CLOSE","b"]`))
+	waitForSubscriptions(t, 1)
+	if got := req("c"); got != "EOSE" {
+		t.Errorf("REQ after a CLOSE got %s; want EOSE", got)
+	}
+
+	conn.Close()
+	waitForSubscriptions(t, 0)
+
+	// REQs sent all at once are handled concurrently, and still limited
+	conn = dialTestRelay(t, srv)
+	defer conn.Close()
+	for i := 0; i < 10; i++ {
+		conn.WriteMessage(websocket.TextMessage, []byte(`["REQ","burst`+strconv.Itoa(i)+`",{}]`))
+	}
+	eose := 0
+	for _, typ := range readTypes(t, conn, 10) {
+		if typ == "EOSE" {
+			eose++
+		}
+	}
+	if eose != 2 {
+		t.Errorf("%d of a burst of REQs accepted; want 2", eose)
+	}
+	waitForSubscriptions(t, 2)
+
+	w := httptest.NewRecorder()
+	srv.HandleNIP11(w, httptest.NewRequest("GET", "/", nil))
+	var info nip11.RelayInformationDocument
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if info.Limitation == nil || info.Limitation.MaxSubscriptions != 2 {
+		t.Errorf("limitation = %+v; want max_subscriptions 2", info.Limitation)
+	}
+}
+
+type rateLimitedRelay struct{ *testRelay }
+
+func (rateLimitedRelay) RequestRate() (float64, int) { return 4, 3 }
+
+func TestRequestRateLimit(t *testing.T) {
+	relay := rateLimitedRelay{&testRelay{storage: &testStorage{}}}
+	srv := startTestRelay(t, relay)
+	defer srv.Shutdown(context.Background())
+	waitForSubscriptions(t, 0)
+	throttled := ThrottledRequests()
+
+	conn := dialTestRelay(t, srv)
+	defer conn.Close()
+	for i := 0; i < 10; i++ {
+		conn.WriteMessage(websocket.TextMessage, []byte(`["REQ","sub`+strconv.Itoa(i)+`",{}]`))
+	}
+	eose, closed := 0, 0
+	for i := 0; i < 10; i++ {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %v", err)
+		}
+		var envelope []string
+		json.Unmarshal(message, &envelope)
+		switch {
+		case envelope[0] == "EOSE":
+			eose++
+		case envelope[0] == "CLOSED" && len(envelope) == 3 && strings.HasPrefix(envelope[2], "rate-limited:"):
+			closed++
+		default:
+			t.Errorf("unexpected message %s", message)
+		}
+	}
+	if eose != 3 || closed != 7 {
+		t.Errorf("a burst of 10 REQs got %d EOSE and %d CLOSED; want 3 and 7", eose, closed)
+	}
+	if got := ThrottledRequests() - throttled; got != 7 {
+		t.Errorf("ThrottledRequests went up by %d; want 7", got)
+	}
+	waitForSubscriptions(t, 3)
+
+	// the subscriptions that got through keep getting events
+	evt := nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Tags: nostr.Tags{}}
+	evt.Sign(nostr.GeneratePrivateKey())
+	if ok, msg := AddEvent(context.Background(), relay, &evt); !ok {
+		t.Fatalf("AddEvent: %s", msg)
+	}
+	if got := readTypes(t, conn, 3); !slices.Equal(got, []string{"EVENT", "EVENT", "EVENT"}) {
+		t.Errorf("open subscriptions got %v; want the event on each", got)
+	}
+
+	// and the bucket refills
+	time.Sleep(300 * time.Millisecond)
+	conn.WriteMessage(websocket.TextMessage, []byte(`["REQ","later",{}]`))
+	if got := readTypes(t, conn, 1)[0]; got != "EOSE" {
+		t.Errorf("REQ after a pause got %s; want EOSE", got)
+	}
+}
+
+type tunedRelay struct {
+	*testRelay
+	opts WebSocketOptions
+}
+
+func (r tunedRelay) WebSocketOptions() WebSocketOptions { return r.opts }
+
+func TestMaxMessageSize(t *testing.T) {
+	srv := startTestRelay(t, tunedRelay{&testRelay{storage: &testStorage{}}, WebSocketOptions{MaxMessageSize: 1024}})
+	defer srv.Shutdown(context.Background())
+
+	conn := dialTestRelay(t, srv)
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte(`["REQ","small",{}]`))
+	if got := readTypes(t, conn, 1)[0]; got != "EOSE" {
+		t.Errorf("small REQ got %s; want EOSE", got)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`["REQ","big",{"authors":["`+strings.Repeat("a", 2000)+`"]}]`))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("oversized message got %v; want the connection closed as too big", err)
+	}
+
+	w := httptest.NewRecorder()
+	srv.HandleNIP11(w, httptest.NewRequest("GET", "/", nil))
+	var info nip11.RelayInformationDocument
+	json.NewDecoder(w.Body).Decode(&info)
+	if info.Limitation == nil || info.Limitation.MaxMessageLength != 1024 {
+		t.Errorf("limitation = %+v; want max_message_length 1024", info.Limitation)
+	}
+}
+
+func TestSlowConsumerDropped(t *testing.T) {
+	srv, err := NewServer(tunedRelay{&testRelay{storage: &testStorage{}}, WebSocketOptions{
+		WriteWait: 200 * time.Millisecond,
+		SendQueue: 4,
+	}})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	logs := &recordingLogger{}
+	srv.Log = logs
+	started := make(chan bool)
+	go srv.Start("127.0.0.1", 0, started)
+	<-started
+	defer srv.Shutdown(context.Background())
+	waitForSubscriptions(t, 0)
+
+	conn := dialTestRelay(t, srv)
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte(`["REQ","sub",{"kinds":[1]}]`))
+	readTypes(t, conn, 1)
+	waitForSubscriptions(t, 1)
+
+	// the client stops reading while far more than the socket buffers hold is sent to it
+	const sent = 400
+	evt := nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: strings.Repeat("x", 64<<10)}
+	for i := 0; i < sent; i++ {
+		notifyListeners(&evt)
+	}
+	logs.waitForLine(t, "dropping websocket", "4 messages waiting")
+	waitForSubscriptions(t, 0)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := 0
+	for {
+		_, _, err := conn.ReadMessage()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatalf("connection still open after %d events", received)
+			}
+			break
+		}
+		received++
+	}
+	if received >= sent {
+		t.Errorf("received all %d events; want the connection dropped before", received)
+	}
+}
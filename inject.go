@@ -0,0 +1,80 @@
+package relayer
+
+import (
+	"context"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Injected events are stored once this many are waiting, or after injectFlushInterval.
+const (
+	injectBatchSize     = 100
+	injectFlushInterval = time.Second
+)
+
+// consumeInjected passes the events of inj on to listeners and the relay's
+// EventSink as they come and, if the storage is a [BatchSaver], stores them in
+// batches. It returns once the injection channel is closed, or when asked to
+// drain by Shutdown: whatever is ready in the channel is then taken and
+// everything pending is saved with the context Shutdown was given.
+func (s *Server) consumeInjected(inj Injector) {
+	defer close(s.injectDone)
+	saver, _ := s.relay.Storage(context.Background()).(BatchSaver)
+
+	var batch []nostr.Event
+	flush := func(ctx context.Context) {
+		if len(batch) == 0 {
+			return
+		}
+		if err := saver.SaveEvents(ctx, batch); err != nil {
+			s.Log.Errorf("failed to save %d injected events: %v", len(batch), err)
+		}
+		batch = nil
+	}
+	handle := func(event nostr.Event) {
+		notifyListeners(&event)
+		publish(s.relay, &event)
+
+		if saver == nil || isEphemeral(s.relay, event.Kind) {
+			// nowhere to store it, or ephemeral
+			return
+		}
+		batch = append(batch, event)
+		if len(batch) >= injectBatchSize {
+			flush(context.Background())
+		}
+	}
+
+	ticker := time.NewTicker(injectFlushInterval)
+	defer ticker.Stop()
+
+	events := inj.InjectEvents()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				flush(context.Background())
+				return
+			}
+			handle(event)
+		case <-ticker.C:
+			flush(context.Background())
+		case ctx := <-s.drainInject:
+		drain:
+			for {
+				select {
+				case event, ok := <-events:
+					if !ok {
+						break drain
+					}
+					handle(event)
+				default:
+					break drain
+				}
+			}
+			flush(ctx)
+			return
+		}
+	}
+}
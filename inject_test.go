@@ -0,0 +1,167 @@
+package relayer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+type injectingRelay struct {
+	testRelay
+	events chan nostr.Event
+}
+
+func (r *injectingRelay) InjectEvents() chan nostr.Event { return r.events }
+
+func TestInjectedEventsSavedInBatches(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		batches []int
+		done    = make(chan struct{})
+	)
+	relay := &injectingRelay{
+		testRelay: testRelay{storage: &testStorage{
+			saveEvents: func(_ context.Context, evts []nostr.Event) error {
+				mu.Lock()
+				defer mu.Unlock()
+				batches = append(batches, len(evts))
+				for _, evt := range evts {
+					if evt.Kind == 20001 {
+						t.Error("ephemeral event was saved")
+					}
+				}
+				return nil
+			},
+		}},
+		events: make(chan nostr.Event),
+	}
+	srv := &Server{Log: defaultLogger("test: "), relay: relay, injectDone: make(chan struct{})}
+
+	go func() {
+		srv.consumeInjected(relay)
+		close(done)
+	}()
+	for i := 0; i < injectBatchSize+50; i++ {
+		relay.events <- nostr.Event{Kind: nostr.KindTextNote}
+	}
+	relay.events <- nostr.Event{Kind: 20001}
+	close(relay.events)
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	total := 0
+	for _, n := range batches {
+		if n > injectBatchSize {
+			t.Errorf("saved a batch of %d events; want at most %d", n, injectBatchSize)
+		}
+		total += n
+	}
+	if total != injectBatchSize+50 {
+		t.Errorf("saved %d events in %v; want %d", total, batches, injectBatchSize+50)
+	}
+}
+
+func TestShutdownDrainsInjectedEvents(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		saved int
+	)
+	relay := &injectingRelay{
+		testRelay: testRelay{storage: &testStorage{
+			saveEvents: func(_ context.Context, evts []nostr.Event) error {
+				mu.Lock()
+				defer mu.Unlock()
+				saved += len(evts)
+				return nil
+			},
+		}},
+		events: make(chan nostr.Event, 10),
+	}
+	for i := 0; i < 10; i++ {
+		relay.events <- nostr.Event{Kind: nostr.KindTextNote}
+	}
+	srv, _ := NewServer(relay)
+	started := make(chan bool)
+	go srv.Start("127.0.0.1", 0, started)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if saved != 10 {
+		t.Errorf("saved %d events on shutdown; want 10", saved)
+	}
+}
+
+// fakeSink records what is published to it.
+type fakeSink struct {
+	mu    sync.Mutex
+	kinds []int
+}
+
+func (s *fakeSink) Publish(evt *nostr.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kinds = append(s.kinds, evt.Kind)
+}
+
+type sinkingRelay struct {
+	injectingRelay
+	sink EventSink
+}
+
+func (r *sinkingRelay) EventSink() EventSink { return r.sink }
+
+func TestEventSink(t *testing.T) {
+	sink := &fakeSink{}
+	relay := &sinkingRelay{
+		injectingRelay: injectingRelay{
+			testRelay: testRelay{
+				storage:     &testStorage{},
+				acceptEvent: func(evt *nostr.Event) bool { return evt.Kind != nostr.KindReaction },
+			},
+			events: make(chan nostr.Event),
+		},
+		sink: sink,
+	}
+	srv := &Server{Log: defaultLogger("test: "), relay: relay, injectDone: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		srv.consumeInjected(relay)
+		close(done)
+	}()
+
+	for _, kind := range []int{nostr.KindTextNote, nostr.KindReaction, 20001} {
+		evt := nostr.Event{Kind: kind, CreatedAt: nostr.Now(), Tags: nostr.Tags{}}
+		AddEvent(context.Background(), relay, &evt)
+	}
+	relay.events <- nostr.Event{Kind: nostr.KindSetMetadata}
+	close(relay.events)
+	<-done
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	want := []int{nostr.KindTextNote, 20001, nostr.KindSetMetadata}
+	if len(sink.kinds) != len(want) {
+		t.Fatalf("published kinds %v; want %v", sink.kinds, want)
+	}
+	for i := range want {
+		if sink.kinds[i] != want[i] {
+			t.Fatalf("published kinds %v; want %v, without the rejected reaction", sink.kinds, want)
+		}
+	}
+
+	// without a sink nothing happens
+	relay.sink = nil
+	evt := nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Tags: nostr.Tags{}}
+	if ok, msg := AddEvent(context.Background(), relay, &evt); !ok {
+		t.Errorf("AddEvent without a sink: %s", msg)
+	}
+}
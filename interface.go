@@ -26,6 +26,21 @@ type Relay interface {
 	Storage(context.Context) Storage
 }
 
+// Rejecter is implemented by relays that want to tell clients why an event was
+// refused. When present, RejectEvent is called in place of [Relay.AcceptEvent] and
+// msg is sent back in the NIP-20 OK message, e.g. "pow: difficulty 8 is less than 20".
+// See also [CheckPoW].
+type Rejecter interface {
+	RejectEvent(context.Context, *nostr.Event) (reject bool, msg string)
+}
+
+// Ephemeraler is implemented by relays choosing which kinds of events are only
+// relayed to current subscribers, never stored, in place of the NIP-16 range
+// [IsEphemeralKind] tells. It applies to injected events too.
+type Ephemeraler interface {
+	IsEphemeral(kind int) bool
+}
+
 // Auther is the interface for implementing NIP-42.
 // ServiceURL() returns the URL used to verify the "AUTH" event from clients.
 type Auther interface {
@@ -36,8 +51,51 @@ type Injector interface {
 	InjectEvents() chan nostr.Event
 }
 
+// SubscriptionLimiter is implemented by relays capping how many subscriptions
+// a single connection can have open at once. REQs that would open more are
+// refused with a notice, and the cap is advertised in NIP-11 as the
+// max_subscriptions of the relay's limitation document.
+type SubscriptionLimiter interface {
+	MaxSubscriptions() int
+}
+
+// RequestRateLimiter is implemented by relays limiting how fast a single
+// connection can send REQs. Each connection gets a bucket of burst REQs,
+// refilled at rate per second, and REQs finding it empty are answered with a
+// CLOSED instead of querying the storage. Subscriptions already open are left
+// alone. Zero values mean DefaultRequestRate and DefaultRequestBurst.
+type RequestRateLimiter interface {
+	RequestRate() (rate float64, burst int)
+}
+
+// WebSocketTuner is implemented by relays changing how websocket connections
+// are handled: how big messages from clients can be, write and ping timings,
+// and how many messages can wait for a client before it is dropped. See
+// [WebSocketOptions]. The max message size is advertised in NIP-11 as the
+// max_message_length of the relay's limitation document.
+type WebSocketTuner interface {
+	WebSocketOptions() WebSocketOptions
+}
+
+// EventSink gets every event a relay accepts or has injected, after it is
+// stored, to pass it on to other systems such as a message bus. Publish is
+// called as events come in, so it shouldn't block, nor keep evt around. Failing
+// to publish is for the sink to deal with.
+type EventSink interface {
+	Publish(evt *nostr.Event)
+}
+
+// EventSinker is implemented by relays passing their events on to an
+// [EventSink], or to none when it returns nil.
+type EventSinker interface {
+	EventSink() EventSink
+}
+
 // Informationer is called to compose NIP-11 response to an HTTP request
-// with application/nostr+json mime type.
+// with application/nostr+json mime type. SupportedNIPs, Software and Version
+// are filled in by the server when left empty, and so are the max_limit of
+// a [QueryLimiter] storage, the max_subscriptions of a [SubscriptionLimiter]
+// and the max_message_length of a [WebSocketTuner].
 // See also [Relay.Name].
 type Informationer interface {
 	GetNIP11InformationDocument() nip11.RelayInformationDocument
@@ -71,7 +129,9 @@ type Storage interface {
 
 	// QueryEvents is invoked upon a client's REQ as described in NIP-01.
 	// it should return a channel with the events as they're recovered from a database.
-	// the channel should be closed after the events are all delivered.
+	// the channel should be closed after the events are all delivered, or as soon as
+	// ctx is done: that's when the client went away or got all the events it wanted.
+	// ctx also tells who the client authenticated as, see [AuthedPubkey].
 	QueryEvents(ctx context.Context, filter *nostr.Filter) (chan *nostr.Event, error)
 	// DeleteEvent is used to handle deletion events, as per NIP-09.
 	DeleteEvent(ctx context.Context, id string, pubkey string) error
@@ -91,6 +151,28 @@ type AdvancedSaver interface {
 	AfterSave(*nostr.Event)
 }
 
+// BatchSaver is implemented by storages that can save many events at once.
+// Events coming from an [Injector] are then stored, in batches; they're not
+// stored otherwise. Events already stored must be skipped without failing the batch.
+type BatchSaver interface {
+	SaveEvents(ctx context.Context, evts []nostr.Event) error
+}
+
 type EventCounter interface {
 	CountEvents(ctx context.Context, filter *nostr.Filter) (int64, error)
 }
+
+// QueryLimiter is implemented by storages that return at most MaxLimit events
+// for a single filter, whatever its limit. It is advertised in NIP-11 as the
+// max_limit of the relay's limitation document.
+type QueryLimiter interface {
+	MaxLimit() int
+}
+
+// Expirer is implemented by storages honoring NIP-40: events whose [Expiration]
+// has passed are left out of QueryEvents and CountEvents, and DeleteExpired
+// removes those that expired before the given time. The server then advertises
+// NIP-40 and calls DeleteExpired every [ExpiredPurgeInterval].
+type Expirer interface {
+	DeleteExpired(ctx context.Context, before nostr.Timestamp) (int64, error)
+}
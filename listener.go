@@ -46,10 +46,58 @@ func GetListeningFilters() nostr.Filters {
 	return respfilters
 }
 
+// ActiveSubscriptions is how many subscriptions all the connected clients have
+// open.
+func ActiveSubscriptions() int {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+
+	n := 0
+	for _, subs := range listeners {
+		n += len(subs)
+	}
+	return n
+}
+
+// reserveListener holds a place for the subscription id of ws until setListener
+// fills it in, unless that would make ws go over max subscriptions. Replacing
+// one of its own is always allowed, and max 0 means no limit. The place is
+// reserved at once as REQs are handled concurrently.
+func reserveListener(ws *WebSocket, id string, max int) bool {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+
+	if ws.closed {
+		return false
+	}
+	subs, ok := listeners[ws]
+	if !ok {
+		subs = make(map[string]*Listener)
+		listeners[ws] = subs
+	}
+	if _, ok := subs[id]; ok {
+		return true
+	}
+	if max > 0 && len(subs) >= max {
+		if len(subs) == 0 {
+			delete(listeners, ws)
+		}
+		return false
+	}
+
+	// no filters, so it matches nothing yet
+	subs[id] = &Listener{}
+	return true
+}
+
 func setListener(id string, ws *WebSocket, filters nostr.Filters) {
 	listenersMutex.Lock()
 	defer listenersMutex.Unlock()
 
+	if ws.closed {
+		return
+	}
+
 	subs, ok := listeners[ws]
 	if !ok {
 		subs = make(map[string]*Listener)
@@ -76,6 +124,7 @@ func removeListenerId(ws *WebSocket, id string) {
 func removeListener(ws *WebSocket) {
 	listenersMutex.Lock()
 	defer listenersMutex.Unlock()
+	ws.closed = true
 	delete(listeners, ws)
 }
 
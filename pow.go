@@ -0,0 +1,39 @@
+package relayer
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+)
+
+// CheckPoW tells whether evt carries at least minDifficulty bits of proof of work,
+// as described in NIP-13. If the event commits to a target difficulty in its
+// "nonce" tag, the event only counts for as much as that target, so ids that are
+// luckier than what their author was mining for don't pass.
+// When the check fails, msg is a NIP-20 "pow:" reason to send back to the client.
+func CheckPoW(evt *nostr.Event, minDifficulty int) (ok bool, msg string) {
+	if minDifficulty <= 0 {
+		return true, ""
+	}
+
+	difficulty := nip13.Difficulty(evt.ID)
+	if nonce := evt.Tags.GetFirst([]string{"nonce", ""}); nonce != nil && len(*nonce) >= 3 {
+		target, err := strconv.Atoi((*nonce)[2])
+		if err != nil {
+			return false, fmt.Sprintf("pow: invalid target difficulty %q", (*nonce)[2])
+		}
+		if target < minDifficulty {
+			return false, fmt.Sprintf("pow: committed target %d is less than %d", target, minDifficulty)
+		}
+		if target < difficulty {
+			difficulty = target
+		}
+	}
+
+	if difficulty < minDifficulty {
+		return false, fmt.Sprintf("pow: difficulty %d is less than %d", difficulty, minDifficulty)
+	}
+	return true, ""
+}
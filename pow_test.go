@@ -0,0 +1,76 @@
+package relayer
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestCheckPoW(t *testing.T) {
+	// 0x000f... has 12 leading zero bits
+	id := "000f" + strings.Repeat("f", 60)
+	tests := []struct {
+		name   string
+		tags   nostr.Tags
+		min    int
+		wantOK bool
+	}{
+		{"no requirement", nil, 0, true},
+		{"above threshold", nil, 10, true},
+		{"at threshold", nil, 12, true},
+		{"below threshold", nil, 16, false},
+		{"committed target reached", nostr.Tags{{"nonce", "42", "12"}}, 12, true},
+		{"committed target too low", nostr.Tags{{"nonce", "42", "8"}}, 10, false},
+		{"committed target above actual", nostr.Tags{{"nonce", "42", "20"}}, 16, false},
+		{"nonce without target", nostr.Tags{{"nonce", "42"}}, 12, true},
+		{"invalid target", nostr.Tags{{"nonce", "42", "lots"}}, 8, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, msg := CheckPoW(&nostr.Event{ID: id, Tags: tt.tags}, tt.min)
+			if ok != tt.wantOK {
+				t.Errorf("CheckPoW() = %v, %q; want %v", ok, msg, tt.wantOK)
+			}
+			if !ok && !strings.HasPrefix(msg, "pow: ") {
+				t.Errorf("CheckPoW() msg = %q; want a pow: reason", msg)
+			}
+		})
+	}
+}
+
+type powRelay struct {
+	testRelay
+	minPoW int
+}
+
+func (r *powRelay) RejectEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+	ok, msg := CheckPoW(evt, r.minPoW)
+	return !ok, msg
+}
+
+func TestAddEventRejectReason(t *testing.T) {
+	saved := 0
+	relay := &powRelay{
+		testRelay: testRelay{
+			storage:     &testStorage{saveEvent: func(context.Context, *nostr.Event) error { saved++; return nil }},
+			acceptEvent: func(*nostr.Event) bool { t.Error("AcceptEvent called on a Rejecter"); return true },
+		},
+		minPoW: 8,
+	}
+
+	ok, msg := AddEvent(context.Background(), relay, &nostr.Event{ID: "01" + strings.Repeat("0", 62)})
+	if ok || msg != "pow: difficulty 7 is less than 8" {
+		t.Errorf("AddEvent(below) = %v, %q; want a pow: rejection", ok, msg)
+	}
+
+	ok, msg = AddEvent(context.Background(), relay, &nostr.Event{ID: "00" + strings.Repeat("f", 62)})
+	if !ok || msg != "" {
+		t.Errorf("AddEvent(above) = %v, %q; want it accepted", ok, msg)
+	}
+	if saved != 1 {
+		t.Errorf("saved %d events; want 1", saved)
+	}
+}
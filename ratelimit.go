@@ -0,0 +1,60 @@
+package relayer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Used by a [RequestRateLimiter] returning zero for either.
+const (
+	DefaultRequestRate  = 1.0
+	DefaultRequestBurst = 20
+)
+
+// throttledRequests counts the REQs refused by a RequestRateLimiter.
+var throttledRequests int64
+
+// ThrottledRequests returns how many REQs were refused for coming too fast
+// since the process started.
+func ThrottledRequests() int64 {
+	return atomic.LoadInt64(&throttledRequests)
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate per second.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		rate = DefaultRequestRate
+	}
+	if burst <= 0 {
+		burst = DefaultRequestBurst
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// take uses up a token, reporting false when there is none left.
+func (b *tokenBucket) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
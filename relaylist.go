@@ -0,0 +1,64 @@
+package relayer
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// KindRelayList is the NIP-65 list of the relays a user reads from and writes to.
+const KindRelayList = 10002
+
+// RelayListEntry is one of the relays of a NIP-65 relay list. Read and Write
+// are both set for relays with no marker.
+type RelayListEntry struct {
+	URL   string `json:"url"`
+	Read  bool   `json:"read"`
+	Write bool   `json:"write"`
+}
+
+// RelayList reads the "r" tags of a NIP-65 relay list, leaving out the ones
+// CheckRelayList would refuse.
+func RelayList(evt *nostr.Event) []RelayListEntry {
+	var entries []RelayListEntry
+	for _, tag := range evt.Tags {
+		if len(tag) < 2 || tag[0] != "r" || checkRelayTag(tag) != nil {
+			continue
+		}
+		entry := RelayListEntry{URL: tag[1], Read: true, Write: true}
+		if len(tag) > 2 && tag[2] != "" {
+			entry.Read, entry.Write = tag[2] == "read", tag[2] == "write"
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// CheckRelayList tells what is wrong with the "r" tags of a NIP-65 relay list,
+// if anything: each must be a ws or wss URL, optionally marked "read" or
+// "write". [AddEvent] refuses relay lists failing it as invalid.
+func CheckRelayList(evt *nostr.Event) error {
+	for _, tag := range evt.Tags {
+		if len(tag) > 0 && tag[0] == "r" {
+			if err := checkRelayTag(tag); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkRelayTag(tag nostr.Tag) error {
+	if len(tag) < 2 {
+		return fmt.Errorf("r tag without a relay url")
+	}
+	u, err := url.Parse(tag[1])
+	if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" || u.User != nil {
+		return fmt.Errorf("%q is not a ws or wss url", tag[1])
+	}
+	if len(tag) > 2 && tag[2] != "" && tag[2] != "read" && tag[2] != "write" {
+		return fmt.Errorf("relay marker %q is neither read nor write", tag[2])
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package relayer
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestAddEventRelayList(t *testing.T) {
+	saved := 0
+	relay := &testRelay{storage: &testStorage{saveEvent: func(context.Context, *nostr.Event) error { saved++; return nil }}}
+	relayList := func(tags ...nostr.Tag) *nostr.Event {
+		return &nostr.Event{Kind: KindRelayList, Tags: tags}
+	}
+
+	for _, tags := range []nostr.Tags{
+		{{"r", "https://relay.example.com"}},
+		{{"r", "relay.example.com"}},
+		{{"r", "wss://"}},
+		{{"r", "not a url at all"}},
+		{{"r"}},
+		{{"r", "wss://relay.example.com", "sometimes"}},
+		{{"r", "wss://relay.example.com"}, {"r", "javascript:alert(1)"}},
+	} {
+		ok, msg := AddEvent(context.Background(), relay, relayList(tags...))
+		if ok || !strings.HasPrefix(msg, "invalid: ") {
+			t.Errorf("AddEvent(relay list %v) = %v, %q; want an invalid: rejection", tags, ok, msg)
+		}
+	}
+	if saved != 0 {
+		t.Fatalf("saved %d bad relay lists", saved)
+	}
+
+	good := relayList(
+		nostr.Tag{"r", "wss://relay.example.com"},
+		nostr.Tag{"r", "ws://localhost:7447", "read"},
+		nostr.Tag{"r", "wss://write.example.com/", "write"},
+		nostr.Tag{"p", "other tags are left alone"},
+	)
+	if ok, msg := AddEvent(context.Background(), relay, good); !ok || saved != 1 {
+		t.Errorf("AddEvent(good relay list) = %v, %q; want it saved", ok, msg)
+	}
+
+	// other kinds can have whatever r tags
+	if ok, msg := AddEvent(context.Background(), relay, &nostr.Event{Kind: nostr.KindTextNote, Tags: nostr.Tags{{"r", "https://example.com"}}}); !ok {
+		t.Errorf("AddEvent(note with a web link) = %v, %q; want it saved", ok, msg)
+	}
+
+	want := []RelayListEntry{
+		{URL: "wss://relay.example.com", Read: true, Write: true},
+		{URL: "ws://localhost:7447", Read: true},
+		{URL: "wss://write.example.com/", Write: true},
+	}
+	if got := RelayList(good); !reflect.DeepEqual(got, want) {
+		t.Errorf("RelayList = %+v; want %+v", got, want)
+	}
+}
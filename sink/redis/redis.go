@@ -0,0 +1,229 @@
+// Package redis is a relayer.EventSink publishing events on a Redis pub/sub
+// channel, for consumers such as indexers that would rather not hold a
+// websocket subscription. It speaks just enough of the Redis protocol to
+// authenticate and PUBLISH.
+package redis
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	// queueSize is how many events can wait to be published before new ones
+	// are dropped.
+	queueSize = 1024
+
+	dialTimeout  = 5 * time.Second
+	writeTimeout = 5 * time.Second
+
+	// retryDelay is how long events are dropped after failing to connect,
+	// before trying again.
+	retryDelay = 5 * time.Second
+)
+
+// Sink publishes every event, as JSON, on a channel of a Redis server. Events
+// are queued and written in order by a single goroutine over one connection,
+// which is opened again when it breaks. While Redis can't be reached events
+// are dropped and counted, not held.
+type Sink struct {
+	addr     string
+	username string
+	password string
+	channel  string
+
+	mu     sync.Mutex
+	closed bool
+	queue  chan []byte
+	done   chan struct{}
+
+	dropped int64
+
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// New makes a Sink publishing on channel of the server at redisURL, like
+// redis://:password@localhost:6379. It connects on the first event.
+func New(redisURL, channel string) (*Sink, error) {
+	u, err := url.Parse(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("invalid redis url %q, want redis://[[user]:password@]host[:port]", redisURL)
+	}
+	if channel == "" {
+		return nil, fmt.Errorf("no channel to publish on")
+	}
+
+	s := &Sink{
+		addr:    u.Host,
+		channel: channel,
+		queue:   make(chan []byte, queueSize),
+		done:    make(chan struct{}),
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+
+	go s.run()
+	return s, nil
+}
+
+// Publish queues evt to be published, dropping it if the queue is full.
+func (s *Sink) Publish(evt *nostr.Event) {
+	payload, err := json.Marshal(evt)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- payload:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+// Dropped is how many events were never published, for a full queue or Redis
+// being unreachable.
+func (s *Sink) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Close publishes what is queued and closes the connection.
+func (s *Sink) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+
+	<-s.done
+	return nil
+}
+
+func (s *Sink) run() {
+	defer close(s.done)
+	defer s.disconnect()
+
+	var retryAt time.Time
+	for payload := range s.queue {
+		if s.conn == nil && time.Now().Before(retryAt) {
+			atomic.AddInt64(&s.dropped, 1)
+			continue
+		}
+
+		err := s.publish(payload)
+		if err != nil && s.conn != nil {
+			// the connection may have been closed under us, try a fresh one
+			s.disconnect()
+			err = s.publish(payload)
+		}
+		if err != nil {
+			if s.conn == nil {
+				retryAt = time.Now().Add(retryDelay)
+			}
+			s.disconnect()
+			atomic.AddInt64(&s.dropped, 1)
+			log.Printf("redis sink: failed to publish to %s: %v", s.addr, err)
+		}
+	}
+}
+
+func (s *Sink) publish(payload []byte) error {
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+
+	s.conn.SetDeadline(time.Now().Add(writeTimeout))
+	if err := s.command("PUBLISH", s.channel, string(payload)); err != nil {
+		return err
+	}
+	_, err := s.reply()
+	return err
+}
+
+func (s *Sink) connect() error {
+	conn, err := net.DialTimeout("tcp", s.addr, dialTimeout)
+	if err != nil {
+		return err
+	}
+	s.conn, s.rd = conn, bufio.NewReader(conn)
+
+	if s.password != "" {
+		args := []string{"AUTH", s.password}
+		if s.username != "" {
+			args = []string{"AUTH", s.username, s.password}
+		}
+		s.conn.SetDeadline(time.Now().Add(writeTimeout))
+		if err := s.command(args...); err != nil {
+			s.disconnect()
+			return err
+		}
+		if _, err := s.reply(); err != nil {
+			s.disconnect()
+			return fmt.Errorf("AUTH: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *Sink) disconnect() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn, s.rd = nil, nil
+	}
+}
+
+// command writes args as a Redis array of bulk strings.
+func (s *Sink) command(args ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := s.conn.Write([]byte(b.String()))
+	return err
+}
+
+// reply reads a simple string, error or integer reply.
+func (s *Sink) reply() (string, error) {
+	line, err := s.rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	switch {
+	case line == "":
+		return "", fmt.Errorf("empty reply")
+	case line[0] == '-':
+		return "", fmt.Errorf("redis: %s", line[1:])
+	case line[0] == '+' || line[0] == ':':
+		return line[1:], nil
+	default:
+		return "", fmt.Errorf("unexpected reply %q", line)
+	}
+}
@@ -0,0 +1,228 @@
+package redis
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// fakeRedis answers AUTH and PUBLISH, recording the commands it gets.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	commands [][]string
+	// connections are closed after this many commands, if not zero
+	hangUpAfter int
+}
+
+func startFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	r := &fakeRedis{ln: ln, password: password}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) url(userinfo string) string {
+	return "redis://" + userinfo + r.ln.Addr().String()
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	authed := r.password == ""
+	served := 0
+	for {
+		args, err := readCommand(rd)
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		r.commands = append(r.commands, args)
+		hangUp := r.hangUpAfter
+		r.mu.Unlock()
+
+		switch {
+		case args[0] == "AUTH" && args[len(args)-1] == r.password:
+			authed = true
+			io.WriteString(conn, "+OK\r\n")
+		case args[0] == "AUTH":
+			io.WriteString(conn, "-WRONGPASS invalid password\r\n")
+		case !authed:
+			io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+		case args[0] == "PUBLISH":
+			io.WriteString(conn, ":1\r\n")
+		default:
+			io.WriteString(conn, "-ERR unknown command\r\n")
+		}
+
+		served++
+		if hangUp > 0 && served >= hangUp {
+			return
+		}
+	}
+}
+
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// published returns the events PUBLISHed on channel.
+func (r *fakeRedis) published(t *testing.T, channel string) []nostr.Event {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var events []nostr.Event
+	for _, args := range r.commands {
+		if args[0] != "PUBLISH" {
+			continue
+		}
+		if len(args) != 3 || args[1] != channel {
+			t.Errorf("PUBLISH %v; want it on %s", args, channel)
+			continue
+		}
+		var evt nostr.Event
+		if err := json.Unmarshal([]byte(args[2]), &evt); err != nil {
+			t.Errorf("published %q, not an event: %v", args[2], err)
+		}
+		events = append(events, evt)
+	}
+	return events
+}
+
+func testEvents(n int) []nostr.Event {
+	sk := nostr.GeneratePrivateKey()
+	events := make([]nostr.Event, n)
+	for i := range events {
+		events[i] = nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: fmt.Sprint(i)}
+		events[i].Sign(sk)
+	}
+	return events
+}
+
+func TestSinkPublishes(t *testing.T) {
+	server := startFakeRedis(t, "hunter2")
+	sink, err := New(server.url(":hunter2@"), "nostr:events")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	events := testEvents(5)
+	for i := range events {
+		sink.Publish(&events[i])
+	}
+	sink.Close()
+	sink.Publish(&events[0]) // ignored once closed
+
+	got := server.published(t, "nostr:events")
+	if len(got) != len(events) {
+		t.Fatalf("published %d events; want %d", len(got), len(events))
+	}
+	for i := range events {
+		if got[i].ID != events[i].ID {
+			t.Errorf("event %d published is %s; want %s, in order", i, got[i].ID, events[i].ID)
+		}
+	}
+	if server.commands[0][0] != "AUTH" {
+		t.Errorf("first command %v; want AUTH", server.commands[0])
+	}
+	if sink.Dropped() != 0 {
+		t.Errorf("dropped %d events; want none", sink.Dropped())
+	}
+}
+
+func TestSinkReconnects(t *testing.T) {
+	server := startFakeRedis(t, "")
+	server.hangUpAfter = 2
+	sink, err := New(server.url(""), "events")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	events := testEvents(7)
+	for i := range events {
+		sink.Publish(&events[i])
+	}
+	sink.Close()
+
+	if got := server.published(t, "events"); len(got) != len(events) {
+		t.Errorf("published %d events over connections that hang up; want %d", len(got), len(events))
+	}
+}
+
+func TestSinkDropsWhenUnreachable(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+
+	sink, err := New("redis://"+addr, "events")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	events := testEvents(3)
+	for i := range events {
+		sink.Publish(&events[i])
+	}
+	sink.Close()
+	if sink.Dropped() != 3 {
+		t.Errorf("dropped %d events; want all 3", sink.Dropped())
+	}
+}
+
+func TestNewValidates(t *testing.T) {
+	for _, tt := range []struct{ url, channel string }{
+		{"http://localhost", "events"},
+		{"redis://", "events"},
+		{"redis://localhost", ""},
+	} {
+		if _, err := New(tt.url, tt.channel); err == nil {
+			t.Errorf("New(%q, %q) accepted", tt.url, tt.channel)
+		}
+	}
+}
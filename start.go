@@ -6,6 +6,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"strconv"
 	"sync"
@@ -40,6 +41,17 @@ type Server struct {
 	clientsMu sync.Mutex
 	clients   map[*websocket.Conn]struct{}
 
+	// set when the relay is an Injector, see consumeInjected
+	drainInject chan context.Context
+	injectDone  chan struct{}
+
+	// closed by Shutdown to stop purgeExpired
+	stopPurge chan struct{}
+
+	// TrustedProxies are the addresses whose X-Forwarded-For is believed when
+	// logging where requests come from, see ParseTrustedProxies.
+	TrustedProxies []netip.Prefix
+
 	// in case you call Server.Start
 	Addr       string
 	serveMux   *http.ServeMux
@@ -70,11 +82,14 @@ func NewServer(relay Relay) (*Server, error) {
 
 	// start listening from events from other sources, if any
 	if inj, ok := relay.(Injector); ok {
-		go func() {
-			for event := range inj.InjectEvents() {
-				notifyListeners(&event)
-			}
-		}()
+		srv.drainInject = make(chan context.Context)
+		srv.injectDone = make(chan struct{})
+		go srv.consumeInjected(inj)
+	}
+
+	if exp, ok := relay.Storage(context.Background()).(Expirer); ok {
+		srv.stopPurge = make(chan struct{})
+		go srv.purgeExpired(exp, srv.stopPurge)
 	}
 
 	return srv, nil
@@ -83,11 +98,11 @@ func NewServer(relay Relay) (*Server, error) {
 // ServeHTTP implements http.Handler interface.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Header.Get("Upgrade") == "websocket" {
-		s.HandleWebsocket(w, r)
+		s.serveLogged(w, r, true, s.HandleWebsocket)
 	} else if r.Header.Get("Accept") == "application/nostr+json" {
-		s.HandleNIP11(w, r)
+		s.serveLogged(w, r, false, s.HandleNIP11)
 	} else {
-		s.serveMux.ServeHTTP(w, r)
+		s.serveLogged(w, r, false, s.serveMux.ServeHTTP)
 	}
 }
 
@@ -126,6 +141,10 @@ func (s *Server) Start(host string, port int, started ...chan bool) error {
 // If the relay is ShutdownAware, Shutdown calls its OnShutdown, passing the context as is.
 // Note that the HTTP server make some time to shutdown and so the context deadline,
 // if any, may have been shortened by the time OnShutdown is called.
+//
+// Once OnShutdown returns, the relay is expected to have stopped injecting events:
+// those still waiting in the [Injector] channel or to be saved are then stored,
+// for as long as ctx allows.
 func (s *Server) Shutdown(ctx context.Context) {
 	s.httpServer.Shutdown(ctx)
 
@@ -137,9 +156,27 @@ func (s *Server) Shutdown(ctx context.Context) {
 		delete(s.clients, conn)
 	}
 
+	if s.stopPurge != nil {
+		close(s.stopPurge)
+	}
+
 	if f, ok := s.relay.(ShutdownAware); ok {
 		f.OnShutdown(ctx)
 	}
+
+	if s.drainInject != nil {
+		select {
+		case s.drainInject <- ctx:
+			select {
+			case <-s.injectDone:
+			case <-ctx.Done():
+				s.Log.Warningf("gave up draining injected events: %v", ctx.Err())
+			}
+		case <-s.injectDone:
+			// the injection channel was closed and everything is saved already
+		case <-ctx.Done():
+		}
+	}
 }
 
 func defaultLogger(prefix string) Logger {
@@ -2,4 +2,8 @@ package storage
 
 import "errors"
 
-var ErrDupEvent = errors.New("duplicate: event already exists")
+var (
+	ErrDupEvent = errors.New("duplicate: event already exists")
+	// ErrOldEvent is returned for replaceable events older than the version stored.
+	ErrOldEvent = errors.New("duplicate: a newer version of this event is stored")
+)
@@ -0,0 +1,14 @@
+package pebblestorage
+
+import (
+	"testing"
+
+	"github.com/fiatjaf/relayer/v2"
+	"github.com/fiatjaf/relayer/v2/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) relayer.Storage {
+		return testBackend(t)
+	})
+}
@@ -0,0 +1,50 @@
+package pebblestorage
+
+import (
+	"context"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func (b *PebbleBackend) DeleteEvent(ctx context.Context, id string, pubkey string) error {
+	rawID, err := decodeHex32(id)
+	if err != nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	evt, err := b.getEvent(rawID)
+	if err == pebble.ErrNotFound || (err == nil && evt.PubKey != pubkey) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	batch := b.NewBatch()
+	defer batch.Close()
+	if err := deleteEvent(batch, evt); err != nil {
+		return err
+	}
+	return batch.Commit(pebble.Sync)
+}
+
+// deleteEvent removes evt and all its index entries.
+func deleteEvent(batch *pebble.Batch, evt *nostr.Event) error {
+	id, err := decodeHex32(evt.ID)
+	if err != nil {
+		return err
+	}
+	pubkey, err := decodeHex32(evt.PubKey)
+	if err != nil {
+		return err
+	}
+
+	batch.Delete(eventKey(id), nil)
+	for _, key := range indexKeys(evt, id, pubkey) {
+		batch.Delete(key, nil)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package pebblestorage
+
+import (
+	"github.com/cockroachdb/pebble"
+	"github.com/fiatjaf/relayer/v2"
+)
+
+const (
+	queryLimit        = 100
+	queryIDsLimit     = 500
+	queryAuthorsLimit = 500
+	queryKindsLimit   = 10
+	queryTagsLimit    = 10
+)
+
+var (
+	_ relayer.Storage      = (*PebbleBackend)(nil)
+	_ relayer.EventCounter = (*PebbleBackend)(nil)
+)
+
+func (b *PebbleBackend) Init() error {
+	db, err := pebble.Open(b.Path, b.Options)
+	if err != nil {
+		return err
+	}
+	b.DB = db
+
+	if b.QueryLimit == 0 {
+		b.QueryLimit = queryLimit
+	}
+	if b.QueryIDsLimit == 0 {
+		b.QueryIDsLimit = queryIDsLimit
+	}
+	if b.QueryAuthorsLimit == 0 {
+		b.QueryAuthorsLimit = queryAuthorsLimit
+	}
+	if b.QueryKindsLimit == 0 {
+		b.QueryKindsLimit = queryKindsLimit
+	}
+	if b.QueryTagsLimit == 0 {
+		b.QueryTagsLimit = queryTagsLimit
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package pebblestorage
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Events are stored as json under their id. Every other key is an index entry
+// with an empty value, ending in the event's created_at and id so scanning a
+// prefix backwards yields the newest events first.
+const (
+	prefixEvent      byte = 'e' // id
+	prefixCreatedAt  byte = 'c' // created_at, id
+	prefixPubkey     byte = 'p' // pubkey, created_at, id
+	prefixKind       byte = 'k' // kind, created_at, id
+	prefixPubkeyKind byte = 'g' // pubkey, kind, created_at, id
+	prefixTag        byte = 't' // tag name, value hash, created_at, id
+)
+
+// decodeHex32 decodes a hex id or pubkey, failing on anything but 32 bytes.
+func decodeHex32(s string) ([]byte, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 32 {
+		return nil, fmt.Errorf("%q is not 32 bytes of hex", s)
+	}
+	return b, nil
+}
+
+func eventKey(id []byte) []byte {
+	return append([]byte{prefixEvent}, id...)
+}
+
+func pubkeyPrefix(pubkey []byte) []byte {
+	return append([]byte{prefixPubkey}, pubkey...)
+}
+
+func kindPrefix(kind int) []byte {
+	return appendUint32([]byte{prefixKind}, uint32(kind))
+}
+
+func pubkeyKindPrefix(pubkey []byte, kind int) []byte {
+	return appendUint32(append([]byte{prefixPubkeyKind}, pubkey...), uint32(kind))
+}
+
+// tagPrefix indexes a tag value by its hash, so all keys under a prefix have
+// the same length. Only single letter tags are indexed, as NIP-12 says.
+func tagPrefix(name, value string) []byte {
+	hash := sha256.Sum256([]byte(value))
+	return append([]byte{prefixTag, name[0]}, hash[:8]...)
+}
+
+// indexKey is prefix followed by the created_at and id of an event.
+func indexKey(prefix []byte, createdAt nostr.Timestamp, id []byte) []byte {
+	key := make([]byte, 0, len(prefix)+8+32)
+	key = append(key, prefix...)
+	key = appendUint64(key, uint64(createdAt))
+	return append(key, id...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// indexKeys lists all the index entries of evt.
+func indexKeys(evt *nostr.Event, id, pubkey []byte) [][]byte {
+	keys := [][]byte{
+		indexKey([]byte{prefixCreatedAt}, evt.CreatedAt, id),
+		indexKey(pubkeyPrefix(pubkey), evt.CreatedAt, id),
+		indexKey(kindPrefix(evt.Kind), evt.CreatedAt, id),
+		indexKey(pubkeyKindPrefix(pubkey, evt.Kind), evt.CreatedAt, id),
+	}
+
+	seen := make(map[string]bool)
+	for _, tag := range evt.Tags {
+		if len(tag) < 2 || len(tag[0]) != 1 {
+			continue
+		}
+		key := indexKey(tagPrefix(tag[0], tag[1]), evt.CreatedAt, id)
+		if !seen[string(key)] {
+			seen[string(key)] = true
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
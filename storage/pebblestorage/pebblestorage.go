@@ -0,0 +1,22 @@
+package pebblestorage
+
+import (
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+)
+
+type PebbleBackend struct {
+	*pebble.DB
+	Path string
+	// Options are passed as is to pebble.Open, nil means the defaults.
+	Options           *pebble.Options
+	QueryLimit        int
+	QueryIDsLimit     int
+	QueryAuthorsLimit int
+	QueryKindsLimit   int
+	QueryTagsLimit    int
+
+	// serializes writes, which look up what they replace before committing
+	mu sync.Mutex
+}
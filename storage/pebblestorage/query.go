@@ -0,0 +1,238 @@
+package pebblestorage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func (b *PebbleBackend) QueryEvents(ctx context.Context, filter *nostr.Filter) (chan *nostr.Event, error) {
+	if filter == nil {
+		return nil, fmt.Errorf("filter cannot be null")
+	}
+	limit := filter.Limit
+	if limit < 1 || limit > b.QueryLimit {
+		limit = b.QueryLimit
+	}
+	evts, err := b.queryEvents(filter, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer close(ch)
+		for _, evt := range evts {
+			select {
+			case ch <- evt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (b *PebbleBackend) CountEvents(ctx context.Context, filter *nostr.Filter) (int64, error) {
+	evts, err := b.queryEvents(filter, math.MaxInt)
+	return int64(len(evts)), err
+}
+
+// queryEvents returns the newest limit events matching filter, newest first
+// and then by descending id, as the sql storages order them.
+func (b *PebbleBackend) queryEvents(filter *nostr.Filter, limit int) ([]*nostr.Event, error) {
+	if filter == nil {
+		return nil, fmt.Errorf("filter cannot be null")
+	}
+
+	found := make(map[string]*nostr.Event)
+	if filter.IDs != nil {
+		if len(filter.IDs) > b.QueryIDsLimit {
+			// too many ids, fail everything
+			return nil, nil
+		}
+		for _, id := range filter.IDs {
+			raw, err := decodeHex32(id)
+			if err != nil {
+				continue
+			}
+			evt, err := b.getEvent(raw)
+			if err == pebble.ErrNotFound {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			if filter.Matches(evt) {
+				found[evt.ID] = evt
+			}
+		}
+	} else {
+		prefixes, ok := b.queryPrefixes(filter)
+		if !ok {
+			return nil, nil
+		}
+		// every prefix is scanned newest first, so its first limit matches
+		// are all it can contribute
+		for _, prefix := range prefixes {
+			n := 0
+			err := b.scan(prefix, filter.Since, filter.Until, func(evt *nostr.Event) bool {
+				if filter.Matches(evt) {
+					found[evt.ID] = evt
+					n++
+				}
+				return n < limit
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	evts := make([]*nostr.Event, 0, len(found))
+	for _, evt := range found {
+		evts = append(evts, evt)
+	}
+	sort.Slice(evts, func(i, j int) bool {
+		if evts[i].CreatedAt != evts[j].CreatedAt {
+			return evts[i].CreatedAt > evts[j].CreatedAt
+		}
+		return evts[i].ID > evts[j].ID
+	})
+	if len(evts) > limit {
+		evts = evts[:limit]
+	}
+
+	return evts, nil
+}
+
+// queryPrefixes picks the index to scan for filter, returning the prefixes to
+// scan in it. ok is false when filter can't match anything.
+func (b *PebbleBackend) queryPrefixes(filter *nostr.Filter) (prefixes [][]byte, ok bool) {
+	var authors [][]byte
+	if filter.Authors != nil {
+		if len(filter.Authors) > b.QueryAuthorsLimit {
+			// too many authors, fail everything
+			return nil, false
+		}
+		for _, author := range filter.Authors {
+			if pubkey, err := decodeHex32(author); err == nil {
+				authors = append(authors, pubkey)
+			}
+		}
+		if len(authors) == 0 {
+			// authors being [] mean you won't get anything
+			return nil, false
+		}
+	}
+
+	if filter.Kinds != nil && (len(filter.Kinds) == 0 || len(filter.Kinds) > b.QueryKindsLimit) {
+		// kinds being [] mean you won't get anything, too many fail everything
+		return nil, false
+	}
+
+	var tagName string
+	tagValues := 0
+	for name, values := range filter.Tags {
+		if len(values) == 0 {
+			// any tag set to [] is wrong
+			return nil, false
+		}
+		tagValues += len(values)
+		if tagValues > b.QueryTagsLimit {
+			// too many tags, fail everything
+			return nil, false
+		}
+		if len(name) == 1 && (tagName == "" || name < tagName) {
+			tagName = name
+		}
+	}
+
+	switch {
+	case authors != nil && filter.Kinds != nil:
+		for _, pubkey := range authors {
+			for _, kind := range filter.Kinds {
+				prefixes = append(prefixes, pubkeyKindPrefix(pubkey, kind))
+			}
+		}
+	case tagName != "":
+		for _, value := range filter.Tags[tagName] {
+			prefixes = append(prefixes, tagPrefix(tagName, value))
+		}
+	case authors != nil:
+		for _, pubkey := range authors {
+			prefixes = append(prefixes, pubkeyPrefix(pubkey))
+		}
+	case filter.Kinds != nil:
+		for _, kind := range filter.Kinds {
+			prefixes = append(prefixes, kindPrefix(kind))
+		}
+	default:
+		prefixes = append(prefixes, []byte{prefixCreatedAt})
+	}
+
+	return prefixes, true
+}
+
+// scan calls fn with the events indexed under prefix, newest first and then by
+// descending id, created after since and before until, for as long as it
+// returns true. Like the sql storages, neither bound is inclusive.
+func (b *PebbleBackend) scan(prefix []byte, since, until *nostr.Timestamp, fn func(*nostr.Event) bool) error {
+	opts := &pebble.IterOptions{LowerBound: prefix, UpperBound: prefixEnd(prefix)}
+	if since != nil && *since >= 0 {
+		opts.LowerBound = appendUint64(append([]byte{}, prefix...), uint64(*since)+1)
+	}
+	if until != nil {
+		if *until <= 0 {
+			return nil
+		}
+		opts.UpperBound = appendUint64(append([]byte{}, prefix...), uint64(*until))
+	}
+
+	iter := b.NewIter(opts)
+	for iter.Last(); iter.Valid(); iter.Prev() {
+		key := iter.Key()
+		evt, err := b.getEvent(key[len(key)-32:])
+		if err == pebble.ErrNotFound {
+			continue
+		} else if err != nil {
+			iter.Close()
+			return err
+		}
+		if !fn(evt) {
+			break
+		}
+	}
+	return iter.Close()
+}
+
+// prefixEnd is the first key after all the ones starting with prefix.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+func (b *PebbleBackend) getEvent(id []byte) (*nostr.Event, error) {
+	value, closer, err := b.Get(eventKey(id))
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	var evt nostr.Event
+	if err := json.Unmarshal(value, &evt); err != nil {
+		return nil, err
+	}
+	return &evt, nil
+}
@@ -0,0 +1,134 @@
+package pebblestorage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryEvents(t *testing.T) {
+	b := testBackend(t)
+	alice, bob := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+
+	a1 := testEvent(alice, 1, 100, "a1", nostr.Tag{"t", "nostr"})
+	a2 := testEvent(alice, 1, 200, "a2", nostr.Tag{"t", "go"}, nostr.Tag{"p", "x"})
+	a3 := testEvent(alice, 7, 300, "+", nostr.Tag{"e", a2.ID})
+	b1 := testEvent(bob, 1, 150, "b1", nostr.Tag{"t", "nostr"})
+	b2 := testEvent(bob, 30023, 250, "b2", nostr.Tag{"d", "post"}, nostr.Tag{"t", "go"})
+	mustSave(t, b, a1, a2, a3, b1, b2)
+
+	ts := func(v nostr.Timestamp) *nostr.Timestamp { return &v }
+
+	var tests = []struct {
+		name   string
+		filter nostr.Filter
+		want   []*nostr.Event
+	}{
+		{"empty filter", nostr.Filter{}, []*nostr.Event{a3, b2, a2, b1, a1}},
+		{"limit", nostr.Filter{Limit: 2}, []*nostr.Event{a3, b2}},
+		{"ids", nostr.Filter{IDs: []string{a1.ID, b2.ID, "nothex"}}, []*nostr.Event{b2, a1}},
+		{"ids and kinds", nostr.Filter{IDs: []string{a1.ID, a3.ID}, Kinds: []int{7}}, []*nostr.Event{a3}},
+		{"authors", nostr.Filter{Authors: []string{a1.PubKey}}, []*nostr.Event{a3, a2, a1}},
+		{"invalid authors", nostr.Filter{Authors: []string{"nothex"}}, nil},
+		{"kinds", nostr.Filter{Kinds: []int{1}}, []*nostr.Event{a2, b1, a1}},
+		{"empty kinds", nostr.Filter{Kinds: []int{}}, nil},
+		{"authors and kinds", nostr.Filter{Authors: []string{a1.PubKey, b1.PubKey}, Kinds: []int{1, 30023}, Limit: 3}, []*nostr.Event{b2, a2, b1}},
+		{"tag", nostr.Filter{Tags: nostr.TagMap{"t": {"nostr"}}}, []*nostr.Event{b1, a1}},
+		{"tag values", nostr.Filter{Tags: nostr.TagMap{"t": {"nostr", "go"}}}, []*nostr.Event{b2, a2, b1, a1}},
+		{"tags", nostr.Filter{Tags: nostr.TagMap{"t": {"go"}, "p": {"x"}}}, []*nostr.Event{a2}},
+		{"tag and author", nostr.Filter{Tags: nostr.TagMap{"t": {"go"}}, Authors: []string{b1.PubKey}}, []*nostr.Event{b2}},
+		{"e tag", nostr.Filter{Tags: nostr.TagMap{"e": {a2.ID}}}, []*nostr.Event{a3}},
+		{"empty tag", nostr.Filter{Tags: nostr.TagMap{"t": {}}}, nil},
+		{"since", nostr.Filter{Since: ts(200)}, []*nostr.Event{a3, b2}},
+		{"until", nostr.Filter{Until: ts(150)}, []*nostr.Event{a1}},
+		{"since and until", nostr.Filter{Since: ts(150), Until: ts(250), Kinds: []int{1}}, []*nostr.Event{a2}},
+		{"nothing", nostr.Filter{Authors: []string{a1.PubKey}, Until: ts(50)}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, ids(tt.want...), ids(query(t, b, tt.filter)...))
+		})
+	}
+}
+
+func TestQueryEventsLimits(t *testing.T) {
+	b := testBackend(t)
+	b.QueryLimit = 3
+	sk := nostr.GeneratePrivateKey()
+
+	var evts []*nostr.Event
+	for i := 0; i < 5; i++ {
+		evts = append(evts, testEvent(sk, 1, nostr.Timestamp(i), fmt.Sprint(i)))
+	}
+	mustSave(t, b, evts...)
+
+	assert.Len(t, query(t, b, nostr.Filter{}), 3, "default limit")
+	assert.Len(t, query(t, b, nostr.Filter{Limit: 10}), 3, "too large limit")
+
+	tooMany := make([]string, b.QueryIDsLimit+1)
+	for i := range tooMany {
+		tooMany[i] = evts[0].ID
+	}
+	assert.Empty(t, query(t, b, nostr.Filter{IDs: tooMany}))
+	assert.Empty(t, query(t, b, nostr.Filter{Authors: tooMany[:b.QueryAuthorsLimit+1]}))
+	assert.Empty(t, query(t, b, nostr.Filter{Kinds: make([]int, b.QueryKindsLimit+1)}))
+	assert.Empty(t, query(t, b, nostr.Filter{Tags: nostr.TagMap{"e": tooMany[:b.QueryTagsLimit+1]}}))
+
+	_, err := b.QueryEvents(context.Background(), nil)
+	assert.Error(t, err)
+}
+
+func TestCountEvents(t *testing.T) {
+	b := testBackend(t)
+	b.QueryLimit = 2
+	sk := nostr.GeneratePrivateKey()
+	for i := 0; i < 5; i++ {
+		mustSave(t, b, testEvent(sk, 1+i%2, nostr.Timestamp(i), fmt.Sprint(i)))
+	}
+
+	count, err := b.CountEvents(context.Background(), &nostr.Filter{Kinds: []int{1}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), count, "counts aren't limited")
+}
+
+func BenchmarkQueryEvents(b *testing.B) {
+	backend := testBackend(b)
+	keys := make([]string, 10)
+	for i := range keys {
+		keys[i] = nostr.GeneratePrivateKey()
+	}
+	pubkey, _ := nostr.GetPublicKey(keys[0])
+	for i := 0; i < 10000; i++ {
+		mustSave(b, backend, testEvent(keys[i%len(keys)], 1+i%3, nostr.Timestamp(i), fmt.Sprint(i),
+			nostr.Tag{"t", fmt.Sprint("topic", i%50)}))
+	}
+
+	for _, bb := range []struct {
+		name   string
+		filter nostr.Filter
+	}{
+		{"recent", nostr.Filter{}},
+		{"author", nostr.Filter{Authors: []string{pubkey}}},
+		{"author and kind", nostr.Filter{Authors: []string{pubkey}, Kinds: []int{2}}},
+		{"kind", nostr.Filter{Kinds: []int{3}}},
+		{"tag", nostr.Filter{Tags: nostr.TagMap{"t": {"topic7"}}}},
+		{"since", nostr.Filter{Kinds: []int{1}, Since: &[]nostr.Timestamp{9000}[0]}},
+	} {
+		b.Run(strings.ReplaceAll(bb.name, " ", "_"), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ch, err := backend.QueryEvents(context.Background(), &bb.filter)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for range ch {
+				}
+			}
+		})
+	}
+}
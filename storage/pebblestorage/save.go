@@ -0,0 +1,110 @@
+package pebblestorage
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/fiatjaf/relayer/v2/storage"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func (b *PebbleBackend) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	id, err := decodeHex32(evt.ID)
+	if err != nil {
+		return err
+	}
+	pubkey, err := decodeHex32(evt.PubKey)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, closer, err := b.Get(eventKey(id)); err == nil {
+		closer.Close()
+		return storage.ErrDupEvent
+	} else if err != pebble.ErrNotFound {
+		return err
+	}
+
+	batch := b.NewBatch()
+	defer batch.Close()
+
+	replaced, err := b.replacedBy(evt, pubkey)
+	if err != nil {
+		return err
+	}
+	for _, old := range replaced {
+		if err := deleteEvent(batch, old); err != nil {
+			return err
+		}
+	}
+
+	value, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	batch.Set(eventKey(id), value, nil)
+	for _, key := range indexKeys(evt, id, pubkey) {
+		batch.Set(key, nil, nil)
+	}
+
+	return batch.Commit(pebble.Sync)
+}
+
+// replacedBy finds the stored events evt replaces, following the same rules
+// as the other storages, returning storage.ErrOldEvent if one of them
+// supersedes evt instead.
+func (b *PebbleBackend) replacedBy(evt *nostr.Event, pubkey []byte) ([]*nostr.Event, error) {
+	var same func(*nostr.Event) bool
+	versioned := true
+	if evt.Kind == nostr.KindSetMetadata || evt.Kind == nostr.KindContactList || (10000 <= evt.Kind && evt.Kind < 20000) {
+		// past events from this user
+		same = func(*nostr.Event) bool { return true }
+	} else if evt.Kind == nostr.KindRecommendServer {
+		// past recommend_server events equal to this one
+		same = func(old *nostr.Event) bool { return old.Content == evt.Content }
+		versioned = false
+	} else if evt.Kind >= 30000 && evt.Kind < 40000 {
+		// NIP-33
+		d := evt.Tags.GetFirst([]string{"d"})
+		if d == nil {
+			return nil, nil
+		}
+		same = func(old *nostr.Event) bool {
+			oldD := old.Tags.GetFirst([]string{"d"})
+			return oldD != nil && oldD.Value() == d.Value()
+		}
+	} else {
+		return nil, nil
+	}
+
+	var replaced []*nostr.Event
+	newer := false
+	err := b.scan(pubkeyKindPrefix(pubkey, evt.Kind), nil, nil, func(old *nostr.Event) bool {
+		if !same(old) {
+			return true
+		}
+		if versioned && !supersedes(evt, old) {
+			newer = true
+			return false
+		}
+		replaced = append(replaced, old)
+		return true
+	})
+	if err == nil && newer {
+		err = storage.ErrOldEvent
+	}
+	return replaced, err
+}
+
+// supersedes tells whether evt replaces old: it must be newer, or as old with
+// a lower id.
+func supersedes(evt, old *nostr.Event) bool {
+	if evt.CreatedAt != old.CreatedAt {
+		return evt.CreatedAt > old.CreatedAt
+	}
+	return evt.ID < old.ID
+}
@@ -0,0 +1,212 @@
+package pebblestorage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/fiatjaf/relayer/v2/storage"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testBackend(t testing.TB) *PebbleBackend {
+	t.Helper()
+	b := &PebbleBackend{Options: &pebble.Options{FS: vfs.NewMem()}}
+	require.NoError(t, b.Init())
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func testEvent(sk string, kind int, createdAt nostr.Timestamp, content string, tags ...nostr.Tag) *nostr.Event {
+	evt := &nostr.Event{
+		CreatedAt: createdAt,
+		Kind:      kind,
+		Tags:      append(nostr.Tags{}, tags...),
+		Content:   content,
+	}
+	evt.Sign(sk)
+	return evt
+}
+
+func mustSave(t testing.TB, b *PebbleBackend, evts ...*nostr.Event) {
+	t.Helper()
+	for _, evt := range evts {
+		require.NoError(t, b.SaveEvent(context.Background(), evt))
+	}
+}
+
+func query(t testing.TB, b *PebbleBackend, filter nostr.Filter) []*nostr.Event {
+	t.Helper()
+	ch, err := b.QueryEvents(context.Background(), &filter)
+	require.NoError(t, err)
+	var evts []*nostr.Event
+	for evt := range ch {
+		evts = append(evts, evt)
+	}
+	return evts
+}
+
+func ids(evts ...*nostr.Event) []string {
+	ids := make([]string, len(evts))
+	for i, evt := range evts {
+		ids[i] = evt.ID
+	}
+	return ids
+}
+
+// countKeys counts everything stored, events and index entries.
+func countKeys(t testing.TB, b *PebbleBackend) int {
+	t.Helper()
+	iter := b.NewIter(nil)
+	defer iter.Close()
+	n := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		n++
+	}
+	return n
+}
+
+func TestSaveEventDuplicate(t *testing.T) {
+	b := testBackend(t)
+	evt := testEvent(nostr.GeneratePrivateKey(), 1, 100, "hello")
+
+	mustSave(t, b, evt)
+	assert.Equal(t, storage.ErrDupEvent, b.SaveEvent(context.Background(), evt))
+	assert.Equal(t, ids(evt), ids(query(t, b, nostr.Filter{})...))
+}
+
+func TestSaveEventInvalid(t *testing.T) {
+	b := testBackend(t)
+	assert.Error(t, b.SaveEvent(context.Background(), &nostr.Event{ID: "nothex", PubKey: "nothex"}))
+}
+
+func TestSaveEventReplaceable(t *testing.T) {
+	sk, other := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+
+	var tests = []struct {
+		name string
+		// the events in saving order, then which of them are left
+		evts []*nostr.Event
+		left []int
+	}{
+		{
+			name: "metadata",
+			evts: []*nostr.Event{
+				testEvent(sk, 0, 100, `{"name":"a"}`),
+				testEvent(sk, 0, 200, `{"name":"b"}`),
+				testEvent(other, 0, 150, `{"name":"c"}`),
+			},
+			left: []int{1, 2},
+		},
+		{
+			name: "contact list",
+			evts: []*nostr.Event{
+				testEvent(sk, 3, 100, ""),
+				testEvent(sk, 3, 200, ""),
+			},
+			left: []int{1},
+		},
+		{
+			name: "replaceable range",
+			evts: []*nostr.Event{
+				testEvent(sk, 10002, 100, "a"),
+				testEvent(sk, 10003, 100, "b"),
+				testEvent(sk, 10002, 200, "c"),
+			},
+			left: []int{2, 1},
+		},
+		{
+			name: "recommend server",
+			evts: []*nostr.Event{
+				testEvent(sk, 2, 100, "wss://a"),
+				testEvent(sk, 2, 200, "wss://b"),
+				testEvent(sk, 2, 300, "wss://a"),
+			},
+			left: []int{2, 1},
+		},
+		{
+			name: "parameterized",
+			evts: []*nostr.Event{
+				testEvent(sk, 30023, 100, "a", nostr.Tag{"d", "one"}),
+				testEvent(sk, 30023, 200, "b", nostr.Tag{"d", "two"}),
+				testEvent(sk, 30023, 300, "c", nostr.Tag{"d", "one"}),
+				testEvent(sk, 30023, 400, "d"),
+			},
+			left: []int{3, 2, 1},
+		},
+		{
+			name: "regular",
+			evts: []*nostr.Event{
+				testEvent(sk, 1, 100, "a"),
+				testEvent(sk, 1, 200, "a"),
+			},
+			left: []int{1, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testBackend(t)
+			mustSave(t, b, tt.evts...)
+
+			var want []string
+			for _, i := range tt.left {
+				want = append(want, tt.evts[i].ID)
+			}
+			assert.Equal(t, want, ids(query(t, b, nostr.Filter{})...))
+
+			// replaced events leave no index entries behind
+			for _, evt := range tt.evts {
+				for _, filter := range []nostr.Filter{
+					{Authors: []string{evt.PubKey}},
+					{Kinds: []int{evt.Kind}},
+					{Authors: []string{evt.PubKey}, Kinds: []int{evt.Kind}},
+				} {
+					for _, got := range query(t, b, filter) {
+						assert.Contains(t, want, got.ID)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteEvent(t *testing.T) {
+	b := testBackend(t)
+	sk := nostr.GeneratePrivateKey()
+	evt := testEvent(sk, 1, 100, "hello", nostr.Tag{"e", "x"}, nostr.Tag{"t", "nostr"})
+	mustSave(t, b, evt)
+
+	// only its author can delete it
+	require.NoError(t, b.DeleteEvent(context.Background(), evt.ID, testEvent(nostr.GeneratePrivateKey(), 1, 1, "").PubKey))
+	assert.Len(t, query(t, b, nostr.Filter{IDs: []string{evt.ID}}), 1)
+
+	require.NoError(t, b.DeleteEvent(context.Background(), evt.ID, evt.PubKey))
+	assert.Empty(t, query(t, b, nostr.Filter{IDs: []string{evt.ID}}))
+	assert.Equal(t, 0, countKeys(t, b), "event or index entries left behind")
+
+	// deleting what isn't there is fine
+	assert.NoError(t, b.DeleteEvent(context.Background(), evt.ID, evt.PubKey))
+	assert.NoError(t, b.DeleteEvent(context.Background(), "nothex", evt.PubKey))
+}
+
+func BenchmarkSaveEvent(b *testing.B) {
+	backend := testBackend(b)
+	sk := nostr.GeneratePrivateKey()
+	evts := make([]*nostr.Event, b.N)
+	for i := range evts {
+		evts[i] = testEvent(sk, 1, nostr.Timestamp(i), fmt.Sprintf("note %d", i),
+			nostr.Tag{"e", fmt.Sprintf("%064x", i)}, nostr.Tag{"t", "bench"})
+	}
+
+	b.ResetTimer()
+	for _, evt := range evts {
+		if err := backend.SaveEvent(context.Background(), evt); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
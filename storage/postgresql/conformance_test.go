@@ -0,0 +1,18 @@
+package postgresql
+
+import (
+	"testing"
+
+	"github.com/fiatjaf/relayer/v2"
+	"github.com/fiatjaf/relayer/v2/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) relayer.Storage {
+		backend := testBackend(t)
+		if _, err := backend.DB.Exec(`TRUNCATE event`); err != nil {
+			t.Fatalf("TRUNCATE: %v", err)
+		}
+		return backend
+	})
+}
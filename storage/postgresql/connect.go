@@ -0,0 +1,78 @@
+package postgresql
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// driverName is the database/sql driver connect uses.
+var driverName = "postgres"
+
+// connect opens the pool for DatabaseURL with the configured settings and waits
+// for the database to answer, retrying with backoff for up to ConnectTimeout so
+// a database that is restarting doesn't stop the relay from starting.
+func (b *PostgresBackend) connect() (*sqlx.DB, error) {
+	if b.MaxOpenConns == 0 {
+		b.MaxOpenConns = maxOpenConns
+	}
+	if b.MaxIdleConns == 0 {
+		b.MaxIdleConns = maxIdleConns
+	}
+	if b.ConnMaxLifetime == 0 {
+		b.ConnMaxLifetime = connMaxLifetime
+	}
+	if b.ConnectTimeout == 0 {
+		b.ConnectTimeout = connectTimeout
+	}
+
+	dsn := b.DatabaseURL
+	if b.StatementTimeout > 0 {
+		dsn = withParam(dsn, "statement_timeout", fmt.Sprint(b.StatementTimeout.Milliseconds()))
+	}
+	db, err := sqlx.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(b.MaxOpenConns)
+	db.SetMaxIdleConns(b.MaxIdleConns)
+	db.SetConnMaxLifetime(b.ConnMaxLifetime)
+
+	log.Printf("postgresql: max open connections %d, max idle %d, max lifetime %s, statement timeout %s",
+		b.MaxOpenConns, b.MaxIdleConns, b.ConnMaxLifetime, b.StatementTimeout)
+
+	deadline := time.Now().Add(b.ConnectTimeout)
+	for wait := 100 * time.Millisecond; ; wait *= 2 {
+		err = db.Ping()
+		if err == nil {
+			return db, nil
+		}
+		if wait > 5*time.Second {
+			wait = 5 * time.Second
+		}
+		if time.Now().Add(wait).After(deadline) {
+			db.Close()
+			return nil, fmt.Errorf("failed to connect after %s: %w", b.ConnectTimeout, err)
+		}
+		log.Printf("postgresql: database not ready, retrying in %s: %v", wait, err)
+		time.Sleep(wait)
+	}
+}
+
+// withParam sets a connection parameter in dsn, given either as a url or as
+// key=value pairs.
+func withParam(dsn, key, value string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		if u, err := url.Parse(dsn); err == nil {
+			q := u.Query()
+			q.Set(key, value)
+			u.RawQuery = q.Encode()
+			return u.String()
+		}
+	}
+	return strings.TrimSpace(dsn + " " + key + "=" + value)
+}
@@ -0,0 +1,103 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDriver refuses its first fails connections, like a database still starting.
+type fakeDriver struct {
+	mu    sync.Mutex
+	fails int
+	opens int
+}
+
+func (d *fakeDriver) Open(string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.opens++
+	if d.opens <= d.fails {
+		return nil, errors.New("connection refused")
+	}
+	return fakeConn{}, nil
+}
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (fakeConn) Close() error                        { return nil }
+func (fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+// useFakeDriver makes connect open fake connections for the rest of the test.
+func useFakeDriver(t *testing.T, fails int) *fakeDriver {
+	fake := &fakeDriver{fails: fails}
+	sql.Register("fake-"+t.Name(), fake)
+	old := driverName
+	driverName = "fake-" + t.Name()
+	t.Cleanup(func() { driverName = old })
+	return fake
+}
+
+func TestConnectPoolSettings(t *testing.T) {
+	useFakeDriver(t, 0)
+	backend := &PostgresBackend{MaxOpenConns: 3, MaxIdleConns: 1}
+	db, err := backend.connect()
+	require.NoError(t, err)
+	defer db.Close()
+
+	assert.Equal(t, 3, db.Stats().MaxOpenConnections)
+	assert.Equal(t, connMaxLifetime, backend.ConnMaxLifetime)
+
+	ctx := context.Background()
+	var conns []*sql.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := db.Conn(ctx)
+		require.NoError(t, err)
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	// only one of them fits among the idle ones
+	assert.Equal(t, int64(2), db.Stats().MaxIdleClosed)
+}
+
+func TestConnectRetries(t *testing.T) {
+	fake := useFakeDriver(t, 3)
+	backend := &PostgresBackend{ConnectTimeout: 10 * time.Second}
+	db, err := backend.connect()
+	require.NoError(t, err)
+	db.Close()
+	assert.Equal(t, 4, fake.opens)
+}
+
+func TestConnectGivesUp(t *testing.T) {
+	useFakeDriver(t, 1000)
+	backend := &PostgresBackend{ConnectTimeout: 500 * time.Millisecond}
+	start := time.Now()
+	_, err := backend.connect()
+	assert.ErrorContains(t, err, "connection refused")
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestWithParam(t *testing.T) {
+	for _, tt := range []struct {
+		dsn  string
+		want string
+	}{
+		{"postgres://u:p@localhost/db", "postgres://u:p@localhost/db?statement_timeout=30000"},
+		{"postgres://u:p@localhost/db?sslmode=disable", "postgres://u:p@localhost/db?sslmode=disable&statement_timeout=30000"},
+		{"postgresql://localhost/db?statement_timeout=5", "postgresql://localhost/db?statement_timeout=30000"},
+		{"host=localhost dbname=db", "host=localhost dbname=db statement_timeout=30000"},
+	} {
+		assert.Equal(t, tt.want, withParam(tt.dsn, "statement_timeout", "30000"))
+	}
+}
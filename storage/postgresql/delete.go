@@ -1,8 +1,36 @@
 package postgresql
 
-import "context"
+import (
+	"context"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// expiredBatch is how many expired events DeleteExpired removes per statement.
+const expiredBatch = 5000
 
 func (b PostgresBackend) DeleteEvent(ctx context.Context, id string, pubkey string) error {
 	_, err := b.DB.ExecContext(ctx, "DELETE FROM event WHERE id = $1 AND pubkey = $2", id, pubkey)
 	return err
 }
+
+// DeleteExpired removes the events whose expiration is before the given time,
+// expiredBatch at a time, returning how many there were.
+func (b PostgresBackend) DeleteExpired(ctx context.Context, before nostr.Timestamp) (int64, error) {
+	var total int64
+	for {
+		res, err := b.DB.ExecContext(ctx, `DELETE FROM event
+          WHERE id IN (SELECT id FROM event WHERE expires_at < $1 LIMIT $2)`, before, expiredBatch)
+		if err != nil {
+			return total, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < expiredBatch {
+			return total, nil
+		}
+	}
+}
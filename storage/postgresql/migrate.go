@@ -0,0 +1,152 @@
+package postgresql
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migration is one of the files in migrations/, named <version>_<description>.sql.
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// migrationsLock is the advisory lock held while migrating, so that relays
+// starting together don't apply the same migration twice.
+const migrationsLock = 7447
+
+// Migrate brings the schema up to date. Each migration not recorded in
+// schema_migrations yet is applied and recorded in a transaction of its own,
+// then the events stored before are updated to the current layout. It is
+// called by Init, once connected.
+func (b *PostgresBackend) Migrate() error {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if err := b.applyMigration(m); err != nil {
+			return fmt.Errorf("migration %s failed: %w", m.name, err)
+		}
+	}
+	return b.migrateTagPairs(tagPairsBatch)
+}
+
+func (b *PostgresBackend) applyMigration(m migration) error {
+	tx, err := b.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationsLock); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+  version integer PRIMARY KEY,
+  name text NOT NULL,
+  applied_at timestamptz NOT NULL DEFAULT now()
+)`); err != nil {
+		return err
+	}
+
+	var applied bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`,
+		m.version).Scan(&applied); err != nil {
+		return err
+	}
+	if applied {
+		return nil
+	}
+
+	if _, err := tx.Exec(m.sql); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`,
+		m.version, m.name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// loadMigrations reads the migrations in fsys, ordered by version.
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]migration, 0, len(entries))
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("migration %s doesn't start with a version", entry.Name())
+		}
+		data, err := fs.ReadFile(fsys, "migrations/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: version, name: name, sql: string(data)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i-1].version == migrations[i].version {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", migrations[i-1].name, migrations[i].name)
+		}
+	}
+	return migrations, nil
+}
+
+// tagPairsBatch is how many events migrateTagPairs updates at once, which keeps
+// each UPDATE short enough not to hold up writers for long.
+const tagPairsBatch = 5000
+
+// migrateTagPairs fills the tagpairs column of the events stored before
+// migration 002 added it, batch rows at a time, then makes it NOT NULL. That
+// also marks the backfill as done, so later calls return right away.
+func (b *PostgresBackend) migrateTagPairs(batch int) error {
+	var nullable string
+	if err := b.DB.QueryRow(`SELECT is_nullable FROM information_schema.columns
+      WHERE table_schema = current_schema() AND table_name = 'event' AND column_name = 'tagpairs'`,
+	).Scan(&nullable); err != nil {
+		return fmt.Errorf("failed to check the tagpairs column: %w", err)
+	}
+	if nullable != "YES" {
+		return nil
+	}
+
+	// finds the rows left to update without scanning the whole table every batch
+	if _, err := b.DB.Exec(`CREATE INDEX IF NOT EXISTS tagpairspending ON event (id) WHERE tagpairs IS NULL`); err != nil {
+		return fmt.Errorf("failed to index events to migrate: %w", err)
+	}
+
+	for {
+		res, err := b.DB.Exec(`UPDATE event SET tagpairs = tags_to_tagpairs(tags)
+          WHERE id IN (SELECT id FROM event WHERE tagpairs IS NULL LIMIT $1)`, batch)
+		if err != nil {
+			return fmt.Errorf("failed to fill tagpairs: %w", err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			break
+		}
+	}
+
+	if _, err := b.DB.Exec(`ALTER TABLE event ALTER COLUMN tagpairs SET NOT NULL;
+      DROP INDEX IF EXISTS tagpairspending;`); err != nil {
+		return fmt.Errorf("failed to finish the tagpairs migration: %w", err)
+	}
+	return nil
+}
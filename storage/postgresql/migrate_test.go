@@ -0,0 +1,257 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateTagPairs(t *testing.T) {
+	backend := testBackend(t)
+	ctx := context.Background()
+
+	// go back to how a table from before tagpairs looks like
+	_, err := backend.DB.Exec(`TRUNCATE event;
+      ALTER TABLE event ALTER COLUMN tagpairs DROP NOT NULL;`)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := backend.DB.Exec(`INSERT INTO event (id, pubkey, created_at, kind, tags, content, sig)
+          VALUES ($1, 'pk', $2, 1, $3, '', 'sig')`,
+			fmt.Sprintf("%064x", i), i+1, fmt.Sprintf(`[["p", "%d"], ["alt", "x"]]`, i%2))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, backend.migrateTagPairs(2))
+
+	var nullable string
+	require.NoError(t, backend.DB.QueryRow(`SELECT is_nullable FROM information_schema.columns
+      WHERE table_schema = current_schema() AND table_name = 'event' AND column_name = 'tagpairs'`,
+	).Scan(&nullable))
+	assert.Equal(t, "NO", nullable)
+
+	ch, err := backend.QueryEvents(ctx, &nostr.Filter{Tags: nostr.TagMap{"p": []string{"1"}}})
+	require.NoError(t, err)
+	var found []string
+	for evt := range ch {
+		found = append(found, evt.ID)
+	}
+	assert.Equal(t, []string{fmt.Sprintf("%064x", 3), fmt.Sprintf("%064x", 1)}, found)
+
+	// done already, so this is a no-op
+	require.NoError(t, backend.migrateTagPairs(2))
+}
+
+func TestTagQueryUsesIndex(t *testing.T) {
+	backend := testBackend(t)
+	_, err := backend.DB.Exec(`TRUNCATE event`)
+	require.NoError(t, err)
+	require.NoError(t, backend.SaveEvents(context.Background(), taggedEvents(1000)))
+
+	query, params, err := backend.queryEventsSql(&nostr.Filter{
+		Kinds: []int{nostr.KindTextNote},
+		Tags:  nostr.TagMap{"p": []string{taggedPubkey(7)}},
+	}, false)
+	require.NoError(t, err)
+
+	// a table this small is cheaper to scan, so rule that out to see whether the
+	// index can be used at all
+	tx, err := backend.DB.Beginx()
+	require.NoError(t, err)
+	defer tx.Rollback()
+	_, err = tx.Exec(`SET LOCAL enable_seqscan = off`)
+	require.NoError(t, err)
+
+	rows, err := tx.Query("EXPLAIN "+query, params...)
+	require.NoError(t, err)
+	defer rows.Close()
+	var plan []string
+	for rows.Next() {
+		var line string
+		require.NoError(t, rows.Scan(&line))
+		plan = append(plan, line)
+	}
+	require.NoError(t, rows.Err())
+	assert.Contains(t, strings.Join(plan, "\n"), "tagpairsidx")
+}
+
+func TestRelayListQuery(t *testing.T) {
+	backend := testBackend(t)
+	ctx := context.Background()
+	_, err := backend.DB.Exec(`TRUNCATE event`)
+	require.NoError(t, err)
+
+	// 500 authors with plenty of notes each, and a relay list they replaced
+	require.NoError(t, backend.SaveEvents(ctx, taggedEvents(20000)))
+	authors := make([]string, 500)
+	for i := range authors {
+		authors[i] = taggedPubkey(i)
+	}
+	require.NoError(t, backend.SaveEvents(ctx, relayLists(authors, 1680000000, "wss://old.example.com")))
+	require.NoError(t, backend.SaveEvents(ctx, relayLists(authors, 1690000000, "wss://new.example.com")))
+	_, err = backend.DB.Exec(`ANALYZE event`)
+	require.NoError(t, err)
+
+	filter := &nostr.Filter{Kinds: []int{10002}, Authors: authors, Limit: 500}
+	ch, err := backend.QueryEvents(ctx, filter)
+	require.NoError(t, err)
+	seen := make(map[string]bool)
+	for evt := range ch {
+		assert.False(t, seen[evt.PubKey], "two relay lists for %s", evt.PubKey)
+		seen[evt.PubKey] = true
+		assert.Equal(t, "wss://new.example.com", evt.Tags.GetFirst([]string{"r"}).Value())
+	}
+	assert.Len(t, seen, len(authors))
+
+	query, params, err := backend.queryEventsSql(filter, false)
+	require.NoError(t, err)
+	rows, err := backend.DB.Query("EXPLAIN "+query, params...)
+	require.NoError(t, err)
+	defer rows.Close()
+	var plan []string
+	for rows.Next() {
+		var line string
+		require.NoError(t, rows.Scan(&line))
+		plan = append(plan, line)
+	}
+	require.NoError(t, rows.Err())
+	assert.Contains(t, strings.Join(plan, "\n"), "relaylistidx")
+}
+
+// relayLists are NIP-65 relay lists of authors, all pointing at relay.
+func relayLists(authors []string, createdAt nostr.Timestamp, relay string) []nostr.Event {
+	evts := make([]nostr.Event, len(authors))
+	for i, pubkey := range authors {
+		evts[i] = nostr.Event{
+			ID:        fmt.Sprintf("%064x", rand.Int63()),
+			PubKey:    pubkey,
+			CreatedAt: createdAt,
+			Kind:      10002,
+			Tags:      nostr.Tags{nostr.Tag{"r", relay}},
+		}
+	}
+	return evts
+}
+
+// taggedEvents are notes each mentioning one of 100 pubkeys.
+func taggedEvents(n int) []nostr.Event {
+	evts := make([]nostr.Event, n)
+	for i := range evts {
+		evts[i] = nostr.Event{
+			ID:        fmt.Sprintf("%064x", rand.Int63()),
+			PubKey:    taggedPubkey(i % 1000),
+			CreatedAt: nostr.Timestamp(1680000000 + i),
+			Kind:      nostr.KindTextNote,
+			Tags:      nostr.Tags{nostr.Tag{"p", taggedPubkey(i % 100)}, nostr.Tag{"e", fmt.Sprintf("%064x", i)}},
+			Content:   fmt.Sprintf("event %d", i),
+		}
+	}
+	return evts
+}
+
+func taggedPubkey(i int) string {
+	return fmt.Sprintf("%064x", i+1)
+}
+
+func BenchmarkTagQuery100k(b *testing.B) {
+	backend := testBackend(b)
+	ctx := context.Background()
+
+	var count int
+	if err := backend.DB.QueryRow(`SELECT count(*) FROM event`).Scan(&count); err != nil {
+		b.Fatalf("count: %v", err)
+	}
+	if count < 100000 {
+		if _, err := backend.DB.Exec(`TRUNCATE event`); err != nil {
+			b.Fatalf("TRUNCATE: %v", err)
+		}
+		if err := backend.SaveEvents(ctx, taggedEvents(100000)); err != nil {
+			b.Fatalf("SaveEvents: %v", err)
+		}
+		if _, err := backend.DB.Exec(`ANALYZE event`); err != nil {
+			b.Fatalf("ANALYZE: %v", err)
+		}
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ch, err := backend.QueryEvents(ctx, &nostr.Filter{
+			Kinds: []int{nostr.KindTextNote},
+			Tags:  nostr.TagMap{"p": []string{taggedPubkey(n % 100)}},
+			Limit: 50,
+		})
+		if err != nil {
+			b.Fatalf("QueryEvents: %v", err)
+		}
+		for range ch {
+		}
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.version, "migration %s", m.name)
+		assert.NotEmpty(t, strings.TrimSpace(m.sql), "migration %s", m.name)
+	}
+
+	_, err = loadMigrations(fstest.MapFS{
+		"migrations/1_a.sql": {Data: []byte("SELECT 1")},
+		"migrations/1_b.sql": {Data: []byte("SELECT 1")},
+	})
+	assert.ErrorContains(t, err, "same version")
+
+	_, err = loadMigrations(fstest.MapFS{"migrations/first.sql": {Data: []byte("SELECT 1")}})
+	assert.ErrorContains(t, err, "doesn't start with a version")
+
+	migrations, err = loadMigrations(fstest.MapFS{
+		"migrations/10_c.sql": {Data: []byte("SELECT 10")},
+		"migrations/2_b.sql":  {Data: []byte("SELECT 2")},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "2_b", migrations[0].name)
+	assert.Equal(t, "10_c", migrations[1].name)
+}
+
+func TestMigrateFreshSchema(t *testing.T) {
+	setup := testBackend(t)
+	schema := fmt.Sprintf("migrate_test_%d", rand.Int31())
+	_, err := setup.DB.Exec(`CREATE SCHEMA ` + schema)
+	require.NoError(t, err)
+	t.Cleanup(func() { setup.DB.Exec(`DROP SCHEMA ` + schema + ` CASCADE`) })
+
+	backend := &PostgresBackend{DatabaseURL: withParam(setup.DatabaseURL, "search_path", schema)}
+	require.NoError(t, backend.Init())
+	defer backend.DB.Close()
+
+	applied := func() []int {
+		var versions []int
+		require.NoError(t, backend.DB.Select(&versions, `SELECT version FROM schema_migrations ORDER BY version`))
+		return versions
+	}
+	assert.Equal(t, []int{1, 2, 3, 4}, applied())
+
+	ctx := context.Background()
+	evt := taggedEvents(1)[0]
+	require.NoError(t, backend.SaveEvent(ctx, &evt))
+
+	// nothing left to do the second time
+	require.NoError(t, backend.Migrate())
+	assert.Equal(t, []int{1, 2, 3, 4}, applied())
+
+	ch, err := backend.QueryEvents(ctx, &nostr.Filter{Tags: nostr.TagMap{"p": []string{taggedPubkey(0)}}})
+	require.NoError(t, err)
+	n := 0
+	for range ch {
+		n++
+	}
+	assert.Equal(t, 1, n)
+}
@@ -0,0 +1,13 @@
+-- "name:value" for each single-letter tag, which tag filters match against.
+-- existing rows are filled in batches by migrateTagPairs, which then makes
+-- the column NOT NULL
+
+CREATE OR REPLACE FUNCTION tags_to_tagpairs(jsonb) RETURNS text[]
+    AS 'SELECT coalesce(array_agg((t->>0) || '':'' || (t->>1)), ''{}'') FROM (SELECT jsonb_array_elements($1) AS t)s WHERE length(t->>0) = 1 AND t->>1 IS NOT NULL;'
+    LANGUAGE SQL
+    IMMUTABLE
+    RETURNS NULL ON NULL INPUT;
+
+ALTER TABLE event ADD COLUMN IF NOT EXISTS tagpairs text[];
+
+CREATE INDEX IF NOT EXISTS tagpairsidx ON event USING gin (tagpairs);
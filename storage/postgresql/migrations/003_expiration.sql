@@ -0,0 +1,14 @@
+-- the NIP-40 expiration of each event, set by SaveEvent from its first
+-- "expiration" tag, so that expired events can be left out of queries and
+-- deleted by DeleteExpired
+
+ALTER TABLE event ADD COLUMN IF NOT EXISTS expires_at bigint;
+
+UPDATE event SET expires_at = (
+    SELECT CASE WHEN t->>1 ~ '^[+-]?[0-9]{1,18}$' THEN (t->>1)::bigint END
+    FROM jsonb_array_elements(tags) WITH ORDINALITY AS e(t, i)
+    WHERE t->>0 = 'expiration'
+    ORDER BY i LIMIT 1
+) WHERE tags @> '[["expiration"]]' AND expires_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS expiresidx ON event (expires_at) WHERE expires_at IS NOT NULL;
@@ -0,0 +1,5 @@
+-- NIP-65 relay lists are looked up for many authors at once by clients
+-- finding where to read them, which the pubkey index alone makes a scan of
+-- everything those authors ever published
+
+CREATE INDEX IF NOT EXISTS relaylistidx ON event USING btree (pubkey text_pattern_ops) WHERE kind = 10002;
@@ -1,13 +1,28 @@
 package postgresql
 
 import (
+	"time"
+
 	"github.com/jmoiron/sqlx"
 )
 
 type PostgresBackend struct {
 	*sqlx.DB
-	DatabaseURL       string
-	QueryLimit        int
+	DatabaseURL string
+	// MaxOpenConns, MaxIdleConns and ConnMaxLifetime tune the connection pool,
+	// see the sql.DB methods of the same names.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	// StatementTimeout makes postgres cancel statements running for longer,
+	// zero means they can run for as long as they need.
+	StatementTimeout time.Duration
+	// ConnectTimeout is how long Init keeps retrying to reach the database.
+	ConnectTimeout time.Duration
+	// QueryLimit is the most events a single filter gets, however high its limit.
+	QueryLimit int
+	// QueryDefaultLimit is what filters without a limit get.
+	QueryDefaultLimit int
 	QueryIDsLimit     int
 	QueryAuthorsLimit int
 	QueryKindsLimit   int
@@ -5,6 +5,8 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"fmt"
+	"log"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -13,40 +15,174 @@ import (
 )
 
 func (b PostgresBackend) QueryEvents(ctx context.Context, filter *nostr.Filter) (ch chan *nostr.Event, err error) {
-	ch = make(chan *nostr.Event)
+	if filter == nil {
+		return nil, fmt.Errorf("filter cannot be null")
+	}
 
-	query, params, err := b.queryEventsSql(filter, false)
+	// the first query runs right away so its errors are returned
+	rows, err := b.openRows(ctx, filter)
 	if err != nil {
 		return nil, err
 	}
 
-	rows, err := b.DB.Query(query, params...)
-	if err != nil && err != sql.ErrNoRows {
-		return nil, fmt.Errorf("failed to fetch events using query %q: %w", query, err)
-	}
-
+	ch = make(chan *nostr.Event)
 	go func() {
-		defer rows.Close()
 		defer close(ch)
-		for rows.Next() {
-			var evt nostr.Event
-			var timestamp int64
-			err := rows.Scan(&evt.ID, &evt.PubKey, &timestamp,
-				&evt.Kind, &evt.Tags, &evt.Content, &evt.Sig)
-			if err != nil {
-				return
+		fetch := func(f *nostr.Filter, yield func(*nostr.Event) bool) error {
+			if f != filter {
+				var err error
+				if rows, err = b.openRows(ctx, f); err != nil {
+					return err
+				}
+			}
+			return scanRows(rows, yield)
+		}
+		err := b.queryPage(filter, fetch, func(evt *nostr.Event) bool {
+			select {
+			case ch <- evt:
+				return true
+			case <-ctx.Done():
+				return false
 			}
-			evt.CreatedAt = nostr.Timestamp(timestamp)
-			ch <- &evt
+		})
+		if err != nil && ctx.Err() == nil {
+			log.Printf("postgresql: failed to query events: %v", err)
 		}
 	}()
 
 	return ch, nil
 }
 
+// queryLimit is how many events filter gets: its own limit, QueryDefaultLimit
+// when it has none, and never more than QueryLimit.
+func (b PostgresBackend) queryLimit(filter *nostr.Filter) int {
+	switch {
+	case filter.Limit < 1:
+		if b.QueryDefaultLimit > 0 && b.QueryDefaultLimit < b.QueryLimit {
+			return b.QueryDefaultLimit
+		}
+		return b.QueryLimit
+	case filter.Limit > b.QueryLimit:
+		return b.QueryLimit
+	default:
+		return filter.Limit
+	}
+}
+
+// fetchFunc runs the query for filter, passing each event to yield until it
+// returns false.
+type fetchFunc func(filter *nostr.Filter, yield func(*nostr.Event) bool) error
+
+// queryPage passes the events matching filter to yield, newest first with ties
+// broken by descending id, as fetched by fetch with one extra event. Pages that
+// would end in the middle of a second leave that second out, so the created_at
+// of their last event, sent as the until of the next filter, resumes right after
+// them without skipping or repeating anything. Seconds holding more events than
+// the limit are returned whole, up to QueryLimit.
+//
+// Events are passed on as they are fetched, except for those of the latest
+// second, which are held until the next second shows up.
+func (b PostgresBackend) queryPage(filter *nostr.Filter, fetch fetchFunc, yield func(*nostr.Event) bool) error {
+	limit := b.queryLimit(filter)
+
+	var held []*nostr.Event
+	sent, fetched, stopped := 0, 0, false
+	flush := func() bool {
+		for _, evt := range held {
+			if !yield(evt) {
+				return false
+			}
+			sent++
+		}
+		held = held[:0]
+		return true
+	}
+
+	err := fetch(filter, func(evt *nostr.Event) bool {
+		fetched++
+		if len(held) > 0 && held[0].CreatedAt != evt.CreatedAt && !flush() {
+			stopped = true
+			return false
+		}
+		held = append(held, evt)
+		return true
+	})
+	switch {
+	case err != nil || stopped:
+		return err
+	case fetched <= limit:
+		flush()
+		return nil
+	case sent > 0:
+		// the held second goes past the limit, it's left for the next page
+		return nil
+	case limit >= b.QueryLimit:
+		// the second has more events than can be returned, the rest of it is lost
+		held = held[:limit]
+		flush()
+		return nil
+	}
+
+	second := *filter
+	since, until := held[0].CreatedAt-1, held[0].CreatedAt+1
+	second.Since, second.Until, second.Limit = &since, &until, b.QueryLimit
+	n := 0
+	return fetch(&second, func(evt *nostr.Event) bool {
+		if n == b.QueryLimit {
+			return false
+		}
+		n++
+		return yield(evt)
+	})
+}
+
+// openRows starts the query for filter. Its rows are nil when the filter can't
+// match anything.
+func (b PostgresBackend) openRows(ctx context.Context, filter *nostr.Filter) (*sql.Rows, error) {
+	query, params, err := b.queryEventsSql(filter, false)
+	if err != nil || query == "" {
+		return nil, err
+	}
+
+	rows, err := b.DB.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch events using query %q: %w", query, err)
+	}
+	return rows, nil
+}
+
+// scanRows passes the events in rows to yield until it returns false, then
+// closes them.
+func scanRows(rows *sql.Rows, yield func(*nostr.Event) bool) error {
+	if rows == nil {
+		return nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var evt nostr.Event
+		var timestamp int64
+		err := rows.Scan(&evt.ID, &evt.PubKey, &timestamp,
+			&evt.Kind, &evt.Tags, &evt.Content, &evt.Sig)
+		if err != nil {
+			return err
+		}
+		evt.CreatedAt = nostr.Timestamp(timestamp)
+		if !yield(&evt) {
+			return nil
+		}
+	}
+	return rows.Err()
+}
+
+// MaxLimit is QueryLimit, advertised as max_limit in NIP-11.
+func (b *PostgresBackend) MaxLimit() int {
+	return b.QueryLimit
+}
+
 func (b PostgresBackend) CountEvents(ctx context.Context, filter *nostr.Filter) (int64, error) {
 	query, params, err := b.queryEventsSql(filter, true)
-	if err != nil {
+	if err != nil || query == "" {
 		return 0, err
 	}
 
@@ -57,6 +193,9 @@ func (b PostgresBackend) CountEvents(ctx context.Context, filter *nostr.Filter)
 	return count, nil
 }
 
+// notExpired is the condition leaving out the events past their expiration.
+const notExpired = "(expires_at IS NULL OR expires_at > extract(epoch FROM now()))"
+
 func (b PostgresBackend) queryEventsSql(filter *nostr.Filter, doCount bool) (string, []any, error) {
 	var conditions []string
 	var params []any
@@ -129,33 +268,35 @@ func (b PostgresBackend) queryEventsSql(filter *nostr.Filter, doCount bool) (str
 		conditions = append(conditions, `kind IN (`+strings.Join(inkinds, ",")+`)`)
 	}
 
-	tagQuery := make([]string, 0, 1)
-	for _, values := range filter.Tags {
+	// each tag name is its own condition, matched against the "name:value"
+	// pairs in the gin-indexed tagpairs column
+	names := make([]string, 0, len(filter.Tags))
+	for name := range filter.Tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ntags := 0
+	for _, name := range names {
+		values := filter.Tags[name]
 		if len(values) == 0 {
 			// any tag set to [] is wrong
 			return "", nil, nil
 		}
 
-		// add these tags to the query
-		tagQuery = append(tagQuery, values...)
-
-		if len(tagQuery) > b.QueryTagsLimit {
+		ntags += len(values)
+		if ntags > b.QueryTagsLimit {
 			// too many tags, fail everything
 			return "", nil, nil
 		}
-	}
 
-	if len(tagQuery) > 0 {
-		arrayBuild := make([]string, len(tagQuery))
-		for i, tagValue := range tagQuery {
+		arrayBuild := make([]string, len(values))
+		for i, value := range values {
 			arrayBuild[i] = "?"
-			params = append(params, tagValue)
+			params = append(params, name+":"+value)
 		}
-
-		// we use a very bad implementation in which we only check the tag values and
-		// ignore the tag names
 		conditions = append(conditions,
-			"tagvalues && ARRAY["+strings.Join(arrayBuild, ",")+"]")
+			"tagpairs && ARRAY["+strings.Join(arrayBuild, ",")+"]")
 	}
 
 	if filter.Since != nil {
@@ -167,30 +308,24 @@ func (b PostgresBackend) queryEventsSql(filter *nostr.Filter, doCount bool) (str
 		params = append(params, filter.Until)
 	}
 
-	if len(conditions) == 0 {
-		// fallback
-		conditions = append(conditions, "true")
-	}
-
-	if filter.Limit < 1 || filter.Limit > b.QueryLimit {
-		params = append(params, b.QueryLimit)
-	} else {
-		params = append(params, filter.Limit)
-	}
+	// NIP-40, expired events stay until DeleteExpired gets to them
+	conditions = append(conditions, notExpired)
 
 	var query string
 	if doCount {
 		query = sqlx.Rebind(sqlx.BindType("postgres"), `SELECT
           COUNT(*)
         FROM event WHERE `+
-			strings.Join(conditions, " AND ")+
-			" ORDER BY created_at DESC LIMIT ?")
+			strings.Join(conditions, " AND "))
 	} else {
+		// one more than the limit tells queryPage whether the page ends in the
+		// middle of a second
+		params = append(params, b.queryLimit(filter)+1)
 		query = sqlx.Rebind(sqlx.BindType("postgres"), `SELECT
           id, pubkey, created_at, kind, tags, content, sig
         FROM event WHERE `+
 			strings.Join(conditions, " AND ")+
-			" ORDER BY created_at DESC LIMIT ?")
+			" ORDER BY created_at DESC, id DESC LIMIT ?")
 	}
 
 	return query, params, nil
@@ -1,17 +1,22 @@
 package postgresql
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
 
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var defaultBackend = PostgresBackend{
 	QueryLimit:        queryLimit,
+	QueryDefaultLimit: queryDefaultLimit,
 	QueryIDsLimit:     queryIDsLimit,
 	QueryAuthorsLimit: queryAuthorsLimit,
 	QueryKindsLimit:   queryKindsLimit,
@@ -31,8 +36,8 @@ func TestQueryEventsSql(t *testing.T) {
 			name:    "empty filter",
 			backend: defaultBackend,
 			filter:  &nostr.Filter{},
-			query:   "SELECT id, pubkey, created_at, kind, tags, content, sig FROM event WHERE true ORDER BY created_at DESC LIMIT $1",
-			params:  []any{100},
+			query:   "SELECT id, pubkey, created_at, kind, tags, content, sig FROM event WHERE (expires_at IS NULL OR expires_at > extract(epoch FROM now())) ORDER BY created_at DESC, id DESC LIMIT $1",
+			params:  []any{101},
 			err:     nil,
 		},
 		{
@@ -41,8 +46,8 @@ func TestQueryEventsSql(t *testing.T) {
 			filter: &nostr.Filter{
 				Limit: 50,
 			},
-			query:  "SELECT id, pubkey, created_at, kind, tags, content, sig FROM event WHERE true ORDER BY created_at DESC LIMIT $1",
-			params: []any{50},
+			query:  "SELECT id, pubkey, created_at, kind, tags, content, sig FROM event WHERE (expires_at IS NULL OR expires_at > extract(epoch FROM now())) ORDER BY created_at DESC, id DESC LIMIT $1",
+			params: []any{51},
 			err:    nil,
 		},
 		{
@@ -51,8 +56,8 @@ func TestQueryEventsSql(t *testing.T) {
 			filter: &nostr.Filter{
 				Limit: 2000,
 			},
-			query:  "SELECT id, pubkey, created_at, kind, tags, content, sig FROM event WHERE true ORDER BY created_at DESC LIMIT $1",
-			params: []any{100},
+			query:  "SELECT id, pubkey, created_at, kind, tags, content, sig FROM event WHERE (expires_at IS NULL OR expires_at > extract(epoch FROM now())) ORDER BY created_at DESC, id DESC LIMIT $1",
+			params: []any{501},
 			err:    nil,
 		},
 		{
@@ -63,9 +68,9 @@ func TestQueryEventsSql(t *testing.T) {
 			},
 			query: `SELECT id, pubkey, created_at, kind, tags, content, sig 
 			FROM event 
-			WHERE (id LIKE '083ec57f36a7b39ab98a57bedab4f85355b2ee89e4b205bed58d7c3ef9edd294%') 
-			ORDER BY created_at DESC LIMIT $1`,
-			params: []any{100},
+			WHERE (id LIKE '083ec57f36a7b39ab98a57bedab4f85355b2ee89e4b205bed58d7c3ef9edd294%') AND (expires_at IS NULL OR expires_at > extract(epoch FROM now()))
+			ORDER BY created_at DESC, id DESC LIMIT $1`,
+			params: []any{101},
 			err:    nil,
 		},
 		{
@@ -76,9 +81,9 @@ func TestQueryEventsSql(t *testing.T) {
 			},
 			query: `SELECT id, pubkey, created_at, kind, tags, content, sig 
 			FROM event 
-			WHERE kind IN(1,2,3) 
-			ORDER BY created_at DESC LIMIT $1`,
-			params: []any{100},
+			WHERE kind IN(1,2,3) AND (expires_at IS NULL OR expires_at > extract(epoch FROM now()))
+			ORDER BY created_at DESC, id DESC LIMIT $1`,
+			params: []any{101},
 			err:    nil,
 		},
 		{
@@ -89,9 +94,26 @@ func TestQueryEventsSql(t *testing.T) {
 			},
 			query: `SELECT id, pubkey, created_at, kind, tags, content, sig 
 			FROM event 
-			WHERE (pubkey LIKE '7bdef7bdebb8721f77927d0e77c66059360fa62371fdf15f3add93923a613229%') 
-			ORDER BY created_at DESC LIMIT $1`,
-			params: []any{100},
+			WHERE (pubkey LIKE '7bdef7bdebb8721f77927d0e77c66059360fa62371fdf15f3add93923a613229%') AND (expires_at IS NULL OR expires_at > extract(epoch FROM now()))
+			ORDER BY created_at DESC, id DESC LIMIT $1`,
+			params: []any{101},
+			err:    nil,
+		},
+		{
+			name:    "tags filter",
+			backend: defaultBackend,
+			filter: &nostr.Filter{
+				Kinds: []int{1},
+				Tags: nostr.TagMap{
+					"p": []string{"a", "b"},
+					"e": []string{"c"},
+				},
+			},
+			query: `SELECT id, pubkey, created_at, kind, tags, content, sig
+			FROM event
+			WHERE kind IN(1) AND tagpairs && ARRAY[$1] AND tagpairs && ARRAY[$2,$3] AND (expires_at IS NULL OR expires_at > extract(epoch FROM now()))
+			ORDER BY created_at DESC, id DESC LIMIT $4`,
+			params: []any{"e:c", "p:a", "p:b", 101},
 			err:    nil,
 		},
 		// errors
@@ -244,8 +266,8 @@ func TestCountEventsSql(t *testing.T) {
 			name:    "empty filter",
 			backend: defaultBackend,
 			filter:  &nostr.Filter{},
-			query:   "SELECT COUNT(*) FROM event WHERE true ORDER BY created_at DESC LIMIT $1",
-			params:  []any{100},
+			query:   "SELECT COUNT(*) FROM event WHERE (expires_at IS NULL OR expires_at > extract(epoch FROM now()))",
+			params:  nil,
 			err:     nil,
 		},
 		{
@@ -256,9 +278,8 @@ func TestCountEventsSql(t *testing.T) {
 			},
 			query: `SELECT COUNT(*)
 			FROM event 
-			WHERE (id LIKE '083ec57f36a7b39ab98a57bedab4f85355b2ee89e4b205bed58d7c3ef9edd294%') 
-			ORDER BY created_at DESC LIMIT $1`,
-			params: []any{100},
+			WHERE (id LIKE '083ec57f36a7b39ab98a57bedab4f85355b2ee89e4b205bed58d7c3ef9edd294%') AND (expires_at IS NULL OR expires_at > extract(epoch FROM now()))`,
+			params: nil,
 			err:    nil,
 		},
 		{
@@ -269,9 +290,8 @@ func TestCountEventsSql(t *testing.T) {
 			},
 			query: `SELECT COUNT(*)
 			FROM event 
-			WHERE kind IN(1,2,3) 
-			ORDER BY created_at DESC LIMIT $1`,
-			params: []any{100},
+			WHERE kind IN(1,2,3) AND (expires_at IS NULL OR expires_at > extract(epoch FROM now()))`,
+			params: nil,
 			err:    nil,
 		},
 		{
@@ -282,9 +302,8 @@ func TestCountEventsSql(t *testing.T) {
 			},
 			query: `SELECT COUNT(*)
 			FROM event 
-			WHERE (pubkey LIKE '7bdef7bdebb8721f77927d0e77c66059360fa62371fdf15f3add93923a613229%') 
-			ORDER BY created_at DESC LIMIT $1`,
-			params: []any{100},
+			WHERE (pubkey LIKE '7bdef7bdebb8721f77927d0e77c66059360fa62371fdf15f3add93923a613229%') AND (expires_at IS NULL OR expires_at > extract(epoch FROM now()))`,
+			params: nil,
 			err:    nil,
 		},
 		// errors
@@ -403,3 +422,154 @@ func TestCountEventsSql(t *testing.T) {
 		})
 	}
 }
+
+// collidingEvents are n events spread over few seconds, up to 5 in each.
+func collidingEvents(n int) []*nostr.Event {
+	sizes := []int{1, 4, 2, 5, 1, 3, 3, 5}
+	evts := make([]*nostr.Event, 0, n)
+	ts := nostr.Timestamp(1680000000)
+	for i := 0; len(evts) < n; i++ {
+		for j := 0; j < sizes[i%len(sizes)] && len(evts) < n; j++ {
+			evts = append(evts, &nostr.Event{
+				ID:        fmt.Sprintf("%064x", rand.Int63()),
+				PubKey:    "pk",
+				CreatedAt: ts,
+				Kind:      nostr.KindTextNote,
+				Tags:      nostr.Tags{},
+				Content:   fmt.Sprintf("event %d", len(evts)),
+				Sig:       "sig",
+			})
+		}
+		ts -= nostr.Timestamp(1 + i%2)
+	}
+	sortEvents(evts)
+	return evts
+}
+
+// sortEvents orders evts the way queryEventsSql does.
+func sortEvents(evts []*nostr.Event) {
+	sort.Slice(evts, func(i, j int) bool {
+		if evts[i].CreatedAt != evts[j].CreatedAt {
+			return evts[i].CreatedAt > evts[j].CreatedAt
+		}
+		return evts[i].ID > evts[j].ID
+	})
+}
+
+// paginate walks back through everything query returns, limit events at a time,
+// using the created_at of the last event of each page as the next until.
+func paginate(t *testing.T, limit int, query func(*nostr.Filter) []*nostr.Event) []*nostr.Event {
+	var all []*nostr.Event
+	filter := &nostr.Filter{Limit: limit}
+	for pages := 0; ; pages++ {
+		if pages > 1000 {
+			t.Fatalf("still paging after %d events", len(all))
+		}
+		page := query(filter)
+		if len(page) == 0 {
+			return all
+		}
+		all = append(all, page...)
+		until := page[len(page)-1].CreatedAt
+		filter = &nostr.Filter{Limit: limit, Until: &until}
+	}
+}
+
+// memoryFetch stands in for the database holding stored, counting the events
+// it reads.
+func memoryFetch(backend PostgresBackend, stored []*nostr.Event, read *int) fetchFunc {
+	return func(filter *nostr.Filter, yield func(*nostr.Event) bool) error {
+		n := 0
+		for _, evt := range stored {
+			if n > backend.queryLimit(filter) {
+				break
+			}
+			if (filter.Since == nil || evt.CreatedAt > *filter.Since) &&
+				(filter.Until == nil || evt.CreatedAt < *filter.Until) {
+				n++
+				*read++
+				if !yield(evt) {
+					break
+				}
+			}
+		}
+		return nil
+	}
+}
+
+func TestQueryPage(t *testing.T) {
+	stored := collidingEvents(60)
+	backend := defaultBackend
+	backend.QueryLimit = 6
+	var read int
+	fetch := memoryFetch(backend, stored, &read)
+
+	// limits under 5 get the seconds bigger than them whole
+	for _, limit := range []int{1, 3, 5, 6} {
+		t.Run(fmt.Sprintf("limit %d", limit), func(t *testing.T) {
+			all := paginate(t, limit, func(filter *nostr.Filter) []*nostr.Event {
+				var page []*nostr.Event
+				err := backend.queryPage(filter, fetch, func(evt *nostr.Event) bool {
+					page = append(page, evt)
+					return true
+				})
+				require.NoError(t, err)
+				if len(page) > backend.QueryLimit {
+					t.Errorf("page of %d events, over the maximum", len(page))
+				}
+				return page
+			})
+			assert.Equal(t, stored, all)
+		})
+	}
+}
+
+func TestQueryPageStopsReading(t *testing.T) {
+	// one event per second, so each is passed on as soon as the next is read
+	stored := collidingEvents(100)
+	for i, evt := range stored {
+		evt.CreatedAt = nostr.Timestamp(1680000000 - i)
+	}
+	var read int
+	fetch := memoryFetch(defaultBackend, stored, &read)
+
+	var got []*nostr.Event
+	err := defaultBackend.queryPage(&nostr.Filter{}, fetch, func(evt *nostr.Event) bool {
+		got = append(got, evt)
+		return len(got) < 2
+	})
+	require.NoError(t, err)
+	assert.Equal(t, stored[:2], got)
+	assert.Equal(t, 3, read)
+}
+
+func TestQueryEventsPagination(t *testing.T) {
+	backend := testBackend(t)
+	ctx := context.Background()
+	_, err := backend.DB.Exec(`TRUNCATE event`)
+	require.NoError(t, err)
+
+	stored := collidingEvents(200)
+	for _, evt := range stored {
+		require.NoError(t, backend.SaveEvent(ctx, evt))
+	}
+
+	all := paginate(t, 5, func(filter *nostr.Filter) []*nostr.Event {
+		ch, err := backend.QueryEvents(ctx, filter)
+		require.NoError(t, err)
+		var page []*nostr.Event
+		for evt := range ch {
+			page = append(page, evt)
+		}
+		return page
+	})
+
+	ids := func(evts []*nostr.Event) []string {
+		ids := make([]string, len(evts))
+		for i, evt := range evts {
+			ids[i] = evt.ID
+		}
+		return ids
+	}
+	assert.Equal(t, ids(stored), ids(all))
+}
@@ -2,20 +2,28 @@ package postgresql
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"fmt"
+	"strings"
 
+	"github.com/fiatjaf/relayer/v2"
 	"github.com/fiatjaf/relayer/v2/storage"
 	"github.com/nbd-wtf/go-nostr"
 )
 
 func (b *PostgresBackend) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	if isReplaceable(evt.Kind) || isAddressable(evt.Kind) {
+		return b.saveReplaceable(ctx, evt)
+	}
+
 	deleteQuery, deleteParams, shouldDelete := deleteBeforeSaveSql(evt)
 	if shouldDelete {
 		_, _ = b.DB.ExecContext(ctx, deleteQuery, deleteParams...)
 	}
 
-	sql, params, _ := saveEventSql(evt)
-	res, err := b.DB.ExecContext(ctx, sql, params...)
+	query, params, _ := saveEventSql(evt)
+	res, err := b.DB.ExecContext(ctx, query, params...)
 	if err != nil {
 		return err
 	}
@@ -32,6 +40,39 @@ func (b *PostgresBackend) SaveEvent(ctx context.Context, evt *nostr.Event) error
 	return nil
 }
 
+// saveEventsChunk bounds the rows of a single multi-row INSERT, keeping it well
+// under postgres' limit of 65535 parameters.
+const saveEventsChunk = 1000
+
+// SaveEvents stores evts using multi-row INSERTs, skipping the ones already stored.
+// Events that replace older ones go through SaveEvent, so they're applied in order.
+func (b *PostgresBackend) SaveEvents(ctx context.Context, evts []nostr.Event) error {
+	plain := make([]nostr.Event, 0, len(evts))
+	for i := range evts {
+		if _, _, shouldDelete := deleteBeforeSaveSql(&evts[i]); !shouldDelete && !isReplaceable(evts[i].Kind) && !isAddressable(evts[i].Kind) {
+			plain = append(plain, evts[i])
+			continue
+		}
+		err := b.SaveEvent(ctx, &evts[i])
+		if err != nil && err != storage.ErrDupEvent && err != storage.ErrOldEvent {
+			return err
+		}
+	}
+
+	for start := 0; start < len(plain); start += saveEventsChunk {
+		end := start + saveEventsChunk
+		if end > len(plain) {
+			end = len(plain)
+		}
+		sql, params := saveEventsSql(plain[start:end])
+		if _, err := b.DB.ExecContext(ctx, sql, params...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (b *PostgresBackend) BeforeSave(ctx context.Context, evt *nostr.Event) {
 	// do nothing
 }
@@ -44,31 +85,102 @@ func (b *PostgresBackend) AfterSave(evt *nostr.Event) {
     )`, evt.PubKey, evt.Kind)
 }
 
+// isReplaceable tells whether only the latest event of kind is kept for each pubkey.
+func isReplaceable(kind int) bool {
+	return kind == nostr.KindSetMetadata || kind == nostr.KindContactList || (10000 <= kind && kind < 20000)
+}
+
+// isAddressable tells whether only the latest event of kind is kept for each
+// pubkey and d tag, as of NIP-33.
+func isAddressable(kind int) bool {
+	return 30000 <= kind && kind < 40000
+}
+
+// addressSql is the condition matching the stored versions of evt, the ones
+// with its pubkey, kind and, if it is addressable, d tag. A missing d tag is
+// the same as an empty one.
+func addressSql(evt *nostr.Event) (string, []any) {
+	if !isAddressable(evt.Kind) {
+		return `pubkey = $1 AND kind = $2`, []any{evt.PubKey, evt.Kind}
+	}
+
+	d := ""
+	if tag := evt.Tags.GetFirst([]string{"d"}); tag != nil {
+		d = tag.Value()
+	}
+	if d == "" {
+		return `pubkey = $1 AND kind = $2 AND (tagpairs && ARRAY[$3]
+      OR NOT EXISTS (SELECT 1 FROM unnest(tagpairs) p WHERE left(p, 2) = 'd:'))`, []any{evt.PubKey, evt.Kind, "d:"}
+	}
+	return `pubkey = $1 AND kind = $2 AND tagpairs && ARRAY[$3]`, []any{evt.PubKey, evt.Kind, "d:" + d}
+}
+
+// supersedes tells whether evt replaces a stored event created at createdAt
+// with the given id: it must be newer, or as old with a lower id.
+func supersedes(evt *nostr.Event, createdAt nostr.Timestamp, id string) bool {
+	if evt.CreatedAt != createdAt {
+		return evt.CreatedAt > createdAt
+	}
+	return evt.ID < id
+}
+
+// saveReplaceable stores evt, a replaceable or addressable event, in place of
+// the versions of it already stored, all in one transaction,
+// returning storage.ErrOldEvent if one of them supersedes it instead.
+func (b *PostgresBackend) saveReplaceable(ctx context.Context, evt *nostr.Event) error {
+	tx, err := b.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// saves of the same pubkey and kind wait for each other, even when there's
+	// no row yet to lock
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1), $2)`,
+		evt.PubKey, evt.Kind); err != nil {
+		return err
+	}
+
+	var (
+		id        string
+		createdAt nostr.Timestamp
+	)
+	address, params := addressSql(evt)
+	err = tx.QueryRowContext(ctx, `SELECT id, created_at FROM event WHERE `+address+`
+      ORDER BY created_at DESC, id ASC LIMIT 1`, params...).Scan(&id, &createdAt)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return err
+	case id == evt.ID:
+		return storage.ErrDupEvent
+	case !supersedes(evt, createdAt, id):
+		return storage.ErrOldEvent
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM event WHERE `+address, params...); err != nil {
+		return err
+	}
+	query, params, _ := saveEventSql(evt)
+	if _, err := tx.ExecContext(ctx, query, params...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func deleteBeforeSaveSql(evt *nostr.Event) (string, []any, bool) {
-	// react to different kinds of events
+	// react to different kinds of events, replaceable and addressable ones
+	// are left to saveReplaceable
 	var (
 		query        = ""
 		params       []any
 		shouldDelete bool
 	)
-	if evt.Kind == nostr.KindSetMetadata || evt.Kind == nostr.KindContactList || (10000 <= evt.Kind && evt.Kind < 20000) {
-		// delete past events from this user
-		query = `DELETE FROM event WHERE pubkey = $1 AND kind = $2`
-		params = []any{evt.PubKey, evt.Kind}
-		shouldDelete = true
-	} else if evt.Kind == nostr.KindRecommendServer {
+	if evt.Kind == nostr.KindRecommendServer {
 		// delete past recommend_server events equal to this one
 		query = `DELETE FROM event WHERE pubkey = $1 AND kind = $2 AND content = $3`
 		params = []any{evt.PubKey, evt.Kind, evt.Content}
 		shouldDelete = true
-	} else if evt.Kind >= 30000 && evt.Kind < 40000 {
-		// NIP-33
-		d := evt.Tags.GetFirst([]string{"d"})
-		if d != nil {
-			query = `DELETE FROM event WHERE pubkey = $1 AND kind = $2 AND tagvalues && ARRAY[$3]`
-			params = []any{evt.PubKey, evt.Kind, d.Value()}
-			shouldDelete = true
-		}
 	}
 
 	return query, params, shouldDelete
@@ -76,14 +188,44 @@ func deleteBeforeSaveSql(evt *nostr.Event) (string, []any, bool) {
 
 func saveEventSql(evt *nostr.Event) (string, []any, error) {
 	const query = `INSERT INTO event (
-	id, pubkey, created_at, kind, tags, content, sig)
-	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	id, pubkey, created_at, kind, tags, content, sig, tagpairs, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, tags_to_tagpairs($5), $8)
 	ON CONFLICT (id) DO NOTHING`
 
 	var (
 		tagsj, _ = json.Marshal(evt.Tags)
-		params   = []any{evt.ID, evt.PubKey, evt.CreatedAt, evt.Kind, tagsj, evt.Content, evt.Sig}
+		params   = []any{evt.ID, evt.PubKey, evt.CreatedAt, evt.Kind, tagsj, evt.Content, evt.Sig, expiresAt(evt)}
 	)
 
 	return query, params, nil
 }
+
+func saveEventsSql(evts []nostr.Event) (string, []any) {
+	var (
+		values = make([]string, 0, len(evts))
+		params = make([]any, 0, len(evts)*8)
+	)
+	for i := range evts {
+		evt := &evts[i]
+		n := len(params)
+		values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d, tags_to_tagpairs($%d), $%d)", n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+5, n+8))
+		tagsj, _ := json.Marshal(evt.Tags)
+		params = append(params, evt.ID, evt.PubKey, evt.CreatedAt, evt.Kind, tagsj, evt.Content, evt.Sig, expiresAt(evt))
+	}
+
+	query := `INSERT INTO event (
+	id, pubkey, created_at, kind, tags, content, sig, tagpairs, expires_at)
+	VALUES ` + strings.Join(values, ", ") + `
+	ON CONFLICT (id) DO NOTHING`
+
+	return query, params
+}
+
+// expiresAt is the value of the expires_at column for evt, NULL when it
+// doesn't expire.
+func expiresAt(evt *nostr.Event) any {
+	if ts, ok := relayer.Expiration(evt); ok {
+		return ts
+	}
+	return nil
+}
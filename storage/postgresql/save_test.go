@@ -1,10 +1,19 @@
 package postgresql
 
 import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/fiatjaf/relayer/v2/storage"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDeleteBeforeSave(t *testing.T) {
@@ -15,15 +24,16 @@ func TestDeleteBeforeSave(t *testing.T) {
 		params       []any
 		shouldDelete bool
 	}{
+		// replaceable and addressable events are left to saveReplaceable
 		{
 			name: "set metadata",
 			event: &nostr.Event{
 				Kind:   nostr.KindSetMetadata,
 				PubKey: "pk",
 			},
-			query:        "DELETE FROM event WHERE pubkey = $1 AND kind = $2",
-			params:       []any{"pk", nostr.KindSetMetadata},
-			shouldDelete: true,
+			query:        "",
+			params:       nil,
+			shouldDelete: false,
 		},
 		{
 			name: "contact list",
@@ -31,9 +41,9 @@ func TestDeleteBeforeSave(t *testing.T) {
 				Kind:   nostr.KindContactList,
 				PubKey: "pk",
 			},
-			query:        "DELETE FROM event WHERE pubkey = $1 AND kind = $2",
-			params:       []any{"pk", nostr.KindContactList},
-			shouldDelete: true,
+			query:        "",
+			params:       nil,
+			shouldDelete: false,
 		},
 		{
 			name: "recommend server",
@@ -53,9 +63,9 @@ func TestDeleteBeforeSave(t *testing.T) {
 				PubKey: "pk",
 				Tags:   nostr.Tags{nostr.Tag{"d", "value"}},
 			},
-			query:        "DELETE FROM event WHERE pubkey = $1 AND kind = $2 AND tagvalues && ARRAY[$3]",
-			params:       []any{"pk", 31000, "value"},
-			shouldDelete: true,
+			query:        "",
+			params:       nil,
+			shouldDelete: false,
 		},
 		{
 			name: "kind > 10000",
@@ -63,9 +73,9 @@ func TestDeleteBeforeSave(t *testing.T) {
 				Kind:   10001,
 				PubKey: "pk",
 			},
-			query:        "DELETE FROM event WHERE pubkey = $1 AND kind = $2",
-			params:       []any{"pk", 10001},
-			shouldDelete: true,
+			query:        "",
+			params:       nil,
+			shouldDelete: false,
 		},
 		{
 			name: "kind < 20000",
@@ -73,9 +83,9 @@ func TestDeleteBeforeSave(t *testing.T) {
 				Kind:   19999,
 				PubKey: "pk",
 			},
-			query:        "DELETE FROM event WHERE pubkey = $1 AND kind = $2",
-			params:       []any{"pk", 19999},
-			shouldDelete: true,
+			query:        "",
+			params:       nil,
+			shouldDelete: false,
 		},
 		// Should not delete cases
 		{
@@ -120,6 +130,144 @@ func TestDeleteBeforeSave(t *testing.T) {
 	}
 }
 
+func TestSupersedes(t *testing.T) {
+	evt := &nostr.Event{ID: "bb", CreatedAt: 100}
+	assert.True(t, supersedes(evt, 99, "cc"))
+	assert.True(t, supersedes(evt, 100, "cc"))
+	assert.False(t, supersedes(evt, 100, "aa"))
+	assert.False(t, supersedes(evt, 101, "aa"))
+	assert.False(t, supersedes(evt, 101, "cc"))
+}
+
+func TestSaveReplaceable(t *testing.T) {
+	backend := testBackend(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+
+	stored := func() []string {
+		pubkey, _ := nostr.GetPublicKey(sk)
+		ch, err := backend.QueryEvents(ctx, &nostr.Filter{Authors: []string{pubkey}, Kinds: []int{nostr.KindSetMetadata}})
+		require.NoError(t, err)
+		var ids []string
+		for evt := range ch {
+			ids = append(ids, evt.ID)
+		}
+		return ids
+	}
+	meta := func(createdAt nostr.Timestamp, name string) *nostr.Event {
+		evt := &nostr.Event{CreatedAt: createdAt, Kind: nostr.KindSetMetadata, Tags: nostr.Tags{}, Content: name}
+		evt.Sign(sk)
+		return evt
+	}
+
+	t.Run("newer wins", func(t *testing.T) {
+		first, second := meta(100, "first"), meta(200, "second")
+		require.NoError(t, backend.SaveEvent(ctx, first))
+		require.NoError(t, backend.SaveEvent(ctx, second))
+		assert.Equal(t, []string{second.ID}, stored())
+		assert.Equal(t, storage.ErrDupEvent, backend.SaveEvent(ctx, second))
+	})
+
+	t.Run("older rejected", func(t *testing.T) {
+		before := stored()
+		assert.Equal(t, storage.ErrOldEvent, backend.SaveEvent(ctx, meta(150, "older")))
+		assert.Equal(t, before, stored())
+	})
+
+	t.Run("ties go to the lower id", func(t *testing.T) {
+		a, b := meta(300, "a"), meta(300, "b")
+		if a.ID > b.ID {
+			a, b = b, a
+		}
+		require.NoError(t, backend.SaveEvent(ctx, b))
+		require.NoError(t, backend.SaveEvent(ctx, a))
+		assert.Equal(t, []string{a.ID}, stored())
+		assert.Equal(t, storage.ErrOldEvent, backend.SaveEvent(ctx, b))
+		assert.Equal(t, []string{a.ID}, stored())
+	})
+}
+
+func TestAddressSql(t *testing.T) {
+	query, params := addressSql(&nostr.Event{Kind: nostr.KindContactList, PubKey: "pk", Tags: nostr.Tags{{"d", "x"}}})
+	assert.Equal(t, "pubkey = $1 AND kind = $2", query)
+	assert.Equal(t, []any{"pk", nostr.KindContactList}, params)
+
+	query, params = addressSql(&nostr.Event{Kind: 30023, PubKey: "pk", Tags: nostr.Tags{{"d", "x"}}})
+	assert.Equal(t, "pubkey = $1 AND kind = $2 AND tagpairs && ARRAY[$3]", query)
+	assert.Equal(t, []any{"pk", 30023, "d:x"}, params)
+
+	// no d tag is the same as an empty one
+	empty, emptyParams := addressSql(&nostr.Event{Kind: 30023, PubKey: "pk", Tags: nostr.Tags{{"d", ""}}})
+	missing, missingParams := addressSql(&nostr.Event{Kind: 30023, PubKey: "pk"})
+	assert.Equal(t, empty, missing)
+	assert.Equal(t, emptyParams, missingParams)
+	assert.Equal(t, []any{"pk", 30023, "d:"}, missingParams)
+}
+
+func TestSaveAddressable(t *testing.T) {
+	backend := testBackend(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+
+	stored := func(kind int) []string {
+		ch, err := backend.QueryEvents(ctx, &nostr.Filter{Authors: []string{pubkey}, Kinds: []int{kind}})
+		require.NoError(t, err)
+		var ids []string
+		for evt := range ch {
+			ids = append(ids, evt.ID)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	event := func(kind int, createdAt nostr.Timestamp, tags ...nostr.Tag) *nostr.Event {
+		evt := &nostr.Event{CreatedAt: createdAt, Kind: kind, Tags: append(nostr.Tags{}, tags...)}
+		evt.Sign(sk)
+		return evt
+	}
+	sorted := func(ids ...string) []string {
+		sort.Strings(ids)
+		return ids
+	}
+
+	t.Run("contact list", func(t *testing.T) {
+		older, newer := event(nostr.KindContactList, 100), event(nostr.KindContactList, 200)
+		require.NoError(t, backend.SaveEvent(ctx, newer))
+		assert.Equal(t, storage.ErrOldEvent, backend.SaveEvent(ctx, older))
+		assert.Equal(t, []string{newer.ID}, stored(nostr.KindContactList))
+	})
+
+	t.Run("by d tag", func(t *testing.T) {
+		one1 := event(30023, 100, nostr.Tag{"d", "one"})
+		two := event(30023, 200, nostr.Tag{"d", "two"})
+		one2 := event(30023, 300, nostr.Tag{"d", "one"})
+		for _, evt := range []*nostr.Event{one1, two, one2} {
+			require.NoError(t, backend.SaveEvent(ctx, evt))
+		}
+		assert.Equal(t, sorted(two.ID, one2.ID), stored(30023))
+
+		// an older version doesn't replace the newer one
+		assert.Equal(t, storage.ErrOldEvent, backend.SaveEvent(ctx, event(30023, 150, nostr.Tag{"d", "one"})))
+		assert.Equal(t, sorted(two.ID, one2.ID), stored(30023))
+	})
+
+	t.Run("missing d tag", func(t *testing.T) {
+		missing := event(30024, 100)
+		empty := event(30024, 200, nostr.Tag{"d", ""})
+		other := event(30024, 300, nostr.Tag{"d", "other"})
+		for _, evt := range []*nostr.Event{missing, other, empty} {
+			require.NoError(t, backend.SaveEvent(ctx, evt))
+		}
+		assert.Equal(t, sorted(empty.ID, other.ID), stored(30024))
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		first, second := event(30025, 100, nostr.Tag{"d", "x"}), event(30025, 200, nostr.Tag{"d", "x"})
+		require.NoError(t, backend.SaveEvents(ctx, []nostr.Event{*second, *first}))
+		assert.Equal(t, []string{second.ID}, stored(30025))
+	})
+}
+
 func TestSaveEventSql(t *testing.T) {
 	now := nostr.Now()
 	var tests = []struct {
@@ -140,10 +288,10 @@ func TestSaveEventSql(t *testing.T) {
 				Sig:       "sig",
 			},
 			query: `INSERT INTO event (
-	id, pubkey, created_at, kind, tags, content, sig)
-	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	id, pubkey, created_at, kind, tags, content, sig, tagpairs, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, tags_to_tagpairs($5), $8)
 	ON CONFLICT (id) DO NOTHING`,
-			params: []any{"id", "pk", now, nostr.KindTextNote, []byte("null"), "test", "sig"},
+			params: []any{"id", "pk", now, nostr.KindTextNote, []byte("null"), "test", "sig", nil},
 			err:    nil,
 		},
 		{
@@ -158,10 +306,10 @@ func TestSaveEventSql(t *testing.T) {
 				Sig:       "sig",
 			},
 			query: `INSERT INTO event (
-	id, pubkey, created_at, kind, tags, content, sig)
-	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	id, pubkey, created_at, kind, tags, content, sig, tagpairs, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, tags_to_tagpairs($5), $8)
 	ON CONFLICT (id) DO NOTHING`,
-			params: []any{"id", "pk", now, nostr.KindTextNote, []byte("[[\"foo\",\"bar\"]]"), "test", "sig"},
+			params: []any{"id", "pk", now, nostr.KindTextNote, []byte("[[\"foo\",\"bar\"]]"), "test", "sig", nil},
 			err:    nil,
 		},
 	}
@@ -175,3 +323,136 @@ func TestSaveEventSql(t *testing.T) {
 		})
 	}
 }
+
+func TestExpiresAt(t *testing.T) {
+	assert.Nil(t, expiresAt(&nostr.Event{}))
+	assert.Nil(t, expiresAt(&nostr.Event{Tags: nostr.Tags{nostr.Tag{"expiration", "soon"}}}))
+	assert.Equal(t, nostr.Timestamp(1700000000), expiresAt(&nostr.Event{Tags: nostr.Tags{nostr.Tag{"expiration", "1700000000"}}}))
+}
+
+func TestExpiredEvents(t *testing.T) {
+	backend := testBackend(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+
+	expiring := &nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindTextNote,
+		Tags:      nostr.Tags{nostr.Tag{"expiration", strconv.FormatInt(int64(nostr.Now()+1), 10)}},
+		Content:   "gone soon",
+	}
+	expiring.Sign(sk)
+	lasting := &nostr.Event{CreatedAt: nostr.Now(), Kind: nostr.KindTextNote, Tags: nostr.Tags{}, Content: "here to stay"}
+	lasting.Sign(sk)
+	require.NoError(t, backend.SaveEvent(ctx, expiring))
+	require.NoError(t, backend.SaveEvent(ctx, lasting))
+
+	filter := &nostr.Filter{Authors: []string{pubkey}}
+	found := func() []string {
+		ch, err := backend.QueryEvents(ctx, filter)
+		require.NoError(t, err)
+		var ids []string
+		for evt := range ch {
+			ids = append(ids, evt.ID)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	both := []string{expiring.ID, lasting.ID}
+	sort.Strings(both)
+	assert.Equal(t, both, found())
+
+	time.Sleep(2 * time.Second)
+	assert.Equal(t, []string{lasting.ID}, found())
+	count, err := backend.CountEvents(ctx, filter)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	var stored int
+	require.NoError(t, backend.DB.Get(&stored, `SELECT count(*) FROM event WHERE id = $1`, expiring.ID))
+	assert.Equal(t, 1, stored, "expired events are only hidden until purged")
+
+	n, err := backend.DeleteExpired(ctx, nostr.Now())
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, n, int64(1))
+	require.NoError(t, backend.DB.Get(&stored, `SELECT count(*) FROM event WHERE id = $1`, expiring.ID))
+	assert.Equal(t, 0, stored)
+	assert.Equal(t, []string{lasting.ID}, found())
+}
+
+func TestSaveEventsSql(t *testing.T) {
+	now := nostr.Now()
+	evts := []nostr.Event{
+		{ID: "id1", PubKey: "pk", CreatedAt: now, Kind: nostr.KindTextNote, Content: "one", Sig: "sig1"},
+		{ID: "id2", PubKey: "pk", CreatedAt: now, Kind: nostr.KindTextNote, Tags: nostr.Tags{nostr.Tag{"foo", "bar"}}, Content: "two", Sig: "sig2"},
+	}
+
+	query, params := saveEventsSql(evts)
+	assert.Equal(t, clean(`INSERT INTO event (
+	id, pubkey, created_at, kind, tags, content, sig, tagpairs, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, tags_to_tagpairs($5), $8), ($9, $10, $11, $12, $13, $14, $15, tags_to_tagpairs($13), $16)
+	ON CONFLICT (id) DO NOTHING`), clean(query))
+	assert.Equal(t, []any{
+		"id1", "pk", now, nostr.KindTextNote, []byte("null"), "one", "sig1", nil,
+		"id2", "pk", now, nostr.KindTextNote, []byte("[[\"foo\",\"bar\"]]"), "two", "sig2", nil,
+	}, params)
+}
+
+// testBackend connects to the database in TEST_POSTGRESQL_DATABASE, skipping
+// the test or benchmark when it isn't set.
+func testBackend(tb testing.TB) *PostgresBackend {
+	url := os.Getenv("TEST_POSTGRESQL_DATABASE")
+	if url == "" {
+		tb.Skip("TEST_POSTGRESQL_DATABASE not set")
+	}
+	backend := &PostgresBackend{DatabaseURL: url}
+	if err := backend.Init(); err != nil {
+		tb.Fatalf("Init: %v", err)
+	}
+	tb.Cleanup(func() { backend.DB.Close() })
+	return backend
+}
+
+func benchmarkEvents(b *testing.B, n int) []nostr.Event {
+	evts := make([]nostr.Event, n)
+	for i := range evts {
+		evts[i] = nostr.Event{
+			PubKey:    "bench",
+			CreatedAt: nostr.Now(),
+			Kind:      nostr.KindTextNote,
+			Tags:      nostr.Tags{},
+			Content:   fmt.Sprintf("event %d of run %d", i, b.N),
+		}
+		evts[i].ID = fmt.Sprintf("%064x", rand.Int63())
+	}
+	return evts
+}
+
+func BenchmarkSaveEvent1000(b *testing.B) {
+	backend := testBackend(b)
+	ctx := context.Background()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		evts := benchmarkEvents(b, 1000)
+		b.StartTimer()
+		for i := range evts {
+			if err := backend.SaveEvent(ctx, &evts[i]); err != nil {
+				b.Fatalf("SaveEvent: %v", err)
+			}
+		}
+	}
+}
+
+func BenchmarkSaveEvents1000(b *testing.B) {
+	backend := testBackend(b)
+	ctx := context.Background()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		evts := benchmarkEvents(b, 1000)
+		b.StartTimer()
+		if err := backend.SaveEvents(ctx, evts); err != nil {
+			b.Fatalf("SaveEvents: %v", err)
+		}
+	}
+}
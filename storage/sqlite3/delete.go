@@ -2,7 +2,10 @@ package sqlite3
 
 import "context"
 
-func (b SQLite3Backend) DeleteEvent(ctx context.Context, id string, pubkey string) error {
+func (b *SQLite3Backend) DeleteEvent(ctx context.Context, id string, pubkey string) error {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+
 	_, err := b.DB.ExecContext(ctx, "DELETE FROM event WHERE id = $1 AND pubkey = $2", id, pubkey)
 	return err
 }
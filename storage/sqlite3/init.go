@@ -1,16 +1,22 @@
 package sqlite3
 
 import (
+	"strings"
+
 	"github.com/fiatjaf/relayer/v2"
 	"github.com/jmoiron/sqlx"
 	"github.com/jmoiron/sqlx/reflectx"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/nbd-wtf/go-nostr"
 )
 
-var _ relayer.Storage = (*SQLite3Backend)(nil)
+var (
+	_ relayer.Storage      = (*SQLite3Backend)(nil)
+	_ relayer.EventCounter = (*SQLite3Backend)(nil)
+)
 
 func (b *SQLite3Backend) Init() error {
-	db, err := sqlx.Connect("sqlite3", b.DatabaseURL)
+	db, err := sqlx.Connect("sqlite3", withDefaultParams(b.DatabaseURL))
 	if err != nil {
 		return err
 	}
@@ -32,5 +38,107 @@ CREATE TABLE IF NOT EXISTS event (
   sig text NOT NULL
 );
     `)
-	return err
+	if err != nil {
+		return err
+	}
+
+	// databases from before the unique index may have duplicates
+	var indexed bool
+	if err := b.DB.Get(&indexed, `SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE name = 'ididx')`); err != nil {
+		return err
+	}
+	if !indexed {
+		if _, err := b.DB.Exec(`DELETE FROM event WHERE rowid NOT IN (SELECT min(rowid) FROM event GROUP BY id)`); err != nil {
+			return err
+		}
+	}
+
+	_, err = b.DB.Exec(`
+CREATE UNIQUE INDEX IF NOT EXISTS ididx ON event (id);
+CREATE INDEX IF NOT EXISTS pubkeyprefix ON event (pubkey);
+CREATE INDEX IF NOT EXISTS timeidx ON event (created_at DESC);
+CREATE INDEX IF NOT EXISTS kindidx ON event (kind);
+
+CREATE TABLE IF NOT EXISTS tag (
+  event_id text NOT NULL,
+  name text NOT NULL,
+  value text NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS tagidx ON tag (name, value);
+CREATE INDEX IF NOT EXISTS tageventidx ON tag (event_id);
+
+CREATE TRIGGER IF NOT EXISTS event_tags_delete AFTER DELETE ON event
+BEGIN
+  DELETE FROM tag WHERE event_id = old.id;
+END;
+    `)
+	if err != nil {
+		return err
+	}
+
+	return b.indexTags()
+}
+
+// withDefaultParams turns on WAL, so reads don't wait for writes, and has
+// connections wait for a locked database instead of failing, unless
+// DatabaseURL says otherwise.
+func withDefaultParams(url string) string {
+	params := []string{}
+	if !strings.Contains(url, "_journal") {
+		params = append(params, "_journal_mode=WAL")
+	}
+	if !strings.Contains(url, "_busy_timeout") && !strings.Contains(url, "_timeout") {
+		params = append(params, "_busy_timeout=5000")
+	}
+	if len(params) == 0 {
+		return url
+	}
+
+	sep := "?"
+	if strings.Contains(url, "?") {
+		sep = "&"
+	}
+	return url + sep + strings.Join(params, "&")
+}
+
+// indexTags fills the tag table for databases created before it existed.
+func (b *SQLite3Backend) indexTags() error {
+	var tagged bool
+	if err := b.DB.Get(&tagged, `SELECT EXISTS (SELECT 1 FROM tag)`); err != nil || tagged {
+		return err
+	}
+
+	var events []struct {
+		ID   string     `json:"id"`
+		Tags nostr.Tags `json:"tags"`
+	}
+	if err := b.DB.Select(&events, `SELECT id, tags FROM event`); err != nil {
+		return err
+	}
+
+	tx, err := b.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, evt := range events {
+		if err := insertTags(tx, evt.ID, evt.Tags); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// insertTags indexes the single letter tags of an event, as NIP-12 says.
+func insertTags(tx *sqlx.Tx, id string, tags nostr.Tags) error {
+	for _, tag := range tags {
+		if len(tag) < 2 || len(tag[0]) != 1 {
+			continue
+		}
+		if _, err := tx.Exec(`INSERT INTO tag (event_id, name, value) VALUES ($1, $2, $3)`, id, tag[0], tag[1]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -12,16 +12,21 @@ import (
 	"github.com/nbd-wtf/go-nostr"
 )
 
-func (b SQLite3Backend) QueryEvents(ctx context.Context, filter *nostr.Filter) (ch chan *nostr.Event, err error) {
+func (b *SQLite3Backend) QueryEvents(ctx context.Context, filter *nostr.Filter) (ch chan *nostr.Event, err error) {
 	ch = make(chan *nostr.Event)
 
 	query, params, err := queryEventsSql(filter, false)
 	if err != nil {
 		return nil, err
 	}
+	if query == "" {
+		// the filter can't match anything
+		close(ch)
+		return ch, nil
+	}
 
-	rows, err := b.DB.Query(query, params...)
-	if err != nil && err != sql.ErrNoRows {
+	rows, err := b.DB.QueryContext(ctx, query, params...)
+	if err != nil {
 		return nil, fmt.Errorf("failed to fetch events using query %q: %w", query, err)
 	}
 
@@ -37,16 +42,20 @@ func (b SQLite3Backend) QueryEvents(ctx context.Context, filter *nostr.Filter) (
 				return
 			}
 			evt.CreatedAt = nostr.Timestamp(timestamp)
-			ch <- &evt
+			select {
+			case ch <- &evt:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
 	return ch, nil
 }
 
-func (b SQLite3Backend) CountEvents(ctx context.Context, filter *nostr.Filter) (int64, error) {
+func (b *SQLite3Backend) CountEvents(ctx context.Context, filter *nostr.Filter) (int64, error) {
 	query, params, err := queryEventsSql(filter, true)
-	if err != nil {
+	if err != nil || query == "" {
 		return 0, err
 	}
 
@@ -130,27 +139,28 @@ func queryEventsSql(filter *nostr.Filter, doCount bool) (string, []any, error) {
 		conditions = append(conditions, `kind IN (`+strings.Join(inkinds, ",")+`)`)
 	}
 
-	tagQuery := make([]string, 0, 1)
-	for _, values := range filter.Tags {
+	tagValues := 0
+	for name, values := range filter.Tags {
 		if len(values) == 0 {
 			// any tag set to [] is wrong
 			return "", nil, nil
 		}
 
-		// add these tags to the query
-		tagQuery = append(tagQuery, values...)
-
-		if len(tagQuery) > 10 {
+		tagValues += len(values)
+		if tagValues > 10 {
 			// too many tags, fail everything
 			return "", nil, nil
 		}
-	}
 
-	// we use a very bad implementation in which we only check the tag values and
-	// ignore the tag names
-	for _, tagValue := range tagQuery {
-		params = append(params, "%"+tagValue+"%")
-		conditions = append(conditions, "tags LIKE ?")
+		// events must have one of the values for every tag name
+		inValues := make([]string, len(values))
+		params = append(params, name)
+		for i, value := range values {
+			inValues[i] = "?"
+			params = append(params, value)
+		}
+		conditions = append(conditions,
+			"id IN (SELECT event_id FROM tag WHERE name = ? AND value IN ("+strings.Join(inValues, ",")+"))")
 	}
 
 	if filter.Since != nil {
@@ -189,7 +199,7 @@ func queryEventsSql(filter *nostr.Filter, doCount bool) (string, []any, error) {
           id, pubkey, created_at, kind, tags, content, sig
         FROM event WHERE `+
 			strings.Join(conditions, " AND ")+
-			" ORDER BY created_at DESC LIMIT ?")
+			" ORDER BY created_at DESC, id DESC LIMIT ?")
 	}
 
 	return query, params, nil
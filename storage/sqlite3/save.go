@@ -2,37 +2,54 @@ package sqlite3
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
-	"fmt"
 
 	"github.com/fiatjaf/relayer/v2/storage"
+	"github.com/jmoiron/sqlx"
 	"github.com/nbd-wtf/go-nostr"
 )
 
 func (b *SQLite3Backend) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+
+	tx, err := b.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	// react to different kinds of events
 	if evt.Kind == nostr.KindSetMetadata || evt.Kind == nostr.KindContactList || (10000 <= evt.Kind && evt.Kind < 20000) {
-		// delete past events from this user
-		b.DB.ExecContext(ctx, `DELETE FROM event WHERE pubkey = $1 AND kind = $2`, evt.PubKey, evt.Kind)
+		// replace past events from this user, unless one of them is newer
+		if err := checkNewer(ctx, tx, evt, `pubkey = $1 AND kind = $2`, evt.PubKey, evt.Kind); err != nil {
+			return err
+		}
+		tx.ExecContext(ctx, `DELETE FROM event WHERE pubkey = $1 AND kind = $2`, evt.PubKey, evt.Kind)
 	} else if evt.Kind == nostr.KindRecommendServer {
 		// delete past recommend_server events equal to this one
-		b.DB.ExecContext(ctx, `DELETE FROM event WHERE pubkey = $1 AND kind = $2 AND content = $3`,
+		tx.ExecContext(ctx, `DELETE FROM event WHERE pubkey = $1 AND kind = $2 AND content = $3`,
 			evt.PubKey, evt.Kind, evt.Content)
 	} else if evt.Kind >= 30000 && evt.Kind < 40000 {
 		// NIP-33
 		d := evt.Tags.GetFirst([]string{"d"})
 		if d != nil {
-			tagsLike := fmt.Sprintf(`%%"d","%s"%%`, d.Value())
-			b.DB.ExecContext(ctx, `DELETE FROM event WHERE pubkey = $1 AND kind = $2 AND tags LIKE $3`, evt.PubKey, evt.Kind, tagsLike)
+			address := `pubkey = $1 AND kind = $2 AND id IN (SELECT event_id FROM tag WHERE name = 'd' AND value = $3)`
+			if err := checkNewer(ctx, tx, evt, address, evt.PubKey, evt.Kind, d.Value()); err != nil {
+				return err
+			}
+			tx.ExecContext(ctx, `DELETE FROM event WHERE `+address, evt.PubKey, evt.Kind, d.Value())
 		}
 	}
 
 	// insert
 	tagsj, _ := json.Marshal(evt.Tags)
-	res, err := b.DB.ExecContext(ctx, `
+	res, err := tx.ExecContext(ctx, `
         INSERT INTO event (id, pubkey, created_at, kind, tags, content, sig)
         VALUES ($1, $2, $3, $4, $5, $6, $7)
-    `, evt.ID, evt.PubKey, evt.CreatedAt, evt.Kind, tagsj, evt.Content, evt.Sig)
+        ON CONFLICT (id) DO NOTHING
+    `, evt.ID, evt.PubKey, evt.CreatedAt, evt.Kind, string(tagsj), evt.Content, evt.Sig)
 	if err != nil {
 		return err
 	}
@@ -46,6 +63,32 @@ func (b *SQLite3Backend) SaveEvent(ctx context.Context, evt *nostr.Event) error
 		return storage.ErrDupEvent
 	}
 
+	if err := insertTags(tx, evt.ID, evt.Tags); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// checkNewer returns storage.ErrOldEvent if one of the stored events matching
+// where supersedes evt: it is newer, or as old with a lower id.
+func checkNewer(ctx context.Context, tx *sqlx.Tx, evt *nostr.Event, where string, params ...any) error {
+	var (
+		id        string
+		createdAt nostr.Timestamp
+	)
+	err := tx.QueryRowContext(ctx, `SELECT id, created_at FROM event WHERE `+where+`
+      ORDER BY created_at DESC, id ASC LIMIT 1`, params...).Scan(&id, &createdAt)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return err
+	case id == evt.ID:
+		return storage.ErrDupEvent
+	case createdAt > evt.CreatedAt || (createdAt == evt.CreatedAt && id < evt.ID):
+		return storage.ErrOldEvent
+	}
 	return nil
 }
 
@@ -54,6 +97,9 @@ func (b *SQLite3Backend) BeforeSave(ctx context.Context, evt *nostr.Event) {
 }
 
 func (b *SQLite3Backend) AfterSave(evt *nostr.Event) {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+
 	// delete all but the 100 most recent ones for each key
 	b.DB.Exec(`DELETE FROM event WHERE pubkey = $1 AND kind = $2 AND created_at < (
       SELECT created_at FROM event WHERE pubkey = $1
@@ -1,10 +1,16 @@
 package sqlite3
 
 import (
+	"sync"
+
 	"github.com/jmoiron/sqlx"
 )
 
 type SQLite3Backend struct {
 	*sqlx.DB
 	DatabaseURL string
+
+	// sqlite takes one writer at a time, so we queue them here rather than
+	// have them wait on the busy timeout
+	writeMu sync.Mutex
 }
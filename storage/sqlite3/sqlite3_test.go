@@ -0,0 +1,19 @@
+package sqlite3
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/fiatjaf/relayer/v2"
+	"github.com/fiatjaf/relayer/v2/storage/storagetest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) relayer.Storage {
+		b := &SQLite3Backend{DatabaseURL: filepath.Join(t.TempDir(), "relay.db")}
+		require.NoError(t, b.Init())
+		t.Cleanup(func() { b.Close() })
+		return b
+	})
+}
@@ -0,0 +1,224 @@
+// Package storagetest checks that a [relayer.Storage] behaves like the others
+// in this repository, so relays can swap one for another.
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/fiatjaf/relayer/v2"
+	"github.com/fiatjaf/relayer/v2/storage"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Run runs the conformance tests, each against a fresh and empty storage
+// returned by open, already initialized.
+//
+// Storages return events newest first and then by descending id, and leave out
+// those created exactly at since or until.
+func Run(t *testing.T, open func(t *testing.T) relayer.Storage) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s relayer.Storage)
+	}{
+		{"query", testQuery},
+		{"same second", testSameSecond},
+		{"duplicate", testDuplicate},
+		{"replaceable", testReplaceable},
+		{"delete", testDelete},
+		{"unsatisfiable filters", testUnsatisfiable},
+		{"count", testCount},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, open(t))
+		})
+	}
+}
+
+func event(sk string, kind int, createdAt nostr.Timestamp, content string, tags ...nostr.Tag) *nostr.Event {
+	evt := &nostr.Event{
+		CreatedAt: createdAt,
+		Kind:      kind,
+		Tags:      append(nostr.Tags{}, tags...),
+		Content:   content,
+	}
+	evt.Sign(sk)
+	return evt
+}
+
+func save(t *testing.T, s relayer.Storage, evts ...*nostr.Event) {
+	t.Helper()
+	for _, evt := range evts {
+		require.NoError(t, s.SaveEvent(context.Background(), evt))
+	}
+}
+
+func query(t *testing.T, s relayer.Storage, filter nostr.Filter) []string {
+	t.Helper()
+	ch, err := s.QueryEvents(context.Background(), &filter)
+	require.NoError(t, err)
+	var ids []string
+	for evt := range ch {
+		ids = append(ids, evt.ID)
+	}
+	return ids
+}
+
+func ids(evts ...*nostr.Event) []string {
+	var ids []string
+	for _, evt := range evts {
+		ids = append(ids, evt.ID)
+	}
+	return ids
+}
+
+func testQuery(t *testing.T, s relayer.Storage) {
+	alice, bob := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	a1 := event(alice, 1, 100, "a1", nostr.Tag{"t", "nostr"})
+	a2 := event(alice, 1, 200, "a2", nostr.Tag{"t", "golang"})
+	a3 := event(alice, 7, 300, "+", nostr.Tag{"e", a2.ID})
+	b1 := event(bob, 1, 150, "b1", nostr.Tag{"t", "nostr"})
+	save(t, s, a1, a2, a3, b1)
+
+	ts := func(v nostr.Timestamp) *nostr.Timestamp { return &v }
+	for _, tt := range []struct {
+		name   string
+		filter nostr.Filter
+		want   []*nostr.Event
+	}{
+		{"everything, newest first", nostr.Filter{}, []*nostr.Event{a3, a2, b1, a1}},
+		{"limit", nostr.Filter{Limit: 2}, []*nostr.Event{a3, a2}},
+		{"ids", nostr.Filter{IDs: []string{a1.ID, b1.ID}}, []*nostr.Event{b1, a1}},
+		{"authors", nostr.Filter{Authors: []string{a1.PubKey}}, []*nostr.Event{a3, a2, a1}},
+		{"kinds", nostr.Filter{Kinds: []int{1}}, []*nostr.Event{a2, b1, a1}},
+		{"authors and kinds", nostr.Filter{Authors: []string{a1.PubKey}, Kinds: []int{7}}, []*nostr.Event{a3}},
+		{"tag", nostr.Filter{Tags: nostr.TagMap{"t": {"nostr"}}}, []*nostr.Event{b1, a1}},
+		{"tag values", nostr.Filter{Tags: nostr.TagMap{"t": {"nostr", "golang"}}}, []*nostr.Event{a2, b1, a1}},
+		{"e tag", nostr.Filter{Tags: nostr.TagMap{"e": {a2.ID}}}, []*nostr.Event{a3}},
+		{"since", nostr.Filter{Since: ts(175)}, []*nostr.Event{a3, a2}},
+		{"until", nostr.Filter{Until: ts(175)}, []*nostr.Event{b1, a1}},
+		{"since and until", nostr.Filter{Since: ts(125), Until: ts(250)}, []*nostr.Event{a2, b1}},
+		{"at since", nostr.Filter{Since: ts(150)}, []*nostr.Event{a3, a2}},
+		{"at until", nostr.Filter{Until: ts(150)}, []*nostr.Event{a1}},
+		{"at since and until", nostr.Filter{Since: ts(100), Until: ts(200)}, []*nostr.Event{b1}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, ids(tt.want...), query(t, s, tt.filter))
+		})
+	}
+
+	// events come back whole
+	ch, err := s.QueryEvents(context.Background(), &nostr.Filter{IDs: []string{a2.ID}})
+	require.NoError(t, err)
+	got := <-ch
+	require.NotNil(t, got)
+	assert.Equal(t, a2.PubKey, got.PubKey)
+	assert.Equal(t, a2.CreatedAt, got.CreatedAt)
+	assert.Equal(t, a2.Kind, got.Kind)
+	assert.Equal(t, a2.Tags, got.Tags)
+	assert.Equal(t, a2.Content, got.Content)
+	assert.Equal(t, a2.Sig, got.Sig)
+	for range ch {
+	}
+}
+
+func testSameSecond(t *testing.T, s relayer.Storage) {
+	var evts []*nostr.Event
+	for i := 0; i < 4; i++ {
+		evts = append(evts, event(nostr.GeneratePrivateKey(), 1, 100, fmt.Sprint(i)))
+	}
+	save(t, s, evts...)
+	sort.Slice(evts, func(i, j int) bool { return evts[i].ID > evts[j].ID })
+
+	ts := func(v nostr.Timestamp) *nostr.Timestamp { return &v }
+	assert.Equal(t, ids(evts...), query(t, s, nostr.Filter{}))
+	assert.Equal(t, ids(evts[:2]...), query(t, s, nostr.Filter{Limit: 2}))
+	assert.Equal(t, ids(evts...), query(t, s, nostr.Filter{Since: ts(99), Until: ts(101)}))
+	assert.Empty(t, query(t, s, nostr.Filter{Since: ts(100)}))
+	assert.Empty(t, query(t, s, nostr.Filter{Until: ts(100)}))
+}
+
+func testDuplicate(t *testing.T, s relayer.Storage) {
+	evt := event(nostr.GeneratePrivateKey(), 1, 100, "hello")
+	save(t, s, evt)
+	assert.Equal(t, storage.ErrDupEvent, s.SaveEvent(context.Background(), evt))
+	assert.Equal(t, ids(evt), query(t, s, nostr.Filter{}))
+}
+
+func testReplaceable(t *testing.T, s relayer.Storage) {
+	sk := nostr.GeneratePrivateKey()
+	meta1 := event(sk, 0, 100, `{"name":"a"}`)
+	meta2 := event(sk, 0, 200, `{"name":"b"}`)
+	one1 := event(sk, 30023, 100, "one", nostr.Tag{"d", "one"})
+	two := event(sk, 30023, 200, "two", nostr.Tag{"d", "two"})
+	one2 := event(sk, 30023, 300, "one again", nostr.Tag{"d", "one"})
+	save(t, s, meta1, meta2, one1, two, one2)
+
+	assert.Equal(t, ids(meta2), query(t, s, nostr.Filter{Kinds: []int{0}}))
+	assert.Equal(t, ids(one2, two), query(t, s, nostr.Filter{Kinds: []int{30023}}))
+
+	// older versions arriving late don't replace the newer ones
+	assert.Equal(t, storage.ErrOldEvent, s.SaveEvent(context.Background(), event(sk, 0, 150, `{"name":"c"}`)))
+	assert.Equal(t, storage.ErrOldEvent, s.SaveEvent(context.Background(), event(sk, 30023, 250, "one late", nostr.Tag{"d", "one"})))
+	assert.Equal(t, ids(meta2), query(t, s, nostr.Filter{Kinds: []int{0}}))
+	assert.Equal(t, ids(one2, two), query(t, s, nostr.Filter{Kinds: []int{30023}}))
+}
+
+func testDelete(t *testing.T, s relayer.Storage) {
+	sk := nostr.GeneratePrivateKey()
+	evt := event(sk, 1, 100, "hello", nostr.Tag{"t", "deleted"})
+	save(t, s, evt)
+
+	// only its author can delete it
+	other := event(nostr.GeneratePrivateKey(), 1, 100, "")
+	require.NoError(t, s.DeleteEvent(context.Background(), evt.ID, other.PubKey))
+	assert.Equal(t, ids(evt), query(t, s, nostr.Filter{IDs: []string{evt.ID}}))
+
+	require.NoError(t, s.DeleteEvent(context.Background(), evt.ID, evt.PubKey))
+	assert.Empty(t, query(t, s, nostr.Filter{IDs: []string{evt.ID}}))
+	assert.Empty(t, query(t, s, nostr.Filter{Tags: nostr.TagMap{"t": {"deleted"}}}))
+	assert.Empty(t, query(t, s, nostr.Filter{Authors: []string{evt.PubKey}}))
+}
+
+func testUnsatisfiable(t *testing.T, s relayer.Storage) {
+	save(t, s, event(nostr.GeneratePrivateKey(), 1, 100, "hello", nostr.Tag{"t", "x"}))
+
+	tooMany := make([]string, 1000)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("%064x", i)
+	}
+	for _, tt := range []struct {
+		name   string
+		filter nostr.Filter
+	}{
+		{"empty kinds", nostr.Filter{Kinds: []int{}}},
+		{"empty tag", nostr.Filter{Tags: nostr.TagMap{"t": {}}}},
+		{"invalid authors", nostr.Filter{Authors: []string{"nothex"}}},
+		{"too many ids", nostr.Filter{IDs: tooMany}},
+		{"too many authors", nostr.Filter{Authors: tooMany}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Empty(t, query(t, s, tt.filter))
+		})
+	}
+}
+
+func testCount(t *testing.T, s relayer.Storage) {
+	counter, ok := s.(relayer.EventCounter)
+	if !ok {
+		t.Skip("not an EventCounter")
+	}
+
+	sk := nostr.GeneratePrivateKey()
+	for i := 0; i < 5; i++ {
+		save(t, s, event(sk, 1+i%2, nostr.Timestamp(100+i), fmt.Sprint(i)))
+	}
+	count, err := counter.CountEvents(context.Background(), &nostr.Filter{Kinds: []int{1}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), count)
+}
@@ -7,9 +7,9 @@ import (
 	"github.com/nbd-wtf/go-nostr"
 )
 
-func startTestRelay(t *testing.T, tr *testRelay) *Server {
+func startTestRelay(t *testing.T, relay Relay) *Server {
 	t.Helper()
-	srv, _ := NewServer(tr)
+	srv, _ := NewServer(relay)
 	started := make(chan bool)
 	go srv.Start("127.0.0.1", 0, started)
 	<-started
@@ -53,6 +53,7 @@ type testStorage struct {
 	deleteEvent func(ctx context.Context, id string, pubkey string) error
 	saveEvent   func(context.Context, *nostr.Event) error
 	countEvents func(context.Context, *nostr.Filter) (int64, error)
+	saveEvents  func(context.Context, []nostr.Event) error
 }
 
 func (st *testStorage) Init() error {
@@ -89,3 +90,10 @@ func (st *testStorage) CountEvents(ctx context.Context, f *nostr.Filter) (int64,
 	}
 	return 0, nil
 }
+
+func (st *testStorage) SaveEvents(ctx context.Context, evts []nostr.Event) error {
+	if fn := st.saveEvents; fn != nil {
+		return fn(ctx, evts)
+	}
+	return nil
+}
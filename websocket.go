@@ -1,11 +1,65 @@
 package relayer
 
 import (
+	"encoding/json"
+	"errors"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/nbd-wtf/go-nostr"
 )
 
+// WebSocketOptions tune the websocket connections of a [WebSocketTuner].
+// Zero values keep the defaults.
+type WebSocketOptions struct {
+	// MaxMessageSize is the largest message, in bytes, taken from a client;
+	// connections sending bigger ones are closed. Defaults to 512000.
+	MaxMessageSize int64
+
+	// WriteWait is how long writing a message to a client can take before
+	// the connection is given up on. Writes have no deadline by default.
+	WriteWait time.Duration
+
+	// Clients are pinged every PingPeriod, and dropped when nothing came from
+	// them in PongWait. PingPeriod must be less than PongWait. They default
+	// to 30 and 60 seconds, or PongWait/2 when only PongWait is set.
+	PingPeriod time.Duration
+	PongWait   time.Duration
+
+	// SendQueue caps the messages waiting to be written to a single client.
+	// A client that stops reading and lets it fill up gets a NOTICE and is
+	// disconnected, instead of holding up the events going to the others.
+	// By default messages are written as they come, with nothing queued.
+	SendQueue int
+}
+
+func (s *Server) webSocketOptions() WebSocketOptions {
+	var opts WebSocketOptions
+	if tuner, ok := s.relay.(WebSocketTuner); ok {
+		opts = tuner.WebSocketOptions()
+	}
+	if opts.MaxMessageSize <= 0 {
+		opts.MaxMessageSize = maxMessageSize
+	}
+	if opts.PongWait <= 0 {
+		opts.PongWait = pongWait
+	}
+	if opts.PingPeriod <= 0 {
+		opts.PingPeriod = opts.PongWait / 2
+	}
+	return opts
+}
+
+// errSlowConsumer is returned for the writes to a connection dropped for
+// letting its SendQueue fill up.
+var errSlowConsumer = errors.New("connection dropped for not reading fast enough")
+
+type queuedMessage struct {
+	typ  int
+	data []byte
+}
+
 type WebSocket struct {
 	conn  *websocket.Conn
 	mutex sync.Mutex
@@ -13,16 +67,100 @@ type WebSocket struct {
 	// nip42
 	challenge string
 	authed    string
+
+	// REQs allowed, if the relay is a RequestRateLimiter; goes away with the connection
+	requests *tokenBucket
+
+	writeWait time.Duration
+
+	// with a SendQueue, messages are written by the writer goroutine of
+	// HandleWebsocket, and overflow is closed once the queue got full. mutex
+	// then only guards queue and dropped, so nothing waits on a slow client.
+	queue    chan queuedMessage
+	overflow chan struct{}
+	dropped  bool
+
+	// set by removeListener once the connection is gone, so that REQs still
+	// being handled don't subscribe it again. Guarded by listenersMutex.
+	closed bool
 }
 
 func (ws *WebSocket) WriteJSON(any interface{}) error {
-	ws.mutex.Lock()
-	defer ws.mutex.Unlock()
-	return ws.conn.WriteJSON(any)
+	if ws.queue == nil {
+		ws.mutex.Lock()
+		defer ws.mutex.Unlock()
+		ws.setWriteDeadline()
+		return ws.conn.WriteJSON(any)
+	}
+
+	data, err := json.Marshal(any)
+	if err != nil {
+		return err
+	}
+	return ws.enqueue(websocket.TextMessage, data)
 }
 
 func (ws *WebSocket) WriteMessage(t int, b []byte) error {
+	if ws.queue == nil {
+		ws.mutex.Lock()
+		defer ws.mutex.Unlock()
+		ws.setWriteDeadline()
+		return ws.conn.WriteMessage(t, b)
+	}
+
+	switch t {
+	case websocket.PingMessage, websocket.PongMessage, websocket.CloseMessage:
+		// these can be written alongside the writer goroutine
+		return ws.conn.WriteControl(t, b, time.Now().Add(ws.closeWait()))
+	}
+	return ws.enqueue(t, b)
+}
+
+func (ws *WebSocket) setWriteDeadline() {
+	if ws.writeWait > 0 {
+		ws.conn.SetWriteDeadline(time.Now().Add(ws.writeWait))
+	}
+}
+
+// closeWait is how long the last writes to a connection being dropped can take.
+func (ws *WebSocket) closeWait() time.Duration {
+	if ws.writeWait > 0 {
+		return ws.writeWait
+	}
+	return writeWait
+}
+
+func (ws *WebSocket) enqueue(t int, b []byte) error {
 	ws.mutex.Lock()
 	defer ws.mutex.Unlock()
-	return ws.conn.WriteMessage(t, b)
+	if ws.dropped {
+		return errSlowConsumer
+	}
+
+	select {
+	case ws.queue <- queuedMessage{t, b}:
+		return nil
+	default:
+		ws.dropped = true
+		close(ws.overflow)
+		// the writer may be stuck writing to a client that stopped reading
+		ws.conn.UnderlyingConn().SetWriteDeadline(time.Now().Add(ws.closeWait()))
+		return errSlowConsumer
+	}
+}
+
+// writeQueued writes what came out of the queue, from the writer goroutine only.
+func (ws *WebSocket) writeQueued(msg queuedMessage) error {
+	ws.setWriteDeadline()
+	return ws.conn.WriteMessage(msg.typ, msg.data)
+}
+
+// drop tells a client that let its queue fill up why it is being disconnected.
+func (ws *WebSocket) drop() {
+	ws.conn.SetWriteDeadline(time.Now().Add(ws.closeWait()))
+	notice, _ := json.Marshal(nostr.NoticeEnvelope("error: too many messages waiting to be sent, read faster"))
+	if ws.conn.WriteMessage(websocket.TextMessage, notice) == nil {
+		ws.conn.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too slow"))
+	}
 }